@@ -107,7 +107,20 @@ func (c *Conn) FileControl(schema string, op FcntlOpcode, arg ...any) (any, erro
 	var ret any
 	switch op {
 	default:
-		return nil, MISUSE
+		if op < FCNTL_CUSTOM {
+			return nil, MISUSE
+		}
+		ctl := &util.CustomControl{}
+		if len(arg) > 0 {
+			ctl.Arg = arg[0]
+		}
+		id := util.AddHandle(c.ctx, ctl)
+		defer util.DelHandle(c.ctx, id)
+		util.Write32(c.mod, ptr, id)
+		rc = res_t(c.call("sqlite3_file_control",
+			stk_t(c.handle), stk_t(schemaPtr),
+			stk_t(op), stk_t(ptr)))
+		ret = ctl.Ret
 
 	case FCNTL_RESET_CACHE:
 		rc = res_t(c.call("sqlite3_file_control",
@@ -280,6 +280,12 @@ const (
 	FCNTL_DATA_VERSION        FcntlOpcode = 35
 	FCNTL_RESERVE_BYTES       FcntlOpcode = 38
 	FCNTL_RESET_CACHE         FcntlOpcode = 42
+
+	// FCNTL_CUSTOM is the first of the opcodes reserved
+	// for Go VFSes implementing [vfs.FileCustomControl].
+	// The first 256 are used by the VFSes in this module,
+	// so other VFSes should use opcodes from FCNTL_CUSTOM + 256.
+	FCNTL_CUSTOM FcntlOpcode = 1 << 16
 )
 
 // LimitCategory are the available run-time limit categories.
@@ -0,0 +1,176 @@
+package rekey
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// Keys configures the keys of an encrypting VFS,
+// which uses ciphers of type C (nil if there's no key).
+type Keys[C comparable] struct {
+	// KDF derives a key from a secret.
+	// If no secret is given, a random key is generated.
+	KDF func(secret string) []byte
+	// New creates a cipher given a key,
+	// or returns nil if the key is not appropriate.
+	New func(key []byte) C
+	// Cipher adapts a cipher to rekey files.
+	Cipher func(C) Cipher
+	// BlockSize is the unit of encryption.
+	BlockSize int
+	// Opcode is the file control opcode that rekeys a database.
+	Opcode uint32
+}
+
+// KeyedFile is a file of an encrypting VFS.
+// It takes keys from URI parameters and PRAGMAs,
+// and rekeys main databases.
+type KeyedFile[C comparable] struct {
+	vfsutil.WrappedFile
+	keys   *Keys[C]
+	cipher C
+	plain  bool          // the main database was decrypted
+	main   *KeyedFile[C] // the main database of a journal or WAL file
+	base   vfs.VFS       // the base VFS of a main database
+	name   string        // the name of a main database
+}
+
+// Open initializes f to wrap file, opened on base with name and flags.
+// Journals and WAL files use the key of main, their main database.
+func (k *Keys[C]) Open(f *KeyedFile[C], main *KeyedFile[C], base vfs.VFS, file vfs.File, name *vfs.Filename, flags vfs.OpenFlag) error {
+	var none C
+	*f = KeyedFile[C]{WrappedFile: vfsutil.WrappedFile{File: file}, keys: k}
+
+	if main != nil {
+		if main.cipher == none && !main.plain {
+			return sqlite3.CANTOPEN
+		}
+		f.main = main
+		return nil
+	}
+
+	if flags&vfs.OPEN_MAIN_DB != 0 {
+		// Main databases can be rekeyed.
+		f.base = base
+		f.name = name.String()
+	}
+
+	var key []byte
+	if params := name.URIParameters(); name == nil {
+		key = k.KDF("") // Temporary files get a random key.
+	} else if t, ok := params["key"]; ok {
+		key = []byte(t[0])
+	} else if t, ok := params["hexkey"]; ok {
+		key, _ = hex.DecodeString(t[0])
+	} else if t, ok := params["textkey"]; ok && len(t[0]) > 0 {
+		key = k.KDF(t[0])
+	} else if flags&vfs.OPEN_MAIN_DB != 0 {
+		// Main databases may have their key specified as a PRAGMA.
+		return nil
+	}
+
+	if f.cipher = k.New(key); f.cipher == none {
+		return sqlite3.CANTOPEN
+	}
+	return nil
+}
+
+// Key returns the cipher of a file, and whether the file is plaintext:
+// journals and WAL files use the key of their main database,
+// which may change with a rekey.
+func (f *KeyedFile[C]) Key() (cipher C, plain bool) {
+	db := f
+	if f.main != nil {
+		db = f.main
+	}
+	return db.cipher, db.plain
+}
+
+// Pragma implements [vfs.FilePragma].
+func (f *KeyedFile[C]) Pragma(name string, value string) (string, error) {
+	var none C
+	var key []byte
+	switch name {
+	case "key", "rekey":
+		key = []byte(value)
+	case "hexkey", "hexrekey":
+		key, _ = hex.DecodeString(value)
+	case "textkey", "textrekey":
+		if len(value) > 0 {
+			key = f.keys.KDF(value)
+		}
+	default:
+		return f.WrappedFile.Pragma(name, value)
+	}
+
+	if strings.HasSuffix(name, "rekey") {
+		if value == "" {
+			// An empty key decrypts the database.
+			return "ok", f.rekey(none)
+		}
+		if cipher := f.keys.New(key); cipher != none {
+			return "ok", f.rekey(cipher)
+		}
+		return "", sqlite3.CANTOPEN
+	}
+
+	if f.cipher = f.keys.New(key); f.cipher != none {
+		f.plain = false
+		return "ok", nil
+	}
+	return "", sqlite3.CANTOPEN
+}
+
+// CustomControl implements [vfs.FileCustomControl].
+func (f *KeyedFile[C]) CustomControl(op uint32, arg any) (any, error) {
+	if op != f.keys.Opcode {
+		return f.WrappedFile.CustomControl(op, arg)
+	}
+	var none C
+	key, _ := arg.([]byte)
+	if len(key) == 0 {
+		return nil, f.rekey(none)
+	}
+	if cipher := f.keys.New(key); cipher != none {
+		return nil, f.rekey(cipher)
+	}
+	return nil, sqlite3.CANTOPEN
+}
+
+// rekey re-encrypts the main database with a new cipher,
+// or decrypts it, if the new cipher is nil.
+// A main database without a key is assumed to be plaintext.
+func (f *KeyedFile[C]) rekey(next C) error {
+	if f.base == nil {
+		return sqlite3.MISUSE
+	}
+	var none C
+	var oldCipher, newCipher Cipher
+	if f.cipher != none {
+		oldCipher = f.keys.Cipher(f.cipher)
+	}
+	if next != none {
+		newCipher = f.keys.Cipher(next)
+	}
+	err := Rekey(f.base, f.name, f.File, f.keys.BlockSize, oldCipher, newCipher)
+	if err != nil {
+		return err
+	}
+	f.cipher = next
+	f.plain = next == none
+	return nil
+}
+
+// Lock implements [vfs.File].
+func (f *KeyedFile[C]) Lock(lock vfs.LockLevel) error {
+	err := f.File.Lock(lock)
+	if err == nil && lock == vfs.LOCK_SHARED && f.base != nil {
+		// Undo an interrupted rekey.
+		err = Recover(f.base, f.name, f.File)
+	}
+	return err
+}
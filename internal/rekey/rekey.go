@@ -0,0 +1,335 @@
+// Package rekey re-encrypts databases in place, crash-safely.
+//
+// Before a database is re-encrypted, the current contents
+// of the database, its rollback journal, and its WAL
+// are saved to a rekey journal (the database name, suffixed with "-rekey").
+// Once the files are re-encrypted and synced, the rekey journal is deleted.
+//
+// If the rekey is interrupted, the next connection to lock the database
+// restores the saved files, undoing the rekey.
+//
+// The package also implements the key handling
+// shared by the encrypting VFSes (see [KeyedFile]).
+package rekey
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// Cipher encrypts and decrypts a block in place,
+// given its offset in the file.
+type Cipher interface {
+	Encrypt(block []byte, off int64)
+	Decrypt(block []byte, off int64)
+}
+
+// The rekey journal starts with a header:
+//   - the magic string (16 bytes);
+//   - the size of each of the saved files (8 bytes each),
+//     or -1 if the file didn't exist;
+//   - the CRC-32 of the rest of the header (the last 4 bytes).
+//
+// The contents of the saved files follow the header.
+const (
+	suffix     = "-rekey"
+	magic      = "SQLite rekey v1\x00"
+	headerSize = 512
+	bufSize    = 64 * 1024
+)
+
+// The files saved to the rekey journal, in order.
+var files = [...]struct {
+	suffix string
+	flags  vfs.OpenFlag
+}{
+	{"", vfs.OPEN_MAIN_DB},
+	{"-journal", vfs.OPEN_MAIN_JOURNAL},
+	{"-wal", vfs.OPEN_WAL},
+}
+
+type sizes [len(files)]int64
+
+// Rekey re-encrypts the database file name,
+// and its rollback journal and WAL, from the old to the new cipher,
+// in blocks of blockSize bytes.
+// A nil cipher means the files are (or become) plaintext.
+//
+// The db file must be opened on base.
+// Rekey acquires an EXCLUSIVE lock on it,
+// and restores its previous lock before returning.
+func Rekey(base vfs.VFS, name string, db vfs.File, blockSize int, old, new Cipher) (err error) {
+	level := vfsutil.WrapLockState(db)
+	if level > vfs.LOCK_EXCLUSIVE {
+		return sqlite3.MISUSE
+	}
+	for _, lock := range []vfs.LockLevel{vfs.LOCK_SHARED, vfs.LOCK_RESERVED, vfs.LOCK_EXCLUSIVE} {
+		if lock > level {
+			if err := db.Lock(lock); err != nil {
+				db.Unlock(level)
+				return err
+			}
+		}
+	}
+	defer db.Unlock(level)
+
+	// Open the files.
+	var open [len(files)]vfs.File
+	var size sizes
+	for i, f := range files {
+		file := db
+		if i > 0 {
+			file, err = openIfExists(base, name+f.suffix, f.flags)
+			if err != nil {
+				return err
+			}
+			if file == nil {
+				size[i] = -1
+				continue
+			}
+			defer file.Close()
+		}
+		open[i] = file
+		if size[i], err = file.Size(); err != nil {
+			return err
+		}
+	}
+
+	block := make([]byte, blockSize)
+
+	// Check the old cipher.
+	if size[0] > 0 {
+		if err := readBlock(db, block, 0); err != nil {
+			return err
+		}
+		if old != nil {
+			old.Decrypt(block, 0)
+		}
+		if string(block[:16]) != "SQLite format 3\x00" {
+			return sqlite3.NOTADB
+		}
+	}
+	if old == nil && new == nil {
+		return nil
+	}
+
+	// Save the files.
+	jrnl, _, err := base.Open(name+suffix, vfs.OPEN_READWRITE|vfs.OPEN_CREATE|vfs.OPEN_MAIN_JOURNAL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if jrnl != nil {
+			jrnl.Close()
+			base.Delete(name+suffix, false)
+		}
+	}()
+
+	buf := make([]byte, bufSize)
+	off := int64(headerSize)
+	for i, file := range open {
+		if file != nil {
+			if err := copyFile(jrnl, off, file, 0, size[i], buf); err != nil {
+				return err
+			}
+			off += size[i]
+		}
+	}
+	if err := jrnl.Sync(vfs.SYNC_FULL); err != nil {
+		return err
+	}
+	if err := writeHeader(jrnl, size); err != nil {
+		return err
+	}
+	if err := jrnl.Sync(vfs.SYNC_FULL); err != nil {
+		return err
+	}
+
+	// Re-encrypt the files.
+	for i, file := range open {
+		if file == nil {
+			continue
+		}
+		err := transform(file, size[i], block, old, new)
+		if err == nil {
+			err = file.Sync(vfs.SYNC_FULL)
+		}
+		if err != nil {
+			// Undo the rekey; if that fails too,
+			// the rekey journal is left for recovery.
+			if restore(base, name, db, jrnl, size, buf) != nil {
+				jrnl.Close()
+				jrnl = nil
+			}
+			return err
+		}
+	}
+
+	// Commit.
+	jrnl.Close()
+	jrnl = nil
+	return base.Delete(name+suffix, true)
+}
+
+// Recover undoes an interrupted rekey of the database file name.
+//
+// The db file must be opened on base, and hold a SHARED lock.
+// To recover, Recover briefly acquires an EXCLUSIVE lock;
+// if it returns an error, the db file is left unlocked.
+func Recover(base vfs.VFS, name string, db vfs.File) (err error) {
+	hot, err := base.Access(name+suffix, vfs.ACCESS_EXISTS)
+	if err != nil || !hot {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			db.Unlock(vfs.LOCK_NONE)
+		}
+	}()
+	if err := db.Lock(vfs.LOCK_RESERVED); err != nil {
+		return err
+	}
+	if err := db.Lock(vfs.LOCK_EXCLUSIVE); err != nil {
+		return err
+	}
+
+	jrnl, err := openIfExists(base, name+suffix, vfs.OPEN_MAIN_JOURNAL)
+	if err != nil {
+		return err
+	}
+	if jrnl != nil {
+		// An invalid header means the files weren't changed.
+		if size, ok := readHeader(jrnl); ok {
+			err = restore(base, name, db, jrnl, size, make([]byte, bufSize))
+		}
+		jrnl.Close()
+		if err != nil {
+			return err
+		}
+		if err := base.Delete(name+suffix, true); err != nil {
+			return err
+		}
+	}
+	db.Unlock(vfs.LOCK_SHARED)
+	return nil
+}
+
+// restore copies the saved files from the rekey journal.
+func restore(base vfs.VFS, name string, db, jrnl vfs.File, size sizes, buf []byte) error {
+	off := int64(headerSize)
+	for i, f := range files {
+		if size[i] < 0 {
+			continue
+		}
+		file := db
+		if i > 0 {
+			var err error
+			file, _, err = base.Open(name+f.suffix, vfs.OPEN_READWRITE|vfs.OPEN_CREATE|f.flags)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+		}
+		if err := copyFile(file, 0, jrnl, off, size[i], buf); err != nil {
+			return err
+		}
+		if err := file.Truncate(size[i]); err != nil {
+			return err
+		}
+		if err := file.Sync(vfs.SYNC_FULL); err != nil {
+			return err
+		}
+		off += size[i]
+	}
+	return nil
+}
+
+// transform re-encrypts a file, one block at a time.
+// A partial final block (of a plaintext file) is padded with zeros.
+func transform(file vfs.File, size int64, block []byte, old, new Cipher) error {
+	for off := int64(0); off < size; off += int64(len(block)) {
+		if err := readBlock(file, block, off); err != nil {
+			return err
+		}
+		if old != nil {
+			old.Decrypt(block, off)
+		}
+		if new != nil {
+			new.Encrypt(block, off)
+		}
+		if _, err := file.WriteAt(block, off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBlock reads a block, padding it with zeros past the end of the file.
+func readBlock(file vfs.File, block []byte, off int64) error {
+	n, err := file.ReadAt(block, off)
+	if n < len(block) {
+		if err != io.EOF {
+			return err
+		}
+		clear(block[n:])
+	}
+	return nil
+}
+
+func copyFile(dst vfs.File, dstOff int64, src vfs.File, srcOff, n int64, buf []byte) error {
+	for n > 0 {
+		b := buf[:min(n, int64(len(buf)))]
+		if m, err := src.ReadAt(b, srcOff); m != len(b) {
+			if err == nil || err == io.EOF {
+				err = sqlite3.IOERR_SHORT_READ
+			}
+			return err
+		}
+		if _, err := dst.WriteAt(b, dstOff); err != nil {
+			return err
+		}
+		srcOff += int64(len(b))
+		dstOff += int64(len(b))
+		n -= int64(len(b))
+	}
+	return nil
+}
+
+func writeHeader(jrnl vfs.File, size sizes) error {
+	var hdr [headerSize]byte
+	copy(hdr[:], magic)
+	for i, s := range size {
+		binary.LittleEndian.PutUint64(hdr[len(magic)+8*i:], uint64(s))
+	}
+	binary.LittleEndian.PutUint32(hdr[headerSize-4:], crc32.ChecksumIEEE(hdr[:headerSize-4]))
+	_, err := jrnl.WriteAt(hdr[:], 0)
+	return err
+}
+
+func readHeader(jrnl vfs.File) (size sizes, ok bool) {
+	var hdr [headerSize]byte
+	if n, _ := jrnl.ReadAt(hdr[:], 0); n != headerSize ||
+		string(hdr[:len(magic)]) != magic ||
+		binary.LittleEndian.Uint32(hdr[headerSize-4:]) != crc32.ChecksumIEEE(hdr[:headerSize-4]) {
+		return size, false
+	}
+	for i := range size {
+		size[i] = int64(binary.LittleEndian.Uint64(hdr[len(magic)+8*i:]))
+	}
+	return size, true
+}
+
+func openIfExists(base vfs.VFS, name string, flags vfs.OpenFlag) (vfs.File, error) {
+	ok, err := base.Access(name, vfs.ACCESS_EXISTS)
+	if err != nil || !ok {
+		return nil, err
+	}
+	file, _, err := base.Open(name, vfs.OPEN_READWRITE|flags)
+	return file, err
+}
@@ -0,0 +1,369 @@
+package rekey
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/internal/util"
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/faultvfs"
+)
+
+const blockSize = 512
+
+// xorCipher is a trivial cipher that depends on the offset of the block.
+type xorCipher byte
+
+func (c xorCipher) Encrypt(block []byte, off int64) {
+	for i := range block {
+		block[i] ^= byte(c) ^ byte(off+int64(i))
+	}
+}
+
+func (c xorCipher) Decrypt(block []byte, off int64) {
+	c.Encrypt(block, off)
+}
+
+// plain returns the contents of a database, its journal, and its WAL.
+// The WAL ends in a partial block.
+func plain() [len(files)][]byte {
+	db := make([]byte, 4*blockSize)
+	copy(db, "SQLite format 3\x00")
+	for i := 16; i < len(db); i++ {
+		db[i] = byte(i * 7)
+	}
+	return [...][]byte{
+		db,
+		bytes.Repeat([]byte("journal!"), 2*blockSize/8),
+		bytes.Repeat([]byte("wal!"), (3*blockSize-100)/4),
+	}
+}
+
+// encrypt pads data to whole blocks, and encrypts it.
+func encrypt(c Cipher, data []byte) []byte {
+	if c == nil {
+		return bytes.Clone(data)
+	}
+	buf := make([]byte, (len(data)+blockSize-1)/blockSize*blockSize)
+	copy(buf, data)
+	for off := 0; off < len(buf); off += blockSize {
+		c.Encrypt(buf[off:off+blockSize], int64(off))
+	}
+	return buf
+}
+
+// decrypt undoes encrypt, given the size of the data.
+func decrypt(c Cipher, data []byte, size int) []byte {
+	buf := bytes.Clone(data)
+	if c != nil {
+		for off := 0; off < len(buf); off += blockSize {
+			c.Decrypt(buf[off:off+blockSize], int64(off))
+		}
+	}
+	return buf[:min(size, len(buf))]
+}
+
+// create writes the files of a database encrypted with c,
+// and opens the database on base.
+func create(t *testing.T, base vfs.VFS, name string, c Cipher) vfs.File {
+	t.Helper()
+	for i, data := range plain() {
+		if err := os.WriteFile(name+files[i].suffix, encrypt(c, data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return open(t, base, name)
+}
+
+func open(t *testing.T, base vfs.VFS, name string) vfs.File {
+	t.Helper()
+	db, _, err := base.Open(name, vfs.OPEN_READWRITE|vfs.OPEN_MAIN_DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// check checks that the files of a database are encrypted with c,
+// and that there is no rekey journal.
+func check(t *testing.T, name string, c Cipher) {
+	t.Helper()
+	for i, want := range plain() {
+		data, err := os.ReadFile(name + files[i].suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c != nil && len(data)%blockSize != 0 {
+			t.Errorf("%s: got size %d", files[i].suffix, len(data))
+		}
+		if got := decrypt(c, data, len(want)); !bytes.Equal(got, want) {
+			t.Errorf("%q: contents differ", name+files[i].suffix)
+		}
+	}
+	if _, err := os.Stat(name + suffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	base := vfs.Find("")
+	name := filepath.Join(t.TempDir(), "test.db")
+
+	// Encrypt, rekey, and decrypt the files,
+	// at the lock level SQLite would hold.
+	db := create(t, base, name, nil)
+	defer db.Close()
+	if err := Rekey(base, name, db, blockSize, nil, xorCipher(1)); err != nil {
+		t.Fatal(err)
+	}
+	check(t, name, xorCipher(1))
+	if lock := vfsutil.WrapLockState(db); lock != vfs.LOCK_NONE {
+		t.Errorf("got lock %v", lock)
+	}
+
+	if err := db.Lock(vfs.LOCK_SHARED); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rekey(base, name, db, blockSize, xorCipher(1), xorCipher(2)); err != nil {
+		t.Fatal(err)
+	}
+	check(t, name, xorCipher(2))
+	if lock := vfsutil.WrapLockState(db); lock != vfs.LOCK_SHARED {
+		t.Errorf("got lock %v", lock)
+	}
+
+	if err := Rekey(base, name, db, blockSize, xorCipher(2), nil); err != nil {
+		t.Fatal(err)
+	}
+	check(t, name, nil)
+	db.Unlock(vfs.LOCK_NONE)
+
+	// Missing files are skipped.
+	if err := base.Delete(name+"-wal", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rekey(base, name, db, blockSize, nil, xorCipher(3)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := base.Access(name+"-wal", vfs.ACCESS_EXISTS); ok {
+		t.Error("WAL created")
+	}
+}
+
+func TestRekey_errors(t *testing.T) {
+	base := vfs.Find("")
+	name := filepath.Join(t.TempDir(), "test.db")
+
+	db := create(t, base, name, xorCipher(1))
+	defer db.Close()
+
+	// The old cipher must decrypt the database.
+	if err := Rekey(base, name, db, blockSize, xorCipher(2), nil); !errors.Is(err, sqlite3.NOTADB) {
+		t.Errorf("got %v, want NOTADB", err)
+	}
+	if err := Rekey(base, name, db, blockSize, nil, xorCipher(2)); !errors.Is(err, sqlite3.NOTADB) {
+		t.Errorf("got %v, want NOTADB", err)
+	}
+	check(t, name, xorCipher(1))
+
+	// Other connections block a rekey.
+	if vfs.SupportsFileLocking {
+		other := open(t, base, name)
+		defer other.Close()
+		if err := other.Lock(vfs.LOCK_SHARED); err != nil {
+			t.Fatal(err)
+		}
+		if err := Rekey(base, name, db, blockSize, xorCipher(1), nil); err != util.ErrorCode(util.BUSY) {
+			t.Errorf("got %v, want BUSY", err)
+		}
+		if lock := vfsutil.WrapLockState(db); lock != vfs.LOCK_NONE {
+			t.Errorf("got lock %v", lock)
+		}
+		other.Unlock(vfs.LOCK_NONE)
+		check(t, name, xorCipher(1))
+	}
+}
+
+func TestRekey_fault(t *testing.T) {
+	// The rekey journal is also a main journal:
+	// it takes 4 writes to save the files.
+	tests := []struct {
+		name  string
+		file  vfs.OpenFlag
+		after int
+	}{
+		{"db", vfs.OPEN_MAIN_DB, 1},
+		{"journal", vfs.OPEN_MAIN_JOURNAL, 4 + 1},
+		{"wal", vfs.OPEN_WAL, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			faults := faultvfs.Wrap(vfs.Find(""))
+			name := filepath.Join(t.TempDir(), "test.db")
+
+			// Fail in the middle of re-encrypting a file:
+			// the rekey is undone.
+			db := create(t, faults, name, xorCipher(1))
+			defer db.Close()
+			faults.Inject(faultvfs.Fault{Op: faultvfs.OpWrite, File: tt.file, After: tt.after})
+			err := Rekey(faults, name, db, blockSize, xorCipher(1), xorCipher(2))
+			if !errors.Is(err, sqlite3.IOERR_WRITE) {
+				t.Fatalf("got %v, want IOERR_WRITE", err)
+			}
+			check(t, name, xorCipher(1))
+
+			// If undoing it fails too, the rekey journal is left,
+			// and the next lock recovers.
+			faults.Clear()
+			faults.Inject(faultvfs.Fault{Op: faultvfs.OpWrite, File: tt.file, After: tt.after, Times: -1})
+			err = Rekey(faults, name, db, blockSize, xorCipher(1), xorCipher(2))
+			if !errors.Is(err, sqlite3.IOERR_WRITE) {
+				t.Fatalf("got %v, want IOERR_WRITE", err)
+			}
+			if ok, _ := faults.Access(name+suffix, vfs.ACCESS_EXISTS); !ok {
+				t.Fatal("want rekey journal")
+			}
+			faults.Clear()
+			recoverDB(t, faults, name)
+			check(t, name, xorCipher(1))
+		})
+	}
+}
+
+func TestRekey_crash(t *testing.T) {
+	dir := t.TempDir()
+
+	for point := 0; ; point++ {
+		faults := faultvfs.Wrap(vfs.Find(""))
+		name := filepath.Join(dir, fmt.Sprintf("crash-%d.db", point))
+
+		db := create(t, faults, name, xorCipher(1))
+		faults.Inject(faultvfs.Fault{Op: faultvfs.OpSync, Kind: faultvfs.PowerLoss, After: point})
+		err := Rekey(faults, name, db, blockSize, xorCipher(1), xorCipher(2))
+		db.Close()
+		if faults.Fired() == 0 {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if point == 0 {
+				t.Fatal("no sync points")
+			}
+			check(t, name, xorCipher(2))
+			break
+		}
+		faults.Recover()
+
+		// An interrupted rekey is undone.
+		recoverDB(t, faults, name)
+		check(t, name, xorCipher(1))
+	}
+}
+
+func TestRecover_header(t *testing.T) {
+	valid := func() []byte {
+		var hdr [headerSize]byte
+		copy(hdr[:], magic)
+		return hdr[:]
+	}
+
+	tests := []struct {
+		name string
+		hdr  func() []byte
+	}{
+		{"empty", func() []byte { return nil }},
+		{"short", func() []byte { return valid()[:100] }},
+		{"zeros", func() []byte { return make([]byte, headerSize) }},
+		{"magic", func() []byte {
+			hdr := valid()
+			hdr[0] ^= 1
+			return hdr
+		}},
+		{"checksum", func() []byte {
+			hdr := valid()
+			hdr[len(magic)] = 1
+			return hdr
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := vfs.Find("")
+			name := filepath.Join(t.TempDir(), "test.db")
+
+			// A rekey journal with an invalid header
+			// is from a rekey that didn't change the files:
+			// it's deleted, and nothing is restored.
+			db := create(t, base, name, xorCipher(1))
+			db.Close()
+			jrnl := append(tt.hdr(), make([]byte, 10*blockSize)...)
+			if err := os.WriteFile(name+suffix, jrnl, 0666); err != nil {
+				t.Fatal(err)
+			}
+			recoverDB(t, base, name)
+			check(t, name, xorCipher(1))
+		})
+	}
+}
+
+func TestRecover_torn(t *testing.T) {
+	base := vfs.Find("")
+	name := filepath.Join(t.TempDir(), "test.db")
+
+	db := create(t, base, name, xorCipher(1))
+	defer db.Close()
+
+	// A rekey journal with a valid header, but missing data,
+	// is an error: it's kept, and the database is left unlocked.
+	var size sizes
+	for i, data := range plain() {
+		size[i] = int64(len(data))
+	}
+	jrnl, _, err := base.Open(name+suffix, vfs.OPEN_READWRITE|vfs.OPEN_CREATE|vfs.OPEN_MAIN_JOURNAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHeader(jrnl, size); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jrnl.WriteAt(make([]byte, blockSize), headerSize); err != nil {
+		t.Fatal(err)
+	}
+	jrnl.Close()
+
+	if err := db.Lock(vfs.LOCK_SHARED); err != nil {
+		t.Fatal(err)
+	}
+	if err := Recover(base, name, db); !errors.Is(err, sqlite3.IOERR_SHORT_READ) {
+		t.Errorf("got %v, want IOERR_SHORT_READ", err)
+	}
+	if lock := vfsutil.WrapLockState(db); lock != vfs.LOCK_NONE {
+		t.Errorf("got lock %v", lock)
+	}
+	if ok, _ := base.Access(name+suffix, vfs.ACCESS_EXISTS); !ok {
+		t.Error("want rekey journal")
+	}
+}
+
+// recoverDB locks the database, as the next connection would.
+func recoverDB(t *testing.T, base vfs.VFS, name string) {
+	t.Helper()
+	db := open(t, base, name)
+	defer db.Close()
+	if err := db.Lock(vfs.LOCK_SHARED); err != nil {
+		t.Fatal(err)
+	}
+	if err := Recover(base, name, db); err != nil {
+		t.Fatal(err)
+	}
+	if lock := vfsutil.WrapLockState(db); lock != vfs.LOCK_SHARED {
+		t.Errorf("got lock %v", lock)
+	}
+	db.Unlock(vfs.LOCK_NONE)
+}
@@ -0,0 +1,31 @@
+package testcfg
+
+import (
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+)
+
+// notest
+
+// Exec executes sql, and fails the test on error.
+func Exec(tb testing.TB, db *sqlite3.Conn, sql string) {
+	tb.Helper()
+	if err := db.Exec(sql); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// Query returns the first column of the first row of sql, as text.
+func Query(tb testing.TB, db *sqlite3.Conn, sql string) string {
+	tb.Helper()
+	stmt, _, err := db.Prepare(sql)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer stmt.Close()
+	if !stmt.Step() {
+		tb.Fatal(stmt.Err())
+	}
+	return stmt.ColumnText(0)
+}
@@ -115,3 +115,18 @@ const (
 	OK_LOAD_PERMANENTLY = OK | (1 << 8)
 	OK_SYMLINK          = OK | (2 << 8) /* internal use only */
 )
+
+// Custom file control opcodes used by the VFSes in this module.
+// Opcodes from FCNTL_CUSTOM to FCNTL_CUSTOM+255 are reserved for them:
+// allocate new ones here, so they don't collide.
+const (
+	FCNTL_CUSTOM = 1 << 16
+
+	FCNTL_STATSVFS_STATS = FCNTL_CUSTOM + 1
+	FCNTL_ADIANTUM_REKEY = FCNTL_CUSTOM + 2
+	FCNTL_XTS_REKEY      = FCNTL_CUSTOM + 3
+	FCNTL_AEAD_RESERVE   = FCNTL_CUSTOM + 4
+	FCNTL_AEAD_VERIFY    = FCNTL_CUSTOM + 5
+	FCNTL_LOGVFS_STATS   = FCNTL_CUSTOM + 6
+	FCNTL_LOGVFS_COMPACT = FCNTL_CUSTOM + 7
+)
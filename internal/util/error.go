@@ -33,6 +33,13 @@ func AssertErr() ErrorString {
 	return ErrorString(msg)
 }
 
+// ErrorCode is the error code type returned by package vfs.
+type ErrorCode uint32
+
+func (e ErrorCode) Error() string {
+	return ErrorCodeString(uint32(e))
+}
+
 func ErrorCodeString(rc uint32) string {
 	switch rc {
 	case ABORT_ROLLBACK:
@@ -10,6 +10,10 @@ import (
 
 type ConnKey struct{}
 
+// CustomControl carries the argument and result
+// of a custom file control opcode.
+type CustomControl struct{ Arg, Ret any }
+
 type moduleKey struct{}
 type moduleState struct {
 	mmapState
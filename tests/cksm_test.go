@@ -2,6 +2,9 @@ package tests
 
 import (
 	_ "embed"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
@@ -10,6 +13,7 @@ import (
 	_ "github.com/ncruces/go-sqlite3/embed"
 	_ "github.com/ncruces/go-sqlite3/internal/testcfg"
 	"github.com/ncruces/go-sqlite3/util/ioutil"
+	"github.com/ncruces/go-sqlite3/vfs"
 	"github.com/ncruces/go-sqlite3/vfs/memdb"
 	"github.com/ncruces/go-sqlite3/vfs/readervfs"
 )
@@ -73,3 +77,86 @@ func Test_enable(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func Test_verify(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sqlite3.Open("file:" + filepath.ToSlash(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.EnableChecksums("main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec(`
+		PRAGMA journal_mode=wal;
+		CREATE TABLE t (id INTEGER PRIMARY KEY, text TEXT);
+		CREATE INDEX i ON t (text);
+		WITH RECURSIVE c(n) AS (SELECT 1 UNION ALL SELECT n+1 FROM c WHERE n < 1000)
+		INSERT INTO t (text) SELECT printf('row %d: %s', n, hex(randomblob(100))) FROM c;
+		INSERT INTO t (text) VALUES (hex(randomblob(10000)));
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad, err := vfs.VerifyChecksums(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bad) != 0 {
+		t.Errorf("got %v", bad)
+	}
+
+	// Checkpoint, and leave some frames in the WAL.
+	_, _, err = db.WALCheckpoint("main", sqlite3.CHECKPOINT_TRUNCATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec(`INSERT INTO t (text) VALUES ('last')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []vfs.BadPage
+	stmt, _, err := db.Prepare(`SELECT rootpage, name FROM sqlite_schema ORDER BY rootpage`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for stmt.Step() {
+		want = append(want, vfs.BadPage{Page: stmt.ColumnInt(0), Owner: stmt.ColumnText(1)})
+	}
+	if err := stmt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte in the root page of each b-tree.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range want {
+		var b [1]byte
+		off := int64(p.Page-1)*4096 + 2000
+		if _, err := f.ReadAt(b[:], off); err != nil {
+			t.Fatal(err)
+		}
+		b[0] ^= 0x10
+		if _, err := f.WriteAt(b[:], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	bad, err = vfs.VerifyChecksums(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(bad, want) {
+		t.Errorf("got %v, want %v", bad, want)
+	}
+}
@@ -0,0 +1,157 @@
+package vfsutil
+
+import "github.com/ncruces/go-sqlite3/vfs"
+
+// WrappedFile helps implement a [vfs.File] that wraps another.
+//
+// It implements every optional vfs.File interface
+// by delegating to the wrapped File,
+// which gets the default behavior for interfaces
+// the wrapped File doesn't implement.
+//
+// Embed it, and override only the methods that need it:
+//
+//	type myFile struct {
+//		vfsutil.WrappedFile
+//	}
+//
+//	func (f *myFile) ReadAt(p []byte, off int64) (int, error) {
+//		// ...
+//		return f.File.ReadAt(p, off)
+//	}
+type WrappedFile struct {
+	vfs.File
+}
+
+var (
+	// Ensure these interfaces are implemented:
+	_ vfs.FileUnwrap             = WrappedFile{}
+	_ vfs.FileLockState          = WrappedFile{}
+	_ vfs.FilePersistWAL         = WrappedFile{}
+	_ vfs.FilePowersafeOverwrite = WrappedFile{}
+	_ vfs.FileChunkSize          = WrappedFile{}
+	_ vfs.FileSizeHint           = WrappedFile{}
+	_ vfs.FileHasMoved           = WrappedFile{}
+	_ vfs.FileOverwrite          = WrappedFile{}
+	_ vfs.FileSync               = WrappedFile{}
+	_ vfs.FileCommitPhaseTwo     = WrappedFile{}
+	_ vfs.FileBatchAtomicWrite   = WrappedFile{}
+	_ vfs.FileCheckpoint         = WrappedFile{}
+	_ vfs.FilePragma             = WrappedFile{}
+	_ vfs.FileBusyHandler        = WrappedFile{}
+	_ vfs.FileCustomControl      = WrappedFile{}
+	_ vfs.FileSharedMemory       = WrappedFile{}
+)
+
+// Unwrap implements [vfs.FileUnwrap].
+func (w WrappedFile) Unwrap() vfs.File {
+	return w.File
+}
+
+// LockState implements [vfs.FileLockState].
+func (w WrappedFile) LockState() vfs.LockLevel {
+	return WrapLockState(w.File)
+}
+
+// PersistWAL implements [vfs.FilePersistWAL].
+func (w WrappedFile) PersistWAL() bool {
+	return WrapPersistWAL(w.File)
+}
+
+// SetPersistWAL implements [vfs.FilePersistWAL].
+func (w WrappedFile) SetPersistWAL(keepWAL bool) {
+	WrapSetPersistWAL(w.File, keepWAL)
+}
+
+// PowersafeOverwrite implements [vfs.FilePowersafeOverwrite].
+func (w WrappedFile) PowersafeOverwrite() bool {
+	return WrapPowersafeOverwrite(w.File)
+}
+
+// SetPowersafeOverwrite implements [vfs.FilePowersafeOverwrite].
+func (w WrappedFile) SetPowersafeOverwrite(psow bool) {
+	WrapSetPowersafeOverwrite(w.File, psow)
+}
+
+// ChunkSize implements [vfs.FileChunkSize].
+func (w WrappedFile) ChunkSize(size int) {
+	WrapChunkSize(w.File, size)
+}
+
+// SizeHint implements [vfs.FileSizeHint].
+func (w WrappedFile) SizeHint(size int64) error {
+	return WrapSizeHint(w.File, size)
+}
+
+// HasMoved implements [vfs.FileHasMoved].
+func (w WrappedFile) HasMoved() (bool, error) {
+	return WrapHasMoved(w.File)
+}
+
+// Overwrite implements [vfs.FileOverwrite].
+func (w WrappedFile) Overwrite() error {
+	return WrapOverwrite(w.File)
+}
+
+// SyncSuper implements [vfs.FileSync].
+func (w WrappedFile) SyncSuper(super string) error {
+	return WrapSyncSuper(w.File, super)
+}
+
+// CommitPhaseTwo implements [vfs.FileCommitPhaseTwo].
+func (w WrappedFile) CommitPhaseTwo() error {
+	return WrapCommitPhaseTwo(w.File)
+}
+
+// BeginAtomicWrite implements [vfs.FileBatchAtomicWrite].
+func (w WrappedFile) BeginAtomicWrite() error {
+	return WrapBeginAtomicWrite(w.File)
+}
+
+// CommitAtomicWrite implements [vfs.FileBatchAtomicWrite].
+func (w WrappedFile) CommitAtomicWrite() error {
+	return WrapCommitAtomicWrite(w.File)
+}
+
+// RollbackAtomicWrite implements [vfs.FileBatchAtomicWrite].
+func (w WrappedFile) RollbackAtomicWrite() error {
+	return WrapRollbackAtomicWrite(w.File)
+}
+
+// CheckpointStart implements [vfs.FileCheckpoint].
+func (w WrappedFile) CheckpointStart() {
+	WrapCheckpointStart(w.File)
+}
+
+// CheckpointDone implements [vfs.FileCheckpoint].
+func (w WrappedFile) CheckpointDone() {
+	WrapCheckpointDone(w.File)
+}
+
+// Pragma implements [vfs.FilePragma].
+func (w WrappedFile) Pragma(name, value string) (string, error) {
+	return WrapPragma(w.File, name, value)
+}
+
+// BusyHandler implements [vfs.FileBusyHandler].
+func (w WrappedFile) BusyHandler(handler func() bool) {
+	WrapBusyHandler(w.File, handler)
+}
+
+// CustomControl implements [vfs.FileCustomControl].
+func (w WrappedFile) CustomControl(op uint32, arg any) (any, error) {
+	return WrapCustomControl(w.File, op, arg)
+}
+
+// SharedMemory implements [vfs.FileSharedMemory].
+func (w WrappedFile) SharedMemory() vfs.SharedMemory {
+	return WrapSharedMemory(w.File)
+}
+
+// SetDB passes the connection that opened the file
+// on to the wrapped File.
+func (w WrappedFile) SetDB(db any) {
+	if f, ok := w.File.(interface{ SetDB(any) }); ok {
+		f.SetDB(db)
+	}
+}
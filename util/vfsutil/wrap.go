@@ -168,6 +168,14 @@ func WrapBusyHandler(f vfs.File, handler func() bool) {
 	}
 }
 
+// WrapCustomControl helps wrap [vfs.FileCustomControl].
+func WrapCustomControl(f vfs.File, op uint32, arg any) (any, error) {
+	if f, ok := f.(vfs.FileCustomControl); ok {
+		return f.CustomControl(op, arg)
+	}
+	return nil, sqlite3.NOTFOUND
+}
+
 // WrapSharedMemory helps wrap [vfs.FileSharedMemory].
 func WrapSharedMemory(f vfs.File) vfs.SharedMemory {
 	if f, ok := f.(vfs.FileSharedMemory); ok {
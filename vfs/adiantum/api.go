@@ -3,7 +3,8 @@
 // The "adiantum" [vfs.VFS] wraps the default VFS using the
 // Adiantum tweakable, length-preserving encryption.
 //
-// Importing package adiantum registers that VFS:
+// Importing package adiantum registers that VFS,
+// and a wrapper to stack it over other VFSes (e.g. "stats+adiantum"):
 //
 //	import _ "github.com/ncruces/go-sqlite3/vfs/adiantum"
 //
@@ -30,17 +31,32 @@
 //	ATTACH DATABASE 'demo.db' AS demo;
 //	PRAGMA demo.textkey='your-secret-key';
 //
+// To change the key of a database, use [Rekey], or any of the following PRAGMAs:
+//
+//	PRAGMA rekey='D41d8cD98f00b204e9800998eCf8427e';
+//	PRAGMA hexrekey='e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855';
+//	PRAGMA textrekey='your-new-secret-key';
+//
+// Rekeying a database opened without a key encrypts it in place,
+// and rekeying a database with an empty key decrypts it in place.
+//
 // [URI]: https://sqlite.org/uri.html
 package adiantum
 
 import (
 	"lukechampine.com/adiantum/hbsh"
 
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/internal/rekey"
+	"github.com/ncruces/go-sqlite3/internal/util"
 	"github.com/ncruces/go-sqlite3/vfs"
 )
 
 func init() {
 	vfs.Register("adiantum", Wrap(vfs.Find(""), nil))
+	vfs.RegisterWrapper("adiantum", func(base vfs.VFS) vfs.VFS {
+		return Wrap(base, nil)
+	})
 }
 
 // Wrap wraps a base VFS to create an encrypting VFS,
@@ -56,8 +72,14 @@ func Wrap(base vfs.VFS, cipher HBSHCreator) vfs.VFS {
 		cipher = adiantumCreator{}
 	}
 	return &hbshVFS{
-		VFS:  base,
-		init: cipher,
+		VFS: base,
+		keys: rekey.Keys[*hbsh.HBSH]{
+			KDF:       cipher.KDF,
+			New:       cipher.HBSH,
+			Cipher:    func(c *hbsh.HBSH) rekey.Cipher { return hbshCipher{c} },
+			BlockSize: blockSize,
+			Opcode:    uint32(_FCNTL_REKEY),
+		},
 	}
 }
 
@@ -72,3 +94,22 @@ type HBSHCreator interface {
 	// If key is not appropriate, nil is returned.
 	HBSH(key []byte) *hbsh.HBSH
 }
+
+const _FCNTL_REKEY = sqlite3.FcntlOpcode(util.FCNTL_ADIANTUM_REKEY)
+
+// Rekey re-encrypts the schema database of a connection,
+// its rollback journal, and its WAL, with a new key.
+// An empty key decrypts the database.
+//
+// Rekey needs exclusive access to the database,
+// and fails with [sqlite3.BUSY] if other connections are using it.
+// Other connections that opened the database before it was rekeyed
+// must be reopened with the new key.
+//
+// If the rekey is interrupted (e.g. by a crash),
+// the database is restored with the old key
+// when it is next opened.
+func Rekey(db *sqlite3.Conn, schema string, key []byte) error {
+	_, err := db.FileControl(schema, _FCNTL_REKEY, key)
+	return err
+}
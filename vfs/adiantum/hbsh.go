@@ -2,12 +2,12 @@ package adiantum
 
 import (
 	"encoding/binary"
-	"encoding/hex"
 	"io"
 
 	"lukechampine.com/adiantum/hbsh"
 
 	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/internal/rekey"
 	"github.com/ncruces/go-sqlite3/internal/util"
 	"github.com/ncruces/go-sqlite3/util/vfsutil"
 	"github.com/ncruces/go-sqlite3/vfs"
@@ -15,7 +15,7 @@ import (
 
 type hbshVFS struct {
 	vfs.VFS
-	init HBSHCreator
+	keys rekey.Keys[*hbsh.HBSH]
 }
 
 func (h *hbshVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
@@ -31,31 +31,16 @@ func (h *hbshVFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (file vfs
 		return file, flags, err
 	}
 
-	var hbsh *hbsh.HBSH
-	if f, ok := vfsutil.UnwrapFile[*hbshFile](name.DatabaseFile()); ok {
-		hbsh = f.hbsh
-	} else {
-		var key []byte
-		if params := name.URIParameters(); name == nil {
-			key = h.init.KDF("") // Temporary files get a random key.
-		} else if t, ok := params["key"]; ok {
-			key = []byte(t[0])
-		} else if t, ok := params["hexkey"]; ok {
-			key, _ = hex.DecodeString(t[0])
-		} else if t, ok := params["textkey"]; ok && len(t[0]) > 0 {
-			key = h.init.KDF(t[0])
-		} else if flags&vfs.OPEN_MAIN_DB != 0 {
-			// Main databases may have their key specified as a PRAGMA.
-			return &hbshFile{File: file, init: h.init}, flags, nil
-		}
-		hbsh = h.init.HBSH(key)
+	f := &hbshFile{}
+	var main *rekey.KeyedFile[*hbsh.HBSH]
+	if m, ok := vfsutil.UnwrapFile[*hbshFile](name.DatabaseFile()); ok {
+		main = &m.KeyedFile
 	}
-
-	if hbsh == nil {
+	if err := h.keys.Open(&f.KeyedFile, main, h.VFS, file, name, flags); err != nil {
 		file.Close()
-		return nil, flags, sqlite3.CANTOPEN
+		return nil, flags, err
 	}
-	return &hbshFile{File: file, hbsh: hbsh, init: h.init}, flags, nil
+	return f, flags, nil
 }
 
 // Larger blocks improve both security (wide-block cipher)
@@ -80,36 +65,17 @@ func roundUp[T int | int64](i T) T {
 }
 
 type hbshFile struct {
-	vfs.File
-	init  HBSHCreator
-	hbsh  *hbsh.HBSH
+	rekey.KeyedFile[*hbsh.HBSH]
 	tweak [tweakSize]byte
 	block [blockSize]byte
 }
 
-func (h *hbshFile) Pragma(name string, value string) (string, error) {
-	var key []byte
-	switch name {
-	case "key":
-		key = []byte(value)
-	case "hexkey":
-		key, _ = hex.DecodeString(value)
-	case "textkey":
-		if len(value) > 0 {
-			key = h.init.KDF(value)
-		}
-	default:
-		return vfsutil.WrapPragma(h.File, name, value)
-	}
-
-	if h.hbsh = h.init.HBSH(key); h.hbsh != nil {
-		return "ok", nil
-	}
-	return "", sqlite3.CANTOPEN
-}
-
 func (h *hbshFile) ReadAt(p []byte, off int64) (n int, err error) {
-	if h.hbsh == nil {
+	cipher, plain := h.Key()
+	if plain {
+		return h.File.ReadAt(p, off)
+	}
+	if cipher == nil {
 		// Only OPEN_MAIN_DB can have a missing key.
 		if off == 0 && len(p) == 100 {
 			// SQLite is trying to read the header of a database file.
@@ -130,7 +96,7 @@ func (h *hbshFile) ReadAt(p []byte, off int64) (n int, err error) {
 		}
 
 		binary.LittleEndian.PutUint64(h.tweak[:], uint64(min))
-		data := h.hbsh.Decrypt(h.block[:], h.tweak[:])
+		data := cipher.Decrypt(h.block[:], h.tweak[:])
 
 		if off > min {
 			data = data[off-min:]
@@ -145,7 +111,11 @@ func (h *hbshFile) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (h *hbshFile) WriteAt(p []byte, off int64) (n int, err error) {
-	if h.hbsh == nil {
+	cipher, plain := h.Key()
+	if plain {
+		return h.File.WriteAt(p, off)
+	}
+	if cipher == nil {
 		return 0, sqlite3.READONLY
 	}
 
@@ -172,7 +142,7 @@ func (h *hbshFile) WriteAt(p []byte, off int64) (n int, err error) {
 				// Either way, zero pad the file to the next block size.
 				clear(data)
 			} else {
-				data = h.hbsh.Decrypt(h.block[:], h.tweak[:])
+				data = cipher.Decrypt(h.block[:], h.tweak[:])
 			}
 			if off > min {
 				data = data[off-min:]
@@ -180,7 +150,7 @@ func (h *hbshFile) WriteAt(p []byte, off int64) (n int, err error) {
 		}
 
 		t := copy(data, p[n:])
-		h.hbsh.Encrypt(h.block[:], h.tweak[:])
+		cipher.Encrypt(h.block[:], h.tweak[:])
 
 		m, err := h.File.WriteAt(h.block[:], min)
 		if m != blockSize {
@@ -216,71 +186,24 @@ func (h *hbshFile) Truncate(size int64) error {
 }
 
 func (h *hbshFile) ChunkSize(size int) {
-	vfsutil.WrapChunkSize(h.File, roundUp(size))
+	h.WrappedFile.ChunkSize(roundUp(size))
 }
 
 func (h *hbshFile) SizeHint(size int64) error {
-	return vfsutil.WrapSizeHint(h.File, roundUp(size))
-}
-
-func (h *hbshFile) Unwrap() vfs.File {
-	return h.File
-}
-
-func (h *hbshFile) SharedMemory() vfs.SharedMemory {
-	return vfsutil.WrapSharedMemory(h.File)
-}
-
-// Wrap optional methods.
-
-func (h *hbshFile) LockState() vfs.LockLevel {
-	return vfsutil.WrapLockState(h.File) // notest
-}
-
-func (h *hbshFile) PersistentWAL() bool {
-	return vfsutil.WrapPersistWAL(h.File) // notest
-}
-
-func (h *hbshFile) SetPersistentWAL(keepWAL bool) {
-	vfsutil.WrapSetPersistWAL(h.File, keepWAL) // notest
-}
-
-func (h *hbshFile) HasMoved() (bool, error) {
-	return vfsutil.WrapHasMoved(h.File) // notest
-}
-
-func (h *hbshFile) Overwrite() error {
-	return vfsutil.WrapOverwrite(h.File) // notest
-}
-
-func (h *hbshFile) SyncSuper(super string) error {
-	return vfsutil.WrapSyncSuper(h.File, super) // notest
+	return h.WrappedFile.SizeHint(roundUp(size))
 }
 
-func (h *hbshFile) CommitPhaseTwo() error {
-	return vfsutil.WrapCommitPhaseTwo(h.File) // notest
-}
-
-func (h *hbshFile) BeginAtomicWrite() error {
-	return vfsutil.WrapBeginAtomicWrite(h.File) // notest
-}
-
-func (h *hbshFile) CommitAtomicWrite() error {
-	return vfsutil.WrapCommitAtomicWrite(h.File) // notest
-}
-
-func (h *hbshFile) RollbackAtomicWrite() error {
-	return vfsutil.WrapRollbackAtomicWrite(h.File) // notest
-}
-
-func (h *hbshFile) CheckpointStart() {
-	vfsutil.WrapCheckpointStart(h.File) // notest
-}
+// hbshCipher adapts an HBSH cipher to rekey files.
+type hbshCipher struct{ hbsh *hbsh.HBSH }
 
-func (h *hbshFile) CheckpointDone() {
-	vfsutil.WrapCheckpointDone(h.File) // notest
+func (c hbshCipher) Encrypt(block []byte, off int64) {
+	var tweak [tweakSize]byte
+	binary.LittleEndian.PutUint64(tweak[:], uint64(off))
+	c.hbsh.Encrypt(block, tweak[:])
 }
 
-func (h *hbshFile) BusyHandler(handler func() bool) {
-	vfsutil.WrapBusyHandler(h.File, handler) // notest
+func (c hbshCipher) Decrypt(block []byte, off int64) {
+	var tweak [tweakSize]byte
+	binary.LittleEndian.PutUint64(tweak[:], uint64(off))
+	c.hbsh.Decrypt(block, tweak[:])
 }
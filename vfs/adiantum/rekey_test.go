@@ -0,0 +1,74 @@
+package adiantum_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs/adiantum"
+)
+
+const (
+	hexkey1 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	hexkey2 = "d41d8cd98f00b204e9800998ecf8427ed41d8cd98f00b204e9800998ecf8427e"
+)
+
+func Test_rekey(t *testing.T) {
+	path := filepath.ToSlash(filepath.Join(t.TempDir(), "test.db"))
+
+	// Create a plaintext database, with pages in the WAL.
+	db, err := sqlite3.Open("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testcfg.Exec(t, db, `PRAGMA journal_mode=wal`)
+	testcfg.Exec(t, db, `CREATE TABLE t (x)`)
+	testcfg.Exec(t, db, `INSERT INTO t VALUES ('plain')`)
+	db.Close()
+
+	// Encrypt it in place, then rekey it.
+	db, err = sqlite3.Open("file:" + path + "?vfs=adiantum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testcfg.Exec(t, db, `PRAGMA hexrekey='`+hexkey1+`'`)
+	testcfg.Exec(t, db, `INSERT INTO t VALUES ('key1')`)
+	testcfg.Exec(t, db, `PRAGMA hexrekey='`+hexkey2+`'`)
+	testcfg.Exec(t, db, `INSERT INTO t VALUES ('key2')`)
+	db.Close()
+
+	db, err = sqlite3.Open("file:" + path + "?vfs=adiantum&hexkey=" + hexkey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec(`SELECT * FROM t`); !errors.Is(err, sqlite3.NOTADB) {
+		t.Errorf("got %v, want NOTADB", err)
+	}
+	db.Close()
+
+	// Decrypt it in place.
+	db, err = sqlite3.Open("file:" + path + "?vfs=adiantum&hexkey=" + hexkey2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := adiantum.Rekey(db, "main", nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = sqlite3.Open("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := testcfg.Query(t, db, `SELECT group_concat(x) FROM t`); got != "plain,key1,key2" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,535 @@
+package aead
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/util/sql3util"
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+type aeadVFS struct {
+	vfs.VFS
+	temp vfs.VFSFilename
+	init AEADCreator
+}
+
+func (a *aeadVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	// notest // OpenFilename is called instead
+	return nil, 0, sqlite3.CANTOPEN
+}
+
+func (a *aeadVFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (file vfs.File, _ vfs.OpenFlag, err error) {
+	// Temporary files have no reserved bytes.
+	if name == nil {
+		return a.temp.OpenFilename(name, flags)
+	}
+
+	file, flags, err = vfsutil.WrapOpenFilename(a.VFS, name, flags)
+
+	// Encrypt main databases, journals and WAL files, except memory files.
+	if err != nil || flags&vfs.OPEN_MEMORY != 0 ||
+		flags&(vfs.OPEN_MAIN_DB|vfs.OPEN_MAIN_JOURNAL|vfs.OPEN_WAL) == 0 {
+		return file, flags, err
+	}
+
+	// Journals and WAL files use the key of their main database.
+	if flags&vfs.OPEN_MAIN_DB == 0 {
+		f, ok := vfsutil.UnwrapFile[*aeadFile](name.DatabaseFile())
+		if !ok || f.cipher == nil {
+			file.Close()
+			return nil, flags, sqlite3.CANTOPEN
+		}
+		kind := kindJournal
+		if flags&vfs.OPEN_WAL != 0 {
+			kind = kindWAL
+		}
+		return &aeadFile{WrappedFile: vfsutil.WrappedFile{File: file}, init: a.init, main: f, kind: kind}, flags, nil
+	}
+
+	f := &aeadFile{WrappedFile: vfsutil.WrappedFile{File: file}, init: a.init, kind: kindDB}
+
+	var key []byte
+	params := name.URIParameters()
+	if t, ok := params["key"]; ok {
+		key = []byte(t[0])
+	} else if t, ok := params["hexkey"]; ok {
+		key, _ = hex.DecodeString(t[0])
+	} else if t, ok := params["textkey"]; ok && len(t[0]) > 0 {
+		key = a.init.KDF(t[0])
+	} else {
+		// Main databases may have their key specified as a PRAGMA.
+		return f, flags, nil
+	}
+
+	if f.cipher = a.init.AEAD(key); f.cipher == nil {
+		file.Close()
+		return nil, flags, sqlite3.CANTOPEN
+	}
+	return f, flags, nil
+}
+
+// Each page is authenticated with the kind of file it belongs to,
+// and its offset in the file, so pages can't be moved around.
+const (
+	kindDB byte = iota
+	kindJournal
+	kindWAL
+)
+
+// The WAL file, and each of its frames, start with a plaintext header.
+// https://sqlite.org/fileformat.html#wal_file_format
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+)
+
+// Bytes 16 through 23 of the database header
+// (page size, file format versions, and reserved bytes)
+// are stored in the clear, so the page size can be known
+// before the first page is decrypted.
+// https://sqlite.org/fileformat.html#the_database_header
+const (
+	clearStart = 16
+	clearEnd   = 24
+)
+
+type aeadFile struct {
+	vfsutil.WrappedFile
+	init     AEADCreator
+	cipher   cipher.AEAD
+	main     *aeadFile // the main database of a journal or WAL file
+	kind     byte
+	pageSize int // of a database or WAL file, zero if unknown
+	buf      []byte
+	ad       [1 + 8 + clearEnd - clearStart]byte
+}
+
+// db returns the file that holds the key:
+// journals and WAL files use the key of their main database.
+func (a *aeadFile) db() *aeadFile {
+	if a.main != nil {
+		return a.main
+	}
+	return a
+}
+
+// reserve returns the number of reserved bytes
+// used to store the nonce and the tag of each page.
+func (a *aeadFile) reserve() int {
+	c := a.db().cipher
+	return c.NonceSize() + c.Overhead()
+}
+
+func (a *aeadFile) Pragma(name string, value string) (string, error) {
+	var key []byte
+	switch name {
+	case "key":
+		key = []byte(value)
+	case "hexkey":
+		key, _ = hex.DecodeString(value)
+	case "textkey":
+		if len(value) > 0 {
+			key = a.init.KDF(value)
+		}
+	default:
+		return a.WrappedFile.Pragma(name, value)
+	}
+
+	if a.cipher = a.init.AEAD(key); a.cipher != nil {
+		return "ok", nil
+	}
+	return "", sqlite3.CANTOPEN
+}
+
+func (a *aeadFile) CustomControl(op uint32, arg any) (any, error) {
+	switch op {
+	case uint32(_FCNTL_RESERVE):
+		if a.db().cipher == nil {
+			return nil, sqlite3.CANTOPEN
+		}
+		return a.reserve(), nil
+	case uint32(_FCNTL_VERIFY):
+		return a.verify()
+	}
+	return a.WrappedFile.CustomControl(op, arg)
+}
+
+func (a *aeadFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if a.db().cipher == nil {
+		// Only OPEN_MAIN_DB can have a missing key.
+		if off == 0 && len(p) == 100 {
+			// SQLite is trying to read the header of a database file.
+			// Pretend the file is empty so the key may be specified as a PRAGMA.
+			return 0, io.EOF
+		}
+		return 0, sqlite3.CANTOPEN
+	}
+
+	for n < len(p) {
+		pos := off + int64(n)
+		start, size, page, err := a.span(pos, len(p)-n, false)
+		if err != nil {
+			return n, err
+		}
+
+		if !page {
+			m, err := a.File.ReadAt(p[n:n+size], pos)
+			n += m
+			if m != size {
+				return n, err
+			}
+			if a.kind == kindWAL && pos == 0 && m >= walHeaderSize {
+				a.setPageSize(p[:walHeaderSize])
+			}
+			continue
+		}
+
+		data := a.buffer(size)
+		if m, err := a.File.ReadAt(data, start); m != size {
+			return n, err
+		}
+		if err := a.open(data, start); err != nil {
+			if a.kind != kindWAL || start == off {
+				return n, err
+			}
+			// SQLite is recovering the WAL, reading frames along with their headers.
+			// A torn frame fails to authenticate, and is as good as corrupt.
+			// Zero it, so that its checksum fails, and recovery stops there.
+			clear(data)
+		}
+		n += copy(p[n:], data[pos-start:])
+	}
+	return n, nil
+}
+
+func (a *aeadFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if a.db().cipher == nil {
+		return 0, sqlite3.READONLY
+	}
+	if off == 0 {
+		if err := a.setPageSize(p); err != nil {
+			return 0, err
+		}
+	}
+
+	for n < len(p) {
+		pos := off + int64(n)
+		start, size, page, err := a.span(pos, len(p)-n, true)
+		if err != nil {
+			return n, err
+		}
+
+		if !page {
+			m, err := a.File.WriteAt(p[n:n+size], pos)
+			n += m
+			if m != size {
+				return n, err
+			}
+			continue
+		}
+
+		data := a.buffer(size)
+		if pos > start || len(p)-n < size {
+			// Partial page write: read-update-write.
+			m, err := a.File.ReadAt(data, start)
+			if m != size {
+				if err != io.EOF {
+					return n, err
+				}
+				// Writing past the EOF.
+				// We're either appending an entirely new page,
+				// or the final page was only partially written.
+				// A partially written page can't be authenticated,
+				// and is as good as corrupt.
+				// Either way, zero pad the file to the next page size.
+				clear(data)
+			} else if err := a.open(data, start); err != nil {
+				return n, err
+			}
+		}
+
+		t := copy(data[pos-start:], p[n:])
+		a.seal(data, start)
+
+		if m, err := a.File.WriteAt(data, start); m != size {
+			return n, err
+		}
+		n += t
+	}
+	return n, nil
+}
+
+// span returns the region of the file that includes off:
+// either an encrypted page, or up to size bytes of plaintext.
+func (a *aeadFile) span(off int64, size int, write bool) (start int64, _ int, page bool, err error) {
+	switch a.kind {
+	case kindDB:
+		// Re-read the page size when reading the first page,
+		// as another connection may have changed it.
+		if a.pageSize == 0 || !write && off < int64(a.pageSize) {
+			if err := a.readPageSize(); err != nil {
+				return 0, 0, false, err
+			}
+		}
+		if a.pageSize == 0 {
+			if write {
+				return 0, 0, false, sqlite3.MISUSE
+			}
+			return 0, 0, false, io.EOF
+		}
+		return off / int64(a.pageSize) * int64(a.pageSize), a.pageSize, true, nil
+
+	case kindWAL:
+		if off < walHeaderSize {
+			return off, min(size, int(walHeaderSize-off)), false, nil
+		}
+		if a.pageSize == 0 {
+			a.readPageSize()
+		}
+		if a.pageSize == 0 {
+			return 0, 0, false, sqlite3.CORRUPT
+		}
+		frameSize := int64(walFrameHeaderSize + a.pageSize)
+		start = walHeaderSize + (off-walHeaderSize)/frameSize*frameSize
+		if off < start+walFrameHeaderSize {
+			return off, min(size, int(start+walFrameHeaderSize-off)), false, nil
+		}
+		return start + walFrameHeaderSize, a.pageSize, true, nil
+
+	default:
+		// Journals are written by SQLite one record at a time.
+		// Page images are 4 bytes into a record, after the page number,
+		// and records are 8 bytes longer than pages.
+		// https://sqlite.org/fileformat.html#the_rollback_journal
+		if off%8 == 4 && sql3util.ValidPageSize(size) {
+			return off, size, true, nil
+		}
+		return off, size, false, nil
+	}
+}
+
+// readPageSize reads the page size of a database or WAL file
+// from its plaintext header.
+func (a *aeadFile) readPageSize() error {
+	switch a.kind {
+	case kindDB:
+		var hdr [clearEnd]byte
+		if n, err := a.File.ReadAt(hdr[:], 0); n != len(hdr) {
+			if err != io.EOF {
+				return err
+			}
+			a.pageSize = 0
+			return nil
+		}
+		size, reserve := parseHeader(hdr[:])
+		if !sql3util.ValidPageSize(size) || reserve < a.reserve() {
+			return sqlite3.NOTADB
+		}
+		a.pageSize = size
+
+	case kindWAL:
+		var hdr [walHeaderSize]byte
+		if n, _ := a.File.ReadAt(hdr[:], 0); n == len(hdr) {
+			a.setPageSize(hdr[:])
+		}
+		if a.pageSize == 0 {
+			a.pageSize = a.main.pageSize
+		}
+	}
+	return nil
+}
+
+// setPageSize learns the page size of a database or WAL file
+// from the header SQLite is reading or writing.
+func (a *aeadFile) setPageSize(hdr []byte) error {
+	switch a.kind {
+	case kindDB:
+		if len(hdr) < clearEnd {
+			break
+		}
+		size, reserve := parseHeader(hdr)
+		if !sql3util.ValidPageSize(size) {
+			return sqlite3.NOTADB
+		}
+		if reserve < a.reserve() {
+			// Not enough reserved bytes: use Init on a new database.
+			return sqlite3.MISUSE
+		}
+		a.pageSize = size
+
+	case kindWAL:
+		if len(hdr) < walHeaderSize {
+			break
+		}
+		if size := int(binary.BigEndian.Uint32(hdr[8:12])); sql3util.ValidPageSize(size) {
+			a.pageSize = size
+		}
+	}
+	return nil
+}
+
+// parseHeader returns the page size and the number of reserved bytes
+// from a database header.
+func parseHeader(hdr []byte) (size, reserve int) {
+	return 256 * int(binary.LittleEndian.Uint16(hdr[16:18])), int(hdr[20])
+}
+
+// seal encrypts a page in place, given its offset in the file.
+// The nonce and the tag are stored in the reserved bytes.
+func (a *aeadFile) seal(page []byte, off int64) {
+	c := a.db().cipher
+	end := len(page) - c.NonceSize()
+	nonce := page[end:]
+	rand.Read(nonce)
+
+	data := page[:end-c.Overhead()]
+	if a.kind != kindDB || off != 0 {
+		c.Seal(data[:0], nonce, data, a.adata(off, nil))
+		return
+	}
+
+	// Keep part of the database header in the clear,
+	// and authenticate it as additional data.
+	var clr [clearEnd - clearStart]byte
+	copy(clr[:], data[clearStart:clearEnd])
+	copy(data[clearStart:], data[clearEnd:])
+	data = data[:len(data)-len(clr)]
+	c.Seal(data[:0], nonce, data, a.adata(off, clr[:]))
+	copy(page[clearEnd:end], page[clearStart:end-len(clr)])
+	copy(page[clearStart:], clr[:])
+}
+
+// open decrypts and authenticates a page in place, given its offset in the file.
+// The reserved bytes used to store the nonce and the tag are zeroed.
+func (a *aeadFile) open(page []byte, off int64) error {
+	c := a.db().cipher
+	end := len(page) - c.NonceSize()
+	nonce := page[end:]
+
+	data := page[:end]
+	if a.kind != kindDB || off != 0 {
+		if _, err := c.Open(data[:0], nonce, data, a.adata(off, nil)); err != nil {
+			return sqlite3.CORRUPT
+		}
+	} else {
+		var clr [clearEnd - clearStart]byte
+		copy(clr[:], data[clearStart:clearEnd])
+		copy(data[clearStart:], data[clearEnd:])
+		data = data[:len(data)-len(clr)]
+		if _, err := c.Open(data[:0], nonce, data, a.adata(off, clr[:])); err != nil {
+			return sqlite3.CORRUPT
+		}
+		copy(page[clearEnd:], page[clearStart:len(data)-c.Overhead()])
+		copy(page[clearStart:], clr[:])
+	}
+
+	// SQLite should always see the reserved bytes as zeros,
+	// as they're included in WAL and journal checksums.
+	clear(page[len(page)-a.reserve():])
+	return nil
+}
+
+func (a *aeadFile) adata(off int64, clr []byte) []byte {
+	ad := append(a.ad[:0], a.kind)
+	ad = binary.LittleEndian.AppendUint64(ad, uint64(off))
+	return append(ad, clr...)
+}
+
+func (a *aeadFile) buffer(size int) []byte {
+	if cap(a.buf) < size {
+		a.buf = make([]byte, size)
+	}
+	return a.buf[:size]
+}
+
+// verify authenticates every page of a database file,
+// and returns the page numbers of those that fail.
+func (a *aeadFile) verify() ([]int, error) {
+	if a.kind != kindDB {
+		return nil, sqlite3.MISUSE
+	}
+	if a.cipher == nil {
+		return nil, sqlite3.CANTOPEN
+	}
+
+	// Keep the file from changing.
+	if vfsutil.WrapLockState(a.File) == vfs.LOCK_NONE {
+		if err := a.File.Lock(vfs.LOCK_SHARED); err != nil {
+			return nil, err
+		}
+		defer a.File.Unlock(vfs.LOCK_NONE)
+	}
+
+	if err := a.readPageSize(); err != nil {
+		return nil, err
+	}
+	if a.pageSize == 0 {
+		return []int{}, nil
+	}
+	size, err := a.File.Size()
+	if err != nil {
+		return nil, err
+	}
+	pageSize := int64(a.pageSize)
+	pages := (size + pageSize - 1) / pageSize
+
+	data := a.buffer(a.pageSize)
+	check := func(pgno int64) (bool, error) {
+		off := (pgno - 1) * pageSize
+		if m, err := a.File.ReadAt(data, off); m != len(data) {
+			if err != io.EOF {
+				return false, err
+			}
+			// A partially written page.
+			return false, nil
+		}
+		return a.open(data, off) == nil, nil
+	}
+
+	var bad []int
+	for pgno := int64(1); pgno <= pages; pgno++ {
+		if ok, err := check(pgno); err != nil {
+			return nil, err
+		} else if !ok {
+			bad = append(bad, int(pgno))
+			continue
+		}
+		if pgno == 1 {
+			// Pages past the in-header database size, if valid,
+			// may have been preallocated, and never written.
+			// https://sqlite.org/fileformat.html#in_header_database_size
+			if n := binary.BigEndian.Uint32(data[28:]); n != 0 &&
+				binary.BigEndian.Uint32(data[24:]) == binary.BigEndian.Uint32(data[92:]) {
+				pages = min(pages, int64(n))
+			}
+		}
+	}
+
+	// A SHARED lock doesn't stop a checkpoint from writing the database,
+	// so pages that fail may have been read while being written.
+	// Read them again, and only report those that still fail.
+	failed := []int{}
+	for _, pgno := range bad {
+		if ok, err := check(int64(pgno)); err != nil {
+			return nil, err
+		} else if !ok {
+			failed = append(failed, pgno)
+		}
+	}
+	return failed, nil
+}
+
+func (a *aeadFile) DeviceCharacteristics() vfs.DeviceCharacteristic {
+	return a.File.DeviceCharacteristics() & (0 |
+		// These flags are safe:
+		vfs.IOCAP_IMMUTABLE |
+		vfs.IOCAP_SEQUENTIAL |
+		vfs.IOCAP_BATCH_ATOMIC |
+		vfs.IOCAP_UNDELETABLE_WHEN_OPEN)
+}
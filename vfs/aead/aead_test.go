@@ -0,0 +1,287 @@
+package aead_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/aead"
+	"github.com/ncruces/go-sqlite3/vfs/faultvfs"
+)
+
+const (
+	hexkey1 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	hexkey2 = "d41d8cd98f00b204e9800998ecf8427ed41d8cd98f00b204e9800998ecf8427e"
+)
+
+func TestAEAD(t *testing.T) {
+	for _, mode := range []string{"delete", "wal"} {
+		t.Run(mode, func(t *testing.T) {
+			path := filepath.ToSlash(filepath.Join(t.TempDir(), "test.db"))
+
+			// Blobs larger than a page span overflow pages,
+			// small ones share leaf pages.
+			db := create(t, path, mode)
+			testcfg.Exec(t, db, `
+				INSERT INTO blobs (data)
+				SELECT randomblob(CASE WHEN value % 10 = 0 THEN 10000 ELSE 100 END)
+				FROM generate_series(1, 500)`)
+			testcfg.Exec(t, db, `UPDATE blobs SET data = zeroblob(5000) WHERE id % 3 = 0`)
+			testcfg.Exec(t, db, `DELETE FROM blobs WHERE id % 5 = 0`)
+			if err := faultvfs.IntegrityCheck(db); err != nil {
+				t.Error(err)
+			}
+			want := testcfg.Query(t, db, `SELECT sum(length(data)) FROM blobs`)
+			db.Close()
+
+			// Data survives reopening, and is encrypted.
+			db = open(t, path, hexkey1)
+			if got := testcfg.Query(t, db, `SELECT sum(length(data)) FROM blobs`); got != want {
+				t.Errorf("got %s bytes, want %s", got, want)
+			}
+			if bad, err := aead.Verify(db, "main"); err != nil {
+				t.Fatal(err)
+			} else if len(bad) != 0 {
+				t.Errorf("got bad pages %v", bad)
+			}
+			db.Close()
+
+			buf, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buf) == 0 || string(buf[:16]) == "SQLite format 3\x00" {
+				t.Error("database not encrypted")
+			}
+			// Zero pages are encrypted too.
+			if bytes.Contains(buf, make([]byte, 256)) {
+				t.Error("database has runs of zeros")
+			}
+
+			// The wrong key fails to authenticate.
+			db, err = sqlite3.Open("file:" + path + "?vfs=aead&hexkey=" + hexkey2)
+			if err == nil {
+				err = db.Exec(`SELECT * FROM blobs`)
+				db.Close()
+			}
+			if !errors.Is(err, sqlite3.CORRUPT) {
+				t.Errorf("got %v, want CORRUPT", err)
+			}
+		})
+	}
+}
+
+func TestAEAD_tamper(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(f *os.File) error
+		bad    []int
+	}{
+		{"page", func(f *os.File) error {
+			return flip(f, 2*4096+100)
+		}, []int{3}},
+		{"reserved", func(f *os.File) error {
+			// The nonce of the second page.
+			return flip(f, 2*4096-1)
+		}, []int{2}},
+		{"cleartext header", func(f *os.File) error {
+			// The payload fraction is stored in the clear,
+			// but authenticated.
+			return flip(f, 21)
+		}, []int{1}},
+		{"swapped pages", func(f *os.File) error {
+			// Pages are bound to their offset.
+			p2 := make([]byte, 4096)
+			p3 := make([]byte, 4096)
+			if _, err := f.ReadAt(p2, 1*4096); err != nil {
+				return err
+			}
+			if _, err := f.ReadAt(p3, 2*4096); err != nil {
+				return err
+			}
+			if _, err := f.WriteAt(p3, 1*4096); err != nil {
+				return err
+			}
+			_, err := f.WriteAt(p2, 2*4096)
+			return err
+		}, []int{2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.ToSlash(filepath.Join(t.TempDir(), "test.db"))
+
+			// A table and an index: three pages.
+			db := create(t, path, "delete")
+			testcfg.Exec(t, db, `CREATE INDEX blobs_data ON blobs (data)`)
+			testcfg.Exec(t, db, `INSERT INTO blobs (data) VALUES (randomblob(200))`)
+			if got := testcfg.Query(t, db, `PRAGMA page_count`); got != "3" {
+				t.Fatalf("got %s pages", got)
+			}
+			db.Close()
+
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.tamper(f); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			// A tampered first page fails opening the connection.
+			db, err = sqlite3.Open("file:" + path + "?vfs=aead&hexkey=" + hexkey1)
+			if err != nil {
+				if !errors.Is(err, sqlite3.CORRUPT) || tt.bad[0] != 1 {
+					t.Fatalf("got %v", err)
+				}
+				return
+			}
+			defer db.Close()
+			err = db.Exec(`SELECT * FROM blobs INDEXED BY blobs_data WHERE data > x''; SELECT * FROM blobs`)
+			if !errors.Is(err, sqlite3.CORRUPT) {
+				t.Errorf("got %v, want CORRUPT", err)
+			}
+
+			bad, err := aead.Verify(db, "main")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(bad, tt.bad) {
+				t.Errorf("got bad pages %v, want %v", bad, tt.bad)
+			}
+		})
+	}
+}
+
+func TestAEAD_init(t *testing.T) {
+	path := filepath.ToSlash(filepath.Join(t.TempDir(), "test.db"))
+
+	// A database needs reserved bytes before it's written to.
+	db, err := sqlite3.Open("file:" + path + "?vfs=aead&hexkey=" + hexkey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec(`CREATE TABLE t (x)`); !errors.Is(err, sqlite3.MISUSE) {
+		t.Errorf("got %v, want MISUSE", err)
+	}
+
+	// Init needs a key.
+	db, err = sqlite3.Open("file:" + path + "?vfs=aead")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := aead.Init(db, "main"); !errors.Is(err, sqlite3.CANTOPEN) {
+		t.Errorf("got %v, want CANTOPEN", err)
+	}
+	testcfg.Exec(t, db, `PRAGMA textkey='correct horse battery staple'`)
+	if err := aead.Init(db, "main"); err != nil {
+		t.Fatal(err)
+	}
+	testcfg.Exec(t, db, `CREATE TABLE t (x)`)
+	testcfg.Exec(t, db, `INSERT INTO t VALUES (1)`)
+	if bad, err := aead.Verify(db, "main"); err != nil {
+		t.Fatal(err)
+	} else if len(bad) != 0 {
+		t.Errorf("got bad pages %v", bad)
+	}
+}
+
+func TestAEAD_crash(t *testing.T) {
+	dir := t.TempDir()
+
+	for point := 0; ; point++ {
+		faults := faultvfs.Wrap(vfs.Find(""))
+		name := fmt.Sprintf("aead-crash-%d", point)
+		vfs.Register(name, aead.Wrap(faults, nil))
+		defer vfs.Unregister(name)
+
+		uri := "file:" + filepath.ToSlash(filepath.Join(dir, name+".db")) + "?vfs=" + name + "&hexkey=" + hexkey1
+		db, err := sqlite3.Open(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := aead.Init(db, "main"); err != nil {
+			t.Fatal(err)
+		}
+		testcfg.Exec(t, db, `PRAGMA journal_mode=wal`)
+		testcfg.Exec(t, db, `PRAGMA synchronous=full`)
+		testcfg.Exec(t, db, `CREATE TABLE t (id INTEGER PRIMARY KEY, data BLOB)`)
+		testcfg.Exec(t, db, `INSERT INTO t (data) SELECT zeroblob(6000) FROM generate_series(1, 100)`)
+
+		// Rewrite overflow chains in checkpointed WAL frames.
+		faults.Inject(faultvfs.Fault{Op: faultvfs.OpSync, Kind: faultvfs.PowerLoss, After: point})
+		for i := range 5 {
+			err = db.Exec(fmt.Sprintf(`UPDATE t SET data = randomblob(6000) WHERE id %% 7 = %d`, i))
+			if err == nil {
+				_, _, err = db.WALCheckpoint("main", sqlite3.CHECKPOINT_PASSIVE)
+			}
+			if err != nil {
+				break
+			}
+		}
+		db.Close()
+		if faults.Fired() == 0 {
+			if point == 0 {
+				t.Fatal("no sync points")
+			}
+			break
+		}
+		faults.Recover()
+
+		db, err = sqlite3.Open(uri)
+		if err != nil {
+			t.Fatalf("point %d: %v", point, err)
+		}
+		if err := faultvfs.IntegrityCheck(db); err != nil {
+			t.Errorf("point %d: %v", point, err)
+		}
+		if got := testcfg.Query(t, db, `SELECT sum(length(data)) FROM t`); got != "600000" {
+			t.Errorf("point %d: got %s bytes", point, got)
+		}
+		db.Close()
+	}
+}
+
+func create(t *testing.T, path, mode string) *sqlite3.Conn {
+	t.Helper()
+	db, err := sqlite3.Open("file:" + path + "?vfs=aead&hexkey=" + hexkey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aead.Init(db, "main"); err != nil {
+		t.Fatal(err)
+	}
+	testcfg.Exec(t, db, `PRAGMA journal_mode=`+mode)
+	testcfg.Exec(t, db, `CREATE TABLE blobs (id INTEGER PRIMARY KEY, data BLOB)`)
+	return db
+}
+
+func open(t *testing.T, path, hexkey string) *sqlite3.Conn {
+	t.Helper()
+	db, err := sqlite3.Open("file:" + path + "?vfs=aead&hexkey=" + hexkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func flip(f *os.File, off int64) error {
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], off); err != nil {
+		return err
+	}
+	b[0] ^= 1
+	_, err := f.WriteAt(b[:], off)
+	return err
+}
@@ -0,0 +1,135 @@
+// Package aead wraps an SQLite VFS to offer authenticated encryption at rest.
+//
+// The "aead" [vfs.VFS] wraps the default VFS using the
+// XChaCha20-Poly1305 authenticated encryption with associated data.
+// Each page is encrypted with a random nonce,
+// and the nonce and the authentication tag are stored
+// in the reserved bytes at the end of the page.
+// Reading a page that was modified fails with [sqlite3.CORRUPT].
+//
+// Importing package aead registers that VFS,
+// and a wrapper to stack it over other VFSes (e.g. "stats+aead"):
+//
+//	import _ "github.com/ncruces/go-sqlite3/vfs/aead"
+//
+// To open an encrypted database you need to provide key material.
+//
+// The simplest way to do that is to specify the key through an [URI] parameter:
+//
+//   - key: key material in binary (32 bytes)
+//   - hexkey: key material in hex (64 hex digits)
+//   - textkey: key material in text (any length)
+//
+// However, this makes your key easily accessible to other parts of
+// your application (e.g. through [vfs.Filename.URIParameters]).
+//
+// To avoid this, invoke any of the following PRAGMAs
+// immediately after opening a connection:
+//
+//	PRAGMA key='D41d8cD98f00b204e9800998eCf8427e';
+//	PRAGMA hexkey='e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855';
+//	PRAGMA textkey='your-secret-key';
+//
+// For an ATTACH-ed database, you must specify the schema name:
+//
+//	ATTACH DATABASE 'demo.db' AS demo;
+//	PRAGMA demo.textkey='your-secret-key';
+//
+// Pages need [ReserveBytes] reserved bytes,
+// which must be set with [Init] before a new database is written to.
+//
+// [URI]: https://sqlite.org/uri.html
+package aead
+
+import (
+	"crypto/cipher"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/internal/util"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/xts"
+)
+
+func init() {
+	vfs.Register("aead", Wrap(vfs.Find(""), nil))
+	vfs.RegisterWrapper("aead", func(base vfs.VFS) vfs.VFS {
+		return Wrap(base, nil)
+	})
+}
+
+// Wrap wraps a base VFS to create an encrypting VFS,
+// possibly using a custom AEAD cipher construction.
+//
+// To use the default XChaCha20-Poly1305 construction, set cipher to nil.
+//
+// The default construction uses a 32 byte key/hexkey.
+// If a textkey is provided, the default KDF is Argon2id
+// with 64 MiB of memory, 3 iterations, and 4 threads.
+//
+// Temporary files don't have reserved bytes,
+// so they're encrypted with random keys by the [xts] VFS.
+func Wrap(base vfs.VFS, cipher AEADCreator) vfs.VFS {
+	if cipher == nil {
+		cipher = chachaCreator{}
+	}
+	return &aeadVFS{
+		VFS:  base,
+		temp: xts.Wrap(base, nil).(vfs.VFSFilename),
+		init: cipher,
+	}
+}
+
+// AEADCreator creates an [cipher.AEAD]
+// given key material.
+type AEADCreator interface {
+	// KDF derives an AEAD key from a secret.
+	// If no secret is given, a random key is generated.
+	KDF(secret string) (key []byte)
+
+	// AEAD creates an AEAD cipher given a key.
+	// If key is not appropriate, nil is returned.
+	AEAD(key []byte) cipher.AEAD
+}
+
+// ReserveBytes is the number of reserved bytes
+// needed by the default construction:
+// a 24 byte nonce, and a 16 byte tag.
+// Custom constructions need NonceSize() + Overhead() bytes.
+const ReserveBytes = 40
+
+const (
+	_FCNTL_RESERVE = sqlite3.FcntlOpcode(util.FCNTL_AEAD_RESERVE)
+	_FCNTL_VERIFY  = sqlite3.FcntlOpcode(util.FCNTL_AEAD_VERIFY)
+)
+
+// Init reserves the bytes needed to encrypt
+// the schema database of a connection.
+// It should be called on a new database,
+// after specifying the key, and before creating any tables.
+//
+// Init fails if the database already has content,
+// and less than the needed reserved bytes.
+func Init(db *sqlite3.Conn, schema string) error {
+	r, err := db.FileControl(schema, _FCNTL_RESERVE)
+	if err != nil {
+		return err
+	}
+	_, err = db.FileControl(schema, sqlite3.FCNTL_RESERVE_BYTES, r.(int))
+	return err
+}
+
+// Verify reads every page of the schema database of a connection,
+// and returns the page numbers of those that fail authentication.
+//
+// Only the database file is verified:
+// pages in the WAL are authenticated as they're read.
+// In WAL mode, a concurrent checkpoint may write pages as they're verified:
+// pages that fail are read again before being reported,
+// but a page that's rewritten again in between may still be reported.
+func Verify(db *sqlite3.Conn, schema string) ([]int, error) {
+	r, err := db.FileControl(schema, _FCNTL_VERIFY)
+	if err != nil {
+		return nil, err
+	}
+	return r.([]int), nil
+}
@@ -0,0 +1,33 @@
+package aead
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// This variable can be replaced with -ldflags:
+//
+//	go build -ldflags="-X github.com/ncruces/go-sqlite3/vfs/aead.pepper=aead"
+var pepper = "github.com/ncruces/go-sqlite3/vfs/aead"
+
+type chachaCreator struct{}
+
+func (chachaCreator) AEAD(key []byte) cipher.AEAD {
+	c, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+func (chachaCreator) KDF(text string) []byte {
+	if text == "" {
+		key := make([]byte, chacha20poly1305.KeySize)
+		n, _ := rand.Read(key)
+		return key[:n]
+	}
+	return argon2.IDKey([]byte(text), []byte(pepper), 3, 64*1024, 4, chacha20poly1305.KeySize)
+}
@@ -180,6 +180,16 @@ type FileBusyHandler interface {
 	BusyHandler(func() bool)
 }
 
+// FileCustomControl extends File to implement custom file control opcodes
+// (those at or above sqlite3.FCNTL_CUSTOM).
+// Return sqlite3.NOTFOUND for unknown opcodes.
+//
+// https://sqlite.org/c3ref/file_control.html
+type FileCustomControl interface {
+	File
+	CustomControl(op uint32, arg any) (any, error)
+}
+
 // FileSharedMemory extends File to possibly implement
 // shared-memory for the WAL-index.
 // The same shared-memory instance must be returned
@@ -0,0 +1,443 @@
+package vfs
+
+import (
+	"encoding/binary"
+
+	"github.com/ncruces/go-sqlite3/internal/util"
+)
+
+// BadPage is a page that failed checksum verification.
+type BadPage struct {
+	Page  int    // the page number
+	Frame int    // the WAL frame that holds the page, or zero for the database file
+	Owner string // the table or index that owns the page, if known
+}
+
+// VerifyChecksums verifies the checksums of every page
+// of the database file at path, and of its WAL.
+// It returns the pages that fail verification,
+// along with the table or index that owns them,
+// as found through the sqlite_schema table.
+//
+// The database must have checksums enabled (see Conn.EnableChecksums).
+// A shared lock is held on the database while it's verified;
+// in WAL mode, this doesn't prevent other connections
+// from writing to the WAL, or checkpointing it.
+//
+// Only the frames SQLite would use when recovering the WAL are verified.
+// Pages are owned by the b-tree that references them in
+// the current version of the database, including the WAL;
+// free pages and pointer map pages have no owner.
+//
+// https://sqlite.org/cksumvfs.html
+func VerifyChecksums(path string) ([]BadPage, error) {
+	db, _, err := vfsOS{}.Open(path, OPEN_READONLY|OPEN_MAIN_DB)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if SupportsFileLocking {
+		if err := db.Lock(LOCK_SHARED); err != nil {
+			return nil, err
+		}
+		defer db.Unlock(LOCK_NONE)
+	}
+
+	var hdr [100]byte
+	if n, _ := db.ReadAt(hdr[:], 0); n != len(hdr) || !isHeader(true, hdr[:], 0) {
+		return nil, _NOTADB
+	}
+	var flags cksmFlags
+	flags.init(&hdr)
+	if !flags.computeCksm {
+		return nil, util.ErrorString("sqlite3: checksums not enabled")
+	}
+
+	s := cksmScan{
+		db:       db,
+		pageSize: flags.pageSize,
+		usable:   flags.pageSize - 8,
+		latest:   map[uint32]int64{},
+	}
+	size, err := db.Size()
+	if err != nil {
+		return nil, err
+	}
+	s.pages = uint32(size / int64(s.pageSize))
+
+	if ok, _ := (vfsOS{}).Access(path+"-wal", ACCESS_EXISTS); ok {
+		wal, _, err := vfsOS{}.Open(path+"-wal", OPEN_READONLY|OPEN_WAL)
+		if err != nil {
+			return nil, err
+		}
+		defer wal.Close()
+		if err := s.readWAL(wal); err != nil {
+			return nil, err
+		}
+	}
+
+	var bad []BadPage
+	page := make([]byte, s.pageSize)
+	for pgno := int64(1); pgno*int64(s.pageSize) <= size; pgno++ {
+		if err := readFull(db, page, (pgno-1)*int64(s.pageSize)); err != nil {
+			return nil, err
+		}
+		if !cksmValid(page) {
+			bad = append(bad, BadPage{Page: int(pgno)})
+		}
+	}
+	for i, f := range s.frames {
+		if err := readFull(s.wal, page, f.off); err != nil {
+			return nil, err
+		}
+		if !cksmValid(page) {
+			bad = append(bad, BadPage{Page: int(f.pgno), Frame: i + 1})
+		}
+	}
+
+	if len(bad) > 0 {
+		owners := s.owners()
+		for i := range bad {
+			bad[i].Owner = owners[uint32(bad[i].Page)]
+		}
+	}
+	return bad, nil
+}
+
+func cksmValid(page []byte) bool {
+	return cksmCompute(page[:len(page)-8]) == *(*[8]byte)(page[len(page)-8:])
+}
+
+// cksmScan reads the current version of the pages of a database,
+// from its WAL, or from the database file.
+type cksmScan struct {
+	db, wal  File
+	pageSize int
+	usable   int
+	pages    uint32           // the size of the database, in pages
+	frames   []walFrame       // the valid frames of the WAL
+	latest   map[uint32]int64 // the offset of the latest version of a page in the WAL
+}
+
+type walFrame struct {
+	pgno uint32
+	off  int64 // the offset of the page in the WAL file
+}
+
+// readWAL finds the valid frames of a WAL, up to its last commit,
+// like SQLite does when recovering the WAL.
+//
+// https://sqlite.org/fileformat.html#wal_file_format
+func (s *cksmScan) readWAL(wal File) error {
+	const (
+		headerSize      = 32
+		frameHeaderSize = 24
+	)
+
+	var hdr [headerSize]byte
+	if n, _ := wal.ReadAt(hdr[:], 0); n != len(hdr) {
+		return nil
+	}
+	magic := binary.BigEndian.Uint32(hdr[0:])
+	if magic&^1 != 0x377f0682 || binary.BigEndian.Uint32(hdr[8:]) != uint32(s.pageSize) {
+		return nil
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if magic&1 != 0 {
+		order = binary.BigEndian
+	}
+	s1, s2 := walChecksum(order, 0, 0, hdr[:24])
+	if s1 != binary.BigEndian.Uint32(hdr[24:]) || s2 != binary.BigEndian.Uint32(hdr[28:]) {
+		return nil
+	}
+
+	var pending []walFrame
+	frame := make([]byte, frameHeaderSize+s.pageSize)
+	for off := int64(headerSize); ; off += int64(len(frame)) {
+		if n, _ := wal.ReadAt(frame, off); n != len(frame) {
+			break
+		}
+		if string(frame[8:16]) != string(hdr[16:24]) {
+			break // Salts don't match.
+		}
+		s1, s2 = walChecksum(order, s1, s2, frame[:8])
+		s1, s2 = walChecksum(order, s1, s2, frame[frameHeaderSize:])
+		if s1 != binary.BigEndian.Uint32(frame[16:]) || s2 != binary.BigEndian.Uint32(frame[20:]) {
+			break
+		}
+
+		pending = append(pending, walFrame{
+			pgno: binary.BigEndian.Uint32(frame[0:]),
+			off:  off + frameHeaderSize,
+		})
+		if commit := binary.BigEndian.Uint32(frame[4:]); commit != 0 {
+			for _, f := range pending {
+				s.latest[f.pgno] = f.off
+			}
+			s.frames = append(s.frames, pending...)
+			s.pages = commit
+			pending = pending[:0]
+		}
+	}
+	s.wal = wal
+	return nil
+}
+
+func walChecksum(order binary.ByteOrder, s1, s2 uint32, a []byte) (uint32, uint32) {
+	for len(a) >= 8 {
+		s1 += order.Uint32(a[0:4]) + s2
+		s2 += order.Uint32(a[4:8]) + s1
+		a = a[8:]
+	}
+	return s1, s2
+}
+
+// page returns the current version of a page, or nil.
+func (s *cksmScan) page(pgno uint32) []byte {
+	if pgno == 0 || pgno > s.pages {
+		return nil
+	}
+	file, off := s.db, int64(pgno-1)*int64(s.pageSize)
+	if o, ok := s.latest[pgno]; ok {
+		file, off = s.wal, o
+	}
+	page := make([]byte, s.pageSize)
+	if readFull(file, page, off) != nil {
+		return nil
+	}
+	return page
+}
+
+// owners finds the table or index that owns each page,
+// walking the b-trees listed in the sqlite_schema table.
+//
+// https://sqlite.org/fileformat.html#b_tree_pages
+func (s *cksmScan) owners() map[uint32]string {
+	type tree struct {
+		root uint32
+		name string
+	}
+	var trees []tree
+
+	owners := map[uint32]string{}
+	s.walk(1, "sqlite_schema", owners, func(payload []byte) {
+		// CREATE TABLE sqlite_schema(type, name, tbl_name, rootpage, sql)
+		cols := parseRecord(payload, 4)
+		if len(cols) < 4 {
+			return
+		}
+		typ, _ := cols[0].(string)
+		name, _ := cols[1].(string)
+		root, _ := cols[3].(int64)
+		if (typ == "table" || typ == "index") && root > 1 {
+			trees = append(trees, tree{uint32(root), name})
+		}
+	})
+	for _, t := range trees {
+		s.walk(t.root, t.name, owners, nil)
+	}
+	return owners
+}
+
+// walk marks the pages of a b-tree as owned by owner.
+// For table b-trees, leaf is called with the payload of each row.
+func (s *cksmScan) walk(pgno uint32, owner string, owners map[uint32]string, leaf func(payload []byte)) {
+	if _, ok := owners[pgno]; ok {
+		return // Avoid cycles in corrupt databases.
+	}
+	page := s.page(pgno)
+	if page == nil {
+		return
+	}
+	owners[pgno] = owner
+
+	hdr := 0
+	if pgno == 1 {
+		hdr = 100
+	}
+	typ := page[hdr]
+	cells := int(binary.BigEndian.Uint16(page[hdr+3:]))
+	ptrs := hdr + 8
+	if typ == 2 || typ == 5 {
+		ptrs = hdr + 12
+	}
+
+	for i := range cells {
+		if ptrs+2*i+2 > s.usable {
+			return
+		}
+		cell := int(binary.BigEndian.Uint16(page[ptrs+2*i:]))
+		if cell+4 > s.usable {
+			return
+		}
+		switch typ {
+		case 2: // Interior index b-tree page.
+			s.walk(binary.BigEndian.Uint32(page[cell:]), owner, owners, nil)
+			s.payload(page, cell+4, false, owner, owners, false)
+		case 5: // Interior table b-tree page.
+			s.walk(binary.BigEndian.Uint32(page[cell:]), owner, owners, leaf)
+		case 10: // Leaf index b-tree page.
+			s.payload(page, cell, false, owner, owners, false)
+		case 13: // Leaf table b-tree page.
+			payload := s.payload(page, cell, true, owner, owners, leaf != nil)
+			if leaf != nil && payload != nil {
+				leaf(payload)
+			}
+		default:
+			return
+		}
+	}
+	if typ == 2 || typ == 5 {
+		s.walk(binary.BigEndian.Uint32(page[hdr+8:]), owner, owners, leaf)
+	}
+}
+
+// payload marks the overflow pages of a cell as owned by owner,
+// and optionally returns the payload of the cell.
+//
+// https://sqlite.org/fileformat.html#cell_payload_overflow_pages
+func (s *cksmScan) payload(page []byte, cell int, table bool, owner string, owners map[uint32]string, read bool) []byte {
+	size, n := getVarint(page[cell:s.usable])
+	if n == 0 {
+		return nil
+	}
+	cell += n
+	if table {
+		// Skip the rowid.
+		if _, n = getVarint(page[cell:s.usable]); n == 0 {
+			return nil
+		}
+		cell += n
+	}
+
+	u := uint64(s.usable)
+	x := u - 35
+	if !table {
+		x = (u-12)*64/255 - 23
+	}
+	local := size
+	if size > x {
+		m := (u-12)*32/255 - 23
+		if local = m + (size-m)%(u-4); local > x {
+			local = m
+		}
+	}
+	if uint64(cell)+local > u || (local < size && uint64(cell)+local+4 > u) {
+		return nil
+	}
+
+	var payload []byte
+	if read {
+		payload = append(payload, page[cell:cell+int(local)]...)
+	}
+	if local == size {
+		return payload
+	}
+
+	next := binary.BigEndian.Uint32(page[cell+int(local):])
+	for remaining := size - local; next != 0 && remaining > 0; {
+		if _, ok := owners[next]; ok {
+			return nil
+		}
+		page := s.page(next)
+		if page == nil {
+			return nil
+		}
+		owners[next] = owner
+		n := min(remaining, u-4)
+		if read {
+			payload = append(payload, page[4:4+n]...)
+		}
+		remaining -= n
+		next = binary.BigEndian.Uint32(page)
+	}
+	if uint64(len(payload)) != size {
+		return nil
+	}
+	return payload
+}
+
+// parseRecord parses the first n columns of a record,
+// returning integers as int64, and text as string.
+//
+// https://sqlite.org/fileformat.html#record_format
+func parseRecord(rec []byte, n int) []any {
+	hdrSize, i := getVarint(rec)
+	if i == 0 || hdrSize > uint64(len(rec)) {
+		return nil
+	}
+	body := int(hdrSize)
+
+	var cols []any
+	for i < int(hdrSize) && len(cols) < n {
+		typ, m := getVarint(rec[i:hdrSize])
+		if m == 0 {
+			return nil
+		}
+		i += m
+
+		var size int
+		switch {
+		case typ <= 4:
+			size = int(typ)
+		case typ == 5:
+			size = 6
+		case typ == 6 || typ == 7:
+			size = 8
+		case typ >= 12:
+			size = int(typ-12) / 2
+		}
+		if body+size > len(rec) {
+			return nil
+		}
+
+		data := rec[body : body+size]
+		switch {
+		case typ >= 1 && typ <= 6:
+			v := int64(int8(data[0])) // Sign extend.
+			for _, b := range data[1:] {
+				v = v<<8 | int64(b)
+			}
+			cols = append(cols, v)
+		case typ == 8 || typ == 9:
+			cols = append(cols, int64(typ-8))
+		case typ >= 13 && typ%2 == 1:
+			cols = append(cols, string(data))
+		default:
+			cols = append(cols, nil)
+		}
+		body += size
+	}
+	return cols
+}
+
+// getVarint decodes a varint, returning its value and length,
+// or a zero length if buf is too short.
+//
+// https://sqlite.org/fileformat.html#varint
+func getVarint(buf []byte) (v uint64, n int) {
+	for n < len(buf) {
+		b := buf[n]
+		n++
+		if n == 9 {
+			return v<<8 | uint64(b), n
+		}
+		v = v<<7 | uint64(b&0x7f)
+		if b < 0x80 {
+			return v, n
+		}
+	}
+	return 0, 0
+}
+
+func readFull(file File, buf []byte, off int64) error {
+	n, err := file.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil {
+		err = _IOERR_SHORT_READ
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+// Package compress wraps an SQLite VFS to compress databases.
+//
+// The "compress" [vfs.VFS] wraps the default VFS,
+// and compresses each page of main database files with [flate].
+// Pages are stored in a container file, indexed by a page map,
+// and space freed by rewritten pages is reused.
+// Journals and WAL files are stored uncompressed.
+//
+// Importing package compress registers that VFS,
+// and a wrapper to stack it over other VFSes (e.g. "xts+compress"):
+//
+//	import _ "github.com/ncruces/go-sqlite3/vfs/compress"
+//
+// The compression ratio of a database
+// (its size, divided by the size of its container file)
+// is available through a PRAGMA:
+//
+//	PRAGMA compress_ratio;
+//
+// The page map of a database is kept in memory,
+// and shared by all connections in the same process,
+// whichever compressing VFS they use.
+// Databases must not be accessed by more than one process at a time.
+package compress
+
+import (
+	"compress/flate"
+	"sync"
+
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+func init() {
+	vfs.Register("compress", Wrap(vfs.Find(""), flate.DefaultCompression))
+	vfs.RegisterWrapper("compress", func(base vfs.VFS) vfs.VFS {
+		return Wrap(base, flate.DefaultCompression)
+	})
+}
+
+// Wrap wraps a base VFS to create a compressing VFS,
+// using the given [flate] compression level.
+func Wrap(base vfs.VFS, level int) vfs.VFS {
+	return &compressVFS{VFS: base, level: level}
+}
+
+type compressVFS struct {
+	vfs.VFS
+	level int
+}
+
+// Containers are shared by every compressing VFS, keyed by name,
+// so that connections opening a database through different stacks
+// see the same page map.
+var (
+	filesMtx sync.Mutex
+	// +checklocks:filesMtx
+	files = map[string]*container{}
+)
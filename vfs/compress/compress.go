@@ -0,0 +1,339 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strconv"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+func (c *compressVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	file, flags, err := c.VFS.Open(name, flags)
+	return c.wrap(file, name, flags, err)
+}
+
+func (c *compressVFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	file, flags, err := vfsutil.WrapOpenFilename(c.VFS, name, flags)
+	return c.wrap(file, name.String(), flags, err)
+}
+
+func (c *compressVFS) wrap(file vfs.File, name string, flags vfs.OpenFlag, err error) (vfs.File, vfs.OpenFlag, error) {
+	// Compress only main databases.
+	if err != nil || flags&vfs.OPEN_MAIN_DB == 0 || flags&vfs.OPEN_MEMORY != 0 || name == "" {
+		return file, flags, err
+	}
+
+	deflate, err := flate.NewWriter(nil, c.level)
+	if err != nil {
+		file.Close()
+		return nil, flags, sqlite3.CANTOPEN
+	}
+	cont, err := acquire(name, file)
+	if err != nil {
+		file.Close()
+		return nil, flags, err
+	}
+	return &compressFile{
+		WrappedFile: vfsutil.WrappedFile{File: file},
+		name:        name,
+		cont:        cont,
+		deflate:     deflate,
+		inflate:     flate.NewReader(nil),
+	}, flags, nil
+}
+
+// acquire returns the shared state of a container file,
+// loading it from file if needed.
+func acquire(name string, file vfs.File) (*container, error) {
+	filesMtx.Lock()
+	defer filesMtx.Unlock()
+
+	cont := files[name]
+	if cont == nil {
+		cont = &container{}
+		cont.mtx.Lock()
+		err := cont.load(file)
+		cont.mtx.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		files[name] = cont
+	}
+	cont.refs++
+	return cont, nil
+}
+
+func release(name string) {
+	filesMtx.Lock()
+	defer filesMtx.Unlock()
+
+	cont := files[name]
+	if cont.refs--; cont.refs == 0 {
+		delete(files, name)
+	}
+}
+
+type compressFile struct {
+	vfsutil.WrappedFile
+	name string
+	cont *container
+
+	deflate *flate.Writer
+	inflate io.ReadCloser
+	buf     bytes.Buffer
+	stored  []byte
+	block   []byte
+}
+
+func (c *compressFile) Close() error {
+	release(c.name)
+	return c.File.Close()
+}
+
+func (c *compressFile) Size() (int64, error) {
+	c.cont.mtx.RLock()
+	defer c.cont.mtx.RUnlock()
+	return c.cont.size, nil
+}
+
+func (c *compressFile) ReadAt(p []byte, off int64) (n int, err error) {
+	cont := c.cont
+	cont.mtx.RLock()
+	defer cont.mtx.RUnlock()
+
+	end := min(off+int64(len(p)), cont.size)
+	for pos := off; pos < end; {
+		block := pos / cont.blockSize
+		if err := c.readBlock(block); err != nil {
+			return n, err
+		}
+		i := copy(p[n:end-off], c.block[pos-block*cont.blockSize:])
+		pos += int64(i)
+		n += i
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *compressFile) WriteAt(p []byte, off int64) (n int, err error) {
+	cont := c.cont
+	cont.mtx.Lock()
+	defer cont.mtx.Unlock()
+
+	if cont.blockSize == 0 {
+		// The first write to a database is usually its first page,
+		// so use the page size as the block size.
+		size := int64(len(p))
+		if off != 0 || !validBlockSize(size) {
+			size = defaultBlockSize
+		}
+		if err := cont.create(c.File, size); err != nil {
+			return 0, err
+		}
+	}
+
+	bs := cont.blockSize
+	for n < len(p) {
+		pos := off + int64(n)
+		block := pos / bs
+		start := pos - block*bs
+		i := int(min(int64(len(p)-n), bs-start))
+
+		var data []byte
+		if start == 0 && int64(i) == bs {
+			data = p[n : n+i]
+		} else {
+			// Partial block write: read-update-write.
+			if err := c.readBlock(block); err != nil {
+				return n, err
+			}
+			copy(c.block[start:], p[n:n+i])
+			data = c.block
+		}
+
+		if err := c.writeBlock(block, data); err != nil {
+			return n, err
+		}
+		n += i
+	}
+
+	return n, cont.setSize(c.File, max(cont.size, off+int64(n)))
+}
+
+func (c *compressFile) Truncate(size int64) error {
+	cont := c.cont
+	cont.mtx.Lock()
+	defer cont.mtx.Unlock()
+
+	if cont.blockSize == 0 {
+		if size == 0 {
+			return nil
+		}
+		if err := cont.create(c.File, defaultBlockSize); err != nil {
+			return err
+		}
+	}
+
+	if size < cont.size {
+		bs := cont.blockSize
+		block := size / bs
+		if rest := size - block*bs; rest != 0 {
+			// Zero the tail of the last block.
+			if err := c.readBlock(block); err != nil {
+				return err
+			}
+			clear(c.block[rest:])
+			if err := c.writeBlock(block, c.block); err != nil {
+				return err
+			}
+			block++
+		}
+		if err := cont.truncate(c.File, block); err != nil {
+			return err
+		}
+	}
+	return cont.setSize(c.File, size)
+}
+
+func (c *compressFile) Sync(flags vfs.SyncFlag) error {
+	if err := c.File.Sync(flags); err != nil {
+		return err
+	}
+
+	cont := c.cont
+	cont.mtx.Lock()
+	defer cont.mtx.Unlock()
+
+	// Free space at the end of the file can be released.
+	end := cont.synced()
+	if size, err := c.File.Size(); err == nil && size > end {
+		return c.File.Truncate(end)
+	}
+	return nil
+}
+
+// readBlock reads a block into c.block.
+// Bytes past the end of the database read as zeros.
+//
+// +checklocksread:c.cont.mtx
+func (c *compressFile) readBlock(block int64) error {
+	cont := c.cont
+	bs := int(cont.blockSize)
+	if len(c.block) != bs {
+		c.block = make([]byte, bs)
+		c.stored = make([]byte, bs)
+	}
+
+	e := cont.entry(block)
+	if e.off == 0 || block*cont.blockSize >= cont.size {
+		clear(c.block)
+		return nil
+	}
+
+	stored := c.stored[:e.len]
+	if n, err := c.File.ReadAt(stored, e.off); n != len(stored) {
+		if err == nil || err == io.EOF {
+			err = sqlite3.CORRUPT
+		}
+		return err
+	}
+	if checksum(stored) != e.crc {
+		return sqlite3.CORRUPT
+	}
+
+	if len(stored) == bs {
+		copy(c.block, stored)
+	} else {
+		c.inflate.(flate.Resetter).Reset(bytes.NewReader(stored), nil)
+		if _, err := io.ReadFull(c.inflate, c.block); err != nil {
+			return sqlite3.CORRUPT
+		}
+	}
+
+	if rest := cont.size - block*cont.blockSize; rest < cont.blockSize {
+		clear(c.block[rest:])
+	}
+	return nil
+}
+
+// writeBlock compresses and writes a block.
+//
+// +checklocks:c.cont.mtx
+func (c *compressFile) writeBlock(block int64, data []byte) error {
+	cont := c.cont
+
+	var e entry
+	if !zeros(data) {
+		c.buf.Reset()
+		c.deflate.Reset(&c.buf)
+		c.deflate.Write(data)
+		c.deflate.Close()
+
+		stored := c.buf.Bytes()
+		if len(stored) >= len(data) {
+			stored = data // Store incompressible blocks as is.
+		}
+		e.len = uint32(len(stored))
+		e.crc = checksum(stored)
+		e.off = cont.alloc(int64(len(stored)))
+		if _, err := c.File.WriteAt(stored, e.off); err != nil {
+			cont.pending = append(cont.pending, e.extent())
+			return err
+		}
+	}
+
+	err := cont.setEntry(c.File, block, e)
+	if err != nil && e.off != 0 {
+		cont.pending = append(cont.pending, e.extent())
+	}
+	return err
+}
+
+func (c *compressFile) Pragma(name string, value string) (string, error) {
+	if name != "compress_ratio" {
+		return c.WrappedFile.Pragma(name, value)
+	}
+
+	cont := c.cont
+	cont.mtx.RLock()
+	defer cont.mtx.RUnlock()
+
+	ratio := 1.0
+	if cont.end > 0 {
+		ratio = float64(cont.size) / float64(cont.end)
+	}
+	return strconv.FormatFloat(ratio, 'f', 2, 64), nil
+}
+
+func (c *compressFile) DeviceCharacteristics() vfs.DeviceCharacteristic {
+	return c.File.DeviceCharacteristics() & (0 |
+		// These flags are safe:
+		vfs.IOCAP_IMMUTABLE |
+		vfs.IOCAP_SUBPAGE_READ |
+		vfs.IOCAP_POWERSAFE_OVERWRITE |
+		vfs.IOCAP_UNDELETABLE_WHEN_OPEN)
+}
+
+func (c *compressFile) ChunkSize(size int) {
+	// Chunks would prevent releasing free space.
+}
+
+func (c *compressFile) SizeHint(size int64) error {
+	// The container file is not preallocated.
+	return nil
+}
+
+func zeros(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
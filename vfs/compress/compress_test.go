@@ -0,0 +1,229 @@
+package compress_test
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/compress"
+	"github.com/ncruces/go-sqlite3/vfs/faultvfs"
+	"github.com/ncruces/go-sqlite3/vfs/vfstest"
+)
+
+func Test_vfstest(t *testing.T) {
+	if !vfs.SupportsFileLocking {
+		t.Skip("skipping without locks")
+	}
+	vfstest.Test(t, compress.Wrap(vfs.Find(""), flate.BestSpeed), nil)
+}
+
+func TestCompress(t *testing.T) {
+	for _, mode := range []string{"delete", "truncate", "wal"} {
+		t.Run(mode, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			uri := "file:" + filepath.ToSlash(path) + "?vfs=compress"
+
+			db, err := sqlite3.Open(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			testcfg.Exec(t, db, `PRAGMA journal_mode=`+mode)
+			testcfg.Exec(t, db, `CREATE TABLE t (id INTEGER PRIMARY KEY, text TEXT)`)
+			testcfg.Exec(t, db, `
+				WITH RECURSIVE c(n) AS (SELECT 1 UNION ALL SELECT n+1 FROM c WHERE n < 5000)
+				INSERT INTO t (text) SELECT printf('row %d: %s', n, hex(zeroblob(100))) FROM c`)
+			testcfg.Exec(t, db, `UPDATE t SET text = upper(text) WHERE id % 3 = 0`)
+			testcfg.Exec(t, db, `DELETE FROM t WHERE id % 5 = 0`)
+			testcfg.Exec(t, db, `PRAGMA wal_checkpoint(TRUNCATE)`)
+
+			ratio, err := strconv.ParseFloat(testcfg.Query(t, db, `PRAGMA compress_ratio`), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ratio < 2 {
+				t.Errorf("got ratio %v", ratio)
+			}
+
+			// The container file is smaller than the database.
+			pages, _ := strconv.Atoi(testcfg.Query(t, db, `PRAGMA page_count`))
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := int64(pages) * 4096; fi.Size() >= size/2 {
+				t.Errorf("got file size %d, database size %d", fi.Size(), size)
+			}
+
+			// Data survives reopening.
+			db.Close()
+			db, err = sqlite3.Open(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if got := testcfg.Query(t, db, `SELECT count(*) FROM t`); got != "4000" {
+				t.Errorf("got %s rows", got)
+			}
+			if err := faultvfs.IntegrityCheck(db); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCompress_reuse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sqlite3.Open("file:" + filepath.ToSlash(path) + "?vfs=compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	testcfg.Exec(t, db, `CREATE TABLE t (id INTEGER PRIMARY KEY, text TEXT)`)
+	testcfg.Exec(t, db, `
+		WITH RECURSIVE c(n) AS (SELECT 1 UNION ALL SELECT n+1 FROM c WHERE n < 2000)
+		INSERT INTO t (text) SELECT printf('row %d: %s', n, hex(zeroblob(100))) FROM c`)
+
+	size := func() int64 {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	initial := size()
+
+	// Rewriting pages reuses the space they freed.
+	for i := range 20 {
+		testcfg.Exec(t, db, fmt.Sprintf(`UPDATE t SET text = printf('update %d: %%s', text)`, i))
+		testcfg.Exec(t, db, `UPDATE t SET text = substr(text, 12)`)
+	}
+	updated := size()
+	if updated > 2*initial {
+		t.Errorf("file grew from %d to %d", initial, updated)
+	}
+
+	// Free space at the end of the file is released by the next sync.
+	testcfg.Exec(t, db, `DELETE FROM t`)
+	testcfg.Exec(t, db, `VACUUM`)
+	testcfg.Exec(t, db, `INSERT INTO t (text) VALUES ('last')`)
+	if got := size(); got >= updated {
+		t.Errorf("file didn't shrink from %d, got %d", updated, got)
+	}
+}
+
+func TestCompress_crash(t *testing.T) {
+	dir := t.TempDir()
+
+	for point := 0; ; point++ {
+		faults := faultvfs.Wrap(vfs.Find(""))
+		name := fmt.Sprintf("compress-crash-%d", point)
+		vfs.Register(name, compress.Wrap(faults, flate.BestSpeed))
+		defer vfs.Unregister(name)
+
+		uri := "file:" + filepath.ToSlash(filepath.Join(dir, name+".db")) + "?vfs=" + name
+		db, err := sqlite3.Open(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testcfg.Exec(t, db, `CREATE TABLE t (id INTEGER PRIMARY KEY, text TEXT)`)
+		testcfg.Exec(t, db, `
+			WITH RECURSIVE c(n) AS (SELECT 1 UNION ALL SELECT n+1 FROM c WHERE n < 1000)
+			INSERT INTO t (text) SELECT printf('row %d: %s', n, hex(zeroblob(100))) FROM c`)
+
+		faults.Inject(faultvfs.Fault{Op: faultvfs.OpSync, Kind: faultvfs.PowerLoss, After: point})
+		for i := range 5 {
+			err = db.Exec(fmt.Sprintf(`UPDATE t SET text = printf('update %d: %%s', text) WHERE id %% 7 = %d`, i, i))
+			if err != nil {
+				break
+			}
+		}
+		db.Close()
+		if faults.Fired() == 0 {
+			if point == 0 {
+				t.Fatal("no sync points")
+			}
+			break
+		}
+		faults.Recover()
+
+		db, err = sqlite3.Open(uri)
+		if err != nil {
+			t.Fatalf("point %d: %v", point, err)
+		}
+		if err := faultvfs.IntegrityCheck(db); err != nil {
+			t.Errorf("point %d: %v", point, err)
+		}
+		if got := testcfg.Query(t, db, `SELECT count(*) FROM t`); got != "1000" {
+			t.Errorf("point %d: got %s rows", point, got)
+		}
+		db.Close()
+	}
+}
+
+func TestCompress_shared(t *testing.T) {
+	vfs.Register("compress-shared", compress.Wrap(vfs.Find(""), flate.BestSpeed))
+	defer vfs.Unregister("compress-shared")
+
+	// Connections using different compressing VFSes share a page map.
+	path := "file:" + filepath.ToSlash(filepath.Join(t.TempDir(), "test.db"))
+	db1, err := sqlite3.Open(path + "?vfs=compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db1.Close()
+	db2, err := sqlite3.Open(path + "?vfs=compress-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+
+	for i := range 10 {
+		db := db1
+		if i%2 != 0 {
+			db = db2
+		}
+		err := db.Exec(`
+			CREATE TABLE IF NOT EXISTS t (x);
+			INSERT INTO t SELECT hex(randomblob(500)) FROM generate_series(1, 100);`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, db := range []*sqlite3.Conn{db1, db2} {
+		if err := faultvfs.IntegrityCheck(db); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCompress_notadb(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := sqlite3.Open("file:" + filepath.ToSlash(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcfg.Exec(t, db, `CREATE TABLE t (x)`)
+	db.Close()
+
+	// A database that isn't compressed can't be opened.
+	db, err = sqlite3.Open("file:" + filepath.ToSlash(path) + "?vfs=compress")
+	if err == nil {
+		err = db.Exec(`SELECT * FROM t`)
+		db.Close()
+	}
+	if !errors.Is(err, sqlite3.NOTADB) && !errors.Is(err, sqlite3.CANTOPEN) {
+		t.Errorf("got %v", err)
+	}
+}
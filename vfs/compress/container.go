@@ -0,0 +1,412 @@
+package compress
+
+import (
+	"cmp"
+	"encoding/binary"
+	"hash/crc32"
+	"math/bits"
+	"slices"
+	"sync"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// The container file starts with a header:
+//   - the magic string (16 bytes);
+//   - the block size (4 bytes);
+//   - the size of the database (8 bytes, at offset 24);
+//   - a directory with the offsets of page map chunks (8 bytes each, at offset 64).
+//
+// Each page map chunk has an entry for each block of the database:
+//   - the offset of the compressed block (8 bytes), or zero for a block of zeros;
+//   - the length of the compressed block (4 bytes),
+//     which is the block size if the block is stored uncompressed;
+//   - the CRC-32 of the compressed block (4 bytes).
+//
+// The first chunk has entries for the first 256 blocks,
+// and each of the following chunks doubles the number of blocks covered,
+// so small databases have a small page map.
+//
+// Blocks, and page map chunks, are stored in the rest of the file.
+const (
+	magic      = "SQLite flate v1\x00"
+	headerSize = 512
+	sizeOffset = 24
+	dirOffset  = 64
+	dirEntries = 25
+
+	entrySize   = 16
+	firstChunk  = 256
+	maxBlocks   = firstChunk << (dirEntries - 1)
+	zeroBufSize = 64 * 1024
+
+	defaultBlockSize = 4096
+	allocUnit        = 64
+)
+
+// Space for blocks is never allocated over the bytes
+// that SQLite uses for locking.
+const (
+	lockStart = 0x40000000
+	lockEnd   = lockStart + 512
+)
+
+// entry locates a compressed block.
+type entry struct {
+	off int64
+	len uint32
+	crc uint32
+}
+
+// extent is a range of bytes in the container file.
+type extent struct {
+	off, len int64
+}
+
+func (e entry) extent() extent {
+	return extent{e.off, roundUp(int64(e.len), allocUnit)}
+}
+
+// container is the state of a container file,
+// shared by all connections in the process.
+//
+// Space freed since the container file was last synced
+// is not reused until the next sync:
+// if power is lost, blocks that SQLite didn't change
+// are never overwritten by blocks that it did.
+type container struct {
+	refs int // connections using the container, guarded by filesMtx
+
+	mtx       sync.RWMutex
+	blockSize int64             // +checklocks:mtx
+	size      int64             // +checklocks:mtx
+	end       int64             // +checklocks:mtx
+	dir       [dirEntries]int64 // +checklocks:mtx
+	blocks    []entry           // +checklocks:mtx
+	free      []extent          // +checklocks:mtx
+	pending   []extent          // +checklocks:mtx
+}
+
+// load reads the header and page map of a container file.
+//
+// +checklocks:c.mtx
+func (c *container) load(file vfs.File) error {
+	size, err := file.Size()
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil // A new file.
+	}
+
+	var hdr [headerSize]byte
+	if n, _ := file.ReadAt(hdr[:], 0); n != headerSize || string(hdr[:len(magic)]) != magic {
+		return sqlite3.NOTADB
+	}
+	c.blockSize = int64(binary.LittleEndian.Uint32(hdr[len(magic):]))
+	c.size = int64(binary.LittleEndian.Uint64(hdr[sizeOffset:]))
+	if !validBlockSize(c.blockSize) || c.size < 0 {
+		return sqlite3.NOTADB
+	}
+
+	used := []extent{{0, headerSize}}
+	buf := make([]byte, zeroBufSize)
+	for i := range c.dir {
+		off := int64(binary.LittleEndian.Uint64(hdr[dirOffset+8*i:]))
+		if off == 0 {
+			continue
+		}
+		start, n := chunkBlocks(i)
+		c.dir[i] = off
+		used = append(used, extent{off, n * entrySize})
+
+		// Read the chunk in pieces.
+		for j := int64(0); j < n; j += zeroBufSize / entrySize {
+			piece := buf[:min(n-j, zeroBufSize/entrySize)*entrySize]
+			if m, _ := file.ReadAt(piece, off+j*entrySize); m != len(piece) {
+				return sqlite3.CORRUPT
+			}
+			for k := 0; k < len(piece); k += entrySize {
+				e := decodeEntry(piece[k:])
+				if e.off == 0 {
+					continue
+				}
+				if e.off < headerSize || int64(e.len) > c.blockSize {
+					return sqlite3.CORRUPT
+				}
+				c.grow(start + j + int64(k/entrySize))
+				c.blocks[start+j+int64(k/entrySize)] = e
+				used = append(used, e.extent())
+			}
+		}
+	}
+
+	// Everything that isn't used is free.
+	slices.SortFunc(used, func(a, b extent) int {
+		return cmp.Compare(a.off, b.off)
+	})
+	for _, u := range used {
+		if u.off >= lockEnd && c.end <= lockStart {
+			c.free = append(c.free, extent{c.end, lockStart - c.end})
+			c.end = lockEnd
+		}
+		if u.off > c.end {
+			c.free = append(c.free, extent{c.end, u.off - c.end})
+		}
+		c.end = max(c.end, u.off+u.len)
+	}
+	return nil
+}
+
+// create writes the header of a new container file.
+//
+// +checklocks:c.mtx
+func (c *container) create(file vfs.File, blockSize int64) error {
+	var hdr [headerSize]byte
+	copy(hdr[:], magic)
+	binary.LittleEndian.PutUint32(hdr[len(magic):], uint32(blockSize))
+	if _, err := file.WriteAt(hdr[:], 0); err != nil {
+		return err
+	}
+	c.blockSize = blockSize
+	c.end = headerSize
+	return nil
+}
+
+// setSize updates the size of the database.
+//
+// +checklocks:c.mtx
+func (c *container) setSize(file vfs.File, size int64) error {
+	if size == c.size {
+		return nil
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(size))
+	if _, err := file.WriteAt(buf[:], sizeOffset); err != nil {
+		return err
+	}
+	c.size = size
+	return nil
+}
+
+// entry returns the page map entry for a block.
+//
+// +checklocks:c.mtx
+func (c *container) entry(block int64) entry {
+	if block < int64(len(c.blocks)) {
+		return c.blocks[block]
+	}
+	return entry{}
+}
+
+// setEntry updates the page map entry for a block,
+// and frees the space used by its previous version.
+//
+// +checklocks:c.mtx
+func (c *container) setEntry(file vfs.File, block int64, e entry) error {
+	if block >= maxBlocks {
+		return sqlite3.FULL
+	}
+	old := c.entry(block)
+	if old == e {
+		return nil
+	}
+
+	i := chunkIndex(block)
+	start, _ := chunkBlocks(i)
+	if c.dir[i] == 0 {
+		if e.off == 0 {
+			return nil // A block of zeros needs no entry.
+		}
+		if err := c.newChunk(file, i); err != nil {
+			return err
+		}
+	}
+
+	var buf [entrySize]byte
+	encodeEntry(buf[:], e)
+	if _, err := file.WriteAt(buf[:], c.dir[i]+(block-start)*entrySize); err != nil {
+		return err
+	}
+
+	c.grow(block)
+	c.blocks[block] = e
+	if old.off != 0 {
+		c.pending = append(c.pending, old.extent())
+	}
+	return nil
+}
+
+// truncate removes the page map entries for blocks past n.
+//
+// +checklocks:c.mtx
+func (c *container) truncate(file vfs.File, n int64) error {
+	for block := int64(len(c.blocks)); block > n; {
+		// Clear entries one page map chunk at a time.
+		i := chunkIndex(block - 1)
+		first, _ := chunkBlocks(i)
+		start := max(n, first)
+		off := c.dir[i] + (start-first)*entrySize
+		if err := writeZeros(file, off, (block-start)*entrySize); err != nil {
+			return err
+		}
+		for _, e := range c.blocks[start:block] {
+			if e.off != 0 {
+				c.pending = append(c.pending, e.extent())
+			}
+		}
+		c.blocks = c.blocks[:start]
+		block = start
+	}
+	return nil
+}
+
+// newChunk allocates a page map chunk.
+//
+// +checklocks:c.mtx
+func (c *container) newChunk(file vfs.File, i int) error {
+	_, n := chunkBlocks(i)
+	ext := extent{c.alloc(n * entrySize), n * entrySize}
+	if err := writeZeros(file, ext.off, ext.len); err != nil {
+		c.pending = append(c.pending, ext)
+		return err
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(ext.off))
+	if _, err := file.WriteAt(buf[:], dirOffset+8*int64(i)); err != nil {
+		c.pending = append(c.pending, ext)
+		return err
+	}
+	c.dir[i] = ext.off
+	return nil
+}
+
+// grow grows the page map to include a block.
+//
+// +checklocks:c.mtx
+func (c *container) grow(block int64) {
+	if n := int(block) + 1; n > len(c.blocks) {
+		c.blocks = slices.Grow(c.blocks, n-len(c.blocks))[:n]
+	}
+}
+
+// alloc allocates space for n bytes.
+//
+// +checklocks:c.mtx
+func (c *container) alloc(n int64) int64 {
+	n = roundUp(n, allocUnit)
+	for i, f := range c.free {
+		if f.len >= n {
+			if f.len == n {
+				c.free = slices.Delete(c.free, i, i+1)
+			} else {
+				c.free[i] = extent{f.off + n, f.len - n}
+			}
+			return f.off
+		}
+	}
+
+	off := c.end
+	if off < lockEnd && off+n > lockStart {
+		c.release(extent{off, lockStart - off})
+		off = lockEnd
+	}
+	c.end = off + n
+	return off
+}
+
+// release frees space, coalescing it with adjacent free space.
+//
+// +checklocks:c.mtx
+func (c *container) release(e extent) {
+	if e.len <= 0 {
+		return
+	}
+	i, _ := slices.BinarySearchFunc(c.free, e.off, func(f extent, off int64) int {
+		return cmp.Compare(f.off, off)
+	})
+	if i > 0 && c.free[i-1].off+c.free[i-1].len == e.off {
+		i--
+		e = extent{c.free[i].off, c.free[i].len + e.len}
+		c.free = slices.Delete(c.free, i, i+1)
+	}
+	if i < len(c.free) && e.off+e.len == c.free[i].off {
+		e.len += c.free[i].len
+		c.free = slices.Delete(c.free, i, i+1)
+	}
+	c.free = slices.Insert(c.free, i, e)
+}
+
+// synced makes space freed before a sync available for reuse,
+// and returns the size the container file can be truncated to.
+//
+// +checklocks:c.mtx
+func (c *container) synced() int64 {
+	for _, e := range c.pending {
+		c.release(e)
+	}
+	c.pending = c.pending[:0]
+
+	if n := len(c.free); n > 0 && c.free[n-1].off+c.free[n-1].len >= c.end {
+		c.end = c.free[n-1].off
+		c.free = c.free[:n-1]
+	}
+	return c.end
+}
+
+// chunkIndex returns the page map chunk for a block.
+func chunkIndex(block int64) int {
+	return bits.Len64(uint64(block / firstChunk))
+}
+
+// chunkBlocks returns the first block in a page map chunk,
+// and the number of blocks in it.
+func chunkBlocks(i int) (start, n int64) {
+	if i == 0 {
+		return 0, firstChunk
+	}
+	n = firstChunk << (i - 1)
+	return n, n
+}
+
+func writeZeros(file vfs.File, off, n int64) error {
+	zeros := make([]byte, min(n, zeroBufSize))
+	for n > 0 {
+		m := min(n, int64(len(zeros)))
+		if _, err := file.WriteAt(zeros[:m], off); err != nil {
+			return err
+		}
+		off += m
+		n -= m
+	}
+	return nil
+}
+
+func decodeEntry(buf []byte) entry {
+	return entry{
+		off: int64(binary.LittleEndian.Uint64(buf[0:])),
+		len: binary.LittleEndian.Uint32(buf[8:]),
+		crc: binary.LittleEndian.Uint32(buf[12:]),
+	}
+}
+
+func encodeEntry(buf []byte, e entry) {
+	binary.LittleEndian.PutUint64(buf[0:], uint64(e.off))
+	binary.LittleEndian.PutUint32(buf[8:], e.len)
+	binary.LittleEndian.PutUint32(buf[12:], e.crc)
+}
+
+func checksum(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
+
+// validBlockSize reports if size is a power of two
+// between 512 and 64KiB (the largest page size).
+func validBlockSize(size int64) bool {
+	return 512 <= size && size <= 65536 && size&(size-1) == 0
+}
+
+func roundUp(i, n int64) int64 {
+	return (i + n - 1) / n * n
+}
@@ -17,11 +17,7 @@ type (
 )
 
 // https://sqlite.org/rescode.html
-type _ErrorCode uint32
-
-func (e _ErrorCode) Error() string {
-	return util.ErrorCodeString(uint32(e))
-}
+type _ErrorCode = util.ErrorCode
 
 const (
 	_OK                      _ErrorCode = util.OK
@@ -31,8 +27,10 @@ const (
 	_READONLY                _ErrorCode = util.READONLY
 	_IOERR                   _ErrorCode = util.IOERR
 	_NOTFOUND                _ErrorCode = util.NOTFOUND
+	_MISUSE                  _ErrorCode = util.MISUSE
 	_FULL                    _ErrorCode = util.FULL
 	_CANTOPEN                _ErrorCode = util.CANTOPEN
+	_NOTADB                  _ErrorCode = util.NOTADB
 	_IOERR_READ              _ErrorCode = util.IOERR_READ
 	_IOERR_SHORT_READ        _ErrorCode = util.IOERR_SHORT_READ
 	_IOERR_WRITE             _ErrorCode = util.IOERR_WRITE
@@ -234,6 +232,7 @@ const (
 	_FCNTL_CKSM_FILE             _FcntlOpcode = 41
 	_FCNTL_RESET_CACHE           _FcntlOpcode = 42
 	_FCNTL_NULL_IO               _FcntlOpcode = 43
+	_FCNTL_CUSTOM                _FcntlOpcode = util.FCNTL_CUSTOM
 )
 
 // https://sqlite.org/c3ref/c_shm_exclusive.html
@@ -0,0 +1,183 @@
+// Package faultvfs implements a fault injection SQLite VFS,
+// for crash consistency testing.
+//
+// A [VFS] wraps any [vfs.VFS], and fails file operations
+// as scripted by the [Fault]s injected into it:
+// it can return errors, make short and torn writes,
+// and simulate a power loss that drops all writes
+// that weren't synced.
+//
+// To simulate a power loss, the VFS keeps a copy of the contents
+// each file had when it was last synced.
+// This is meant for testing, and for small databases.
+//
+// [CrashTest] replays a workload, simulating a power loss
+// at each of its sync points, and checks that the database survives.
+//
+// The VFS is not registered; register it with [vfs.Register]:
+//
+//	faults := faultvfs.Wrap(vfs.Find(""))
+//	vfs.Register("fault", faults)
+package faultvfs
+
+import (
+	"sync"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// Op is a file operation that can fail.
+type Op uint8
+
+const (
+	OpRead Op = iota + 1
+	OpWrite
+	OpTruncate
+	OpSync
+	OpLock
+)
+
+// Kind is a kind of fault.
+type Kind uint8
+
+const (
+	// Error fails the operation.
+	Error Kind = iota
+	// ShortWrite writes only part of the data, then fails.
+	// Other operations fail as with Error.
+	ShortWrite
+	// TornWrite simulates a power loss in the middle of a write:
+	// only some of its sectors reach the disk.
+	// Other operations fail as with PowerLoss.
+	TornWrite
+	// PowerLoss simulates a power loss before the operation.
+	PowerLoss
+)
+
+// Fault describes a scripted failure.
+type Fault struct {
+	Op   Op
+	Kind Kind
+
+	// File restricts the fault to some types of file
+	// (e.g. [vfs.OPEN_MAIN_DB], [vfs.OPEN_WAL]).
+	// Zero matches any file.
+	File vfs.OpenFlag
+
+	// After is the number of matching operations
+	// that succeed before the fault.
+	After int
+
+	// Times is the number of times the fault repeats.
+	// Zero means once, and negative means forever.
+	Times int
+
+	// Err is the error returned by the failed operation.
+	// Defaults to an I/O error for the operation,
+	// or to [sqlite3.FULL] for short writes.
+	Err error
+}
+
+func (f *Fault) err() error {
+	if f.Err != nil {
+		return f.Err
+	}
+	if f.Kind == ShortWrite && f.Op == OpWrite {
+		return sqlite3.FULL
+	}
+	switch f.Op {
+	case OpRead:
+		return sqlite3.IOERR_READ
+	case OpWrite:
+		return sqlite3.IOERR_WRITE
+	case OpTruncate:
+		return sqlite3.IOERR_TRUNCATE
+	case OpSync:
+		return sqlite3.IOERR_FSYNC
+	case OpLock:
+		return sqlite3.IOERR_LOCK
+	}
+	return sqlite3.IOERR
+}
+
+// VFS is a fault injection [vfs.VFS].
+//
+// After a power loss, files opened before it fail all operations,
+// and opening or deleting files fails, until [VFS.Recover] is called.
+type VFS struct {
+	base vfs.VFS
+
+	mtx     sync.Mutex
+	faults  []*fault              // +checklocks:mtx
+	files   map[string]*fileState // +checklocks:mtx
+	epoch   int                   // +checklocks:mtx
+	crashed bool                  // +checklocks:mtx
+}
+
+type fault struct {
+	Fault
+	seen  int
+	fired int
+}
+
+// Wrap wraps base with fault injection.
+func Wrap(base vfs.VFS) *VFS {
+	return &VFS{
+		base:  base,
+		files: map[string]*fileState{},
+	}
+}
+
+// Inject adds a fault.
+// Faults are matched in the order they're injected,
+// and each operation fails at most once.
+func (v *VFS) Inject(f Fault) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.faults = append(v.faults, &fault{Fault: f})
+}
+
+// Clear removes all faults.
+func (v *VFS) Clear() {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.faults = nil
+}
+
+// Fired reports how many times injected faults have fired.
+func (v *VFS) Fired() (n int) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	for _, f := range v.faults {
+		n += f.fired
+	}
+	return n
+}
+
+// Crash simulates a power loss:
+// all writes that weren't synced are dropped.
+func (v *VFS) Crash() {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.crash()
+}
+
+// Crashed reports whether there was a power loss
+// since the VFS was created, or last recovered.
+func (v *VFS) Crashed() bool {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	return v.crashed
+}
+
+// Recover restores power after a power loss,
+// and removes all faults.
+// Files opened before the power loss keep failing,
+// and should be closed.
+func (v *VFS) Recover() {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.crashed = false
+	v.faults = nil
+}
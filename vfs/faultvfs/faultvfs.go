@@ -0,0 +1,311 @@
+package faultvfs
+
+import (
+	"io"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// Torn writes are torn at sector boundaries.
+const sectorSize = 512
+
+// Open implements [vfs.VFS].
+func (v *VFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	if v.Crashed() {
+		return nil, flags, sqlite3.CANTOPEN
+	}
+	file, flags, err := v.base.Open(name, flags)
+	if err != nil {
+		return file, flags, err
+	}
+	return v.wrap(file, name, flags), flags, nil
+}
+
+// OpenFilename implements [vfs.VFSFilename].
+func (v *VFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	if v.Crashed() {
+		return nil, flags, sqlite3.CANTOPEN
+	}
+	file, flags, err := vfsutil.WrapOpenFilename(v.base, name, flags)
+	if err != nil {
+		return file, flags, err
+	}
+	return v.wrap(file, name.String(), flags), flags, nil
+}
+
+// Delete implements [vfs.VFS].
+// Deleting a file is durable.
+func (v *VFS) Delete(name string, dirSync bool) error {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if v.crashed {
+		return sqlite3.IOERR_DELETE
+	}
+	if s := v.files[name]; s != nil {
+		s.dirty = false
+		s.durable = nil
+		delete(v.files, name)
+	}
+	return v.base.Delete(name, dirSync)
+}
+
+// Access implements [vfs.VFS].
+func (v *VFS) Access(name string, flag vfs.AccessFlag) (bool, error) {
+	return v.base.Access(name, flag)
+}
+
+// FullPathname implements [vfs.VFS].
+func (v *VFS) FullPathname(name string) (string, error) {
+	return v.base.FullPathname(name)
+}
+
+// fileState tracks the durable contents of a file.
+type fileState struct {
+	path    string
+	flags   vfs.OpenFlag
+	handles map[*faultFile]struct{}
+	durable []byte // contents as of the last sync
+	dirty   bool   // whether there were writes since the last sync
+}
+
+func (v *VFS) wrap(file vfs.File, path string, flags vfs.OpenFlag) *faultFile {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	f := &faultFile{WrappedFile: vfsutil.WrappedFile{File: file}, vfs: v, flags: flags, epoch: v.epoch}
+	// Temporary and memory files don't survive a power loss anyway.
+	if path == "" || flags&(vfs.OPEN_DELETEONCLOSE|vfs.OPEN_MEMORY) != 0 {
+		return f
+	}
+
+	s := v.files[path]
+	if s == nil {
+		s = &fileState{
+			path:    path,
+			flags:   flags,
+			handles: map[*faultFile]struct{}{},
+		}
+		v.files[path] = s
+	}
+	s.handles[f] = struct{}{}
+	f.state = s
+	return f
+}
+
+// match finds the fault for an operation, if any.
+//
+// +checklocks:v.mtx
+func (v *VFS) match(op Op, flags vfs.OpenFlag) *fault {
+	for _, f := range v.faults {
+		if f.Op != op || f.File != 0 && f.File&flags == 0 {
+			continue
+		}
+		f.seen++
+		if f.seen > f.After && (f.Times < 0 || f.fired < max(1, f.Times)) {
+			f.fired++
+			return f
+		}
+	}
+	return nil
+}
+
+// +checklocks:v.mtx
+func (v *VFS) crash() {
+	v.crashed = true
+	v.epoch++
+	for path, s := range v.files {
+		if s.dirty {
+			v.revert(s)
+		}
+		if len(s.handles) == 0 {
+			delete(v.files, path)
+		}
+	}
+}
+
+// revert drops all writes since the last sync.
+//
+// +checklocks:v.mtx
+func (v *VFS) revert(s *fileState) {
+	var file vfs.File
+	for f := range s.handles {
+		file = f.File
+		break
+	}
+	if file == nil {
+		flags := s.flags&^(vfs.OPEN_READONLY|vfs.OPEN_CREATE|vfs.OPEN_EXCLUSIVE) | vfs.OPEN_READWRITE
+		f, _, err := v.base.Open(s.path, flags)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		file = f
+	}
+
+	file.WriteAt(s.durable, 0)
+	file.Truncate(int64(len(s.durable)))
+	s.durable = nil
+	s.dirty = false
+}
+
+type faultFile struct {
+	vfsutil.WrappedFile
+	vfs   *VFS
+	state *fileState // nil for files that aren't tracked
+	flags vfs.OpenFlag
+	epoch int
+}
+
+// before is called before each operation,
+// and returns the fault to inject, if any.
+// Before writes, it saves the durable contents of the file.
+func (f *faultFile) before(op Op) (*fault, error) {
+	v := f.vfs
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if f.epoch != v.epoch {
+		return nil, sqlite3.IOERR
+	}
+
+	flt := v.match(op, f.flags)
+	if flt != nil {
+		switch {
+		case flt.Kind == PowerLoss,
+			flt.Kind == TornWrite && op != OpWrite:
+			v.crash()
+			return nil, flt.err()
+		case flt.Kind == Error,
+			flt.Kind == ShortWrite && op != OpWrite:
+			return nil, flt.err()
+		}
+	}
+
+	if s := f.state; s != nil && !s.dirty && (op == OpWrite || op == OpTruncate) {
+		size, err := f.File.Size()
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size)
+		n, err := f.File.ReadAt(data, 0)
+		if n != len(data) {
+			if err == nil || err == io.EOF {
+				err = sqlite3.IOERR_READ
+			}
+			return nil, err
+		}
+		s.durable = data
+		s.dirty = true
+	}
+	return flt, nil
+}
+
+func (f *faultFile) Close() error {
+	if s := f.state; s != nil {
+		v := f.vfs
+		v.mtx.Lock()
+		delete(s.handles, f)
+		if len(s.handles) == 0 && !s.dirty && v.files[s.path] == s {
+			delete(v.files, s.path)
+		}
+		v.mtx.Unlock()
+	}
+	return f.File.Close()
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := f.before(OpRead); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	flt, err := f.before(OpWrite)
+	if err != nil {
+		return 0, err
+	}
+	if flt == nil {
+		return f.File.WriteAt(p, off)
+	}
+
+	switch flt.Kind {
+	case ShortWrite:
+		n, _ := f.File.WriteAt(p[:len(p)/2], off)
+		return n, flt.err()
+
+	case TornWrite:
+		f.vfs.Crash()
+		// The first few sectors made it to disk.
+		n := len(p) / 2
+		if n > sectorSize {
+			n &^= sectorSize - 1
+		}
+		f.File.WriteAt(p[:n], off)
+		return 0, flt.err()
+	}
+	panic("unreachable")
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if _, err := f.before(OpTruncate); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Sync(flags vfs.SyncFlag) error {
+	if _, err := f.before(OpSync); err != nil {
+		return err
+	}
+	if err := f.File.Sync(flags); err != nil {
+		return err
+	}
+	if s := f.state; s != nil {
+		v := f.vfs
+		v.mtx.Lock()
+		if f.epoch == v.epoch {
+			s.durable = nil
+			s.dirty = false
+		}
+		v.mtx.Unlock()
+	}
+	return nil
+}
+
+func (f *faultFile) Size() (int64, error) {
+	if err := f.alive(); err != nil {
+		return 0, err
+	}
+	return f.File.Size()
+}
+
+func (f *faultFile) Lock(lock vfs.LockLevel) error {
+	if _, err := f.before(OpLock); err != nil {
+		return err
+	}
+	return f.File.Lock(lock)
+}
+
+func (f *faultFile) CheckReservedLock() (bool, error) {
+	if err := f.alive(); err != nil {
+		return false, err
+	}
+	return f.File.CheckReservedLock()
+}
+
+func (f *faultFile) DeviceCharacteristics() vfs.DeviceCharacteristic {
+	// Batch atomic writes would bypass syncs.
+	return f.File.DeviceCharacteristics() &^ vfs.IOCAP_BATCH_ATOMIC
+}
+
+func (f *faultFile) alive() error {
+	f.vfs.mtx.Lock()
+	defer f.vfs.mtx.Unlock()
+	if f.epoch != f.vfs.epoch {
+		return sqlite3.IOERR
+	}
+	return nil
+}
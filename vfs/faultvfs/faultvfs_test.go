@@ -0,0 +1,264 @@
+package faultvfs_test
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	_ "github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/faultvfs"
+)
+
+func setup(db *sqlite3.Conn) error {
+	return db.Exec(`
+		PRAGMA synchronous=full;
+		CREATE TABLE t (id INTEGER PRIMARY KEY, x);
+		CREATE INDEX t_x ON t (x);
+	`)
+}
+
+// workload commits transactions of 10 rows each,
+// and then deletes some of them.
+func workload(db *sqlite3.Conn) error {
+	for i := range 4 {
+		err := db.Exec(`
+			BEGIN;
+			WITH RECURSIVE c(n) AS (SELECT 1 UNION ALL SELECT n+1 FROM c WHERE n<10)
+			INSERT INTO t (x) SELECT randomblob(300) FROM c;
+			COMMIT;
+		`)
+		if err != nil {
+			return err
+		}
+		if i == 2 {
+			err := db.Exec(`DELETE FROM t WHERE id <= 10`)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+}
+
+// check that transactions are all or nothing.
+func check(db *sqlite3.Conn) error {
+	stmt, _, err := db.Prepare(`SELECT count(*) FROM t`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	if stmt.Step() && stmt.ColumnInt(0)%10 != 0 {
+		return errors.New("partial transaction")
+	}
+	return stmt.Err()
+}
+
+func TestCrashTest(t *testing.T) {
+	for _, mode := range []string{"delete", "truncate", "persist", "wal"} {
+		t.Run(mode, func(t *testing.T) {
+			test := faultvfs.CrashTest{
+				Dir:         t.TempDir(),
+				JournalMode: mode,
+				Setup:       setup,
+				Workload:    workload,
+				Check:       check,
+			}
+			points, err := test.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if points < 6 {
+				t.Errorf("got %d sync points", points)
+			}
+		})
+	}
+}
+
+func TestCrashTest_tornWrite(t *testing.T) {
+	for _, mode := range []string{"delete", "wal"} {
+		t.Run(mode, func(t *testing.T) {
+			test := faultvfs.CrashTest{
+				Dir:         t.TempDir(),
+				JournalMode: mode,
+				Setup:       setup,
+				Workload:    workload,
+				Check:       check,
+				Fault: func(point int) faultvfs.Fault {
+					return faultvfs.Fault{Op: faultvfs.OpWrite, Kind: faultvfs.TornWrite, After: point}
+				},
+			}
+			points, err := test.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if points < 10 {
+				t.Errorf("got %d write points", points)
+			}
+		})
+	}
+}
+
+func TestCrashTest_durability(t *testing.T) {
+	var committed int
+	test := faultvfs.CrashTest{
+		Dir:   t.TempDir(),
+		Setup: setup,
+		Workload: func(db *sqlite3.Conn) error {
+			// Without syncs, committed transactions are lost.
+			committed = 0
+			if err := db.Exec(`PRAGMA synchronous=off`); err != nil {
+				return err
+			}
+			for range 3 {
+				if err := db.Exec(`INSERT INTO t (x) VALUES (1)`); err != nil {
+					return err
+				}
+				committed++
+			}
+			return nil
+		},
+		Check: func(db *sqlite3.Conn) error {
+			stmt, _, err := db.Prepare(`SELECT count(*) FROM t`)
+			if err != nil {
+				return err
+			}
+			defer stmt.Close()
+			if stmt.Step() && stmt.ColumnInt(0) < committed {
+				return errors.New("lost a committed transaction")
+			}
+			return stmt.Err()
+		},
+		Fault: func(point int) faultvfs.Fault {
+			return faultvfs.Fault{Op: faultvfs.OpWrite, Kind: faultvfs.PowerLoss, After: point}
+		},
+	}
+	_, err := test.Run()
+	if err == nil || !strings.HasSuffix(err.Error(), "lost a committed transaction") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func open(t *testing.T) (*faultvfs.VFS, *sqlite3.Conn, string) {
+	t.Helper()
+	faults := faultvfs.Wrap(vfs.Find(""))
+	vfs.Register(t.Name(), faults)
+	t.Cleanup(func() { vfs.Unregister(t.Name()) })
+
+	uri := "file:" + filepath.ToSlash(filepath.Join(t.TempDir(), "test.db")) + "?vfs=" + t.Name()
+	db, err := sqlite3.Open(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := setup(db); err != nil {
+		t.Fatal(err)
+	}
+	return faults, db, uri
+}
+
+func TestFault(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault faultvfs.Fault
+		want  error
+	}{
+		{"read", faultvfs.Fault{Op: faultvfs.OpRead, File: vfs.OPEN_MAIN_DB}, sqlite3.IOERR_READ},
+		{"write", faultvfs.Fault{Op: faultvfs.OpWrite}, sqlite3.IOERR_WRITE},
+		{"short", faultvfs.Fault{Op: faultvfs.OpWrite, Kind: faultvfs.ShortWrite}, sqlite3.FULL},
+		{"sync", faultvfs.Fault{Op: faultvfs.OpSync}, sqlite3.IOERR_FSYNC},
+		{"lock", faultvfs.Fault{Op: faultvfs.OpLock, Err: sqlite3.BUSY}, sqlite3.BUSY},
+		{"journal", faultvfs.Fault{Op: faultvfs.OpWrite, File: vfs.OPEN_MAIN_JOURNAL}, sqlite3.IOERR_WRITE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			faults, db, _ := open(t)
+
+			// Drop the page cache, so reads hit the file.
+			if err := db.Exec(`PRAGMA cache_size=0`); err != nil {
+				t.Fatal(err)
+			}
+
+			faults.Inject(tt.fault)
+			err := db.Exec(`INSERT INTO t (x) VALUES (1)`)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			if n := faults.Fired(); n != 1 {
+				t.Errorf("fired %d times", n)
+			}
+
+			// Faults fire once, by default.
+			if err := db.Exec(`INSERT INTO t (x) VALUES (2)`); err != nil {
+				t.Fatal(err)
+			}
+			if err := faultvfs.IntegrityCheck(db); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFault_after(t *testing.T) {
+	faults, db, _ := open(t)
+
+	faults.Inject(faultvfs.Fault{Op: faultvfs.OpSync, After: 2, Times: 2})
+	var errs int
+	for range 6 {
+		if err := db.Exec(`INSERT INTO t (x) VALUES (1)`); err != nil {
+			errs++
+		}
+	}
+	// Rolling back also syncs, and may fail.
+	if errs == 0 || faults.Fired() != 2 {
+		t.Errorf("got %d errors, fired %d times", errs, faults.Fired())
+	}
+	if err := faultvfs.IntegrityCheck(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrash(t *testing.T) {
+	faults, db, uri := open(t)
+
+	err := db.Exec(`
+		PRAGMA synchronous=off;
+		INSERT INTO t (x) VALUES (1);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	faults.Crash()
+	if !faults.Crashed() {
+		t.Error("want crashed")
+	}
+	if err := db.Exec(`SELECT * FROM t`); !errors.Is(err, sqlite3.IOERR) {
+		t.Errorf("got %v, want IOERR", err)
+	}
+	db.Close()
+	faults.Recover()
+
+	db, err = sqlite3.Open(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The table was synced, the row was not.
+	stmt, _, err := db.Prepare(`SELECT count(*) FROM t`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	if !stmt.Step() {
+		t.Fatal(stmt.Err())
+	}
+	if n := stmt.ColumnInt(0); n != 0 {
+		t.Errorf("got %d rows", n)
+	}
+}
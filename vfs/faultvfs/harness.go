@@ -0,0 +1,142 @@
+package faultvfs
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// CrashTest tests that a workload survives a power loss
+// at each of its sync points.
+type CrashTest struct {
+	// Dir is the directory where databases are created.
+	Dir string
+
+	// Base is the VFS under test.
+	// Defaults to the OS VFS.
+	Base vfs.VFS
+
+	// JournalMode is the journal mode (e.g. "wal").
+	// Defaults to "delete".
+	JournalMode string
+
+	// Setup, if not nil, prepares the database.
+	// It doesn't lose power.
+	Setup func(*sqlite3.Conn) error
+
+	// Workload is the workload that loses power.
+	Workload func(*sqlite3.Conn) error
+
+	// Fault, if not nil, returns the fault to inject
+	// at each point, instead of a power loss at each sync.
+	Fault func(point int) Fault
+
+	// Check, if not nil, checks the invariants of the application
+	// after recovering from the power loss.
+	Check func(*sqlite3.Conn) error
+}
+
+// Run runs the workload once for each of its sync points,
+// on a new database, and simulates a power loss at that point.
+// It then reopens the database,
+// and checks it with PRAGMA integrity_check.
+//
+// Run stops once the fault no longer fires,
+// and returns the number of points tested.
+func (c *CrashTest) Run() (int, error) {
+	for point := 0; ; point++ {
+		fired, err := c.run(point)
+		if err != nil {
+			return point, fmt.Errorf("faultvfs: point %d: %w", point, err)
+		}
+		if !fired {
+			return point, nil
+		}
+	}
+}
+
+func (c *CrashTest) run(point int) (fired bool, err error) {
+	base := c.Base
+	if base == nil {
+		base = vfs.Find("")
+	}
+	faults := Wrap(base)
+	name := fmt.Sprintf("faultvfs-%p", faults)
+	vfs.Register(name, faults)
+	defer vfs.Unregister(name)
+
+	path := filepath.Join(c.Dir, fmt.Sprintf("crash-%d.db", point))
+	uri := "file:" + filepath.ToSlash(path) + "?vfs=" + name
+
+	db, err := sqlite3.Open(uri)
+	if err != nil {
+		return false, err
+	}
+	defer func() { db.Close() }()
+
+	mode := c.JournalMode
+	if mode == "" {
+		mode = "delete"
+	}
+	if err := db.Exec(`PRAGMA journal_mode=` + mode); err != nil {
+		return false, err
+	}
+	if c.Setup != nil {
+		if err := c.Setup(db); err != nil {
+			return false, err
+		}
+	}
+
+	if c.Fault != nil {
+		faults.Inject(c.Fault(point))
+	} else {
+		faults.Inject(Fault{Op: OpSync, Kind: PowerLoss, After: point})
+	}
+	err = c.Workload(db)
+	if faults.Fired() == 0 {
+		return false, err
+	}
+
+	// Close the connection that failed, and recover.
+	db.Close()
+	faults.Recover()
+
+	db, err = sqlite3.Open(uri)
+	if err != nil {
+		return true, err
+	}
+	if err := IntegrityCheck(db); err != nil {
+		return true, err
+	}
+	if c.Check != nil {
+		return true, c.Check(db)
+	}
+	return true, nil
+}
+
+// IntegrityCheck runs PRAGMA integrity_check,
+// and returns an error for any problem found.
+func IntegrityCheck(db *sqlite3.Conn) error {
+	stmt, _, err := db.Prepare(`PRAGMA integrity_check`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	var errs []error
+	for stmt.Step() {
+		if msg := stmt.ColumnText(0); msg != "ok" {
+			errs = append(errs, errors.New(msg))
+		}
+	}
+	if err := stmt.Err(); err != nil {
+		return err
+	}
+	if errs != nil {
+		return fmt.Errorf("%w: %w", sqlite3.CORRUPT, errors.Join(errs...))
+	}
+	return nil
+}
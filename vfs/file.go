@@ -67,12 +67,15 @@ func (vfsOS) Access(name string, flags AccessFlag) (bool, error) {
 	return err == nil, err
 }
 
-func (vfsOS) Open(name string, flags OpenFlag) (File, OpenFlag, error) {
-	// notest // OpenFilename is called instead
-	return nil, 0, _CANTOPEN
+func (v vfsOS) Open(name string, flags OpenFlag) (File, OpenFlag, error) {
+	return v.open(name, flags, "")
 }
 
-func (vfsOS) OpenFilename(name *Filename, flags OpenFlag) (File, OpenFlag, error) {
+func (v vfsOS) OpenFilename(name *Filename, flags OpenFlag) (File, OpenFlag, error) {
+	return v.open(name.String(), flags, name.URIParameter("modeof"))
+}
+
+func (vfsOS) open(name string, flags OpenFlag, modeof string) (File, OpenFlag, error) {
 	oflags := _O_NOFOLLOW
 	if flags&OPEN_EXCLUSIVE != 0 {
 		oflags |= os.O_EXCL
@@ -92,26 +95,26 @@ func (vfsOS) OpenFilename(name *Filename, flags OpenFlag) (File, OpenFlag, error
 
 	var err error
 	var f *os.File
-	if name == nil {
+	if name == "" {
 		f, err = os.CreateTemp(os.Getenv("SQLITE_TMPDIR"), "*.db")
 	} else {
-		f, err = os.OpenFile(name.String(), oflags, 0666)
+		f, err = os.OpenFile(name, oflags, 0666)
 	}
 	if err != nil {
-		if name == nil {
+		if name == "" {
 			return nil, flags, _IOERR_GETTEMPPATH
 		}
 		if errors.Is(err, syscall.EISDIR) {
 			return nil, flags, _CANTOPEN_ISDIR
 		}
 		if isCreate && isJournl && errors.Is(err, fs.ErrPermission) &&
-			osAccess(name.String(), ACCESS_EXISTS) != nil {
+			osAccess(name, ACCESS_EXISTS) != nil {
 			return nil, flags, _READONLY_DIRECTORY
 		}
 		return nil, flags, err
 	}
 
-	if modeof := name.URIParameter("modeof"); modeof != "" {
+	if modeof != "" {
 		if err = osSetMode(f, modeof); err != nil {
 			f.Close()
 			return nil, flags, _IOERR_FSTAT
@@ -128,8 +131,9 @@ func (vfsOS) OpenFilename(name *Filename, flags OpenFlag) (File, OpenFlag, error
 		readOnly: flags&OPEN_READONLY != 0,
 		syncDir:  isUnix && isCreate && isJournl,
 		delete:   !isUnix && flags&OPEN_DELETEONCLOSE != 0,
-		shm:      NewSharedMemory(name.String()+"-shm", flags),
+		holder:   registerHolder(f.Name(), flags),
 	}
+	file.shm = trackShm(NewSharedMemory(name+"-shm", flags), file.holder)
 	return &file, flags, nil
 }
 
@@ -143,6 +147,7 @@ type vfsFile struct {
 	atomic   bool
 	delete   bool
 	psow     bool
+	holder   *lockHolder
 }
 
 var (
@@ -152,6 +157,7 @@ var (
 	_ FileSizeHint           = &vfsFile{}
 	_ FilePersistWAL         = &vfsFile{}
 	_ FilePowersafeOverwrite = &vfsFile{}
+	_ filePDB                = &vfsFile{}
 )
 
 func (f *vfsFile) Close() error {
@@ -162,6 +168,7 @@ func (f *vfsFile) Close() error {
 		f.shm.Close()
 	}
 	f.Unlock(LOCK_NONE)
+	f.holder.unregister()
 	return f.File.Close()
 }
 
@@ -245,3 +252,9 @@ func (f *vfsFile) PowersafeOverwrite() bool        { return f.psow }
 func (f *vfsFile) PersistWAL() bool                { return f.keepWAL }
 func (f *vfsFile) SetPowersafeOverwrite(psow bool) { f.psow = psow }
 func (f *vfsFile) SetPersistWAL(keepWAL bool)      { f.keepWAL = keepWAL }
+
+// SetDB records the connection that opened the file,
+// to be reported by [LockHolders].
+func (f *vfsFile) SetDB(db any) {
+	f.holder.setDB(db)
+}
@@ -0,0 +1,37 @@
+// Package fsvfs implements an SQLite VFS for databases in an [fs.FS].
+//
+// [Register] registers an [fs.FS] as a read-only [vfs.VFS],
+// and database paths are resolved against its root.
+// This permits, for example, querying databases
+// embedded in a Go binary with [embed.FS]:
+//
+//	//go:embed testdata
+//	var testdata embed.FS
+//
+//	func init() {
+//		fsvfs.Register("testdata", testdata)
+//	}
+//
+//	db, err := sqlite3.Open("file:testdata/demo.db?vfs=testdata")
+//
+// Files are read through [io.ReaderAt], if they implement it,
+// otherwise through [io.Seeker].
+//
+// Databases are immutable, as if opened with "immutable=1":
+// SQLite does not lock them, nor look for their journals or WAL files.
+package fsvfs
+
+import (
+	"io/fs"
+
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// Register registers fsys as a read-only VFS.
+// The caller should ensure that files in fsys do not mutate,
+// otherwise SQLite might return incorrect query results and/or [sqlite3.CORRUPT] errors.
+//
+// Use [vfs.Unregister] to unregister it.
+func Register(name string, fsys fs.FS) {
+	vfs.Register(name, fsVFS{fsys})
+}
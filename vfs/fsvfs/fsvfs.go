@@ -0,0 +1,131 @@
+package fsvfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/util/ioutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+type fsVFS struct{ fsys fs.FS }
+
+func (v fsVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	if flags&vfs.OPEN_MAIN_DB == 0 || !fs.ValidPath(name) {
+		return nil, flags, sqlite3.CANTOPEN
+	}
+
+	f, err := v.fsys.Open(name)
+	if err != nil {
+		return nil, flags, sqlite3.CANTOPEN
+	}
+
+	var file vfs.File
+	if r, ok := f.(io.ReaderAt); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, flags, err
+		}
+		file = &fsFile{
+			SizeReaderAt: readerAtSize{r, fi.Size()},
+			Closer:       f,
+		}
+	} else if s, ok := f.(io.ReadSeeker); ok {
+		r := ioutil.NewSeekingReaderAt(s)
+		file = &fsFile{SizeReaderAt: r, Closer: r}
+	} else {
+		f.Close()
+		return nil, flags, sqlite3.CANTOPEN
+	}
+	return file, flags | vfs.OPEN_READONLY, nil
+}
+
+func (fsVFS) Delete(name string, dirSync bool) error {
+	// notest
+	return sqlite3.IOERR_DELETE
+}
+
+func (v fsVFS) Access(name string, flag vfs.AccessFlag) (bool, error) {
+	if flag == vfs.ACCESS_READWRITE || !fs.ValidPath(name) {
+		return false, nil
+	}
+	_, err := fs.Stat(v.fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (fsVFS) FullPathname(name string) (string, error) {
+	// Paths are relative to the root of the file system.
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return ".", nil
+	}
+	return name[1:], nil
+}
+
+type readerAtSize struct {
+	io.ReaderAt
+	size int64
+}
+
+func (r readerAtSize) ReadAt(p []byte, off int64) (int, error) {
+	// Some readers fail reading past the end.
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+func (r readerAtSize) Size() (int64, error) {
+	return r.size, nil
+}
+
+type fsFile struct {
+	ioutil.SizeReaderAt
+	io.Closer
+}
+
+func (*fsFile) WriteAt(b []byte, off int64) (n int, err error) {
+	// notest
+	return 0, sqlite3.READONLY
+}
+
+func (*fsFile) Truncate(size int64) error {
+	// notest
+	return sqlite3.READONLY
+}
+
+func (*fsFile) Sync(flag vfs.SyncFlag) error {
+	// notest
+	return nil
+}
+
+func (*fsFile) Lock(lock vfs.LockLevel) error {
+	// notest
+	return nil
+}
+
+func (*fsFile) Unlock(lock vfs.LockLevel) error {
+	// notest
+	return nil
+}
+
+func (*fsFile) CheckReservedLock() (bool, error) {
+	// notest
+	return false, nil
+}
+
+func (*fsFile) SectorSize() int {
+	// notest
+	return 0
+}
+
+func (*fsFile) DeviceCharacteristics() vfs.DeviceCharacteristic {
+	return vfs.IOCAP_IMMUTABLE | vfs.IOCAP_SUBPAGE_READ
+}
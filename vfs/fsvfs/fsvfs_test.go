@@ -0,0 +1,131 @@
+package fsvfs_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	_ "github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/fsvfs"
+	"github.com/ncruces/go-sqlite3/vfs/vfstest"
+)
+
+func Test_vfstest(t *testing.T) {
+	fsys := fstest.MapFS{}
+	fsvfs.Register("fsvfs-vfstest", fsys)
+	defer vfs.Unregister("fsvfs-vfstest")
+
+	vfstest.Test(t, vfs.Find("fsvfs-vfstest"), &vfstest.Options{
+		ReadOnly: true,
+		Name: func(t *testing.T) string {
+			return t.Name() + ".db"
+		},
+		Create: func(t *testing.T, data []byte) string {
+			name := t.Name() + ".db"
+			fsys[name] = &fstest.MapFile{Data: data}
+			t.Cleanup(func() { delete(fsys, name) })
+			return name
+		},
+	})
+}
+
+func TestRegister(t *testing.T) {
+	data := create(t)
+
+	// Files that implement io.ReaderAt, and files that don't.
+	fsvfs.Register("fsvfs-dir", os.DirFS(filepath.Dir(data)))
+	fsvfs.Register("fsvfs-seek", seekFS{fstest.MapFS{
+		"data/test.db": &fstest.MapFile{Data: read(t, data)},
+	}})
+	defer vfs.Unregister("fsvfs-dir")
+	defer vfs.Unregister("fsvfs-seek")
+
+	for _, uri := range []string{
+		"file:test.db?vfs=fsvfs-dir",
+		"file:/test.db?vfs=fsvfs-dir&immutable=1",
+		"file:data/test.db?vfs=fsvfs-seek",
+		"file:/data/../data/test.db?vfs=fsvfs-seek&mode=ro",
+	} {
+		t.Run(uri, func(t *testing.T) {
+			db, err := sqlite3.Open(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			stmt, _, err := db.Prepare(`SELECT sum(x) FROM t`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stmt.Close()
+			if !stmt.Step() {
+				t.Fatal(stmt.Err())
+			}
+			if got := stmt.ColumnInt(0); got != 5050 {
+				t.Errorf("got %d", got)
+			}
+			stmt.Close()
+
+			if err := db.Exec(`INSERT INTO t VALUES (0)`); !errors.Is(err, sqlite3.READONLY) {
+				t.Errorf("got %v, want READONLY", err)
+			}
+		})
+	}
+
+	_, err := sqlite3.Open("file:missing.db?vfs=fsvfs-dir")
+	if !errors.Is(err, sqlite3.CANTOPEN) {
+		t.Errorf("got %v, want CANTOPEN", err)
+	}
+}
+
+// seekFS hides io.ReaderAt from the files of a file system.
+type seekFS struct{ fsys fs.FS }
+
+func (s seekFS) Open(name string) (fs.File, error) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return seekFile{f}, nil
+}
+
+type seekFile struct{ fs.File }
+
+func (f seekFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(interface {
+		Seek(int64, int) (int64, error)
+	}).Seek(offset, whence)
+}
+
+func create(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sqlite3.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Exec(`
+		CREATE TABLE t (x);
+		INSERT INTO t SELECT value FROM generate_series(1, 100);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func read(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,197 @@
+package vfs
+
+import (
+	"cmp"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// LockHolder describes a file opened by the default VFS,
+// and the locks it holds.
+type LockHolder struct {
+	// Path is the name of the file.
+	Path string
+	// Flags are the flags the file was opened with.
+	Flags OpenFlag
+	// Lock is the lock held on the file.
+	Lock LockLevel
+	// ShmShared and ShmExclusive are the WAL-index locks held:
+	// bit i is set if slot i is locked in that mode.
+	// Slot 0 is the write lock, 1 the checkpoint lock,
+	// 2 the recovery lock, and 3 to 7 are the read locks.
+	ShmShared, ShmExclusive uint8
+	// DB is the *sqlite3.Conn that opened the file, if known.
+	DB any
+}
+
+// LockHolders returns every file handle opened by the default VFS
+// in this process for the database at path,
+// along with the locks it currently holds.
+// If path is empty, it returns every open file handle.
+//
+// LockHolders is meant for debugging:
+// the returned locks are a snapshot, and may change at any time.
+func LockHolders(path string) []LockHolder {
+	if path != "" {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	}
+
+	holdersMtx.Lock()
+	var list []*lockHolder
+	for h := range holders {
+		if path == "" || h.path == path {
+			list = append(list, h)
+		}
+	}
+	holdersMtx.Unlock()
+
+	slices.SortFunc(list, func(a, b *lockHolder) int {
+		return cmp.Or(cmp.Compare(a.path, b.path), cmp.Compare(a.id, b.id))
+	})
+
+	ret := make([]LockHolder, len(list))
+	for i, h := range list {
+		h.mtx.Lock()
+		ret[i] = LockHolder{
+			Path:         h.path,
+			Flags:        h.flags,
+			Lock:         h.lock,
+			ShmShared:    h.shmShared,
+			ShmExclusive: h.shmExclusive,
+			DB:           h.db,
+		}
+		h.mtx.Unlock()
+	}
+	return ret
+}
+
+var (
+	holdersMtx sync.Mutex
+	holdersSeq uint64                       // +checklocks:holdersMtx
+	holders    = map[*lockHolder]struct{}{} // +checklocks:holdersMtx
+)
+
+// lockHolder mirrors the lock state of a file,
+// so that it can be safely read by other goroutines.
+type lockHolder struct {
+	id    uint64
+	path  string
+	flags OpenFlag
+
+	mtx          sync.Mutex
+	lock         LockLevel // +checklocks:mtx
+	shmShared    uint8     // +checklocks:mtx
+	shmExclusive uint8     // +checklocks:mtx
+	db           any       // +checklocks:mtx
+}
+
+func registerHolder(path string, flags OpenFlag) *lockHolder {
+	holdersMtx.Lock()
+	defer holdersMtx.Unlock()
+	holdersSeq++
+	h := &lockHolder{id: holdersSeq, path: path, flags: flags}
+	holders[h] = struct{}{}
+	return h
+}
+
+func (h *lockHolder) unregister() {
+	if h == nil {
+		return
+	}
+	holdersMtx.Lock()
+	defer holdersMtx.Unlock()
+	delete(holders, h)
+}
+
+func (h *lockHolder) setLock(lock LockLevel) {
+	if h == nil {
+		return
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.lock = lock
+}
+
+func (h *lockHolder) setDB(db any) {
+	if h == nil {
+		return
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.db = db
+}
+
+func (h *lockHolder) setShmLock(offset, n int32, flags _ShmFlag) {
+	if h == nil {
+		return
+	}
+	mask := uint8((1<<n - 1) << offset)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	switch {
+	case flags&_SHM_UNLOCK != 0:
+		h.shmShared &^= mask
+		h.shmExclusive &^= mask
+	case flags&_SHM_SHARED != 0:
+		h.shmShared |= mask
+	case flags&_SHM_EXCLUSIVE != 0:
+		h.shmExclusive |= mask
+	}
+}
+
+func (h *lockHolder) clearShmLocks() {
+	if h == nil {
+		return
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.shmShared = 0
+	h.shmExclusive = 0
+}
+
+// trackShm wraps a shared-memory to track the WAL-index locks it holds.
+// The wrapper supports blocking locks only if the shared-memory does.
+func trackShm(shm SharedMemory, holder *lockHolder) SharedMemory {
+	if shm == nil {
+		return nil
+	}
+	if _, ok := shm.(blockingSharedMemory); ok {
+		return &blockingHolderShm{holderShm{shm, holder}}
+	}
+	return &holderShm{shm, holder}
+}
+
+// holderShm tracks the WAL-index locks held through a shared-memory.
+type holderShm struct {
+	SharedMemory
+	holder *lockHolder
+}
+
+func (s *holderShm) shmLock(offset, n int32, flags _ShmFlag) _ErrorCode {
+	rc := s.SharedMemory.shmLock(offset, n, flags)
+	if rc == _OK || flags&_SHM_UNLOCK != 0 {
+		s.holder.setShmLock(offset, n, flags)
+	}
+	return rc
+}
+
+func (s *holderShm) shmUnmap(delete bool) {
+	s.SharedMemory.shmUnmap(delete)
+	s.holder.clearShmLocks()
+}
+
+func (s *holderShm) Close() error {
+	defer s.holder.clearShmLocks()
+	return s.SharedMemory.Close()
+}
+
+type blockingHolderShm struct{ holderShm }
+
+var _ blockingSharedMemory = &blockingHolderShm{}
+
+func (s *blockingHolderShm) shmEnableBlocking(block bool) {
+	s.SharedMemory.(blockingSharedMemory).shmEnableBlocking(block)
+}
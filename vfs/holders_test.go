@@ -0,0 +1,23 @@
+package vfs
+
+import "testing"
+
+func Test_trackShm(t *testing.T) {
+	if trackShm(nil, nil) != nil {
+		t.Error("want nil")
+	}
+
+	// Blocking support is preserved, not added.
+	if shm := NewSharedMemory("test.db-shm", OPEN_MAIN_DB); shm != nil {
+		_, want := shm.(blockingSharedMemory)
+		_, got := trackShm(shm, nil).(blockingSharedMemory)
+		if got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if _, ok := trackShm(nonBlockingShm{}, nil).(blockingSharedMemory); ok {
+		t.Error("want non-blocking")
+	}
+}
+
+type nonBlockingShm struct{ SharedMemory }
@@ -20,6 +20,7 @@ const (
 )
 
 func (f *vfsFile) Lock(lock LockLevel) error {
+	defer func() { f.holder.setLock(f.lock) }()
 	switch {
 	case lock != LOCK_SHARED && lock != LOCK_RESERVED && lock != LOCK_EXCLUSIVE:
 		// Argument check. SQLite never explicitly requests a pending lock.
@@ -85,6 +86,7 @@ func (f *vfsFile) Lock(lock LockLevel) error {
 }
 
 func (f *vfsFile) Unlock(lock LockLevel) error {
+	defer func() { f.holder.setLock(f.lock) }()
 	switch {
 	case lock != LOCK_NONE && lock != LOCK_SHARED:
 		// Argument check.
@@ -0,0 +1,106 @@
+// Package lockdebug serves the locks held by SQLite connections over HTTP.
+//
+// Register its handler with a debug server:
+//
+//	http.HandleFunc("/debug/sqlite/locks", lockdebug.Handler)
+//
+// The handler renders [vfs.LockHolders] as plain text:
+// a line for every file opened by the default VFS in the process,
+// with its file lock, its WAL-index locks, and the connection that opened it.
+// Use the "path" query parameter to show only the files of a database.
+package lockdebug
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// Handler renders the locks held by open files.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	Write(w, vfs.LockHolders(r.FormValue("path")))
+}
+
+// Write renders lock holders as a table.
+func Write(w io.Writer, holders []vfs.LockHolder) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tKIND\tLOCK\tSHM\tCONN")
+	for _, h := range holders {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			h.Path, kind(h.Flags), level(h.Lock),
+			shmLocks(h.ShmShared, h.ShmExclusive), conn(h.DB))
+	}
+	return tw.Flush()
+}
+
+func kind(flags vfs.OpenFlag) string {
+	switch {
+	case flags&vfs.OPEN_MAIN_DB != 0:
+		return "main"
+	case flags&vfs.OPEN_MAIN_JOURNAL != 0:
+		return "journal"
+	case flags&vfs.OPEN_WAL != 0:
+		return "wal"
+	case flags&vfs.OPEN_TEMP_DB != 0:
+		return "temp"
+	case flags&vfs.OPEN_TEMP_JOURNAL != 0:
+		return "temp-journal"
+	case flags&vfs.OPEN_SUBJOURNAL != 0:
+		return "subjournal"
+	case flags&vfs.OPEN_SUPER_JOURNAL != 0:
+		return "super-journal"
+	case flags&vfs.OPEN_TRANSIENT_DB != 0:
+		return "transient"
+	}
+	return "-"
+}
+
+func level(lock vfs.LockLevel) string {
+	switch lock {
+	case vfs.LOCK_NONE:
+		return "NONE"
+	case vfs.LOCK_SHARED:
+		return "SHARED"
+	case vfs.LOCK_RESERVED:
+		return "RESERVED"
+	case vfs.LOCK_PENDING:
+		return "PENDING"
+	case vfs.LOCK_EXCLUSIVE:
+		return "EXCLUSIVE"
+	}
+	return fmt.Sprint(uint32(lock))
+}
+
+var slots = [...]string{"WRITE", "CKPT", "RECOVER", "READ0", "READ1", "READ2", "READ3", "READ4"}
+
+// shmLocks renders WAL-index locks, e.g. "READ0 WRITE!",
+// marking exclusive locks with an exclamation mark.
+func shmLocks(shared, exclusive uint8) string {
+	var locks []string
+	for i, name := range slots {
+		switch {
+		case exclusive&(1<<i) != 0:
+			locks = append(locks, name+"!")
+		case shared&(1<<i) != 0:
+			locks = append(locks, name)
+		}
+	}
+	if locks == nil {
+		return "-"
+	}
+	return strings.Join(locks, " ")
+}
+
+func conn(db any) string {
+	if c, ok := db.(*sqlite3.Conn); ok {
+		return fmt.Sprintf("%p", c)
+	}
+	return "-"
+}
@@ -0,0 +1,150 @@
+package lockdebug_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/lockdebug"
+)
+
+func TestLockHolders(t *testing.T) {
+	if !vfs.SupportsFileLocking || !vfs.SupportsSharedMemory {
+		t.Skip("skipping without locks")
+	}
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	reader := open(t, path)
+	writer := open(t, path)
+	testcfg.Exec(t, writer, `PRAGMA journal_mode=wal`)
+	testcfg.Exec(t, writer, `CREATE TABLE t (x)`)
+
+	// The reader holds a WAL read lock, the writer the WAL write lock.
+	testcfg.Exec(t, reader, `BEGIN`)
+	testcfg.Exec(t, reader, `SELECT * FROM t`)
+	testcfg.Exec(t, writer, `BEGIN IMMEDIATE`)
+
+	var main []vfs.LockHolder
+	for _, h := range vfs.LockHolders(path) {
+		if h.Flags&vfs.OPEN_MAIN_DB != 0 {
+			main = append(main, h)
+		}
+	}
+	if len(main) != 2 {
+		t.Fatalf("got %+v", main)
+	}
+	for _, h := range main {
+		if h.Lock != vfs.LOCK_SHARED {
+			t.Errorf("got lock %v", h.Lock)
+		}
+		switch h.DB {
+		case reader:
+			if h.ShmShared&^1 == 0 || h.ShmExclusive != 0 {
+				t.Errorf("reader got %08b %08b", h.ShmShared, h.ShmExclusive)
+			}
+		case writer:
+			if h.ShmExclusive&1 == 0 {
+				t.Errorf("writer got %08b %08b", h.ShmShared, h.ShmExclusive)
+			}
+		default:
+			t.Errorf("got db %v", h.DB)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(lockdebug.Handler))
+	defer srv.Close()
+	res, err := srv.Client().Get(srv.URL + "?path=" + url.QueryEscape(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(body); !strings.Contains(got, "WRITE!") || !strings.Contains(got, path) {
+		t.Errorf("got %q", got)
+	}
+
+	// WAL locks are released when transactions end
+	// (the database remains SHARED locked in WAL mode),
+	// and handles when connections are closed.
+	testcfg.Exec(t, writer, `COMMIT`)
+	testcfg.Exec(t, reader, `COMMIT`)
+	for _, h := range vfs.LockHolders(path) {
+		if h.Lock > vfs.LOCK_SHARED || h.ShmExclusive&1 != 0 {
+			t.Errorf("got %+v", h)
+		}
+	}
+	reader.Close()
+	writer.Close()
+	if got := vfs.LockHolders(path); len(got) != 0 {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestLockHolders_rollback(t *testing.T) {
+	if !vfs.SupportsFileLocking {
+		t.Skip("skipping without locks")
+	}
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	reader := open(t, path)
+	writer := open(t, path)
+	testcfg.Exec(t, writer, `CREATE TABLE t (x)`)
+
+	locks := func() map[any]vfs.LockLevel {
+		m := map[any]vfs.LockLevel{}
+		for _, h := range vfs.LockHolders(path) {
+			if h.Flags&vfs.OPEN_MAIN_DB != 0 {
+				m[h.DB] = h.Lock
+			}
+		}
+		return m
+	}
+
+	// The reader holds a SHARED lock, the writer a RESERVED lock.
+	testcfg.Exec(t, reader, `BEGIN`)
+	testcfg.Exec(t, reader, `SELECT * FROM t`)
+	testcfg.Exec(t, writer, `BEGIN IMMEDIATE`)
+	testcfg.Exec(t, writer, `INSERT INTO t VALUES (1)`)
+	if got := locks(); got[reader] != vfs.LOCK_SHARED || got[writer] != vfs.LOCK_RESERVED {
+		t.Errorf("got %v", got)
+	}
+
+	// The writer can't commit while the reader holds its lock,
+	// and is left holding a PENDING lock.
+	if err := writer.Exec(`COMMIT`); !errors.Is(err, sqlite3.BUSY) {
+		t.Fatalf("got %v, want BUSY", err)
+	}
+	if got := locks(); got[reader] != vfs.LOCK_SHARED || got[writer] != vfs.LOCK_PENDING {
+		t.Errorf("got %v", got)
+	}
+
+	// Once the reader is done, the writer commits,
+	// and both release their locks.
+	testcfg.Exec(t, reader, `COMMIT`)
+	testcfg.Exec(t, writer, `COMMIT`)
+	if got := locks(); got[reader] != vfs.LOCK_NONE || got[writer] != vfs.LOCK_NONE {
+		t.Errorf("got %v", got)
+	}
+}
+
+func open(t *testing.T, path string) *sqlite3.Conn {
+	t.Helper()
+	db, err := sqlite3.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
@@ -0,0 +1,96 @@
+// Package logvfs wraps an SQLite VFS to store databases in a log.
+//
+// The "log" [vfs.VFS] wraps the default VFS,
+// and never overwrites the pages of main database files in place.
+// Each page write is appended to the tail of a log, made of segment files,
+// and an in-memory page index maps pages to their latest version.
+// Syncs are group commits: they sync every segment written since the last sync.
+// Journals and WAL files are stored as is.
+//
+// A background compactor reclaims the space used by stale pages:
+// once more than half of the log is garbage,
+// live pages are appended to the tail, and old segments are deleted.
+//
+// The page index is rebuilt from the segments when a database is opened,
+// ignoring any record that was torn by a crash.
+//
+// Importing package logvfs registers that VFS,
+// and a wrapper to stack it over other VFSes (e.g. "xts+log"):
+//
+//	import _ "github.com/ncruces/go-sqlite3/vfs/logvfs"
+//
+// For a database "demo.db", the log is stored in a manifest file, "demo.db-log",
+// and segment files: "demo.db-log.000001", "demo.db-log.000002", etc.
+// The database file itself is empty, but still holds the locks.
+//
+// The page index of a database is kept in memory,
+// and shared by all connections in the same process.
+// Connections that open a database through a different base VFS,
+// or with a different segment size, than the first one fail with CANTOPEN.
+// Databases must not be accessed by more than one process at a time.
+package logvfs
+
+import (
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/internal/util"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+func init() {
+	vfs.Register("log", Wrap(vfs.Find(""), DefaultSegmentSize))
+	vfs.RegisterWrapper("log", func(base vfs.VFS) vfs.VFS {
+		return Wrap(base, DefaultSegmentSize)
+	})
+}
+
+// DefaultSegmentSize is the default size of a segment file.
+const DefaultSegmentSize = 16 << 20
+
+// Wrap wraps a base VFS to create a log-structured VFS,
+// starting a new segment file whenever the tail segment
+// reaches the given size.
+func Wrap(base vfs.VFS, segmentSize int64) vfs.VFS {
+	return &logVFS{
+		VFS:         base,
+		segmentSize: max(segmentSize, minSegmentSize),
+	}
+}
+
+const (
+	// FCNTL_STATS is the file control opcode that returns
+	// the [Stats] of the log of a database.
+	//
+	//	stats, err := db.FileControl("main", logvfs.FCNTL_STATS)
+	FCNTL_STATS = sqlite3.FcntlOpcode(util.FCNTL_LOGVFS_STATS)
+
+	// FCNTL_COMPACT is the file control opcode that
+	// compacts the log of a database, and waits for it.
+	//
+	//	_, err := db.FileControl("main", logvfs.FCNTL_COMPACT)
+	FCNTL_COMPACT = sqlite3.FcntlOpcode(util.FCNTL_LOGVFS_COMPACT)
+)
+
+// Stats are the storage and compaction statistics of a log.
+type Stats struct {
+	Segments    int   // segment files in the log
+	LogBytes    int64 // bytes in segment files
+	LiveBytes   int64 // bytes used by live pages
+	Compactions int64 // compactions completed
+	PagesMoved  int64 // live pages rewritten by compactions
+	BytesFreed  int64 // bytes freed by compactions
+}
+
+// GetStats returns the [Stats] of the log of the schema database.
+func GetStats(db *sqlite3.Conn, schema string) (Stats, error) {
+	ret, err := db.FileControl(schema, FCNTL_STATS)
+	if err != nil {
+		return Stats{}, err
+	}
+	return ret.(Stats), nil
+}
+
+// Compact compacts the log of the schema database.
+func Compact(db *sqlite3.Conn, schema string) error {
+	_, err := db.FileControl(schema, FCNTL_COMPACT)
+	return err
+}
@@ -0,0 +1,671 @@
+package logvfs
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"sync"
+
+	"github.com/edofic/go-ordmap/v2"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// The manifest file has two slots, written alternately,
+// so that a torn write never loses the previous version.
+// Each slot has:
+//   - the magic string (16 bytes);
+//   - the generation of the slot (8 bytes, at offset 16);
+//   - the block size (4 bytes, at offset 24);
+//   - the number of the first live segment (4 bytes, at offset 28);
+//   - a random log ID (8 bytes, at offset 32);
+//   - the CRC-32C of the above (4 bytes, at offset 40).
+//
+// Segment files are a sequence of records, each with a header:
+//   - the CRC-32C of the log ID, the rest of the record, and its data (4 bytes);
+//   - the record kind (1 byte, at offset 4);
+//   - the sequence number of the record (8 bytes, at offset 8);
+//   - the block number, for page records,
+//     or the database size, for size records (8 bytes, at offset 16).
+//
+// Page records are followed by the contents of the block.
+// When a log is loaded, records are replayed by sequence number,
+// which compactions preserve when they move page records.
+// Records from a different log ID (e.g. left over from a deleted database)
+// fail the checksum, and are ignored.
+const (
+	magic        = "SQLite log v1\x00\x00\x00"
+	slotSize     = 512
+	manifestSize = 44
+
+	recordHeaderSize = 24
+	kindPage         = 1
+	kindSize         = 2
+
+	defaultBlockSize = 4096
+	minSegmentSize   = 64 * 1024
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// location locates the latest version of a block.
+type location struct {
+	seg uint32
+	off int64
+	seq uint64
+}
+
+type segment struct {
+	id    uint32
+	file  vfs.File
+	size  int64 // bytes in the file
+	live  int64 // bytes used by live page records
+	dirty bool  // written since the last sync
+}
+
+// logDB is the state of a log,
+// shared by all connections in the process.
+type logDB struct {
+	refs int // connections using the log, guarded by logsMtx
+
+	vfs         vfs.VFS
+	name        string
+	flags       vfs.OpenFlag
+	segmentSize int64
+
+	compactMtx sync.Mutex // serializes compactions
+	wake       chan struct{}
+	done       chan struct{}
+	wg         sync.WaitGroup
+
+	mtx       sync.RWMutex
+	manifest  vfs.File                                  // +checklocks:mtx
+	gen       uint64                                    // +checklocks:mtx
+	id        uint64                                    // +checklocks:mtx
+	blockSize int64                                     // +checklocks:mtx
+	size      int64                                     // +checklocks:mtx
+	seq       uint64                                    // +checklocks:mtx
+	index     ordmap.NodeBuiltin[int64, location]       // +checklocks:mtx
+	first     uint32                                    // +checklocks:mtx
+	last      uint32                                    // +checklocks:mtx
+	segs      map[uint32]*segment                       // +checklocks:mtx
+	tail      *segment                                  // +checklocks:mtx
+	block     []byte                                    // +checklocks:mtx
+	record    []byte                                    // +checklocks:mtx
+	counters  struct{ compactions, moved, freed int64 } // +checklocks:mtx
+}
+
+func manifestName(name string) string {
+	return name + "-log"
+}
+
+func segmentName(name string, id uint32) string {
+	return fmt.Sprintf("%s-log.%06d", name, id)
+}
+
+// load reads the manifest of a log, and replays its segments
+// to rebuild the page index.
+func (l *logDB) load() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.first = 1
+	l.segs = map[uint32]*segment{}
+	l.index = ordmap.NewBuiltin[int64, location]()
+
+	name := manifestName(l.name)
+	flags := l.flags
+	if flags&vfs.OPEN_READWRITE != 0 {
+		flags |= vfs.OPEN_CREATE
+	} else if ok, err := l.vfs.Access(name, vfs.ACCESS_EXISTS); err != nil || !ok {
+		return err // A new log.
+	}
+	file, _, err := l.vfs.Open(name, flags)
+	if err != nil {
+		return err
+	}
+	l.manifest = file
+
+	if !l.readManifest() {
+		return nil // A new log.
+	}
+	l.last = l.first - 1
+
+	// Delete segments left over by an interrupted compaction.
+	if flags&vfs.OPEN_READWRITE != 0 {
+		for id := l.first - 1; id > 0; id-- {
+			name := segmentName(l.name, id)
+			if ok, _ := l.vfs.Access(name, vfs.ACCESS_EXISTS); !ok {
+				break
+			}
+			l.vfs.Delete(name, false)
+		}
+	}
+
+	type record struct {
+		kind byte
+		arg  int64
+		loc  location
+	}
+	var records []record
+
+	data := make([]byte, l.blockSize)
+	for id := l.first; ; id++ {
+		name := segmentName(l.name, id)
+		if ok, err := l.vfs.Access(name, vfs.ACCESS_EXISTS); err != nil {
+			return err
+		} else if !ok {
+			break
+		}
+		file, _, err := l.vfs.Open(name, l.flags)
+		if err != nil {
+			return err
+		}
+		size, err := file.Size()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		l.segs[id] = &segment{id: id, file: file, size: size}
+		l.last = id
+
+		// Read records until the end of the segment, or a torn record.
+		r := bufio.NewReaderSize(io.NewSectionReader(file, 0, size), 64*1024)
+		var hdr [recordHeaderSize]byte
+		for off := int64(0); ; {
+			if _, err := io.ReadFull(r, hdr[:]); err != nil {
+				break
+			}
+			kind := hdr[4]
+			if kind != kindPage && kind != kindSize {
+				break
+			}
+			if kind == kindPage {
+				if _, err := io.ReadFull(r, data); err != nil {
+					break
+				}
+			}
+			if binary.LittleEndian.Uint32(hdr[0:]) != l.checksum(hdr[:], data, kind) {
+				break
+			}
+			records = append(records, record{
+				kind: kind,
+				arg:  int64(binary.LittleEndian.Uint64(hdr[16:])),
+				loc: location{
+					seg: id,
+					off: off,
+					seq: binary.LittleEndian.Uint64(hdr[8:]),
+				},
+			})
+			off += l.recordSize(kind)
+		}
+	}
+
+	// Replay records, in order.
+	slices.SortStableFunc(records, func(a, b record) int {
+		return cmp.Compare(a.loc.seq, b.loc.seq)
+	})
+	for _, rec := range records {
+		l.seq = max(l.seq, rec.loc.seq)
+		switch rec.kind {
+		case kindPage:
+			l.index = l.index.Insert(rec.arg, rec.loc)
+		case kindSize:
+			if rec.arg < l.size {
+				l.removeBlocks((rec.arg + l.blockSize - 1) / l.blockSize)
+			}
+			l.size = rec.arg
+		}
+	}
+
+	// Replay removes blocks from segments whose live bytes are unknown,
+	// so compute them from scratch.
+	for _, seg := range l.segs {
+		seg.live = 0
+	}
+	for it := l.index.Iterate(); !it.Done(); it.Next() {
+		l.segs[it.GetValue().seg].live += l.recordSize(kindPage)
+	}
+	return nil
+}
+
+// readManifest reads the latest valid slot of the manifest.
+//
+// +checklocks:l.mtx
+func (l *logDB) readManifest() bool {
+	var found bool
+	var buf [manifestSize]byte
+	for i := range int64(2) {
+		if n, _ := l.manifest.ReadAt(buf[:], i*slotSize); n != len(buf) {
+			continue
+		}
+		if string(buf[:len(magic)]) != magic ||
+			binary.LittleEndian.Uint32(buf[40:]) != crc32.Checksum(buf[:40], castagnoli) {
+			continue
+		}
+		gen := binary.LittleEndian.Uint64(buf[16:])
+		if found && gen < l.gen {
+			continue
+		}
+		blockSize := int64(binary.LittleEndian.Uint32(buf[24:]))
+		if !validBlockSize(blockSize) {
+			continue
+		}
+		found = true
+		l.gen = gen
+		l.blockSize = blockSize
+		l.first = binary.LittleEndian.Uint32(buf[28:])
+		l.id = binary.LittleEndian.Uint64(buf[32:])
+	}
+	return found
+}
+
+// writeManifest writes the next slot of the manifest, and syncs it.
+//
+// +checklocks:l.mtx
+func (l *logDB) writeManifest() error {
+	var buf [manifestSize]byte
+	copy(buf[:], magic)
+	binary.LittleEndian.PutUint64(buf[16:], l.gen+1)
+	binary.LittleEndian.PutUint32(buf[24:], uint32(l.blockSize))
+	binary.LittleEndian.PutUint32(buf[28:], l.first)
+	binary.LittleEndian.PutUint64(buf[32:], l.id)
+	binary.LittleEndian.PutUint32(buf[40:], crc32.Checksum(buf[:40], castagnoli))
+	if _, err := l.manifest.WriteAt(buf[:], int64((l.gen+1)%2)*slotSize); err != nil {
+		return err
+	}
+	if err := l.manifest.Sync(vfs.SYNC_NORMAL); err != nil {
+		return err
+	}
+	l.gen++
+	return nil
+}
+
+// create starts a new log.
+//
+// +checklocks:l.mtx
+func (l *logDB) create(blockSize int64) error {
+	if l.manifest == nil {
+		return sqlite3.READONLY
+	}
+	l.blockSize = blockSize
+	l.id = rand.Uint64()
+	if err := l.writeManifest(); err != nil {
+		l.blockSize = 0
+		return err
+	}
+	return nil
+}
+
+// start starts the background compactor.
+func (l *logDB) start() {
+	l.wake = make(chan struct{}, 1)
+	l.done = make(chan struct{})
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		for {
+			select {
+			case <-l.done:
+				return
+			case <-l.wake:
+				// Errors are retried on the next compaction.
+				l.compact()
+			}
+		}
+	}()
+}
+
+// close stops the background compactor, and closes all files.
+func (l *logDB) close() {
+	if l.done != nil {
+		close(l.done)
+		l.wg.Wait()
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for _, seg := range l.segs {
+		seg.file.Close()
+	}
+	if l.manifest != nil {
+		l.manifest.Close()
+	}
+}
+
+func (l *logDB) recordSize(kind byte) int64 {
+	if kind == kindPage {
+		return recordHeaderSize + l.blockSize
+	}
+	return recordHeaderSize
+}
+
+func (l *logDB) checksum(hdr, data []byte, kind byte) uint32 {
+	var id [8]byte
+	binary.LittleEndian.PutUint64(id[:], l.id)
+	crc := crc32.Update(0, castagnoli, id[:])
+	crc = crc32.Update(crc, castagnoli, hdr[4:recordHeaderSize])
+	if kind == kindPage {
+		crc = crc32.Update(crc, castagnoli, data)
+	}
+	return crc
+}
+
+// append appends a record to the tail of the log.
+//
+// +checklocks:l.mtx
+func (l *logDB) append(kind byte, seq uint64, arg int64, data []byte) (location, error) {
+	if l.tail == nil || l.tail.size >= l.segmentSize {
+		if err := l.roll(); err != nil {
+			return location{}, err
+		}
+	}
+
+	size := l.recordSize(kind)
+	if int64(len(l.record)) < size {
+		l.record = make([]byte, size)
+	}
+	rec := l.record[:size]
+	clear(rec[:recordHeaderSize])
+	rec[4] = kind
+	binary.LittleEndian.PutUint64(rec[8:], seq)
+	binary.LittleEndian.PutUint64(rec[16:], uint64(arg))
+	if kind == kindPage {
+		copy(rec[recordHeaderSize:], data)
+	}
+	binary.LittleEndian.PutUint32(rec[0:], l.checksum(rec, data, kind))
+
+	tail := l.tail
+	if _, err := tail.file.WriteAt(rec, tail.size); err != nil {
+		return location{}, err
+	}
+	loc := location{seg: tail.id, off: tail.size, seq: seq}
+	tail.size += size
+	tail.dirty = true
+	return loc, nil
+}
+
+// roll starts a new tail segment.
+//
+// +checklocks:l.mtx
+func (l *logDB) roll() error {
+	id := l.last + 1
+	file, _, err := l.vfs.Open(segmentName(l.name, id), l.flags|vfs.OPEN_CREATE)
+	if err != nil {
+		return err
+	}
+	// Discard a segment left over from a deleted database.
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return err
+	}
+	l.tail = &segment{id: id, file: file}
+	l.segs[id] = l.tail
+	l.last = id
+	return nil
+}
+
+// readBlock reads part of a block, starting at off.
+// Blocks that were never written read as zeros.
+//
+// +checklocksread:l.mtx
+func (l *logDB) readBlock(p []byte, block, off int64) error {
+	loc, ok := l.index.Get(block)
+	if !ok {
+		clear(p)
+		return nil
+	}
+	seg := l.segs[loc.seg]
+	if n, err := seg.file.ReadAt(p, loc.off+recordHeaderSize+off); n != len(p) {
+		if err == nil || err == io.EOF {
+			err = sqlite3.CORRUPT
+		}
+		return err
+	}
+	return nil
+}
+
+// writeBlock appends a new version of a block.
+//
+// +checklocks:l.mtx
+func (l *logDB) writeBlock(block int64, data []byte) error {
+	l.seq++
+	loc, err := l.append(kindPage, l.seq, block, data)
+	if err != nil {
+		return err
+	}
+	l.setLocation(block, loc)
+	return nil
+}
+
+// setLocation updates the page index, and live page accounting.
+//
+// +checklocks:l.mtx
+func (l *logDB) setLocation(block int64, loc location) {
+	size := l.recordSize(kindPage)
+	if old, ok := l.index.Get(block); ok {
+		l.segs[old.seg].live -= size
+	}
+	l.segs[loc.seg].live += size
+	l.index = l.index.Insert(block, loc)
+}
+
+// removeBlocks removes blocks past n from the page index.
+//
+// +checklocks:l.mtx
+func (l *logDB) removeBlocks(n int64) {
+	var remove []int64
+	for it := l.index.Iterate(); !it.Done(); it.Next() {
+		if block := it.GetKey(); block >= n {
+			remove = append(remove, block)
+		}
+	}
+	size := l.recordSize(kindPage)
+	for _, block := range remove {
+		loc, _ := l.index.Get(block)
+		if seg := l.segs[loc.seg]; seg != nil {
+			seg.live -= size
+		}
+		l.index = l.index.Remove(block)
+	}
+}
+
+// setSize appends a record with the size of the database.
+//
+// +checklocks:l.mtx
+func (l *logDB) setSize(size int64) error {
+	l.seq++
+	if _, err := l.append(kindSize, l.seq, size, nil); err != nil {
+		return err
+	}
+	l.size = size
+	return nil
+}
+
+// sync syncs every segment written since the last sync,
+// and wakes the compactor if there's enough garbage.
+func (l *logDB) sync(flags vfs.SyncFlag) error {
+	l.mtx.Lock()
+	err := l.syncSegments(flags)
+	compact := err == nil && l.garbage()
+	l.mtx.Unlock()
+
+	if compact {
+		select {
+		case l.wake <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// +checklocks:l.mtx
+func (l *logDB) syncSegments(flags vfs.SyncFlag) error {
+	for _, seg := range l.segs {
+		if seg.dirty {
+			if err := seg.file.Sync(flags); err != nil {
+				return err
+			}
+			seg.dirty = false
+		}
+	}
+	return nil
+}
+
+// garbage reports if more than half the log is garbage.
+//
+// +checklocksread:l.mtx
+func (l *logDB) garbage() bool {
+	var size, live int64
+	for _, seg := range l.segs {
+		size += seg.size
+		live += seg.live
+	}
+	garbage := size - live
+	return garbage > size/2 && garbage >= l.segmentSize
+}
+
+// compact moves the live pages of every segment before the tail
+// to a new tail, and then deletes those segments.
+//
+// Moved pages keep their sequence numbers,
+// so replaying the log is unaffected
+// if the process crashes before segments are deleted.
+func (l *logDB) compact() error {
+	l.compactMtx.Lock()
+	defer l.compactMtx.Unlock()
+
+	l.mtx.Lock()
+	if l.tail == nil {
+		l.mtx.Unlock()
+		return nil
+	}
+	if err := l.roll(); err != nil {
+		l.mtx.Unlock()
+		return err
+	}
+	victims := l.tail.id
+	// Size records in deleted segments are replaced by this one.
+	// It must precede any size change made while pages are moved:
+	// replaying a shrink removes blocks only past the previous size.
+	if err := l.setSize(l.size); err != nil {
+		l.mtx.Unlock()
+		return err
+	}
+	index := l.index
+	data := make([]byte, l.blockSize)
+	l.mtx.Unlock()
+
+	// Segments before the tail are not written to,
+	// and only compactions delete them,
+	// so they can be read without holding the lock.
+	var moved int64
+	for it := index.Iterate(); !it.Done(); it.Next() {
+		block, loc := it.GetKey(), it.GetValue()
+		if loc.seg >= victims {
+			continue
+		}
+
+		l.mtx.RLock()
+		seg := l.segs[loc.seg]
+		l.mtx.RUnlock()
+		if n, err := seg.file.ReadAt(data, loc.off+recordHeaderSize); n != len(data) {
+			if err == nil || err == io.EOF {
+				err = sqlite3.CORRUPT
+			}
+			return err
+		}
+
+		l.mtx.Lock()
+		// Skip blocks that were rewritten, or removed, meanwhile.
+		if cur, ok := l.index.Get(block); ok && cur == loc {
+			loc, err := l.append(kindPage, loc.seq, block, data)
+			if err != nil {
+				l.mtx.Unlock()
+				return err
+			}
+			l.setLocation(block, loc)
+			moved++
+		}
+		l.mtx.Unlock()
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if err := l.syncSegments(vfs.SYNC_NORMAL); err != nil {
+		return err
+	}
+	first := l.first
+	l.first = victims
+	if err := l.writeManifest(); err != nil {
+		l.first = first
+		return err
+	}
+
+	var freed int64
+	for id := first; id < victims; id++ {
+		if seg := l.segs[id]; seg != nil {
+			seg.file.Close()
+			freed += seg.size
+			delete(l.segs, id)
+		}
+		l.vfs.Delete(segmentName(l.name, id), false)
+	}
+	l.counters.compactions++
+	l.counters.moved += moved
+	l.counters.freed += freed
+	return nil
+}
+
+func (l *logDB) stats() Stats {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	stats := Stats{
+		Segments:    len(l.segs),
+		Compactions: l.counters.compactions,
+		PagesMoved:  l.counters.moved,
+		BytesFreed:  l.counters.freed,
+	}
+	for _, seg := range l.segs {
+		stats.LogBytes += seg.size
+		stats.LiveBytes += seg.live
+	}
+	return stats
+}
+
+// deleteLog deletes the manifest and segments of a log.
+func deleteLog(base vfs.VFS, name string, syncDir bool) error {
+	l := logDB{vfs: base, name: name, flags: vfs.OPEN_MAIN_JOURNAL | vfs.OPEN_READONLY}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.first = 1
+	file, _, err := base.Open(manifestName(name), l.flags)
+	if err == nil {
+		l.manifest = file
+		l.readManifest()
+		file.Close()
+	}
+
+	if err := base.Delete(manifestName(name), syncDir); err != nil {
+		return err
+	}
+	for id := l.first; ; id++ {
+		name := segmentName(name, id)
+		if ok, _ := base.Access(name, vfs.ACCESS_EXISTS); !ok {
+			break
+		}
+		if err := base.Delete(name, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package logvfs
+
+import (
+	"io"
+	"sync"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+type logVFS struct {
+	vfs.VFS
+	segmentSize int64
+}
+
+// Logs are shared by every log-structured VFS, keyed by name,
+// so that all connections to a database see the same page index.
+// Later connections must use the same base VFS and segment size.
+var (
+	logsMtx sync.Mutex
+	// +checklocks:logsMtx
+	logs = map[string]*logDB{}
+)
+
+func (l *logVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	file, flags, err := l.VFS.Open(name, flags)
+	return l.wrap(file, name, flags, err)
+}
+
+func (l *logVFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	file, flags, err := vfsutil.WrapOpenFilename(l.VFS, name, flags)
+	return l.wrap(file, name.String(), flags, err)
+}
+
+func (l *logVFS) wrap(file vfs.File, name string, flags vfs.OpenFlag, err error) (vfs.File, vfs.OpenFlag, error) {
+	// Log only main databases.
+	if err != nil || flags&vfs.OPEN_MAIN_DB == 0 || flags&vfs.OPEN_MEMORY != 0 || name == "" {
+		return file, flags, err
+	}
+
+	log, err := l.acquire(name, flags)
+	if err != nil {
+		file.Close()
+		return nil, flags, err
+	}
+	return &logFile{
+		WrappedFile: vfsutil.WrappedFile{File: file},
+		log:         log,
+	}, flags, nil
+}
+
+// acquire returns the shared state of a log,
+// loading it if needed.
+func (l *logVFS) acquire(name string, flags vfs.OpenFlag) (*logDB, error) {
+	logsMtx.Lock()
+	defer logsMtx.Unlock()
+
+	log := logs[name]
+	if log == nil {
+		log = &logDB{
+			vfs:         l.VFS,
+			name:        name,
+			flags:       flags&^(vfs.OPEN_MAIN_DB|vfs.OPEN_EXCLUSIVE|vfs.OPEN_DELETEONCLOSE) | vfs.OPEN_MAIN_JOURNAL,
+			segmentSize: l.segmentSize,
+		}
+		if err := log.load(); err != nil {
+			log.close()
+			return nil, err
+		}
+		log.start()
+		logs[name] = log
+	} else if log.vfs != l.VFS || log.segmentSize != l.segmentSize {
+		return nil, sqlite3.CANTOPEN
+	}
+	log.refs++
+	return log, nil
+}
+
+func release(log *logDB) {
+	logsMtx.Lock()
+	defer logsMtx.Unlock()
+
+	if log.refs--; log.refs == 0 {
+		delete(logs, log.name)
+		log.close()
+	}
+}
+
+func (l *logVFS) Delete(name string, syncDir bool) error {
+	// Delete the manifest first: without it,
+	// any remaining segment files are ignored.
+	if ok, _ := l.VFS.Access(manifestName(name), vfs.ACCESS_EXISTS); ok {
+		if err := deleteLog(l.VFS, name, syncDir); err != nil {
+			return err
+		}
+	}
+	return l.VFS.Delete(name, syncDir)
+}
+
+type logFile struct {
+	vfsutil.WrappedFile
+	log *logDB
+}
+
+func (f *logFile) Close() error {
+	release(f.log)
+	return f.File.Close()
+}
+
+func (f *logFile) Size() (int64, error) {
+	f.log.mtx.RLock()
+	defer f.log.mtx.RUnlock()
+	return f.log.size, nil
+}
+
+func (f *logFile) ReadAt(p []byte, off int64) (n int, err error) {
+	log := f.log
+	log.mtx.RLock()
+	defer log.mtx.RUnlock()
+
+	end := min(off+int64(len(p)), log.size)
+	for pos := off; pos < end; {
+		block := pos / log.blockSize
+		start := pos - block*log.blockSize
+		i := int(min(end-pos, log.blockSize-start))
+		if err := log.readBlock(p[n:n+i], block, start); err != nil {
+			return n, err
+		}
+		pos += int64(i)
+		n += i
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *logFile) WriteAt(p []byte, off int64) (n int, err error) {
+	log := f.log
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+
+	if log.blockSize == 0 {
+		// The first write to a database is usually its first page,
+		// so use the page size as the block size.
+		size := int64(len(p))
+		if off != 0 || !validBlockSize(size) {
+			size = defaultBlockSize
+		}
+		if err := log.create(size); err != nil {
+			return 0, err
+		}
+	}
+
+	bs := log.blockSize
+	for n < len(p) {
+		pos := off + int64(n)
+		block := pos / bs
+		start := pos - block*bs
+		i := int(min(int64(len(p)-n), bs-start))
+
+		var data []byte
+		if start == 0 && int64(i) == bs {
+			data = p[n : n+i]
+		} else {
+			// Partial block write: read-update-write.
+			if log.block == nil {
+				log.block = make([]byte, bs)
+			}
+			if err := log.readBlock(log.block, block, 0); err != nil {
+				return n, err
+			}
+			copy(log.block[start:], p[n:n+i])
+			data = log.block
+		}
+
+		if err := log.writeBlock(block, data); err != nil {
+			return n, err
+		}
+		n += i
+	}
+
+	if end := off + int64(n); end > log.size {
+		return n, log.setSize(end)
+	}
+	return n, nil
+}
+
+func (f *logFile) Truncate(size int64) error {
+	log := f.log
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+
+	if size == log.size {
+		return nil
+	}
+	if log.blockSize == 0 {
+		if err := log.create(defaultBlockSize); err != nil {
+			return err
+		}
+	}
+
+	if size < log.size {
+		bs := log.blockSize
+		block := size / bs
+		if rest := size - block*bs; rest != 0 {
+			// Zero the tail of the last block.
+			if log.block == nil {
+				log.block = make([]byte, bs)
+			}
+			if err := log.readBlock(log.block, block, 0); err != nil {
+				return err
+			}
+			clear(log.block[rest:])
+			if err := log.writeBlock(block, log.block); err != nil {
+				return err
+			}
+			block++
+		}
+		log.removeBlocks(block)
+	}
+	return log.setSize(size)
+}
+
+func (f *logFile) Sync(flags vfs.SyncFlag) error {
+	if err := f.File.Sync(flags); err != nil {
+		return err
+	}
+	return f.log.sync(flags)
+}
+
+func (f *logFile) CustomControl(op uint32, arg any) (any, error) {
+	switch op {
+	case uint32(FCNTL_STATS):
+		return f.log.stats(), nil
+	case uint32(FCNTL_COMPACT):
+		return nil, f.log.compact()
+	}
+	return f.WrappedFile.CustomControl(op, arg)
+}
+
+func (f *logFile) DeviceCharacteristics() vfs.DeviceCharacteristic {
+	return f.File.DeviceCharacteristics() & (0 |
+		// These flags are safe:
+		vfs.IOCAP_IMMUTABLE |
+		vfs.IOCAP_SUBPAGE_READ |
+		vfs.IOCAP_POWERSAFE_OVERWRITE |
+		vfs.IOCAP_UNDELETABLE_WHEN_OPEN)
+}
+
+func (f *logFile) ChunkSize(size int) {
+	// The database file is empty.
+}
+
+func (f *logFile) SizeHint(size int64) error {
+	// Segment files are not preallocated.
+	return nil
+}
+
+func validBlockSize(size int64) bool {
+	return 512 <= size && size <= 65536 && size&(size-1) == 0
+}
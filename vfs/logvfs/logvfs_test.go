@@ -0,0 +1,281 @@
+package logvfs_test
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/faultvfs"
+	"github.com/ncruces/go-sqlite3/vfs/logvfs"
+	"github.com/ncruces/go-sqlite3/vfs/vfstest"
+)
+
+const segmentSize = 64 * 1024
+
+func Test_vfstest(t *testing.T) {
+	if !vfs.SupportsFileLocking {
+		t.Skip("skipping without locks")
+	}
+	vfstest.Test(t, logvfs.Wrap(vfs.Find(""), segmentSize), nil)
+}
+
+func TestLog(t *testing.T) {
+	vfs.Register("log-small", logvfs.Wrap(vfs.Find(""), segmentSize))
+	defer vfs.Unregister("log-small")
+
+	for _, mode := range []string{"delete", "wal"} {
+		t.Run(mode, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			uri := "file:" + filepath.ToSlash(path) + "?vfs=log-small"
+
+			db, err := sqlite3.Open(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			// Cold pages are written once, and spread across segments.
+			// A hot page is rewritten by every transaction.
+			testcfg.Exec(t, db, `PRAGMA journal_mode=`+mode)
+			testcfg.Exec(t, db, `CREATE TABLE cold (id INTEGER PRIMARY KEY, data BLOB)`)
+			testcfg.Exec(t, db, `CREATE TABLE hot (id INTEGER PRIMARY KEY, n INTEGER)`)
+			testcfg.Exec(t, db, `INSERT INTO cold (data) SELECT randomblob(4000) FROM generate_series(1, 50)`)
+			testcfg.Exec(t, db, `INSERT INTO hot VALUES (1, 0)`)
+			testcfg.Exec(t, db, `PRAGMA wal_checkpoint`)
+			if _, err := os.Stat(path + "-log.000003"); err != nil {
+				t.Error(err)
+			}
+			for i := range 200 {
+				testcfg.Exec(t, db, `UPDATE hot SET n = n + 1`)
+				if i%20 == 0 {
+					testcfg.Exec(t, db, `PRAGMA wal_checkpoint`)
+				}
+			}
+			testcfg.Exec(t, db, `DELETE FROM cold WHERE id % 5 = 0`)
+			testcfg.Exec(t, db, `PRAGMA wal_checkpoint(TRUNCATE)`)
+
+			// Pages are stored in the log, not the database file.
+			if fi, err := os.Stat(path); err != nil {
+				t.Fatal(err)
+			} else if fi.Size() != 0 {
+				t.Errorf("got database size %d", fi.Size())
+			}
+
+			if err := logvfs.Compact(db, "main"); err != nil {
+				t.Fatal(err)
+			}
+			stats, err := logvfs.GetStats(db, "main")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Compactions == 0 || stats.BytesFreed == 0 {
+				t.Errorf("got %+v", stats)
+			}
+			if stats.LiveBytes > stats.LogBytes {
+				t.Errorf("got %+v", stats)
+			}
+			// Compaction moved cold pages out of the first segment.
+			if _, err := os.Stat(path + "-log.000001"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("got %v", err)
+			}
+			pages := testcfg.Query(t, db, `PRAGMA page_count`)
+			if want := fmt.Sprint(stats.LiveBytes / (4096 + 24)); want != pages {
+				t.Errorf("got %s live pages, want %s", want, pages)
+			}
+
+			// The index is rebuilt when reopening.
+			db.Close()
+			db, err = sqlite3.Open(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if got := testcfg.Query(t, db, `SELECT count(*) || ':' || n FROM cold, hot GROUP BY n`); got != "40:200" {
+				t.Errorf("got %s", got)
+			}
+			if err := faultvfs.IntegrityCheck(db); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLog_shrink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	uri := "file:" + filepath.ToSlash(path) + "?vfs=log"
+
+	db, err := sqlite3.Open(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	testcfg.Exec(t, db, `CREATE TABLE t (id INTEGER PRIMARY KEY, data BLOB)`)
+	testcfg.Exec(t, db, `
+		WITH RECURSIVE c(n) AS (SELECT 1 UNION ALL SELECT n+1 FROM c WHERE n < 500)
+		INSERT INTO t (data) SELECT randomblob(1000) FROM c`)
+	testcfg.Exec(t, db, `DELETE FROM t WHERE id > 10`)
+	testcfg.Exec(t, db, `VACUUM`)
+
+	// Live bytes are rebuilt when reopening a shrunk database.
+	for range 2 {
+		stats, err := logvfs.GetStats(db, "main")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages := testcfg.Query(t, db, `PRAGMA page_count`)
+		if want := fmt.Sprint(stats.LiveBytes / (4096 + 24)); want != pages {
+			t.Errorf("got %+v, want %s pages", stats, pages)
+		}
+
+		db.Close()
+		db, err = sqlite3.Open(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+	}
+	if got := testcfg.Query(t, db, `SELECT count(*) FROM t`); got != "10" {
+		t.Errorf("got %s rows", got)
+	}
+	if err := faultvfs.IntegrityCheck(db); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLog_shared(t *testing.T) {
+	vfs.Register("log-shared", logvfs.Wrap(vfs.Find(""), logvfs.DefaultSegmentSize))
+	defer vfs.Unregister("log-shared")
+	vfs.Register("log-other", logvfs.Wrap(vfs.Find(""), segmentSize))
+	defer vfs.Unregister("log-other")
+
+	// Connections using log-structured VFSes
+	// with the same base and segment size share a page index.
+	path := "file:" + filepath.ToSlash(filepath.Join(t.TempDir(), "test.db"))
+	db1, err := sqlite3.Open(path + "?vfs=log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db1.Close()
+	db2, err := sqlite3.Open(path + "?vfs=log-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+
+	for i := range 10 {
+		db := db1
+		if i%2 != 0 {
+			db = db2
+		}
+		err := db.Exec(`
+			CREATE TABLE IF NOT EXISTS t (x);
+			INSERT INTO t SELECT hex(randomblob(500)) FROM generate_series(1, 100);`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, db := range []*sqlite3.Conn{db1, db2} {
+		if err := faultvfs.IntegrityCheck(db); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// A different segment size can't share it.
+	db3, err := sqlite3.Open(path + "?vfs=log-other")
+	if err == nil {
+		db3.Close()
+		t.Fatal("want error")
+	}
+	if !errors.Is(err, sqlite3.CANTOPEN) {
+		t.Errorf("got %v, want CANTOPEN", err)
+	}
+}
+
+func TestLog_delete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := sqlite3.Open("file:" + filepath.ToSlash(path) + "?vfs=log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcfg.Exec(t, db, `CREATE TABLE t (x)`)
+	testcfg.Exec(t, db, `INSERT INTO t VALUES ('hello')`)
+	db.Close()
+
+	// Deleting the database deletes its log.
+	if err := vfs.Find("log").Delete(path, false); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("got %v", matches)
+	}
+}
+
+func TestLog_crash(t *testing.T) {
+	dir := t.TempDir()
+
+	for point := 0; ; point++ {
+		faults := faultvfs.Wrap(vfs.Find(""))
+		name := fmt.Sprintf("log-crash-%d", point)
+		vfs.Register(name, logvfs.Wrap(faults, segmentSize))
+		defer vfs.Unregister(name)
+
+		uri := "file:" + filepath.ToSlash(filepath.Join(dir, name+".db")) + "?vfs=" + name
+		db, err := sqlite3.Open(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testcfg.Exec(t, db, `PRAGMA synchronous=full`)
+		testcfg.Exec(t, db, `CREATE TABLE cold (id INTEGER PRIMARY KEY, data BLOB)`)
+		testcfg.Exec(t, db, `CREATE TABLE hot (id INTEGER PRIMARY KEY, n INTEGER)`)
+		testcfg.Exec(t, db, `INSERT INTO cold (data) SELECT zeroblob(4000) FROM generate_series(1, 30)`)
+		testcfg.Exec(t, db, `INSERT INTO hot VALUES (1, 0)`)
+
+		// Crash while rewriting the hot page, and compacting.
+		faults.Inject(faultvfs.Fault{Op: faultvfs.OpSync, Kind: faultvfs.PowerLoss, After: point})
+		for i := range 4 {
+			err = db.Exec(`UPDATE hot SET n = n + 1`)
+			if err == nil && i == 1 {
+				err = logvfs.Compact(db, "main")
+			}
+			if err != nil {
+				break
+			}
+		}
+		db.Close()
+		if faults.Fired() == 0 {
+			if point == 0 {
+				t.Fatal("no sync points")
+			}
+			break
+		}
+		faults.Recover()
+
+		db, err = sqlite3.Open(uri)
+		if err != nil {
+			t.Fatalf("point %d: %v", point, err)
+		}
+		if err := faultvfs.IntegrityCheck(db); err != nil {
+			t.Errorf("point %d: %v", point, err)
+		}
+		if got := testcfg.Query(t, db, `SELECT count(*) FROM cold WHERE data = zeroblob(4000)`); got != "30" {
+			t.Errorf("point %d: got %s blobs", point, got)
+		}
+		if got := testcfg.Query(t, db, `SELECT count(*) FROM hot WHERE n BETWEEN 0 AND 4`); got != "1" {
+			t.Errorf("point %d: got %s hot rows", point, got)
+		}
+		db.Close()
+	}
+}
@@ -3,6 +3,8 @@
 // The "memdb" [vfs.VFS] allows the same in-memory database to be shared
 // among multiple database connections in the same process,
 // as long as the database name begins with "/".
+// Shared databases also support WAL mode,
+// keeping the WAL file and WAL-index in memory.
 //
 // Importing package memdb registers the VFS:
 //
@@ -37,17 +39,10 @@ func Create(name string, data []byte) {
 	defer memoryMtx.Unlock()
 
 	db := &memDB{
-		refs: 1,
-		name: name,
-		size: int64(len(data)),
-	}
-
-	// Convert data from WAL/2 to rollback journal.
-	if len(data) >= 20 && (false ||
-		data[18] == 2 && data[19] == 2 ||
-		data[18] == 3 && data[19] == 3) {
-		data[18] = 1
-		data[19] = 1
+		refs:    1,
+		created: true,
+		name:    name,
+		size:    int64(len(data)),
 	}
 
 	sectors := divRoundUp(db.size, sectorSize)
@@ -61,7 +56,10 @@ func Create(name string, data []byte) {
 			copy((*db.data[i])[:], sector)
 		}
 	}
+	// Initial contents are accounted for, but don't count against the limit.
+	memoryUsed.Add(sectors * sectorSize)
 
+	unlink(name)
 	memoryDBs[name] = db
 }
 
@@ -69,7 +67,24 @@ func Create(name string, data []byte) {
 func Delete(name string) {
 	memoryMtx.Lock()
 	defer memoryMtx.Unlock()
+	unlink(name)
+}
+
+// unlink removes a shared memory database from the registry,
+// dropping the reference from Create.
+// Open connections keep using the database until they're closed.
+//
+// +checklocks:memoryMtx
+func unlink(name string) {
+	db := memoryDBs[name]
+	if db == nil {
+		return
+	}
 	delete(memoryDBs, name)
+	if db.created {
+		db.created = false
+		db.unref()
+	}
 }
 
 // TestDB creates an empty shared memory database for the test to use.
@@ -0,0 +1,98 @@
+package memdb
+
+import (
+	"cmp"
+	"slices"
+	"sync/atomic"
+
+	"github.com/ncruces/go-sqlite3"
+)
+
+var (
+	memoryUsed  atomic.Int64
+	memoryLimit atomic.Int64
+)
+
+// SetMemoryLimit limits the memory used by all memdb databases
+// (shared or not) to limit bytes, and returns the previous limit.
+// A zero or negative limit means no limit.
+//
+// Writes that would exceed the limit fail with [sqlite3.FULL].
+// Memory is released when a database is truncated,
+// or deleted and all its connections closed.
+// Initial contents given to [Create] count against the limit,
+// but never fail.
+func SetMemoryLimit(limit int64) int64 {
+	return memoryLimit.Swap(limit)
+}
+
+// MemoryInUse returns the memory used by all memdb databases.
+func MemoryInUse() int64 {
+	return memoryUsed.Load()
+}
+
+// SetSizeLimit limits the size of a shared memory database
+// to limit bytes.
+// A zero or negative limit means no limit.
+//
+// Writes that would grow the database past the limit
+// fail with [sqlite3.FULL].
+// The limit applies to the database file, not to its WAL file,
+// which is only bound by [SetMemoryLimit].
+func SetSizeLimit(name string, limit int64) error {
+	memoryMtx.Lock()
+	db := memoryDBs[name]
+	memoryMtx.Unlock()
+	if db == nil {
+		return sqlite3.CANTOPEN
+	}
+
+	db.dataMtx.Lock()
+	defer db.dataMtx.Unlock()
+	db.limit = limit
+	return nil
+}
+
+// DBInfo describes a shared memory database.
+type DBInfo struct {
+	Name      string
+	Refs      int   // Open connections, plus one if created with Create.
+	Size      int64 // The size of the database file.
+	SizeLimit int64 // The limit set with SetSizeLimit.
+}
+
+// Databases lists the shared memory databases, sorted by name.
+//
+// Databases that are never deleted are a common source of leaks:
+// those are listed until deleted, even with no open connections.
+func Databases() []DBInfo {
+	memoryMtx.Lock()
+	defer memoryMtx.Unlock()
+
+	dbs := make([]DBInfo, 0, len(memoryDBs))
+	for name, db := range memoryDBs {
+		db.dataMtx.RLock()
+		dbs = append(dbs, DBInfo{
+			Name:      name,
+			Refs:      int(db.refs),
+			Size:      db.size,
+			SizeLimit: db.limit,
+		})
+		db.dataMtx.RUnlock()
+	}
+	slices.SortFunc(dbs, func(a, b DBInfo) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return dbs
+}
+
+// reserve accounts for n more bytes,
+// unless that would exceed the memory limit.
+func reserve(n int64) bool {
+	limit := memoryLimit.Load()
+	if memoryUsed.Add(n) <= limit || limit <= 0 {
+		return true
+	}
+	memoryUsed.Add(-n)
+	return false
+}
@@ -0,0 +1,111 @@
+package memdb
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+)
+
+func TestSetSizeLimit(t *testing.T) {
+	Create("size_limit.db", nil)
+	defer Delete("size_limit.db")
+
+	if err := SetSizeLimit("size_limit.db", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetSizeLimit("missing.db", 1<<20); !errors.Is(err, sqlite3.CANTOPEN) {
+		t.Errorf("got %v, want CANTOPEN", err)
+	}
+
+	db, err := sqlite3.Open("file:/size_limit.db?vfs=memdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Exec(`CREATE TABLE t (x)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec(`INSERT INTO t VALUES (zeroblob(100000))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec(`INSERT INTO t VALUES (zeroblob(1000000))`)
+	if !errors.Is(err, sqlite3.FULL) {
+		t.Errorf("got %v, want FULL", err)
+	}
+
+	dbs := Databases()
+	for _, info := range dbs {
+		if info.Name == "size_limit.db" {
+			if info.Refs != 2 {
+				t.Errorf("got %d refs, want 2", info.Refs)
+			}
+			if info.SizeLimit != 1<<20 || info.Size > 1<<20 || info.Size < 100000 {
+				t.Errorf("got %+v", info)
+			}
+			return
+		}
+	}
+	t.Errorf("database not listed: %v", dbs)
+}
+
+func TestSetMemoryLimit(t *testing.T) {
+	defer SetMemoryLimit(SetMemoryLimit(MemoryInUse() + 1<<20))
+
+	Create("memory_limit.db", nil)
+	db, err := sqlite3.Open("file:/memory_limit.db?vfs=memdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Exec(`CREATE TABLE t (x)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec(`INSERT INTO t VALUES (zeroblob(2000000))`)
+	if !errors.Is(err, sqlite3.FULL) {
+		t.Errorf("got %v, want FULL", err)
+	}
+
+	// Deleting the database releases its memory.
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := MemoryInUse()
+	Delete("memory_limit.db")
+	if MemoryInUse() >= used {
+		t.Error("memory was not released")
+	}
+}
+
+func TestMemoryInUse(t *testing.T) {
+	used := MemoryInUse()
+
+	db, err := sqlite3.Open("file:private.db?vfs=memdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Exec(`CREATE TABLE t (x); INSERT INTO t VALUES (zeroblob(1000000));`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if MemoryInUse() <= used {
+		t.Error("memory was not accounted for")
+	}
+
+	// Closing a private database releases its memory.
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := MemoryInUse(); got != used {
+		t.Errorf("got %d, want %d", got, used)
+	}
+}
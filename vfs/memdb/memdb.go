@@ -3,6 +3,7 @@ package memdb
 import (
 	"io"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,19 +19,18 @@ var _ [0]struct{} = [sectorSize & 65535]struct{}{}
 type memVFS struct{}
 
 func (memVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
-	// For simplicity, we do not support reading or writing data
-	// across "sector" boundaries.
-	//
-	// This is not a problem for most SQLite file types:
+	// We support these SQLite file types:
 	// - databases, which only do page aligned reads/writes;
 	// - temp journals, as used by the sorter, which does the same:
 	//   https://github.com/sqlite/sqlite/blob/b74eb0/src/vdbesort.c#L409-L412
+	// - WAL files of shared databases, which do unaligned reads/writes.
 	//
 	// We refuse to open all other file types,
 	// but returning OPEN_MEMORY means SQLite won't ask us to.
 	const types = vfs.OPEN_MAIN_DB |
 		vfs.OPEN_TEMP_DB |
-		vfs.OPEN_TEMP_JOURNAL
+		vfs.OPEN_TEMP_JOURNAL |
+		vfs.OPEN_WAL
 	if flags&types == 0 {
 		// notest // OPEN_MEMORY
 		return nil, flags, sqlite3.CANTOPEN
@@ -39,6 +39,14 @@ func (memVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, err
 	// A shared database has a name that begins with "/".
 	shared := len(name) > 1 && name[0] == '/'
 
+	if flags&vfs.OPEN_WAL != 0 {
+		// WAL files belong to a shared database.
+		if !shared {
+			return nil, flags, sqlite3.CANTOPEN
+		}
+		return openWAL(name[1:], flags)
+	}
+
 	var db *memDB
 	if shared {
 		name = name[1:]
@@ -50,24 +58,79 @@ func (memVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, err
 		if flags&vfs.OPEN_CREATE == 0 {
 			return nil, flags, sqlite3.CANTOPEN
 		}
-		db = &memDB{name: name}
+		db = newMemDB(name)
 	}
-	if shared {
+	file := &memFile{
+		memDB:    db,
+		readOnly: flags&vfs.OPEN_READONLY != 0,
+	}
+	if !shared {
+		db.refs = 1 // +checklocksignore: db is not shared
+	} else {
 		db.refs++ // +checklocksforce: memoryMtx is held
 		memoryDBs[name] = db
+		// Connections to the same database share the WAL-index.
+		if flags&vfs.OPEN_MAIN_DB != 0 {
+			file.shm = vfs.NewMemorySharedMemory(db)
+		}
 	}
+	return file, flags | vfs.OPEN_MEMORY, nil
+}
+
+// openWAL opens the WAL file of a shared database.
+// The WAL is kept with the database, until SQLite deletes it.
+func openWAL(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	memoryMtx.Lock()
+	defer memoryMtx.Unlock()
 
+	main := walMain(name)
+	if main == nil {
+		return nil, flags, sqlite3.CANTOPEN
+	}
+	if main.wal == nil {
+		if flags&vfs.OPEN_CREATE == 0 {
+			return nil, flags, sqlite3.CANTOPEN
+		}
+		main.wal = newMemDB(name)
+		main.wal.refs = 1 // the reference from main
+	}
+	main.wal.refs++
 	return &memFile{
-		memDB:    db,
+		memDB:    main.wal,
 		readOnly: flags&vfs.OPEN_READONLY != 0,
-	}, flags | vfs.OPEN_MEMORY, nil
+	}, flags, nil
+}
+
+// walMain returns the shared database that owns a WAL file.
+// +checklocks:memoryMtx
+func walMain(name string) *memDB {
+	if name, ok := strings.CutSuffix(name, "-wal"); ok {
+		return memoryDBs[name]
+	}
+	return nil
 }
 
 func (memVFS) Delete(name string, dirSync bool) error {
+	if len(name) > 1 && name[0] == '/' {
+		memoryMtx.Lock()
+		defer memoryMtx.Unlock()
+		if main := walMain(name[1:]); main != nil && main.wal != nil {
+			main.wal.unref()
+			main.wal = nil
+			return nil
+		}
+	}
 	return sqlite3.IOERR_DELETE_NOENT // used to delete journals
 }
 
 func (memVFS) Access(name string, flag vfs.AccessFlag) (bool, error) {
+	if len(name) > 1 && name[0] == '/' {
+		memoryMtx.Lock()
+		defer memoryMtx.Unlock()
+		if main := walMain(name[1:]); main != nil {
+			return main.wal != nil, nil
+		}
+	}
 	return false, nil // used to check for journals
 }
 
@@ -82,9 +145,16 @@ type memDB struct {
 	data []*[sectorSize]byte
 	// +checklocks:dataMtx
 	size int64
+	// +checklocks:dataMtx
+	limit int64
 
+	// References from open files, Create, and (for WAL files) the main database.
 	// +checklocks:memoryMtx
 	refs int32
+	// +checklocks:memoryMtx
+	created bool
+	// +checklocks:memoryMtx
+	wal *memDB
 
 	shared   int32 // +checklocks:lockMtx
 	pending  bool  // +checklocks:lockMtx
@@ -94,28 +164,59 @@ type memDB struct {
 	dataMtx sync.RWMutex
 }
 
+func newMemDB(name string) *memDB {
+	return &memDB{name: name}
+}
+
 func (m *memDB) release() {
 	memoryMtx.Lock()
 	defer memoryMtx.Unlock()
-	if m.refs--; m.refs == 0 && m == memoryDBs[m.name] {
+	m.unref()
+}
+
+// unref drops a reference to the database.
+// Sectors are only ever referenced by their database,
+// so memory is released once the last reference is dropped.
+//
+// +checklocks:memoryMtx
+func (m *memDB) unref() {
+	if m.refs--; m.refs != 0 {
+		return
+	}
+	if m == memoryDBs[m.name] {
 		delete(memoryDBs, m.name)
 	}
+	if m.wal != nil {
+		m.wal.unref()
+		m.wal = nil
+	}
+
+	m.dataMtx.Lock()
+	defer m.dataMtx.Unlock()
+	memoryUsed.Add(-int64(len(m.data)) * sectorSize)
+	m.data = nil
+	m.size = 0
 }
 
 type memFile struct {
 	*memDB
+	shm      vfs.SharedMemory
 	lock     vfs.LockLevel
 	readOnly bool
 }
 
 var (
 	// Ensure these interfaces are implemented:
-	_ vfs.FileLockState = &memFile{}
-	_ vfs.FileSizeHint  = &memFile{}
+	_ vfs.FileLockState    = &memFile{}
+	_ vfs.FileSizeHint     = &memFile{}
+	_ vfs.FileSharedMemory = &memFile{}
 )
 
 func (m *memFile) Close() error {
 	m.release()
+	if m.shm != nil {
+		m.shm.Close()
+	}
 	return m.Unlock(vfs.LOCK_NONE)
 }
 
@@ -123,20 +224,16 @@ func (m *memFile) ReadAt(b []byte, off int64) (n int, err error) {
 	m.dataMtx.RLock()
 	defer m.dataMtx.RUnlock()
 
-	if off >= m.size {
-		return 0, io.EOF
-	}
-
-	base := off / sectorSize
-	rest := off % sectorSize
-	have := int64(sectorSize)
-	if base == int64(len(m.data))-1 {
-		have = modRoundUp(m.size, sectorSize)
-	}
-	n = copy(b, (*m.data[base])[rest:have])
-	if n < len(b) {
-		// notest // assume reads are page aligned
-		return 0, io.ErrNoProgress
+	for n < len(b) {
+		if off >= m.size {
+			return n, io.EOF
+		}
+		base := off / sectorSize
+		rest := off % sectorSize
+		have := min(sectorSize, m.size-base*sectorSize)
+		i := copy(b[n:], (*m.data[base])[rest:have])
+		off += int64(i)
+		n += i
 	}
 	return n, nil
 }
@@ -145,18 +242,18 @@ func (m *memFile) WriteAt(b []byte, off int64) (n int, err error) {
 	m.dataMtx.Lock()
 	defer m.dataMtx.Unlock()
 
-	base := off / sectorSize
-	rest := off % sectorSize
-	for base >= int64(len(m.data)) {
-		m.data = append(m.data, new([sectorSize]byte))
-	}
-	n = copy((*m.data[base])[rest:], b)
-	if n < len(b) {
-		// notest // assume writes are page aligned
-		return n, io.ErrShortWrite
+	if end := off + int64(len(b)); end > m.size {
+		if err := m.grow(end); err != nil {
+			return 0, err
+		}
 	}
-	if size := off + int64(len(b)); size > m.size {
-		m.size = size
+
+	for n < len(b) {
+		base := off / sectorSize
+		rest := off % sectorSize
+		i := copy((*m.data[base])[rest:], b[n:])
+		off += int64(i)
+		n += i
 	}
 	return n, nil
 }
@@ -169,23 +266,42 @@ func (m *memFile) Truncate(size int64) error {
 
 // +checklocks:m.dataMtx
 func (m *memFile) truncate(size int64) error {
-	if size < m.size {
-		base := size / sectorSize
-		rest := size % sectorSize
-		if rest != 0 {
-			clear((*m.data[base])[rest:])
-		}
+	if size > m.size {
+		return m.grow(size)
 	}
-	sectors := divRoundUp(size, sectorSize)
-	for sectors > int64(len(m.data)) {
-		m.data = append(m.data, new([sectorSize]byte))
+	base := size / sectorSize
+	rest := size % sectorSize
+	if rest != 0 {
+		clear((*m.data[base])[rest:])
 	}
+	sectors := divRoundUp(size, sectorSize)
+	memoryUsed.Add((sectors - int64(len(m.data))) * sectorSize)
 	clear(m.data[sectors:])
 	m.data = m.data[:sectors]
 	m.size = size
 	return nil
 }
 
+// grow extends the file to size,
+// allocating sectors within the memory limits.
+// +checklocks:m.dataMtx
+func (m *memDB) grow(size int64) error {
+	if m.limit > 0 && size > m.limit {
+		return sqlite3.FULL
+	}
+	sectors := divRoundUp(size, sectorSize)
+	if alloc := (sectors - int64(len(m.data))) * sectorSize; alloc > 0 {
+		if !reserve(alloc) {
+			return sqlite3.FULL
+		}
+		for sectors > int64(len(m.data)) {
+			m.data = append(m.data, new([sectorSize]byte))
+		}
+	}
+	m.size = size
+	return nil
+}
+
 func (m *memFile) Sync(flag vfs.SyncFlag) error {
 	return nil
 }
@@ -299,10 +415,10 @@ func (m *memFile) LockState() vfs.LockLevel {
 	return m.lock
 }
 
-func divRoundUp(a, b int64) int64 {
-	return (a + b - 1) / b
+func (m *memFile) SharedMemory() vfs.SharedMemory {
+	return m.shm
 }
 
-func modRoundUp(a, b int64) int64 {
-	return b - (b-a%b)%b
+func divRoundUp(a, b int64) int64 {
+	return (a + b - 1) / b
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/ncruces/go-sqlite3"
 	_ "github.com/ncruces/go-sqlite3/embed"
 	_ "github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs/vfstest"
 )
 
 //go:embed testdata/wal.db
@@ -27,4 +28,108 @@ func Test_wal(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	stmt, _, err := db.Prepare(`PRAGMA journal_mode`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	if !stmt.Step() {
+		t.Fatal(stmt.Err())
+	}
+	if got := stmt.ColumnText(0); got != "wal" {
+		t.Errorf("got %q want wal", got)
+	}
+}
+
+func Test_wal_concurrent(t *testing.T) {
+	t.Parallel()
+	name := "file:/" + t.Name() + ".db?vfs=memdb"
+	Create(t.Name()+".db", nil)
+	defer Delete(t.Name() + ".db")
+
+	writer, err := sqlite3.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	err = writer.Exec(`
+		PRAGMA journal_mode=wal;
+		CREATE TABLE t (x);
+		INSERT INTO t VALUES (randomblob(100000));
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := sqlite3.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// A read transaction keeps its snapshot
+	// while the writer commits.
+	err = reader.Exec(`BEGIN`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := count(t, reader); got != 1 {
+		t.Errorf("got %d want 1", got)
+	}
+
+	err = writer.Exec(`INSERT INTO t VALUES (randomblob(100000))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := count(t, reader); got != 1 {
+		t.Errorf("got %d want 1", got)
+	}
+
+	err = reader.Exec(`COMMIT`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := count(t, reader); got != 2 {
+		t.Errorf("got %d want 2", got)
+	}
+
+	// The WAL survives connections being closed.
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reader.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := count(t, reader); got != 2 {
+		t.Errorf("got %d want 2", got)
+	}
+}
+
+func count(t testing.TB, db *sqlite3.Conn) int {
+	t.Helper()
+
+	stmt, _, err := db.Prepare(`SELECT count(*) FROM t`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	if !stmt.Step() {
+		t.Fatal(stmt.Err())
+	}
+	return stmt.ColumnInt(0)
+}
+
+func Test_vfstest(t *testing.T) {
+	vfstest.Test(t, memVFS{}, &vfstest.Options{
+		Name: func(t *testing.T) string {
+			// Shared databases can be opened more than once.
+			return "/" + t.Name() + ".db"
+		},
+	})
 }
@@ -0,0 +1,52 @@
+// Package multiplex wraps an SQLite VFS to split files across chunks.
+//
+// The "multiplex" [vfs.VFS] wraps the default VFS,
+// and spreads each database, journal, and WAL file
+// across chunk files of a fixed maximum size,
+// like SQLite's [multiplexor].
+// It can be used to overcome file size limits.
+//
+// The first chunk of a file is stored under its own name,
+// and holds its locks and shared memory.
+// Each of the following chunks is stored with the name of the file,
+// followed by a three digit suffix:
+// "demo.db", "demo.db.001", "demo.db.002", etc.
+//
+// Importing package multiplex registers that VFS,
+// and a wrapper to stack other VFSes over it (e.g. "multiplex+xts"):
+//
+//	import _ "github.com/ncruces/go-sqlite3/vfs/multiplex"
+//
+// The chunk size can be set with the "chunksize" [URI] parameter,
+// and is rounded up to a multiple of 64KiB,
+// so that database pages never straddle chunks.
+//
+// Chunks after the first are opened by name, using [vfs.VFS.Open].
+// To encrypt a multiplexed database, stack the encrypting VFS
+// over the multiplexing VFS, rather than under it.
+//
+// [multiplexor]: https://sqlite.org/src/doc/trunk/src/test_multiplex.c
+// [URI]: https://sqlite.org/uri.html
+package multiplex
+
+import "github.com/ncruces/go-sqlite3/vfs"
+
+func init() {
+	vfs.Register("multiplex", Wrap(vfs.Find(""), DefaultChunkSize))
+	vfs.RegisterWrapper("multiplex", func(base vfs.VFS) vfs.VFS {
+		return Wrap(base, DefaultChunkSize)
+	})
+}
+
+// DefaultChunkSize is the default chunk size:
+// 64KiB less than 2GiB, like SQLite's multiplexor.
+const DefaultChunkSize = 2147418112
+
+// Wrap wraps a base VFS to create a multiplexing VFS,
+// using chunks of the given size, unless overridden by URI parameter.
+func Wrap(base vfs.VFS, chunkSize int64) vfs.VFS {
+	return &multiplexVFS{
+		VFS:       base,
+		chunkSize: roundChunkSize(chunkSize),
+	}
+}
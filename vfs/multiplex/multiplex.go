@@ -0,0 +1,351 @@
+package multiplex
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// The largest page size, and the smallest chunk size.
+const minChunkSize = 65536
+
+// Chunk suffixes have three digits.
+const maxChunks = 1000
+
+type multiplexVFS struct {
+	vfs.VFS
+	chunkSize int64
+}
+
+func (m *multiplexVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	return m.open(name, flags, m.chunkSize, func() (vfs.File, vfs.OpenFlag, error) {
+		return m.VFS.Open(name, flags)
+	})
+}
+
+func (m *multiplexVFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	chunkSize := m.chunkSize
+	if s := name.URIParameter("chunksize"); s != "" {
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || i <= 0 {
+			return nil, flags, sqlite3.CANTOPEN
+		}
+		chunkSize = roundChunkSize(i)
+	}
+	return m.open(name.String(), flags, chunkSize, func() (vfs.File, vfs.OpenFlag, error) {
+		return vfsutil.WrapOpenFilename(m.VFS, name, flags)
+	})
+}
+
+func (m *multiplexVFS) open(name string, flags vfs.OpenFlag, chunkSize int64, open func() (vfs.File, vfs.OpenFlag, error)) (vfs.File, vfs.OpenFlag, error) {
+	// Temporary and memory files are not multiplexed.
+	if name == "" || flags&vfs.OPEN_MEMORY != 0 {
+		return open()
+	}
+
+	// Chunks left over from a deleted file
+	// must not become part of a new one.
+	exists, err := m.VFS.Access(name, vfs.ACCESS_EXISTS)
+	if err != nil {
+		return nil, flags, err
+	}
+
+	file, flags, err := open()
+	if err != nil {
+		return file, flags, err
+	}
+
+	f := &multiplexFile{
+		WrappedFile: vfsutil.WrappedFile{File: file},
+		vfs:         m.VFS,
+		name:        name,
+		flags:       flags,
+		chunkSize:   chunkSize,
+		chunks:      []vfs.File{file},
+	}
+	if !exists && flags&vfs.OPEN_READWRITE != 0 {
+		if err := f.removeChunks(1); err != nil {
+			f.Close()
+			return nil, flags, err
+		}
+	}
+	return f, flags, nil
+}
+
+func (m *multiplexVFS) Delete(name string, syncDir bool) error {
+	// Deleting the first chunk deletes the file (e.g. commits a journal).
+	if err := m.VFS.Delete(name, syncDir); err != nil {
+		return err
+	}
+	for i := 1; i < maxChunks; i++ {
+		ok, err := m.VFS.Access(chunkName(name, i), vfs.ACCESS_EXISTS)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if err := m.VFS.Delete(chunkName(name, i), syncDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type multiplexFile struct {
+	vfsutil.WrappedFile
+	vfs       vfs.VFS
+	name      string
+	flags     vfs.OpenFlag
+	chunkSize int64
+	chunks    []vfs.File // open chunks, or nil
+}
+
+func (m *multiplexFile) Close() error {
+	for i := 1; i < len(m.chunks); i++ {
+		m.closeChunk(i)
+	}
+	return m.File.Close()
+}
+
+// chunk returns an open chunk, opening (or creating) it if needed.
+// If the chunk doesn't exist, and create is false, nil is returned.
+func (m *multiplexFile) chunk(i int, create bool) (vfs.File, error) {
+	if i < len(m.chunks) && m.chunks[i] != nil {
+		return m.chunks[i], nil
+	}
+	if i >= maxChunks {
+		return nil, sqlite3.FULL
+	}
+
+	name := chunkName(m.name, i)
+	if !create {
+		ok, err := m.vfs.Access(name, vfs.ACCESS_EXISTS)
+		if err != nil || !ok {
+			return nil, err
+		}
+	}
+
+	// Chunks other than the first are opened as journals:
+	// they need no shared memory,
+	// and their directory is synced when they're created.
+	flags := m.flags&^(vfs.OPEN_MAIN_DB|vfs.OPEN_WAL|vfs.OPEN_EXCLUSIVE) | vfs.OPEN_MAIN_JOURNAL
+	if create && flags&vfs.OPEN_READWRITE != 0 {
+		flags |= vfs.OPEN_CREATE
+	}
+	file, _, err := m.vfs.Open(name, flags)
+	if err != nil {
+		return nil, err
+	}
+	for len(m.chunks) <= i {
+		m.chunks = append(m.chunks, nil)
+	}
+	m.chunks[i] = file
+	return file, nil
+}
+
+// closeChunk closes an open chunk.
+func (m *multiplexFile) closeChunk(i int) {
+	if i < len(m.chunks) && m.chunks[i] != nil {
+		m.chunks[i].Close()
+		m.chunks[i] = nil
+	}
+}
+
+// removeChunks removes chunks, starting with chunk i.
+// Database and WAL files may be shared by other connections,
+// so their chunks are truncated, rather than deleted.
+func (m *multiplexFile) removeChunks(i int) error {
+	for ; i < maxChunks; i++ {
+		if m.flags&(vfs.OPEN_MAIN_DB|vfs.OPEN_WAL) != 0 {
+			c, err := m.chunk(i, false)
+			if err != nil {
+				return err
+			}
+			if c == nil {
+				return nil
+			}
+			if err := c.Truncate(0); err != nil {
+				return err
+			}
+		} else {
+			name := chunkName(m.name, i)
+			ok, err := m.vfs.Access(name, vfs.ACCESS_EXISTS)
+			if err != nil || !ok {
+				return err
+			}
+			m.closeChunk(i)
+			if err := m.vfs.Delete(name, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *multiplexFile) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		pos := off + int64(n)
+		i, coff := m.locate(pos)
+		size := int(min(int64(len(p)-n), m.chunkSize-coff))
+
+		c, err := m.chunk(i, false)
+		if err != nil {
+			return n, err
+		}
+		var k int
+		if c != nil {
+			k, err = c.ReadAt(p[n:n+size], coff)
+			if k == size {
+				n += k
+				continue
+			}
+			if err != io.EOF {
+				return n + k, err
+			}
+		}
+
+		// A short chunk: either the end of the file, or a hole.
+		end, err := m.Size()
+		if err != nil {
+			return n + k, err
+		}
+		hole := int(max(0, min(int64(size), end-pos)))
+		if k >= hole {
+			return n + k, io.EOF
+		}
+		clear(p[n+k : n+hole])
+		n += hole
+		if hole < size {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+func (m *multiplexFile) WriteAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		pos := off + int64(n)
+		i, coff := m.locate(pos)
+		size := int(min(int64(len(p)-n), m.chunkSize-coff))
+
+		c, err := m.chunk(i, true)
+		if err != nil {
+			return n, err
+		}
+		k, err := c.WriteAt(p[n:n+size], coff)
+		n += k
+		if k != size {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (m *multiplexFile) Truncate(size int64) error {
+	i, coff := m.locate(size)
+
+	// Fill the chunks before the new end of the file.
+	for j := range i {
+		c, err := m.chunk(j, true)
+		if err != nil {
+			return err
+		}
+		s, err := c.Size()
+		if err != nil {
+			return err
+		}
+		if s < m.chunkSize {
+			if err := c.Truncate(m.chunkSize); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The new end of the file falls on a chunk boundary.
+	if coff == 0 && i > 0 {
+		return m.removeChunks(i)
+	}
+
+	c, err := m.chunk(i, true)
+	if err != nil {
+		return err
+	}
+	if err := c.Truncate(coff); err != nil {
+		return err
+	}
+	return m.removeChunks(i + 1)
+}
+
+func (m *multiplexFile) Size() (int64, error) {
+	var size int64
+	for i := 0; i < maxChunks; i++ {
+		c, err := m.chunk(i, false)
+		if err != nil {
+			return 0, err
+		}
+		if c == nil {
+			break
+		}
+		s, err := c.Size()
+		if err != nil {
+			return 0, err
+		}
+		if s > 0 {
+			size = int64(i)*m.chunkSize + s
+		}
+	}
+	return size, nil
+}
+
+func (m *multiplexFile) Sync(flags vfs.SyncFlag) error {
+	for _, c := range m.chunks {
+		if c != nil {
+			if err := c.Sync(flags); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *multiplexFile) SizeHint(size int64) error {
+	// Chunks are not preallocated.
+	return nil
+}
+
+func (m *multiplexFile) ChunkSize(size int) {
+	// Chunks would grow past their size.
+}
+
+func (m *multiplexFile) DeviceCharacteristics() vfs.DeviceCharacteristic {
+	return m.File.DeviceCharacteristics() & (0 |
+		// These flags are safe:
+		vfs.IOCAP_IMMUTABLE |
+		vfs.IOCAP_SEQUENTIAL |
+		vfs.IOCAP_SUBPAGE_READ |
+		vfs.IOCAP_POWERSAFE_OVERWRITE |
+		vfs.IOCAP_UNDELETABLE_WHEN_OPEN)
+}
+
+// locate returns the chunk that holds an offset,
+// and the offset in that chunk.
+func (m *multiplexFile) locate(off int64) (int, int64) {
+	return int(off / m.chunkSize), off % m.chunkSize
+}
+
+func chunkName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s.%03d", name, i)
+}
+
+func roundChunkSize(size int64) int64 {
+	size = max(size, minChunkSize)
+	return (size + minChunkSize - 1) / minChunkSize * minChunkSize
+}
@@ -0,0 +1,238 @@
+package multiplex_test
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/faultvfs"
+	"github.com/ncruces/go-sqlite3/vfs/multiplex"
+	"github.com/ncruces/go-sqlite3/vfs/vfstest"
+	_ "github.com/ncruces/go-sqlite3/vfs/xts"
+)
+
+const chunkSize = 65536
+
+func Test_vfstest(t *testing.T) {
+	if !vfs.SupportsFileLocking {
+		t.Skip("skipping without locks")
+	}
+	vfstest.Test(t, multiplex.Wrap(vfs.Find(""), chunkSize), nil)
+}
+
+func TestMultiplex(t *testing.T) {
+	for _, mode := range []string{"delete", "truncate", "persist", "wal"} {
+		t.Run(mode, func(t *testing.T) {
+			// The chunk size is rounded up to a multiple of 64KiB.
+			path := filepath.Join(t.TempDir(), "test.db")
+			uri := fmt.Sprintf("file:%s?vfs=multiplex&chunksize=%d", filepath.ToSlash(path), chunkSize-4096)
+
+			db, err := sqlite3.Open(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			// Each blob spans an overflow chain longer than a chunk.
+			testcfg.Exec(t, db, `PRAGMA journal_mode=`+mode)
+			testcfg.Exec(t, db, `PRAGMA wal_autocheckpoint=0`)
+			testcfg.Exec(t, db, `CREATE TABLE blobs (id INTEGER PRIMARY KEY, data BLOB)`)
+			testcfg.Exec(t, db, `
+				INSERT INTO blobs (data)
+				SELECT printf('%.*c', 100000, char(65 + value % 26)) FROM generate_series(1, 40)`)
+			testcfg.Exec(t, db, `UPDATE blobs SET data = printf('%.*c', 150000, char(97 + id % 26)) WHERE id % 3 = 0`)
+			testcfg.Exec(t, db, `DELETE FROM blobs WHERE id % 5 = 0`)
+			if mode == "wal" {
+				// So is the WAL.
+				if _, err := os.Stat(path + "-wal.001"); err != nil {
+					t.Error(err)
+				}
+			}
+			testcfg.Exec(t, db, `PRAGMA wal_checkpoint(TRUNCATE)`)
+
+			// The database is split into full chunks.
+			pages := testcfg.Query(t, db, `PRAGMA page_count`)
+			var size int64
+			for i := 0; ; i++ {
+				name := path
+				if i > 0 {
+					name += fmt.Sprintf(".%03d", i)
+				}
+				fi, err := os.Stat(name)
+				if errors.Is(err, fs.ErrNotExist) {
+					if i < 10 {
+						t.Errorf("got %d chunks", i)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if next, err := os.Stat(fmt.Sprintf("%s.%03d", path, i+1)); err == nil && next.Size() > 0 {
+					if fi.Size() != chunkSize {
+						t.Errorf("chunk %d has size %d", i, fi.Size())
+					}
+				} else if fi.Size() > chunkSize {
+					t.Errorf("last chunk %d has size %d", i, fi.Size())
+				}
+				size += fi.Size()
+			}
+			if want := fmt.Sprint(size / 4096); want != pages {
+				t.Errorf("got %s pages, want %s", pages, want)
+			}
+
+			// Shrinking the database removes chunks.
+			testcfg.Exec(t, db, `DELETE FROM blobs WHERE id > 4`)
+			testcfg.Exec(t, db, `VACUUM`)
+			testcfg.Exec(t, db, `PRAGMA wal_checkpoint(TRUNCATE)`)
+			if fi, err := os.Stat(path + ".010"); err == nil && fi.Size() != 0 {
+				t.Errorf("got chunk size %d", fi.Size())
+			}
+
+			// Data survives reopening.
+			db.Close()
+			db, err = sqlite3.Open(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if got := testcfg.Query(t, db, `
+				SELECT group_concat(id || ':' || length(data)) FROM blobs
+				WHERE data = printf('%.*c', 100000, char(65 + id % 26))
+				   OR data = printf('%.*c', 150000, char(97 + id % 26))`); got != "1:100000,2:100000,3:150000,4:100000" {
+				t.Errorf("got %s", got)
+			}
+			if err := faultvfs.IntegrityCheck(db); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestMultiplex_delete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	uri := fmt.Sprintf("file:%s?vfs=multiplex&chunksize=%d", filepath.ToSlash(path), chunkSize)
+
+	db, err := sqlite3.Open(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcfg.Exec(t, db, `CREATE TABLE blobs (id INTEGER PRIMARY KEY, data BLOB)`)
+	testcfg.Exec(t, db, `INSERT INTO blobs (data) SELECT randomblob(200000) FROM generate_series(1, 2)`)
+
+	// Rewriting a blob spreads the journal across chunks.
+	testcfg.Exec(t, db, `BEGIN`)
+	testcfg.Exec(t, db, `UPDATE blobs SET data = zeroblob(200000) WHERE id = 1`)
+	if _, err := os.Stat(path + "-journal.001"); err != nil {
+		t.Error(err)
+	}
+	testcfg.Exec(t, db, `COMMIT`)
+	db.Close()
+
+	// Committing deletes the journal, and all its chunks.
+	matches, err := filepath.Glob(path + "-journal*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("got %v", matches)
+	}
+
+	// Deleting the database deletes all its chunks.
+	v := vfs.Find("multiplex")
+	if err := v.Delete(path, false); err != nil {
+		t.Fatal(err)
+	}
+	matches, err = filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("got %v", matches)
+	}
+	if ok, err := v.Access(path, vfs.ACCESS_EXISTS); err != nil || ok {
+		t.Errorf("got %v, %v", ok, err)
+	}
+}
+
+func TestMultiplex_xts(t *testing.T) {
+	defer vfs.Unregister("multiplex+xts")
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	uri := fmt.Sprintf("file:%s?vfs=multiplex+xts&chunksize=%d&textkey=secret", filepath.ToSlash(path), chunkSize)
+
+	db, err := sqlite3.Open(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Encrypted pages of a blob that crosses chunks.
+	testcfg.Exec(t, db, `CREATE TABLE blobs (id INTEGER PRIMARY KEY, data BLOB)`)
+	testcfg.Exec(t, db, `INSERT INTO blobs (data) VALUES (zeroblob(3 * 65536))`)
+	if _, err := os.Stat(path + ".003"); err != nil {
+		t.Error(err)
+	}
+	if got := testcfg.Query(t, db, `SELECT data = zeroblob(3 * 65536) FROM blobs`); got != "1" {
+		t.Errorf("got %s", got)
+	}
+	if err := faultvfs.IntegrityCheck(db); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMultiplex_crash(t *testing.T) {
+	dir := t.TempDir()
+
+	for point := 0; ; point++ {
+		faults := faultvfs.Wrap(vfs.Find(""))
+		name := fmt.Sprintf("multiplex-crash-%d", point)
+		vfs.Register(name, multiplex.Wrap(faults, chunkSize))
+		defer vfs.Unregister(name)
+
+		uri := "file:" + filepath.ToSlash(filepath.Join(dir, name+".db")) + "?vfs=" + name
+		db, err := sqlite3.Open(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testcfg.Exec(t, db, `CREATE TABLE blobs (id INTEGER PRIMARY KEY, data BLOB)`)
+		testcfg.Exec(t, db, `INSERT INTO blobs (data) SELECT zeroblob(100000) FROM generate_series(1, 4)`)
+
+		// Grow and shrink blobs, so the journal and the database
+		// gain and lose chunks.
+		faults.Inject(faultvfs.Fault{Op: faultvfs.OpSync, Kind: faultvfs.PowerLoss, After: point})
+		for i := range 3 {
+			err = db.Exec(fmt.Sprintf(`UPDATE blobs SET data = zeroblob(%d) WHERE id %% 2 = %d`, 50000+100000*i, i%2))
+			if err != nil {
+				break
+			}
+		}
+		db.Close()
+		if faults.Fired() == 0 {
+			if point == 0 {
+				t.Fatal("no sync points")
+			}
+			break
+		}
+		faults.Recover()
+
+		db, err = sqlite3.Open(uri)
+		if err != nil {
+			t.Fatalf("point %d: %v", point, err)
+		}
+		if err := faultvfs.IntegrityCheck(db); err != nil {
+			t.Errorf("point %d: %v", point, err)
+		}
+		if got := testcfg.Query(t, db, `SELECT count(*) FROM blobs WHERE data = zeroblob(length(data))`); got != "4" {
+			t.Errorf("point %d: got %s blobs", point, got)
+		}
+		db.Close()
+	}
+}
@@ -1,12 +1,19 @@
-// Package ordmap implements the "memdb" SQLite VFS.
+// Package ordmap implements the "memdb" SQLite VFS
+// with multi-version concurrency control.
 //
-// The "ordmap" [vfs.VFS] allows the same in-memory database to be shared
+// The "ordmapmvcc" [vfs.VFS] allows the same in-memory database to be shared
 // among multiple database connections in the same process,
 // as long as the database name begins with "/".
 //
+// Readers keep reading the version of the database that was current
+// when they acquired their SHARED lock, so readers never block writers,
+// and writers never block readers.
+// Writers still exclude each other, and a transaction that read
+// an outdated version fails with BUSY_SNAPSHOT if it tries to write.
+//
 // Importing package ordmap registers the VFS:
 //
-//	import _ "github.com/ncruces/go-sqlite3/vfs/ordmap"
+//	import _ "github.com/ncruces/go-sqlite3/vfs/ordmap-mvcc"
 package ordmap
 
 import (
@@ -40,8 +47,10 @@ func Create(name string, data []byte) {
 	db := &memDB{
 		refs: 1,
 		name: name,
-		data: ordmap.NewBuiltin[int64, []byte](),
-		size: int64(len(data)),
+		head: memData{
+			data: ordmap.NewBuiltin[int64, []byte](),
+			size: int64(len(data)),
+		},
 	}
 
 	// Convert data from WAL/2 to rollback journal.
@@ -52,11 +61,11 @@ func Create(name string, data []byte) {
 		data[19] = 1
 	}
 
-	sectors := divRoundUp(db.size, sectorSize)
+	sectors := divRoundUp(db.head.size, sectorSize)
 	for i := int64(0); i < sectors; i++ {
 		sector := make([]byte, sectorSize)
 		copy(sector, data[i*sectorSize:])
-		db.data = db.data.Insert(i, sector)
+		db.head.data = db.head.data.Insert(i, sector)
 	}
 
 	memoryDBs[name] = db
@@ -2,6 +2,9 @@ package ordmap
 
 import (
 	_ "embed"
+	"errors"
+	"fmt"
+	"sync/atomic"
 	"testing"
 
 	"github.com/ncruces/go-sqlite3"
@@ -28,3 +31,167 @@ func Test_wal(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func Test_snapshot(t *testing.T) {
+	t.Parallel()
+
+	Create("snapshot.db", nil)
+	defer Delete("snapshot.db")
+
+	db1, err := sqlite3.Open("file:/snapshot.db?vfs=ordmapmvcc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db1.Close()
+
+	db2, err := sqlite3.Open("file:/snapshot.db?vfs=ordmapmvcc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+
+	err = db1.Exec(`
+		CREATE TABLE users (id INT, name VARCHAR(10));
+		INSERT INTO users (id, name) VALUES (0, 'go'), (1, 'zig');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start a read transaction, pinning a snapshot.
+	err = db2.Exec(`BEGIN`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := count(t, db2); got != 2 {
+		t.Errorf("got %d, want 2", got)
+	}
+
+	// Commit a write concurrently, without blocking on the reader.
+	done := make(chan error)
+	go func() {
+		done <- db1.Exec(`INSERT INTO users (id, name) VALUES (2, 'whatever')`)
+	}()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := count(t, db1); got != 3 {
+		t.Errorf("got %d, want 3", got)
+	}
+
+	// The reader still sees its snapshot.
+	if got := count(t, db2); got != 2 {
+		t.Errorf("got %d, want 2", got)
+	}
+
+	// Writing to an outdated snapshot fails.
+	err = db2.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)
+	if !errors.Is(err, sqlite3.BUSY_SNAPSHOT) {
+		t.Errorf("got %v, want BUSY_SNAPSHOT", err)
+	}
+
+	err = db2.Exec(`COMMIT`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new transaction sees the committed write.
+	if got := count(t, db2); got != 3 {
+		t.Errorf("got %d, want 3", got)
+	}
+}
+
+func Test_snapshot_concurrent(t *testing.T) {
+	t.Parallel()
+
+	Create("concurrent.db", nil)
+	defer Delete("concurrent.db")
+
+	writer, err := sqlite3.Open("file:/concurrent.db?vfs=ordmapmvcc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	reader, err := sqlite3.Open("file:/concurrent.db?vfs=ordmapmvcc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	err = writer.Exec(`CREATE TABLE users (id INT, name VARCHAR(10))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stop atomic.Bool
+	done := make(chan error)
+	go func() { done <- readSnapshots(reader, &stop) }()
+
+	// Readers never block the writer.
+	for i := range 100 {
+		err := writer.Exec(fmt.Sprintf(`INSERT INTO users (id, name) VALUES (%d, 'go')`, i))
+		if err != nil {
+			t.Error(err)
+			break
+		}
+	}
+
+	stop.Store(true)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readSnapshots repeatedly checks that reads within a transaction are consistent,
+// and that successive transactions never see older data, until stopped.
+func readSnapshots(db *sqlite3.Conn, stop *atomic.Bool) error {
+	stmt, _, err := db.Prepare(`SELECT count(*) FROM users`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	count := func() int {
+		defer stmt.Reset()
+		stmt.Step()
+		return stmt.ColumnInt(0)
+	}
+
+	for last := 0; !stop.Load(); {
+		// Within a transaction, every read sees the same snapshot.
+		if err := db.Exec(`BEGIN`); err != nil {
+			return err
+		}
+		first := count()
+		for range 10 {
+			if got := count(); got != first {
+				return fmt.Errorf("got %d, want %d", got, first)
+			}
+		}
+		if err := db.Exec(`COMMIT`); err != nil {
+			return err
+		}
+
+		if first < last {
+			return fmt.Errorf("went back in time: got %d, after %d", first, last)
+		}
+		last = first
+	}
+	return stmt.Err()
+}
+
+func count(t testing.TB, db *sqlite3.Conn) int {
+	t.Helper()
+
+	stmt, _, err := db.Prepare(`SELECT count(*) FROM users`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	if !stmt.Step() {
+		t.Fatal(stmt.Err())
+	}
+	return stmt.ColumnInt(0)
+}
@@ -3,6 +3,11 @@
 // The "ordmap" [vfs.VFS] allows the same in-memory database to be shared
 // among multiple database connections in the same process,
 // as long as the database name begins with "/".
+// Shared databases also support WAL mode,
+// keeping the WAL file and WAL-index in memory.
+//
+// The "sector_size" URI parameter sets the sector size
+// (the unit of copy-on-write) of new databases.
 //
 // Importing package ordmap registers the VFS:
 //
@@ -16,6 +21,7 @@ import (
 	"testing"
 
 	"github.com/edofic/go-ordmap/v2"
+	"github.com/ncruces/go-sqlite3"
 	"github.com/ncruces/go-sqlite3/vfs"
 )
 
@@ -34,45 +40,89 @@ var (
 // The new database takes ownership of data,
 // and the caller should not use data after this call.
 func Create(name string, data []byte) {
-	memoryMtx.Lock()
-	defer memoryMtx.Unlock()
+	CreateWithOptions(name, data, Options{})
+}
 
-	db := &memDB{
-		refs: 1,
-		name: name,
-		data: ordmap.NewBuiltin[int64, []byte](),
-		size: int64(len(data)),
-	}
+// Options configure a shared memory database.
+type Options struct {
+	// SectorSize is the unit of copy-on-write:
+	// writing to a database page copies the sector that contains it.
+	// Smaller sectors reduce copying for small page sizes,
+	// at the cost of more bookkeeping.
+	//
+	// It must be a power of two between 512 and 65536.
+	// Zero means 65536.
+	SectorSize int
+}
 
-	// Convert data from WAL/2 to rollback journal.
-	if len(data) >= 20 && (false ||
-		data[18] == 2 && data[19] == 2 ||
-		data[18] == 3 && data[19] == 3) {
-		data[18] = 1
-		data[19] = 1
+// CreateWithOptions is like [Create], but allows configuring the database.
+// It fails with [sqlite3.MISUSE] if the options are invalid.
+//
+// Initial contents count against the memory limit, but never fail.
+func CreateWithOptions(name string, data []byte, opts Options) error {
+	size := int64(opts.SectorSize)
+	if size == 0 {
+		size = sectorSize
+	}
+	if !validSectorSize(size) {
+		return sqlite3.MISUSE
 	}
 
-	sectors := divRoundUp(db.size, sectorSize)
-	for i := int64(0); i < sectors; i++ {
-		sector := make([]byte, sectorSize)
-		copy(sector, data[i*sectorSize:])
-		db.data = db.data.Insert(i, sector)
+	var used int64
+	sectors := ordmap.NewBuiltin[int64, []byte]()
+	for i := int64(0); i < divRoundUp(int64(len(data)), size); i++ {
+		sector := make([]byte, size)
+		copy(sector, data[i*size:])
+		sectors = sectors.Insert(i, sector)
+		used += size
 	}
+	account(used)
 
-	memoryDBs[name] = db
+	memoryMtx.Lock()
+	defer memoryMtx.Unlock()
+	unlink(name)
+	memoryDBs[name] = &memDB{
+		refs:       1,
+		created:    true,
+		name:       name,
+		sectorSize: size,
+		data:       sectors,
+		size:       int64(len(data)),
+		used:       used,
+	}
+	return nil
 }
 
 func Fork(name, newName string) {
 	memoryMtx.Lock()
 	defer memoryMtx.Unlock()
-	memoryDBs[newName] = memoryDBs[name].fork()
+	f := memoryDBs[name].fork()
+	f.created = true
+	unlink(newName)
+	memoryDBs[newName] = f
 }
 
 // Delete deletes a shared memory database.
+// Its memory is released once all connections to it are closed.
 func Delete(name string) {
 	memoryMtx.Lock()
 	defer memoryMtx.Unlock()
+	unlink(name)
+}
+
+// unlink removes a database from the shared ones,
+// dropping the reference from Create, Fork or ReadFrom.
+// +checklocks:memoryMtx
+func unlink(name string) {
+	db := memoryDBs[name]
+	if db == nil {
+		return
+	}
 	delete(memoryDBs, name)
+	if db.created {
+		db.created = false
+		db.unref()
+	}
 }
 
 // TestDB creates an empty shared memory database for the test to use.
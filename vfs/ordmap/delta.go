@@ -0,0 +1,201 @@
+package ordmap
+
+import (
+	"bytes"
+	"cmp"
+	"unsafe"
+
+	"github.com/ncruces/go-sqlite3"
+)
+
+// A Delta holds the sectors that differ between two databases.
+//
+// Use [Diff] to compute a delta, and [Apply] to replay it.
+type Delta struct {
+	// Size is the size of the changed database.
+	Size int64
+
+	// SectorSize is the sector size of the databases.
+	// Zero means the default, 65536.
+	SectorSize int64
+
+	// Sectors holds the changed sectors, keyed by sector index.
+	// A nil sector reads as zeroes.
+	Sectors map[int64][]byte
+}
+
+// Diff computes the changes needed to turn base into fork.
+//
+// Since forks share unchanged sectors with their parent,
+// this is cheapest between a database and its forks,
+// but works for any pair of shared memory databases.
+//
+// The delta shares memory with the databases,
+// and the caller should not modify it.
+// Diff fails with [sqlite3.BUSY] if a transaction
+// is writing to either database,
+// or if either WAL has transactions that weren't checkpointed,
+// and with [sqlite3.MISMATCH] if their sector sizes differ.
+func Diff(base, fork string) (*Delta, error) {
+	b, err := lookup(base)
+	if err != nil {
+		return nil, err
+	}
+	f, err := lookup(fork)
+	if err != nil {
+		return nil, err
+	}
+	if b.sectorSize != f.sectorSize {
+		return nil, sqlite3.MISMATCH
+	}
+
+	bv, err := b.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	fv, err := f.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	delta := Delta{
+		Size:       fv.size,
+		SectorSize: f.sectorSize,
+		Sectors:    map[int64][]byte{},
+	}
+
+	// Merge walk both maps in sector order.
+	i, j := bv.data.Iterate(), fv.data.Iterate()
+	for !i.Done() || !j.Done() {
+		switch {
+		case j.Done() || !i.Done() && i.GetKey() < j.GetKey():
+			// Sector only in base.
+			delta.Sectors[i.GetKey()] = nil
+			i.Next()
+		case i.Done() || j.GetKey() < i.GetKey():
+			// Sector only in fork.
+			delta.Sectors[j.GetKey()] = j.GetValue()
+			j.Next()
+		default:
+			if !sameSector(i.GetValue(), j.GetValue()) {
+				delta.Sectors[j.GetKey()] = j.GetValue()
+			}
+			i.Next()
+			j.Next()
+		}
+	}
+
+	// Sectors past the end are removed by truncation.
+	last := divRoundUp(fv.size, f.sectorSize)
+	for k := range delta.Sectors {
+		if k >= last {
+			delete(delta.Sectors, k)
+		}
+	}
+	return &delta, nil
+}
+
+// Apply replays delta onto a shared memory database.
+//
+// The database should have the same contents as
+// the base the delta was computed against.
+// The database takes ownership of delta,
+// and the caller should not modify it after this call.
+// A WAL left behind by a connection is discarded.
+// Apply fails with [sqlite3.BUSY] if any connection
+// holds a lock on the database,
+// and with [sqlite3.MISMATCH] if the sector sizes differ.
+func Apply(name string, delta *Delta) error {
+	memoryMtx.Lock()
+	defer memoryMtx.Unlock()
+
+	db := memoryDBs[name]
+	if db == nil {
+		return sqlite3.CANTOPEN
+	}
+	if cmp.Or(delta.SectorSize, sectorSize) != db.sectorSize {
+		return sqlite3.MISMATCH
+	}
+	if err := db.apply(delta); err != nil {
+		return err
+	}
+	db.dropWAL()
+	return nil
+}
+
+func (m *memDB) apply(delta *Delta) error {
+	m.lockMtx.Lock()
+	defer m.lockMtx.Unlock()
+	if m.shared > 0 || m.reserved || m.pending {
+		return sqlite3.BUSY
+	}
+
+	m.dataMtx.Lock()
+	defer m.dataMtx.Unlock()
+	for k, sector := range delta.Sectors {
+		// The sector may be shared, but the database accounts for it.
+		account(int64(cap(sector)))
+		m.setSector(k, sector)
+	}
+	return m.truncate(delta.Size)
+}
+
+func lookup(name string) (*memDB, error) {
+	memoryMtx.Lock()
+	defer memoryMtx.Unlock()
+	if db := memoryDBs[name]; db != nil {
+		return db, nil
+	}
+	return nil, sqlite3.CANTOPEN
+}
+
+// snapshot returns the current contents of the database,
+// unless a transaction is writing to it,
+// or the WAL has transactions that weren't checkpointed.
+func (m *memDB) snapshot() (memVersion, error) {
+	memoryMtx.Lock()
+	wal := m.wal
+	memoryMtx.Unlock()
+
+	if wal != nil {
+		// Hold the WAL while taking the snapshot,
+		// so that a checkpoint can't empty it halfway through.
+		wal.dataMtx.RLock()
+		defer wal.dataMtx.RUnlock()
+		if wal.size > 0 {
+			return memVersion{}, sqlite3.BUSY
+		}
+	}
+
+	m.lockMtx.Lock()
+	defer m.lockMtx.Unlock()
+	if m.pending {
+		return memVersion{}, sqlite3.BUSY
+	}
+
+	m.dataMtx.RLock()
+	defer m.dataMtx.RUnlock()
+	return memVersion{data: m.data, size: m.size, used: m.used}, nil
+}
+
+func sameSector(a, b []byte) bool {
+	// Copy-on-write means unchanged sectors share memory.
+	if len(a) == len(b) && unsafe.SliceData(a) == unsafe.SliceData(b) {
+		return true
+	}
+	// Sectors may be shorter than sectorSize,
+	// in which case the missing bytes read as zeroes.
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	return bytes.Equal(a, b[:len(a)]) && isZero(b[len(a):])
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
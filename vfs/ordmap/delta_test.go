@@ -0,0 +1,110 @@
+package ordmap_test
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/vfs/ordmap"
+)
+
+func TestDiff(t *testing.T) {
+	ordmap.Create("diff_base.db", append([]byte(nil), testDB...))
+	defer ordmap.Delete("diff_base.db")
+	ordmap.Create("diff_replica.db", append([]byte(nil), testDB...))
+	defer ordmap.Delete("diff_replica.db")
+
+	ordmap.Fork("diff_base.db", "diff_fork.db")
+	defer ordmap.Delete("diff_fork.db")
+
+	delta, err := ordmap.Diff("diff_base.db", "diff_fork.db")
+	require.NoError(t, err)
+	require.Empty(t, delta.Sectors)
+
+	fork := assert(sql.Open("sqlite3", "file:/diff_fork.db?vfs=ordmap")).noErr(t)
+	defer fork.Close()
+	assert(fork.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)).noErr(t)
+	assert(fork.Exec(`CREATE TABLE langs (name VARCHAR(10))`)).noErr(t)
+	assert(fork.Exec(`INSERT INTO langs (name) VALUES ('go'), ('zig')`)).noErr(t)
+
+	delta, err = ordmap.Diff("diff_base.db", "diff_fork.db")
+	require.NoError(t, err)
+	require.NotEmpty(t, delta.Sectors)
+
+	err = ordmap.Apply("diff_replica.db", delta)
+	require.NoError(t, err)
+
+	replica := assert(sql.Open("sqlite3", "file:/diff_replica.db?vfs=ordmap")).noErr(t)
+	defer replica.Close()
+	require.Equal(t, loadRows(t, fork), loadRows(t, replica))
+
+	var count int
+	err = replica.QueryRow(`SELECT count(*) FROM langs`).Scan(&count)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	// The base is unchanged.
+	base := assert(sql.Open("sqlite3", "file:/diff_base.db?vfs=ordmap")).noErr(t)
+	defer base.Close()
+	require.Equal(t, map[string]string{
+		"0": "go",
+		"1": "zig",
+		"2": "whatever",
+	}, loadRows(t, base))
+
+	// Nothing changed since the delta was applied.
+	delta, err = ordmap.Diff("diff_fork.db", "diff_replica.db")
+	require.NoError(t, err)
+	require.Empty(t, delta.Sectors)
+}
+
+func TestDiff_missing(t *testing.T) {
+	_, err := ordmap.Diff("missing.db", "missing.db")
+	require.Error(t, err)
+
+	err = ordmap.Apply("missing.db", &ordmap.Delta{})
+	require.Error(t, err)
+}
+
+func TestDiff_wal(t *testing.T) {
+	ordmap.Create("diff_wal.db", append([]byte(nil), testDB...))
+	defer ordmap.Delete("diff_wal.db")
+	ordmap.Create("diff_wal_replica.db", append([]byte(nil), testDB...))
+	defer ordmap.Delete("diff_wal_replica.db")
+	ordmap.Fork("diff_wal.db", "diff_wal_fork.db")
+	defer ordmap.Delete("diff_wal_fork.db")
+
+	fork := assert(sql.Open("sqlite3", "file:/diff_wal_fork.db?vfs=ordmap&_pragma=journal_mode(wal)")).noErr(t)
+	defer fork.Close()
+	fork.SetMaxOpenConns(1)
+	assert(fork.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)).noErr(t)
+
+	// The insert is in the WAL.
+	_, err := ordmap.Diff("diff_wal.db", "diff_wal_fork.db")
+	require.True(t, errors.Is(err, sqlite3.BUSY))
+
+	assert(fork.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)).noErr(t)
+	delta, err := ordmap.Diff("diff_wal.db", "diff_wal_fork.db")
+	require.NoError(t, err)
+
+	// Leave a WAL behind in the replica.
+	replica, err := sqlite3.Open("file:/diff_wal_replica.db?vfs=ordmap")
+	require.NoError(t, err)
+	_, err = replica.Config(sqlite3.DBCONFIG_NO_CKPT_ON_CLOSE, true)
+	require.NoError(t, err)
+	require.NoError(t, replica.Exec(`PRAGMA journal_mode=wal`))
+	require.NoError(t, replica.Exec(`DELETE FROM users`))
+	require.NoError(t, replica.Close())
+
+	// Applying discards the WAL.
+	require.NoError(t, ordmap.Apply("diff_wal_replica.db", delta))
+
+	db := assert(sql.Open("sqlite3", "file:/diff_wal_replica.db?vfs=ordmap")).noErr(t)
+	defer db.Close()
+	require.Equal(t, loadRows(t, fork), loadRows(t, db))
+}
@@ -0,0 +1,119 @@
+package ordmap
+
+import (
+	"cmp"
+	"slices"
+	"sync/atomic"
+
+	"github.com/ncruces/go-sqlite3"
+)
+
+var (
+	memoryUsed  atomic.Int64
+	memoryLimit atomic.Int64
+)
+
+// SetMemoryLimit limits the memory used by all ordmap databases
+// (shared or not) to limit bytes, and returns the previous limit.
+// A zero or negative limit means no limit.
+//
+// Writes that would exceed the limit fail with [sqlite3.FULL].
+//
+// Each database, fork and version accounts for the sectors it references,
+// even those it shares: forking a database, or retaining a version,
+// counts its memory again.
+// This may overestimate the memory in use,
+// but keeps forks and versions cheap.
+// Memory of a deleted database is released
+// once all its connections are closed.
+// Initial contents given to [Create], forks, versions and deltas
+// count against the limit, but never fail.
+func SetMemoryLimit(limit int64) int64 {
+	return memoryLimit.Swap(limit)
+}
+
+// MemoryInUse returns the memory used by all ordmap databases.
+func MemoryInUse() int64 {
+	return memoryUsed.Load()
+}
+
+// SetSizeLimit limits the size of a shared memory database
+// to limit bytes.
+// A zero or negative limit means no limit.
+//
+// Writes that would grow the database past the limit
+// fail with [sqlite3.FULL].
+// The limit applies to the database file, not to its WAL file,
+// which is only bound by [SetMemoryLimit].
+func SetSizeLimit(name string, limit int64) error {
+	db, err := lookup(name)
+	if err != nil {
+		return err
+	}
+
+	db.dataMtx.Lock()
+	defer db.dataMtx.Unlock()
+	db.limit = limit
+	return nil
+}
+
+// DBInfo describes a shared memory database.
+type DBInfo struct {
+	Name      string
+	Refs      int   // Open connections, plus one if created with Create, Fork or ReadFrom.
+	Size      int64 // The size of the database file.
+	SizeLimit int64 // The limit set with SetSizeLimit.
+}
+
+// Databases lists the shared memory databases, sorted by name.
+//
+// Databases that are never deleted are a common source of leaks:
+// those are listed until deleted, even with no open connections.
+func Databases() []DBInfo {
+	memoryMtx.Lock()
+	defer memoryMtx.Unlock()
+
+	dbs := make([]DBInfo, 0, len(memoryDBs))
+	for name, db := range memoryDBs {
+		db.dataMtx.RLock()
+		dbs = append(dbs, DBInfo{
+			Name:      name,
+			Refs:      int(db.refs),
+			Size:      db.size,
+			SizeLimit: db.limit,
+		})
+		db.dataMtx.RUnlock()
+	}
+	slices.SortFunc(dbs, func(a, b DBInfo) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return dbs
+}
+
+// reserve accounts for n more bytes,
+// unless that would exceed the memory limit.
+func reserve(n int64) bool {
+	limit := memoryLimit.Load()
+	if memoryUsed.Add(n) <= limit || limit <= 0 {
+		return true
+	}
+	memoryUsed.Add(-n)
+	return false
+}
+
+// account accounts for n more (or, if negative, fewer) bytes,
+// regardless of the memory limit.
+func account(n int64) {
+	memoryUsed.Add(n)
+}
+
+// newSector allocates a sector,
+// unless that would exceed the memory limit.
+// The sector is accounted for: the caller should
+// hand it to a database, or account for it going away.
+func newSector(size int64) ([]byte, error) {
+	if !reserve(size) {
+		return nil, sqlite3.FULL
+	}
+	return make([]byte, size), nil
+}
@@ -0,0 +1,81 @@
+package ordmap_test
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/vfs/ordmap"
+)
+
+func TestSetSizeLimit(t *testing.T) {
+	ordmap.Create("size_limit.db", append([]byte(nil), testDB...))
+	defer ordmap.Delete("size_limit.db")
+
+	require.NoError(t, ordmap.SetSizeLimit("size_limit.db", 1<<20))
+	err := ordmap.SetSizeLimit("missing.db", 1<<20)
+	require.True(t, errors.Is(err, sqlite3.CANTOPEN))
+
+	db := assert(sql.Open("sqlite3", "file:/size_limit.db?vfs=ordmap")).noErr(t)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	assert(db.Exec(`CREATE TABLE blobs (b BLOB)`)).noErr(t)
+	assert(db.Exec(`INSERT INTO blobs VALUES (zeroblob(100000))`)).noErr(t)
+	_, err = db.Exec(`INSERT INTO blobs VALUES (zeroblob(1000000))`)
+	require.True(t, errors.Is(err, sqlite3.FULL))
+
+	var found bool
+	for _, info := range ordmap.Databases() {
+		if info.Name == "size_limit.db" {
+			found = true
+			require.Equal(t, 2, info.Refs)
+			require.Equal(t, int64(1<<20), info.SizeLimit)
+			require.Less(t, info.Size, int64(1<<20))
+		}
+	}
+	require.True(t, found)
+}
+
+func TestSetMemoryLimit(t *testing.T) {
+	before := ordmap.MemoryInUse()
+	ordmap.Create("memory_limit.db", nil)
+	db := assert(sql.Open("sqlite3", "file:/memory_limit.db?vfs=ordmap")).noErr(t)
+	defer db.Close()
+	assert(db.Exec(`CREATE TABLE blobs (b BLOB)`)).noErr(t)
+	assert(db.Exec(`INSERT INTO blobs VALUES (randomblob(500000))`)).noErr(t)
+
+	// Forks and versions share sectors, but account for them.
+	used := ordmap.MemoryInUse() - before
+	for _, name := range []string{"memory_fork1.db", "memory_fork2.db", "memory_fork3.db"} {
+		ordmap.Fork("memory_limit.db", name)
+		defer ordmap.Delete(name)
+	}
+	require.Equal(t, before+4*used, ordmap.MemoryInUse())
+	require.NoError(t, ordmap.Tag("memory_fork1.db", "v1"))
+	require.Equal(t, before+5*used, ordmap.MemoryInUse())
+	require.NoError(t, ordmap.Untag("memory_fork1.db", "v1"))
+	require.Equal(t, before+4*used, ordmap.MemoryInUse())
+
+	defer ordmap.SetMemoryLimit(ordmap.SetMemoryLimit(ordmap.MemoryInUse() + 1<<19))
+	_, err := db.Exec(`INSERT INTO blobs VALUES (randomblob(1000000))`)
+	require.True(t, errors.Is(err, sqlite3.FULL))
+
+	// Restoring a version copies its first sector.
+	require.NoError(t, ordmap.Tag("memory_limit.db", "v2"))
+	err = ordmap.Restore("memory_limit.db", "v2")
+	require.True(t, errors.Is(err, sqlite3.FULL))
+
+	// Deleting the database and its forks releases its memory.
+	require.NoError(t, db.Close())
+	ordmap.Delete("memory_limit.db")
+	for _, name := range []string{"memory_fork1.db", "memory_fork2.db", "memory_fork3.db"} {
+		ordmap.Delete(name)
+	}
+	require.Equal(t, before, ordmap.MemoryInUse())
+}
@@ -3,6 +3,8 @@ package ordmap
 import (
 	"io"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,27 +13,43 @@ import (
 	"github.com/ncruces/go-sqlite3/vfs"
 )
 
+// Default sector size.
+// Sector sizes can be configured per database,
+// using the "sector_size" URI parameter, or [CreateWithOptions].
 const sectorSize = 65536 // 64KiB
 
-// Ensure sectorSize is a multiple of 64K (the largest page size).
-var _ [0]struct{} = [sectorSize & 65535]struct{}{}
-
 type memVFS struct{}
 
 func (memVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
-	// For simplicity, we do not support reading or writing data
-	// across "sector" boundaries in a single call.
-	//
-	// This is not a problem for most SQLite file types:
+	return open(name, flags, sectorSize)
+}
+
+func (memVFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	// The sector size only matters for new databases.
+	size := int64(sectorSize)
+	if s := name.URIParameter("sector_size"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || !validSectorSize(n) {
+			return nil, flags, sqlite3.CANTOPEN
+		}
+		size = n
+	}
+	return open(name.String(), flags, size)
+}
+
+func open(name string, flags vfs.OpenFlag, sectorSize int64) (vfs.File, vfs.OpenFlag, error) {
+	// We support these SQLite file types:
 	// - databases, which only do page aligned reads/writes;
 	// - temp journals, as used by the sorter, which does the same:
 	//   https://github.com/sqlite/sqlite/blob/b74eb0/src/vdbesort.c#L409-L412
+	// - WAL files of shared databases, which do unaligned reads/writes.
 	//
 	// We refuse to open all other file types,
 	// but returning OPEN_MEMORY means SQLite won't ask us to.
 	const types = vfs.OPEN_MAIN_DB |
 		vfs.OPEN_TEMP_DB |
-		vfs.OPEN_TEMP_JOURNAL
+		vfs.OPEN_TEMP_JOURNAL |
+		vfs.OPEN_WAL
 	if flags&types == 0 {
 		// notest // OPEN_MEMORY
 		return nil, flags, sqlite3.CANTOPEN
@@ -40,6 +58,14 @@ func (memVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, err
 	// A shared database has a name that begins with "/".
 	shared := len(name) > 1 && name[0] == '/'
 
+	if flags&vfs.OPEN_WAL != 0 {
+		// WAL files belong to a shared database.
+		if !shared {
+			return nil, flags, sqlite3.CANTOPEN
+		}
+		return openWAL(name[1:], flags)
+	}
+
 	var db *memDB
 	if shared {
 		name = name[1:]
@@ -52,27 +78,80 @@ func (memVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, err
 			return nil, flags, sqlite3.CANTOPEN
 		}
 		// Create a new database backend
-		db = &memDB{
-			name: name,
-			data: ordmap.NewBuiltin[int64, []byte](),
+		db = newMemDB(name, sectorSize)
+		if !shared {
+			db.refs = 1 // +checklocksignore: db is not shared
 		}
 	}
+	file := &memFile{
+		memDB:    db,
+		readOnly: flags&vfs.OPEN_READONLY != 0,
+	}
 	if shared {
 		db.refs++ // +checklocksforce: memoryMtx is held
 		memoryDBs[name] = db
+		// Connections to the same database share the WAL-index.
+		if flags&vfs.OPEN_MAIN_DB != 0 {
+			file.shm = vfs.NewMemorySharedMemory(db)
+		}
 	}
+	return file, flags | vfs.OPEN_MEMORY, nil
+}
+
+// openWAL opens the WAL file of a shared database.
+// The WAL is kept with the database, until SQLite deletes it.
+func openWAL(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	memoryMtx.Lock()
+	defer memoryMtx.Unlock()
 
+	main := walMain(name)
+	if main == nil {
+		return nil, flags, sqlite3.CANTOPEN
+	}
+	if main.wal == nil {
+		if flags&vfs.OPEN_CREATE == 0 {
+			return nil, flags, sqlite3.CANTOPEN
+		}
+		main.wal = newMemDB(name, main.sectorSize)
+		main.wal.refs = 1 // the reference from main
+	}
+	main.wal.refs++
 	return &memFile{
-		memDB:    db,
+		memDB:    main.wal,
 		readOnly: flags&vfs.OPEN_READONLY != 0,
-	}, flags | vfs.OPEN_MEMORY, nil
+	}, flags, nil
+}
+
+// walMain returns the shared database that owns a WAL file.
+// +checklocks:memoryMtx
+func walMain(name string) *memDB {
+	if name, ok := strings.CutSuffix(name, "-wal"); ok {
+		return memoryDBs[name]
+	}
+	return nil
 }
 
 func (memVFS) Delete(name string, dirSync bool) error {
+	if len(name) > 1 && name[0] == '/' {
+		memoryMtx.Lock()
+		defer memoryMtx.Unlock()
+		if main := walMain(name[1:]); main != nil && main.wal != nil {
+			main.wal.unref()
+			main.wal = nil
+			return nil
+		}
+	}
 	return sqlite3.IOERR_DELETE_NOENT // used to delete journals
 }
 
 func (memVFS) Access(name string, flag vfs.AccessFlag) (bool, error) {
+	if len(name) > 1 && name[0] == '/' {
+		memoryMtx.Lock()
+		defer memoryMtx.Unlock()
+		if main := walMain(name[1:]); main != nil {
+			return main.wal != nil, nil
+		}
+	}
 	return false, nil // used to check for journals
 }
 
@@ -83,6 +162,9 @@ func (memVFS) FullPathname(name string) (string, error) {
 type memDB struct {
 	name string
 
+	// Size of the copy-on-write unit, fixed on creation.
+	sectorSize int64
+
 	// Stores database content keyed by sector index.
 	// Slices are typically sectorSize bytes long, except potentially the last one.
 	// +checklocks:dataMtx
@@ -92,9 +174,31 @@ type memDB struct {
 	// +checklocks:dataMtx
 	size int64
 
+	// Memory used by data, which the database accounts for.
+	// +checklocks:dataMtx
+	used int64
+
+	// Named versions retained by Tag.
+	// +checklocks:dataMtx
+	versions map[string]memVersion
+
+	// Size limit set by SetSizeLimit.
+	// +checklocks:dataMtx
+	limit int64
+
+	// References from open files, Create, Fork and ReadFrom,
+	// and (for WAL files) the main database.
 	// +checklocks:memoryMtx
 	refs int32
 
+	// Created with Create, Fork or ReadFrom, and not deleted.
+	// +checklocks:memoryMtx
+	created bool
+
+	// The WAL file, if the database is in WAL mode.
+	// +checklocks:memoryMtx
+	wal *memDB
+
 	shared   int32 // +checklocks:lockMtx
 	pending  bool  // +checklocks:lockMtx
 	reserved bool  // +checklocks:lockMtx
@@ -103,39 +207,135 @@ type memDB struct {
 	dataMtx sync.RWMutex
 }
 
+func newMemDB(name string, sectorSize int64) *memDB {
+	return &memDB{
+		name:       name,
+		sectorSize: sectorSize,
+		data:       ordmap.NewBuiltin[int64, []byte](),
+	}
+}
+
+// validSectorSize reports if size is a power of two
+// between 512 and 64KiB (the largest page size).
+func validSectorSize(size int64) bool {
+	return 512 <= size && size <= 65536 && size&(size-1) == 0
+}
+
 func (m *memDB) release() {
 	memoryMtx.Lock()
 	defer memoryMtx.Unlock()
-	if m.refs--; m.refs == 0 && m == memoryDBs[m.name] {
+	m.unref()
+}
+
+// unref removes a reference to the database,
+// and releases its memory once there are none left.
+// +checklocks:memoryMtx
+func (m *memDB) unref() {
+	if m.refs--; m.refs != 0 {
+		return
+	}
+	if m == memoryDBs[m.name] {
 		delete(memoryDBs, m.name)
 	}
-}
+	if m.wal != nil {
+		m.wal.unref()
+		m.wal = nil
+	}
 
-func (m *memDB) fork() *memDB {
 	m.dataMtx.Lock()
 	defer m.dataMtx.Unlock()
-	return &memDB{
-		refs: 1,
-		name: m.name,
-		data: m.data,
-		size: m.size,
+	account(-m.used)
+	for _, v := range m.versions {
+		account(-v.used)
+	}
+	m.data = ordmap.NewBuiltin[int64, []byte]()
+	m.versions = nil
+	m.size = 0
+	m.used = 0
+}
+
+// dropWAL discards the WAL of a database whose contents were replaced,
+// since its transactions would be replayed over the new contents.
+// Connections in WAL mode always hold a SHARED lock,
+// so once there are no locks, no connection is using it.
+// +checklocks:memoryMtx
+func (m *memDB) dropWAL() {
+	if m.wal != nil {
+		m.wal.unref()
+		m.wal = nil
+	}
+}
+
+// +checklocks:memoryMtx
+func (m *memDB) fork() *memDB {
+	// Transactions in the WAL may not have been checkpointed yet.
+	// Lock the WAL before the database (like snapshot),
+	// so that a checkpoint can't move them while forking.
+	if m.wal != nil {
+		m.wal.dataMtx.RLock()
+		defer m.wal.dataMtx.RUnlock()
+	}
+	m.dataMtx.RLock()
+	defer m.dataMtx.RUnlock()
+
+	f := m.clone()
+	if m.wal != nil {
+		f.wal = m.wal.clone()
+	}
+	return f
+}
+
+// +checklocksread:m.dataMtx
+func (m *memDB) clone() *memDB {
+	f := &memDB{
+		refs:       1,
+		name:       m.name,
+		sectorSize: m.sectorSize,
+		data:       m.data,
+		size:       m.size,
+		used:       m.used,
+		limit:      m.limit,
+	}
+	// The fork shares sectors, but accounts for them.
+	account(f.used)
+	return f
+}
+
+// setSector replaces a sector with one the caller accounted for,
+// or removes it, if nil.
+// +checklocks:m.dataMtx
+func (m *memDB) setSector(base int64, sector []byte) {
+	if old, ok := m.data.Get(base); ok {
+		account(-int64(cap(old)))
+		m.used -= int64(cap(old))
+	}
+	if sector == nil {
+		m.data = m.data.Remove(base)
+	} else {
+		m.data = m.data.Insert(base, sector)
+		m.used += int64(cap(sector))
 	}
 }
 
 type memFile struct {
 	*memDB
+	shm      vfs.SharedMemory
 	lock     vfs.LockLevel
 	readOnly bool
 }
 
 var (
 	// Ensure these interfaces are implemented:
-	_ vfs.FileLockState = &memFile{}
-	_ vfs.FileSizeHint  = &memFile{}
+	_ vfs.FileLockState    = &memFile{}
+	_ vfs.FileSizeHint     = &memFile{}
+	_ vfs.FileSharedMemory = &memFile{}
 )
 
 func (m *memFile) Close() error {
 	m.release()
+	if m.shm != nil {
+		m.shm.Close()
+	}
 	return m.Unlock(vfs.LOCK_NONE)
 }
 
@@ -143,89 +343,43 @@ func (m *memFile) ReadAt(b []byte, off int64) (n int, err error) {
 	m.dataMtx.RLock()
 	defer m.dataMtx.RUnlock()
 
-	fileSize := m.size // Capture size under lock
-
 	if off < 0 {
 		// This case should ideally not happen with SQLite VFS usage.
-		return 0, sqlite3.IOERR_READ // Or perhaps io.ErrUnexpectedEOF
-	}
-	if off >= fileSize {
-		return 0, io.EOF
-	}
-
-	// Calculate how many bytes we *can* read from the file overall
-	readableFromFile := fileSize - off
-	bytesToRead := int64(len(b))
-	isShortReadEOF := false // Will we hit EOF and read less than len(b)?
-	if bytesToRead > readableFromFile {
-		bytesToRead = readableFromFile // Limit read to EOF
-		isShortReadEOF = true
+		return 0, sqlite3.IOERR_READ
 	}
 
-	if bytesToRead == 0 {
-		// This can happen if off == fileSize, should be caught by initial check.
-		return 0, io.EOF
-	}
+	// Reads may cross sectors (WAL files do unaligned reads),
+	// so read one sector at a time.
+	for n < len(b) {
+		if off >= m.size {
+			return n, io.EOF
+		}
 
-	// Assume reads don't cross sectors (as per original code's VFS comment)
-	base := off / sectorSize
-	rest := off % sectorSize
+		base := off / m.sectorSize
+		rest := off % m.sectorSize
 
-	// Calculate max bytes to read *within this sector* boundary
-	bytesInSector := sectorSize - rest
-	readNow := min(bytesToRead, bytesInSector) // Actual bytes to process in this call
+		// Don't read past the end of the sector, or the file.
+		readNow := min(int64(len(b)-n), m.sectorSize-rest, m.size-off)
+		dst := b[n : n+int(readNow)]
 
-	page, ok := m.data.Get(base)
-	if !ok {
-		// Sparse read - return zeroes
-		clear(b[:readNow])
-		n = int(readNow)
-	} else {
-		// Sector exists. Read from the available slice data.
-		availableInPage := int64(len(page)) - rest
-		if availableInPage <= 0 {
-			// Offset is at or past the end of this page's actual stored data.
-			// Return zeroes for the requested portion within this conceptual sector.
-			clear(b[:readNow])
-			n = int(readNow)
-		} else {
-			// Read available data from the page slice
-			readFromPage := min(readNow, availableInPage)
-			bytesCopied := copy(b[:readFromPage], page[rest:rest+readFromPage])
-			n = bytesCopied
-
-			// If readNow > readFromPage, it means we need more zeroes
-			// after the end of the actual slice data up to the readNow limit.
-			if readNow > readFromPage {
-				zeroStart := readFromPage
-				zeroEnd := readNow
-				clear(b[zeroStart:zeroEnd])
-				n = int(readNow) // Total bytes "read" (data + zeroes)
-			}
+		// Sparse sectors, and bytes past the end of a short slice, read as zeroes.
+		var copied int
+		if page, ok := m.data.Get(base); ok && rest < int64(len(page)) {
+			copied = copy(dst, page[rest:])
 		}
-	}
+		clear(dst[copied:])
 
-	// Determine return error based on io.ReaderAt spec
-	if isShortReadEOF {
-		// We read fewer bytes than originally requested *because* we hit EOF
-		err = io.EOF
-	} else if int64(n) < int64(len(b)) {
-		// We read fewer bytes than requested, but didn't hit EOF.
-		// This implies the read *would* have crossed a sector boundary if fully satisfied.
-		// Given the original VFS constraint assumption, SQLite shouldn't cause this.
-		// If it *did*, returning nil error is pragmatic, allowing the next read call.
-		err = nil
+		off += readNow
+		n += int(readNow)
 	}
-	// If n == len(b), err is nil.
-
-	return n, err
+	return n, nil
 }
 
 // writeToSector handles the logic of writing data into a specific sector's slice.
 // Assumes m.dataMtx is already held for writing.
 // +checklocks:m.dataMtx
 func (m *memFile) writeToSector(base int64, offsetInSector int64, dataToWrite []byte) (int, error) {
-	if offsetInSector < 0 || offsetInSector >= sectorSize {
+	if offsetInSector < 0 || offsetInSector >= m.sectorSize {
 		return 0, sqlite3.IOERR_WRITE // Invalid offset
 	}
 	if len(dataToWrite) == 0 {
@@ -233,19 +387,21 @@ func (m *memFile) writeToSector(base int64, offsetInSector int64, dataToWrite []
 	}
 
 	neededEndOffset := offsetInSector + int64(len(dataToWrite))
-	if neededEndOffset > sectorSize {
+	if neededEndOffset > m.sectorSize {
 		// Caller should have prevented this based on non-crossing assumption
 		return 0, io.ErrShortWrite // Attempt to write past sector boundary
 	}
 
+	// Copy-on-write: always allocate a new sector.
+	newPage, err := newSector(m.sectorSize)
+	if err != nil {
+		return 0, err
+	}
 	page, ok := m.data.Get(base)
-	if !ok {
-		page = make([]byte, sectorSize)
-	} else {
-		newPage := make([]byte, sectorSize)
+	if ok {
 		copy(newPage, page) // Copy existing data
-		page = newPage
 	}
+	page = newPage
 
 	// Perform the copy
 	n := copy(page[offsetInSector:], dataToWrite)
@@ -255,7 +411,7 @@ func (m *memFile) writeToSector(base int64, offsetInSector int64, dataToWrite []
 		return n, io.ErrShortWrite // Or sqlite3.IOERR_WRITE
 	}
 
-	m.data = m.data.Insert(base, page)
+	m.setSector(base, page)
 	return n, nil
 }
 
@@ -264,62 +420,56 @@ func (m *memFile) WriteAt(b []byte, off int64) (n int, err error) {
 	defer m.dataMtx.Unlock()
 
 	if off < 0 {
-		return 0, sqlite3.IOERR_WRITE // Or io.ErrUnexpectedEOF
+		return 0, sqlite3.IOERR_WRITE
 	}
-	if len(b) == 0 {
-		return 0, nil
+	if err := m.checkLimit(off + int64(len(b))); err != nil {
+		return 0, err
 	}
 
-	base := off / sectorSize
-	rest := off % sectorSize
-	writeEndOff := off + int64(len(b))
+	// Writes may cross sectors (WAL files do unaligned writes),
+	// so write one sector at a time.
+	for n < len(b) {
+		base := off / m.sectorSize
+		rest := off % m.sectorSize
+		writeNow := min(int64(len(b)-n), m.sectorSize-rest)
 
-	// Check if write crosses sector boundary (based on original code's assumption)
-	if writeEndOff > (base+1)*sectorSize {
-		// notest // assume writes are page aligned and non-crossing
-		// Write only the portion that fits in the current sector
-		bytesToWrite := sectorSize - rest
-		if bytesToWrite <= 0 {
-			// Write starts exactly at or beyond the sector boundary.
-			return 0, io.ErrShortWrite // Cannot write 0 bytes or start past end
-		}
+		written, err := m.writeToSector(base, rest, b[n:n+int(writeNow)])
+		off += int64(written)
+		n += written
 
-		n, err = m.writeToSector(base, rest, b[:bytesToWrite])
-		// Update size only for the bytes actually written in this sector
-		currentWriteEnd := off + int64(n)
-		if currentWriteEnd > m.size {
-			m.size = currentWriteEnd
+		// Update size if this write extended the file
+		if off > m.size {
+			m.size = off
 		}
 		if err != nil {
-			return n, err // Return error from writeToSector if any
+			return n, err
 		}
-		// Return ErrShortWrite because we couldn't write all of `b`
-		return n, io.ErrShortWrite
-	}
-
-	// Write fits entirely within a single sector
-	n, err = m.writeToSector(base, rest, b)
-	if err != nil {
-		return n, err // Return error from writeToSector if any
-	}
-
-	// Update size if this write extended the file
-	if writeEndOff > m.size {
-		m.size = writeEndOff
 	}
-	return n, nil // Success
+	return n, nil
 }
 
 func (m *memFile) Truncate(size int64) error {
 	m.dataMtx.Lock()
 	defer m.dataMtx.Unlock()
+	if err := m.checkLimit(size); err != nil {
+		return err
+	}
 	return m.truncate(size)
 }
 
+// checkLimit fails with FULL if the file would grow past its size limit.
+// +checklocks:m.dataMtx
+func (m *memDB) checkLimit(size int64) error {
+	if m.limit > 0 && size > m.limit && size > m.size {
+		return sqlite3.FULL
+	}
+	return nil
+}
+
 // truncate adjusts the file size and underlying map data.
 // Assumes m.dataMtx lock is held.
 // +checklocks:m.dataMtx
-func (m *memFile) truncate(size int64) error {
+func (m *memDB) truncate(size int64) error {
 	if size < 0 {
 		size = 0 // File size cannot be negative
 	}
@@ -327,25 +477,28 @@ func (m *memFile) truncate(size int64) error {
 	m.size = size // Update logical size
 
 	if size == 0 {
+		account(-m.used)
 		m.data = ordmap.NewBuiltin[int64, []byte]()
+		m.used = 0
 		return nil
 	}
 
 	// Calculate the index of the last sector needed and its size
-	lastBase := (size - 1) / sectorSize
-	sizeInLastSector := size - (lastBase * sectorSize) // Bytes used in the last sector
+	lastBase := (size - 1) / m.sectorSize
+	sizeInLastSector := size - (lastBase * m.sectorSize) // Bytes used in the last sector
 
+	// Shorten the last sector, without copying it:
+	// bytes past the end of a short slice read as zeroes,
+	// and writes copy the sector before changing it.
 	lastSector, ok := m.data.Get(lastBase)
-	if ok {
-		truncated := make([]byte, sectorSize)
-		copy(truncated, lastSector)
-		m.data = m.data.Insert(lastBase, truncated[:sizeInLastSector])
+	if ok && int64(len(lastSector)) > sizeInLastSector {
+		m.data = m.data.Insert(lastBase, lastSector[:sizeInLastSector])
 	}
 
 	for iter := m.data.Iterate(); !iter.Done(); iter.Next() {
 		key := iter.GetKey()
 		if key > lastBase {
-			m.data = m.data.Remove(key)
+			m.setSector(key, nil)
 		}
 	}
 
@@ -475,7 +628,7 @@ func (m *memFile) CheckReservedLock() (bool, error) {
 func (m *memFile) SectorSize() int {
 	// Must be >= 512 and a power of two. Matches SQLite page size constraints.
 	// Used for certain optimizations like atomic writes if IOCAP_ATOMIC is set.
-	return sectorSize
+	return int(m.sectorSize)
 }
 
 func (m *memFile) DeviceCharacteristics() vfs.DeviceCharacteristic {
@@ -498,6 +651,9 @@ func (m *memFile) SizeHint(size int64) error {
 	if size > m.size {
 		// Only update logical size if hinting larger. Don't preallocate.
 		// Don't shrink based on a hint.
+		if err := m.checkLimit(size); err != nil {
+			return err
+		}
 		return m.truncate(size)
 	}
 	return nil // Hinting smaller or same size is a no-op.
@@ -513,15 +669,12 @@ func (m *memFile) LockState() vfs.LockLevel {
 	return m.lock
 }
 
+func (m *memFile) SharedMemory() vfs.SharedMemory {
+	// Only the main file of a shared database has a WAL-index.
+	return m.shm
+}
+
 // Helper functions (unchanged)
 func divRoundUp(a, b int64) int64 {
 	return (a + b - 1) / b
 }
-
-// min returns the smaller of two int64 values.
-func min(a, b int64) int64 {
-	if a < b {
-		return a
-	}
-	return b
-}
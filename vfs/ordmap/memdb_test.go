@@ -2,11 +2,13 @@ package ordmap
 
 import (
 	_ "embed"
+	"sync"
 	"testing"
 
 	"github.com/ncruces/go-sqlite3"
 	_ "github.com/ncruces/go-sqlite3/embed"
 	_ "github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs/vfstest"
 )
 
 //go:embed testdata/wal.db
@@ -27,4 +29,141 @@ func Test_wal(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	stmt, _, err := db.Prepare(`PRAGMA journal_mode`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	if !stmt.Step() {
+		t.Fatal(stmt.Err())
+	}
+	if got := stmt.ColumnText(0); got != "wal" {
+		t.Errorf("got %q want wal", got)
+	}
+}
+
+func Test_wal_concurrent(t *testing.T) {
+	t.Parallel()
+	name := "file:/" + t.Name() + ".db?vfs=ordmap&_pragma=busy_timeout(10000)"
+	Create(t.Name()+".db", nil)
+	defer Delete(t.Name() + ".db")
+
+	writer, err := sqlite3.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	err = writer.Exec(`
+		PRAGMA journal_mode=wal;
+		CREATE TABLE t (x);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reader, err := sqlite3.Open(name)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer reader.Close()
+
+			// Counts never go backwards.
+			last := 0
+			for last < 100 {
+				stmt, _, err := reader.Prepare(`SELECT count(*) FROM t`)
+				if err != nil {
+					errs <- err
+					return
+				}
+				stmt.Step()
+				n := stmt.ColumnInt(0)
+				if err := stmt.Close(); err != nil {
+					errs <- err
+					return
+				}
+				if n < last {
+					t.Errorf("count went from %d to %d", last, n)
+					return
+				}
+				last = n
+			}
+		}()
+	}
+
+	for range 100 {
+		err := writer.Exec(`INSERT INTO t VALUES (randomblob(10000))`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func Test_wal_fork(t *testing.T) {
+	t.Parallel()
+	Create(t.Name()+".db", nil)
+	defer Delete(t.Name() + ".db")
+	defer Delete(t.Name() + ".fork")
+
+	db, err := sqlite3.Open("file:/" + t.Name() + ".db?vfs=ordmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Exec(`
+		PRAGMA journal_mode=wal;
+		PRAGMA wal_autocheckpoint=0;
+		CREATE TABLE t (x);
+		INSERT INTO t VALUES (1), (2), (3);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fork includes transactions
+	// that weren't checkpointed.
+	Fork(t.Name()+".db", t.Name()+".fork")
+
+	fork, err := sqlite3.Open("file:/" + t.Name() + ".fork?vfs=ordmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fork.Close()
+
+	stmt, _, err := fork.Prepare(`SELECT count(*) FROM t`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	if !stmt.Step() {
+		t.Fatal(stmt.Err())
+	}
+	if got := stmt.ColumnInt(0); got != 3 {
+		t.Errorf("got %d want 3", got)
+	}
+}
+
+func Test_vfstest(t *testing.T) {
+	vfstest.Test(t, memVFS{}, &vfstest.Options{
+		Name: func(t *testing.T) string {
+			// Shared databases can be opened more than once.
+			return "/" + t.Name() + ".db"
+		},
+	})
 }
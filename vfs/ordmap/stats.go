@@ -0,0 +1,69 @@
+package ordmap
+
+import (
+	"unsafe"
+
+	"github.com/edofic/go-ordmap/v2"
+	"github.com/ncruces/go-sqlite3"
+)
+
+// DBStats reports the memory used by a shared memory database.
+type DBStats struct {
+	SectorSize  int64 // The sector size of the database.
+	Sectors     int64 // The number of sectors stored.
+	LiveBytes   int64 // The memory used by the stored sectors.
+	SharedBytes int64 // The part of LiveBytes that is shared with other databases.
+}
+
+// Stats reports the memory used by a shared memory database.
+//
+// Sectors are shared with forks of the database,
+// with the database it was forked from,
+// and with the versions those databases retain.
+// Memory retained only by versions of this database isn't counted.
+//
+// Stats visits every sector of every shared memory database,
+// so it can be expensive.
+func Stats(name string) (DBStats, error) {
+	memoryMtx.Lock()
+	defer memoryMtx.Unlock()
+
+	db := memoryDBs[name]
+	if db == nil {
+		return DBStats{}, sqlite3.CANTOPEN
+	}
+
+	// Find sectors referenced by other databases.
+	others := map[*byte]struct{}{}
+	for _, other := range memoryDBs {
+		if other == db {
+			continue
+		}
+		other.dataMtx.RLock()
+		addSectors(others, other.data)
+		for _, v := range other.versions {
+			addSectors(others, v.data)
+		}
+		other.dataMtx.RUnlock()
+	}
+
+	db.dataMtx.RLock()
+	defer db.dataMtx.RUnlock()
+
+	stats := DBStats{SectorSize: db.sectorSize}
+	for iter := db.data.Iterate(); !iter.Done(); iter.Next() {
+		sector := iter.GetValue()
+		stats.Sectors++
+		stats.LiveBytes += int64(cap(sector))
+		if _, ok := others[unsafe.SliceData(sector)]; ok {
+			stats.SharedBytes += int64(cap(sector))
+		}
+	}
+	return stats, nil
+}
+
+func addSectors(set map[*byte]struct{}, data ordmap.NodeBuiltin[int64, []byte]) {
+	for iter := data.Iterate(); !iter.Done(); iter.Next() {
+		set[unsafe.SliceData(iter.GetValue())] = struct{}{}
+	}
+}
@@ -0,0 +1,80 @@
+package ordmap_test
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/vfs/ordmap"
+)
+
+func TestStats(t *testing.T) {
+	err := ordmap.CreateWithOptions("stats.db", append([]byte(nil), testDB...), ordmap.Options{SectorSize: 512})
+	require.NoError(t, err)
+	defer ordmap.Delete("stats.db")
+
+	stats, err := ordmap.Stats("stats.db")
+	require.NoError(t, err)
+	require.Equal(t, int64(512), stats.SectorSize)
+	require.Equal(t, int64(len(testDB)/512), stats.Sectors)
+	require.Equal(t, int64(len(testDB)), stats.LiveBytes)
+	require.Zero(t, stats.SharedBytes)
+
+	db := assert(sql.Open("sqlite3", "file:/stats.db?vfs=ordmap")).noErr(t)
+	defer db.Close()
+	assert(db.Exec(`CREATE TABLE blobs (b BLOB)`)).noErr(t)
+	assert(db.Exec(`INSERT INTO blobs SELECT randomblob(100) FROM generate_series(1, 100)`)).noErr(t)
+
+	// A fork shares every sector.
+	ordmap.Fork("stats.db", "stats_fork.db")
+	defer ordmap.Delete("stats_fork.db")
+
+	stats, err = ordmap.Stats("stats_fork.db")
+	require.NoError(t, err)
+	require.Equal(t, int64(512), stats.SectorSize)
+	require.Equal(t, stats.LiveBytes, stats.SharedBytes)
+
+	// Writing to the fork copies only the changed sectors.
+	fork := assert(sql.Open("sqlite3", "file:/stats_fork.db?vfs=ordmap")).noErr(t)
+	defer fork.Close()
+	assert(fork.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)).noErr(t)
+
+	stats, err = ordmap.Stats("stats_fork.db")
+	require.NoError(t, err)
+	require.Less(t, stats.SharedBytes, stats.LiveBytes)
+	require.Less(t, stats.LiveBytes-stats.SharedBytes, stats.LiveBytes/4)
+
+	// Databases with different sector sizes can't be diffed.
+	ordmap.Create("stats_default.db", append([]byte(nil), testDB...))
+	defer ordmap.Delete("stats_default.db")
+
+	_, err = ordmap.Diff("stats_default.db", "stats.db")
+	require.True(t, errors.Is(err, sqlite3.MISMATCH))
+}
+
+func TestStats_uri(t *testing.T) {
+	db := assert(sql.Open("sqlite3", "file:/stats_uri.db?vfs=ordmap&sector_size=4096")).noErr(t)
+	defer db.Close()
+	assert(db.Exec(`CREATE TABLE t (x)`)).noErr(t)
+
+	stats, err := ordmap.Stats("stats_uri.db")
+	require.NoError(t, err)
+	require.Equal(t, int64(4096), stats.SectorSize)
+
+	_, err = ordmap.Stats("missing.db")
+	require.True(t, errors.Is(err, sqlite3.CANTOPEN))
+}
+
+func TestCreateWithOptions(t *testing.T) {
+	err := ordmap.CreateWithOptions("options.db", nil, ordmap.Options{SectorSize: 1000})
+	require.True(t, errors.Is(err, sqlite3.MISUSE))
+
+	db := assert(sql.Open("sqlite3", "file:/options.db?vfs=ordmap&sector_size=1000")).noErr(t)
+	defer db.Close()
+	require.Error(t, db.Ping())
+}
@@ -0,0 +1,148 @@
+package ordmap
+
+import (
+	"io"
+
+	"github.com/edofic/go-ordmap/v2"
+	"github.com/ncruces/go-sqlite3"
+)
+
+var zeroes [sectorSize]byte
+
+// WriteTo writes the contents of a shared memory database to w,
+// in the SQLite database file format.
+//
+// WriteTo captures the current contents of the database and streams them,
+// so writers can continue while the copy is in progress.
+// Since the copy doesn't go through SQLite, it is cheaper than a backup,
+// but it won't include transactions that are in the WAL:
+// for databases in WAL mode, run a TRUNCATE checkpoint first.
+//
+// WriteTo fails with [sqlite3.BUSY] if a transaction is writing to the database,
+// or if the WAL has transactions that weren't checkpointed.
+func WriteTo(name string, w io.Writer) (n int64, err error) {
+	db, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := db.snapshot()
+	if err != nil {
+		return 0, err
+	}
+
+	for base := int64(0); base*db.sectorSize < v.size; base++ {
+		want := min(db.sectorSize, v.size-base*db.sectorSize)
+
+		// Sparse sectors, and bytes past the end of a short slice, read as zeroes.
+		sector, _ := v.data.Get(base)
+		sector = sector[:min(int64(len(sector)), want)]
+		m, err := w.Write(sector)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+		m, err = w.Write(zeroes[:want-int64(len(sector))])
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ReadFrom replaces the contents of a shared memory database
+// with a database file read from r, until EOF.
+// The database is created if it doesn't exist,
+// with the default sector size.
+//
+// The stream is read before the database is touched,
+// and the contents are replaced atomically.
+// ReadFrom fails with [sqlite3.BUSY] if any connection
+// holds a lock on the database,
+// and with [sqlite3.FULL] if the memory limit is exceeded.
+func ReadFrom(name string, r io.Reader) (n int64, err error) {
+	size := int64(sectorSize)
+	if db, err := lookup(name); err == nil {
+		size = db.sectorSize
+	}
+
+	// Sectors are accounted for as they're read,
+	// until the database takes them.
+	v := memVersion{data: ordmap.NewBuiltin[int64, []byte]()}
+	defer func() { account(-v.used) }()
+
+	for base := int64(0); ; base++ {
+		sector, err := newSector(size)
+		if err != nil {
+			return n, err
+		}
+		m, err := io.ReadFull(r, sector)
+		n += int64(m)
+		// Skip sectors that are all zeroes.
+		if isZero(sector[:m]) {
+			account(-size)
+		} else {
+			v.data = v.data.Insert(base, sector)
+			v.used += size
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	memoryMtx.Lock()
+	defer memoryMtx.Unlock()
+
+	v.size = n
+	db := memoryDBs[name]
+	if db == nil {
+		memoryDBs[name] = &memDB{
+			refs:       1,
+			created:    true,
+			name:       name,
+			sectorSize: size,
+			data:       v.data,
+			size:       v.size,
+			used:       v.used,
+		}
+		v.used = 0
+		return n, nil
+	}
+	if db.sectorSize != size {
+		// The database was replaced while we were reading.
+		return n, sqlite3.BUSY
+	}
+	if err := db.replace(v); err != nil {
+		return n, err
+	}
+	v.used = 0
+	db.dropWAL()
+	return n, nil
+}
+
+// replace atomically replaces the contents of the database
+// with a version the caller accounted for,
+// unless any connection holds a lock on it.
+func (m *memDB) replace(v memVersion) error {
+	m.lockMtx.Lock()
+	defer m.lockMtx.Unlock()
+	if m.shared > 0 || m.reserved || m.pending {
+		return sqlite3.BUSY
+	}
+
+	m.dataMtx.Lock()
+	defer m.dataMtx.Unlock()
+	v, err := v.bumpChangeCounter(m.data)
+	if err != nil {
+		return err
+	}
+	account(-m.used)
+	m.data = v.data
+	m.size = v.size
+	m.used = v.used
+	return nil
+}
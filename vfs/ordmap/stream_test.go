@@ -0,0 +1,101 @@
+package ordmap_test
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/vfs/ordmap"
+)
+
+func TestWriteTo(t *testing.T) {
+	ordmap.Create("stream.db", append([]byte(nil), testDB...))
+	defer ordmap.Delete("stream.db")
+	defer ordmap.Delete("stream_copy.db")
+
+	var buf bytes.Buffer
+	n, err := ordmap.WriteTo("stream.db", &buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(testDB)), n)
+	require.Equal(t, testDB, buf.Bytes())
+
+	db := assert(sql.Open("sqlite3", "file:/stream.db?vfs=ordmap")).noErr(t)
+	defer db.Close()
+	assert(db.Exec(`PRAGMA journal_mode=wal`)).noErr(t)
+	assert(db.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)).noErr(t)
+
+	// The insert is in the WAL.
+	_, err = ordmap.WriteTo("stream.db", &buf)
+	require.True(t, errors.Is(err, sqlite3.BUSY))
+
+	assert(db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)).noErr(t)
+
+	buf.Reset()
+	_, err = ordmap.WriteTo("stream.db", &buf)
+	require.NoError(t, err)
+
+	n, err = ordmap.ReadFrom("stream_copy.db", &buf)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(testDB)), n)
+
+	copy := assert(sql.Open("sqlite3", "file:/stream_copy.db?vfs=ordmap")).noErr(t)
+	defer copy.Close()
+	require.Equal(t, loadRows(t, db), loadRows(t, copy))
+}
+
+func TestWriteTo_concurrent(t *testing.T) {
+	ordmap.Create("stream_writer.db", append([]byte(nil), testDB...))
+	defer ordmap.Delete("stream_writer.db")
+	defer ordmap.Delete("stream_export.db")
+
+	db := assert(sql.Open("sqlite3", "file:/stream_writer.db?vfs=ordmap")).noErr(t)
+	defer db.Close()
+
+	// Write to the database while the export is in progress.
+	var buf bytes.Buffer
+	w := writerFunc(func(p []byte) (int, error) {
+		if buf.Len() == 0 {
+			assert(db.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)).noErr(t)
+		}
+		return buf.Write(p)
+	})
+	_, err := ordmap.WriteTo("stream_writer.db", w)
+	require.NoError(t, err)
+
+	_, err = ordmap.ReadFrom("stream_export.db", &buf)
+	require.NoError(t, err)
+
+	export := assert(sql.Open("sqlite3", "file:/stream_export.db?vfs=ordmap")).noErr(t)
+	defer export.Close()
+	require.Equal(t, map[string]string{
+		"0": "go",
+		"1": "zig",
+		"2": "whatever",
+	}, loadRows(t, export))
+	require.Len(t, loadRows(t, db), 4)
+}
+
+func TestReadFrom_busy(t *testing.T) {
+	ordmap.Create("stream_busy.db", append([]byte(nil), testDB...))
+	defer ordmap.Delete("stream_busy.db")
+
+	db := assert(sql.Open("sqlite3", "file:/stream_busy.db?vfs=ordmap")).noErr(t)
+	defer db.Close()
+
+	tx := assert(db.Begin()).noErr(t)
+	defer tx.Rollback()
+	assert(tx.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)).noErr(t)
+
+	_, err := ordmap.ReadFrom("stream_busy.db", bytes.NewReader(testDB))
+	require.True(t, errors.Is(err, sqlite3.BUSY))
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
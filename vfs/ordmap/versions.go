@@ -0,0 +1,153 @@
+package ordmap
+
+import (
+	"encoding/binary"
+	"slices"
+
+	"github.com/edofic/go-ordmap/v2"
+	"github.com/ncruces/go-sqlite3"
+)
+
+// memVersion is a retained version of a database.
+type memVersion struct {
+	data ordmap.NodeBuiltin[int64, []byte]
+	size int64
+	used int64 // memory used by data, which the version accounts for
+}
+
+// Tag retains the current contents of a shared memory database
+// as a named version, replacing any version with the same name.
+//
+// Retaining a version is cheap, since it shares
+// unchanged sectors with the database.
+// Tag fails with [sqlite3.BUSY] if a transaction
+// is writing to the database,
+// or if the WAL has transactions that weren't checkpointed:
+// for databases in WAL mode, run a TRUNCATE checkpoint first.
+func Tag(name, version string) error {
+	db, err := lookup(name)
+	if err != nil {
+		return err
+	}
+
+	v, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+
+	db.dataMtx.Lock()
+	defer db.dataMtx.Unlock()
+	if db.versions == nil {
+		db.versions = map[string]memVersion{}
+	}
+	// The version shares sectors, but accounts for them.
+	account(v.used)
+	if old, ok := db.versions[version]; ok {
+		account(-old.used)
+	}
+	db.versions[version] = v
+	return nil
+}
+
+// Untag releases a named version of a shared memory database.
+func Untag(name, version string) error {
+	db, err := lookup(name)
+	if err != nil {
+		return err
+	}
+
+	db.dataMtx.Lock()
+	defer db.dataMtx.Unlock()
+	if v, ok := db.versions[version]; ok {
+		account(-v.used)
+		delete(db.versions, version)
+	}
+	return nil
+}
+
+// Versions returns the names of the versions
+// retained for a shared memory database, sorted.
+func Versions(name string) ([]string, error) {
+	db, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	db.dataMtx.RLock()
+	defer db.dataMtx.RUnlock()
+	versions := make([]string, 0, len(db.versions))
+	for v := range db.versions {
+		versions = append(versions, v)
+	}
+	slices.Sort(versions)
+	return versions, nil
+}
+
+// Restore atomically replaces the contents of a shared memory database
+// with a named version, previously retained with [Tag].
+// The version is kept, and can be restored again.
+// A WAL left behind by a connection is discarded.
+//
+// Restore fails with [sqlite3.NOTFOUND] if there is no such version,
+// with [sqlite3.BUSY] if any connection holds a lock on the database,
+// and with [sqlite3.FULL] if the memory limit is exceeded.
+func Restore(name, version string) error {
+	memoryMtx.Lock()
+	defer memoryMtx.Unlock()
+
+	db := memoryDBs[name]
+	if db == nil {
+		return sqlite3.CANTOPEN
+	}
+
+	db.dataMtx.RLock()
+	v, ok := db.versions[version]
+	db.dataMtx.RUnlock()
+	if !ok {
+		return sqlite3.NOTFOUND
+	}
+	// The database shares sectors with the version, but accounts for them.
+	account(v.used)
+	if err := db.replace(v); err != nil {
+		account(-v.used)
+		return err
+	}
+	db.dropWAL()
+	return nil
+}
+
+// bumpChangeCounter returns a copy of the version
+// with the file change counter set past the one in curr.
+//
+// Connections use the change counter to decide if their page cache is stale.
+// A restored version may have the same counter as the contents
+// some connection has cached, so make sure it's a new one.
+//
+// https://sqlite.org/fileformat.html#file_change_counter
+func (v memVersion) bumpChangeCounter(curr ordmap.NodeBuiltin[int64, []byte]) (memVersion, error) {
+	page, ok := v.data.Get(0)
+	if !ok || len(page) < 100 {
+		return v, nil
+	}
+	var counter uint32
+	if curr, ok := curr.Get(0); ok && len(curr) >= 100 {
+		counter = binary.BigEndian.Uint32(curr[24:])
+	}
+	old := binary.BigEndian.Uint32(page[24:])
+	counter = max(counter, old) + 1
+
+	sector, err := newSector(int64(len(page)))
+	if err != nil {
+		return v, err
+	}
+	copy(sector, page)
+	binary.BigEndian.PutUint32(sector[24:], counter)
+	// Keep the in-header database size valid, if it was.
+	if binary.BigEndian.Uint32(page[92:]) == old {
+		binary.BigEndian.PutUint32(sector[92:], counter)
+	}
+	account(-int64(cap(page)))
+	v.used += int64(cap(sector)) - int64(cap(page))
+	v.data = v.data.Insert(0, sector)
+	return v, nil
+}
@@ -0,0 +1,106 @@
+package ordmap_test
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/vfs/ordmap"
+)
+
+func TestRestore(t *testing.T) {
+	ordmap.Create("versions.db", append([]byte(nil), testDB...))
+	defer ordmap.Delete("versions.db")
+
+	db := assert(sql.Open("sqlite3", "file:/versions.db?vfs=ordmap")).noErr(t)
+	defer db.Close()
+
+	seeded := loadRows(t, db)
+	require.NoError(t, ordmap.Tag("versions.db", "seeded"))
+
+	assert(db.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)).noErr(t)
+	require.NoError(t, ordmap.Tag("versions.db", "rust"))
+	rust := loadRows(t, db)
+
+	assert(db.Exec(`DELETE FROM users`)).noErr(t)
+	require.Empty(t, loadRows(t, db))
+
+	versions, err := ordmap.Versions("versions.db")
+	require.NoError(t, err)
+	require.Equal(t, []string{"rust", "seeded"}, versions)
+
+	// Connections see the restored version.
+	require.NoError(t, ordmap.Restore("versions.db", "seeded"))
+	require.Equal(t, seeded, loadRows(t, db))
+
+	assert(db.Exec(`INSERT INTO users (id, name) VALUES (4, 'java')`)).noErr(t)
+	require.NoError(t, ordmap.Restore("versions.db", "rust"))
+	require.Equal(t, rust, loadRows(t, db))
+
+	// Versions can be restored more than once.
+	require.NoError(t, ordmap.Restore("versions.db", "seeded"))
+	require.Equal(t, seeded, loadRows(t, db))
+
+	require.NoError(t, ordmap.Untag("versions.db", "rust"))
+	err = ordmap.Restore("versions.db", "rust")
+	require.True(t, errors.Is(err, sqlite3.NOTFOUND))
+}
+
+func TestRestore_busy(t *testing.T) {
+	ordmap.Create("busy.db", append([]byte(nil), testDB...))
+	defer ordmap.Delete("busy.db")
+	require.NoError(t, ordmap.Tag("busy.db", "seeded"))
+
+	db := assert(sql.Open("sqlite3", "file:/busy.db?vfs=ordmap")).noErr(t)
+	defer db.Close()
+
+	tx := assert(db.Begin()).noErr(t)
+	defer tx.Rollback()
+	assert(tx.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)).noErr(t)
+
+	err := ordmap.Restore("busy.db", "seeded")
+	require.True(t, errors.Is(err, sqlite3.BUSY))
+}
+
+func TestRestore_wal(t *testing.T) {
+	ordmap.Create("versions_wal.db", append([]byte(nil), testDB...))
+	defer ordmap.Delete("versions_wal.db")
+
+	db, err := sqlite3.Open("file:/versions_wal.db?vfs=ordmap")
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Leave the WAL behind when closing.
+	_, err = db.Config(sqlite3.DBCONFIG_NO_CKPT_ON_CLOSE, true)
+	require.NoError(t, err)
+	require.NoError(t, db.Exec(`PRAGMA journal_mode=wal`))
+	require.NoError(t, ordmap.Tag("versions_wal.db", "seeded"))
+
+	// The new table is only in the WAL.
+	require.NoError(t, db.Exec(`CREATE TABLE langs (name VARCHAR(10))`))
+	err = ordmap.Tag("versions_wal.db", "langs")
+	require.True(t, errors.Is(err, sqlite3.BUSY))
+
+	// Connections in WAL mode hold a lock.
+	err = ordmap.Restore("versions_wal.db", "seeded")
+	require.True(t, errors.Is(err, sqlite3.BUSY))
+
+	// Restoring discards the WAL.
+	require.NoError(t, db.Close())
+	require.NoError(t, ordmap.Restore("versions_wal.db", "seeded"))
+
+	db, err = sqlite3.Open("file:/versions_wal.db?vfs=ordmap")
+	require.NoError(t, err)
+	defer db.Close()
+
+	stmt, _, err := db.Prepare(`SELECT count(*) FROM sqlite_master WHERE name IN ('users', 'langs')`)
+	require.NoError(t, err)
+	defer stmt.Close()
+	require.True(t, stmt.Step())
+	require.Equal(t, 1, stmt.ColumnInt(0))
+}
@@ -0,0 +1,120 @@
+// Package overlay implements a copy-on-write SQLite VFS
+// over a read-only base database.
+//
+// The "overlay" [vfs.VFS] opens database files read-only,
+// through the default VFS,
+// and keeps all changes in memory.
+// Reads fall through to the base file, and sectors are
+// copied into memory the first time they're written to.
+// The base file is never modified.
+//
+// All connections to the same path share the same overlay,
+// which is discarded when the last connection is closed.
+//
+//	db, err := sql.Open("sqlite3", "file:snapshot.db?vfs=overlay")
+//
+// Use [Create] to layer an overlay over any [ioutil.SizeReaderAt]
+// (including a [vfs.File]), and [Fork] to make instant copies of an overlay.
+//
+// The base database must not change while an overlay uses it,
+// and must not be in WAL mode with uncheckpointed changes.
+// The "overlay" VFS holds a SHARED lock on the base file
+// until the last connection to the overlay is closed,
+// which keeps connections in rollback journal mode from committing to it
+// (opening the overlay fails with BUSY while one is).
+// Bases given to [Create] are not locked.
+//
+// Importing package overlay registers the VFS:
+//
+//	import _ "github.com/ncruces/go-sqlite3/vfs/overlay"
+package overlay
+
+import (
+	"sync"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/util/ioutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+func init() {
+	vfs.Register("overlay", overlayVFS{vfs.Find("")})
+}
+
+var (
+	overlayMtx sync.Mutex
+	// +checklocks:overlayMtx
+	overlayDBs = map[string]*overlayDB{}
+)
+
+// Create creates a shared overlay database, using base as its initial contents.
+// Connections open the overlay with its name (e.g. "file:name?vfs=overlay").
+//
+// The overlay does not take ownership of base,
+// but reads from it until the overlay and all its forks are deleted,
+// and all connections to them are closed.
+func Create(name string, base ioutil.SizeReaderAt) error {
+	db, err := newOverlayDB(name, base, nil)
+	if err != nil {
+		return err
+	}
+
+	overlayMtx.Lock()
+	defer overlayMtx.Unlock()
+	register(db)
+	return nil
+}
+
+// Fork creates a shared overlay database named newName
+// with the current contents of the overlay database name.
+// The fork shares the base, and all unchanged sectors, with the original.
+//
+// Fork fails with [sqlite3.CANTOPEN] if there is no such database,
+// and [sqlite3.BUSY] if a transaction is writing to it.
+func Fork(name, newName string) error {
+	overlayMtx.Lock()
+	defer overlayMtx.Unlock()
+
+	db := overlayDBs[name]
+	if db == nil {
+		return sqlite3.CANTOPEN
+	}
+
+	db.lockMtx.Lock()
+	defer db.lockMtx.Unlock()
+	if db.pending {
+		return sqlite3.BUSY
+	}
+
+	register(db.fork(newName))
+	return nil
+}
+
+// Delete deletes a shared overlay database.
+// Connections to it remain valid until they're closed.
+func Delete(name string) {
+	overlayMtx.Lock()
+	defer overlayMtx.Unlock()
+	unregister(name)
+}
+
+// +checklocks:overlayMtx
+func register(db *overlayDB) {
+	unregister(db.name)
+	db.refs++
+	db.registered = true
+	overlayDBs[db.name] = db
+}
+
+// +checklocks:overlayMtx
+func unregister(name string) {
+	db := overlayDBs[name]
+	if db == nil {
+		return
+	}
+	delete(overlayDBs, name)
+	if db.registered {
+		db.registered = false
+		db.unref()
+	}
+}
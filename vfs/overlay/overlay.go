@@ -0,0 +1,427 @@
+package overlay
+
+import (
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/edofic/go-ordmap/v2"
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/util/ioutil"
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+const sectorSize = 65536 // 64KiB
+
+// Ensure sectorSize is a multiple of 64K (the largest page size).
+var _ [0]struct{} = [sectorSize & 65535]struct{}{}
+
+type overlayVFS struct {
+	base vfs.VFS
+}
+
+func (o overlayVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	// notest // OpenFilename is called instead
+	return nil, 0, sqlite3.CANTOPEN
+}
+
+func (o overlayVFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	// Temporary files are opened by the base VFS.
+	// Returning OPEN_MEMORY for the main database means
+	// SQLite won't ask us for journals.
+	if flags&vfs.OPEN_MAIN_DB == 0 || name == nil {
+		return vfsutil.WrapOpenFilename(o.base, name, flags)
+	}
+
+	path := name.String()
+	overlayMtx.Lock()
+	defer overlayMtx.Unlock()
+
+	db := overlayDBs[path]
+	if db == nil {
+		// Open the base database read-only.
+		bflags := flags&^(vfs.OPEN_READWRITE|vfs.OPEN_CREATE) | vfs.OPEN_READONLY
+		file, _, err := vfsutil.WrapOpenFilename(o.base, name, bflags)
+		if err != nil {
+			return nil, flags, err
+		}
+		// Hold a SHARED lock on the base while the overlay uses it,
+		// so other connections can't commit changes to it.
+		if err := file.Lock(vfs.LOCK_SHARED); err != nil {
+			file.Close()
+			return nil, flags, err
+		}
+		db, err = newOverlayDB(path, file, file)
+		if err != nil {
+			file.Close()
+			return nil, flags, err
+		}
+		overlayDBs[path] = db
+	}
+	db.refs++ // +checklocksforce: overlayMtx is held
+
+	return &overlayFile{
+		overlayDB: db,
+		readOnly:  flags&vfs.OPEN_READONLY != 0,
+	}, flags | vfs.OPEN_MEMORY, nil
+}
+
+func (o overlayVFS) Delete(name string, dirSync bool) error {
+	// Never delete files from the base.
+	return sqlite3.IOERR_DELETE_NOENT // used to delete journals
+}
+
+func (o overlayVFS) Access(name string, flag vfs.AccessFlag) (bool, error) {
+	return false, nil // used to check for journals
+}
+
+func (o overlayVFS) FullPathname(name string) (string, error) {
+	overlayMtx.Lock()
+	_, ok := overlayDBs[name]
+	overlayMtx.Unlock()
+	if ok {
+		return name, nil
+	}
+	return o.base.FullPathname(name)
+}
+
+// overlayBase is the read-only layer shared by an overlay and its forks.
+type overlayBase struct {
+	ioutil.SizeReaderAt
+	closer io.Closer
+	refs   atomic.Int32
+}
+
+func (b *overlayBase) release() error {
+	if b.refs.Add(-1) == 0 && b.closer != nil {
+		return b.closer.Close()
+	}
+	return nil
+}
+
+type overlayDB struct {
+	name string
+	base *overlayBase
+
+	// Stores written sectors keyed by sector index,
+	// other sectors are read from the base.
+	// Slices are typically sectorSize bytes long, except potentially the last one.
+	// +checklocks:dataMtx
+	data ordmap.NodeBuiltin[int64, []byte]
+
+	// Logical size of the file.
+	// +checklocks:dataMtx
+	size int64
+
+	// Base data at or past this offset has been truncated away.
+	// +checklocks:dataMtx
+	low int64
+
+	// Counts connections, plus one if registered
+	// by Create or Fork and not yet deleted.
+	// +checklocks:overlayMtx
+	refs int32
+	// +checklocks:overlayMtx
+	registered bool
+
+	shared   int32 // +checklocks:lockMtx
+	pending  bool  // +checklocks:lockMtx
+	reserved bool  // +checklocks:lockMtx
+
+	lockMtx sync.Mutex
+	dataMtx sync.RWMutex
+}
+
+func newOverlayDB(name string, base ioutil.SizeReaderAt, closer io.Closer) (*overlayDB, error) {
+	size, err := base.Size()
+	if err != nil {
+		return nil, err
+	}
+	b := &overlayBase{
+		SizeReaderAt: base,
+		closer:       closer,
+	}
+	b.refs.Store(1)
+	return &overlayDB{
+		name: name,
+		base: b,
+		data: ordmap.NewBuiltin[int64, []byte](),
+		size: size,
+		low:  size,
+	}, nil
+}
+
+func (o *overlayDB) release() {
+	overlayMtx.Lock()
+	defer overlayMtx.Unlock()
+	o.unref()
+}
+
+// +checklocks:overlayMtx
+func (o *overlayDB) unref() {
+	if o.refs--; o.refs == 0 {
+		if o == overlayDBs[o.name] {
+			delete(overlayDBs, o.name)
+		}
+		o.base.release()
+	}
+}
+
+func (o *overlayDB) fork(name string) *overlayDB {
+	o.dataMtx.RLock()
+	defer o.dataMtx.RUnlock()
+	o.base.refs.Add(1)
+	return &overlayDB{
+		name: name,
+		base: o.base,
+		data: o.data,
+		size: o.size,
+		low:  o.low,
+	}
+}
+
+// readBase reads a sector from the base, up to low,
+// zero filling the rest.
+// +checklocksread:o.dataMtx
+func (o *overlayDB) readBase(b []byte, off int64) error {
+	n := max(0, min(int64(len(b)), o.low-off))
+	if n > 0 {
+		m, err := o.base.ReadAt(b[:n], off)
+		if int64(m) < n && err != io.EOF {
+			return err
+		}
+		if off <= 18 && off+int64(m) >= 20 {
+			// Convert WAL/2 to rollback journal.
+			h := b[18-off : 20-off]
+			if h[0] == 2 && h[1] == 2 || h[0] == 3 && h[1] == 3 {
+				h[0] = 1
+				h[1] = 1
+			}
+		}
+		n = int64(m)
+	}
+	clear(b[n:])
+	return nil
+}
+
+type overlayFile struct {
+	*overlayDB
+	lock     vfs.LockLevel
+	readOnly bool
+}
+
+var (
+	// Ensure these interfaces are implemented:
+	_ vfs.FileLockState = &overlayFile{}
+	_ vfs.FileSizeHint  = &overlayFile{}
+)
+
+func (o *overlayFile) Close() error {
+	o.release()
+	return o.Unlock(vfs.LOCK_NONE)
+}
+
+func (o *overlayFile) ReadAt(b []byte, off int64) (n int, err error) {
+	o.dataMtx.RLock()
+	defer o.dataMtx.RUnlock()
+
+	if off >= o.size {
+		return 0, io.EOF
+	}
+
+	base := off / sectorSize
+	rest := off % sectorSize
+	have := min(int64(len(b)), sectorSize-rest, o.size-off)
+
+	if page, ok := o.data.Get(base); ok {
+		n = copy(b[:have], page[min(rest, int64(len(page))):])
+		clear(b[n:have])
+	} else if err := o.readBase(b[:have], off); err != nil {
+		return 0, err
+	}
+
+	if n = int(have); n < len(b) {
+		if off+have < o.size {
+			// notest // assume reads are page aligned
+			return 0, io.ErrNoProgress
+		}
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (o *overlayFile) WriteAt(b []byte, off int64) (n int, err error) {
+	o.dataMtx.Lock()
+	defer o.dataMtx.Unlock()
+
+	base := off / sectorSize
+	rest := off % sectorSize
+
+	// Copy the sector, pulling it from the base on first write.
+	page := make([]byte, sectorSize)
+	if old, ok := o.data.Get(base); ok {
+		copy(page, old)
+	} else if err := o.readBase(page, base*sectorSize); err != nil {
+		return 0, err
+	}
+
+	n = copy(page[rest:], b)
+	o.data = o.data.Insert(base, page)
+	if size := off + int64(n); size > o.size {
+		o.size = size
+	}
+	if n < len(b) {
+		// notest // assume writes are page aligned
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+func (o *overlayFile) Truncate(size int64) error {
+	o.dataMtx.Lock()
+	defer o.dataMtx.Unlock()
+	return o.truncate(size)
+}
+
+// +checklocks:o.dataMtx
+func (o *overlayFile) truncate(size int64) error {
+	if size < o.size {
+		// Base data past the new size must read as zeroes.
+		o.low = min(o.low, size)
+
+		lastBase := divRoundUp(size, sectorSize) - 1
+		if page, ok := o.data.Get(lastBase); ok {
+			sizeInLastSector := size - lastBase*sectorSize
+			truncated := make([]byte, sectorSize)
+			copy(truncated, page[:min(int64(len(page)), sizeInLastSector)])
+			o.data = o.data.Insert(lastBase, truncated[:sizeInLastSector])
+		}
+		for iter := o.data.Iterate(); !iter.Done(); iter.Next() {
+			if key := iter.GetKey(); key > lastBase {
+				o.data = o.data.Remove(key)
+			}
+		}
+	}
+	o.size = size
+	return nil
+}
+
+func (o *overlayFile) Sync(flag vfs.SyncFlag) error {
+	return nil
+}
+
+func (o *overlayFile) Size() (int64, error) {
+	o.dataMtx.RLock()
+	defer o.dataMtx.RUnlock()
+	return o.size, nil
+}
+
+const spinWait = 25 * time.Microsecond
+
+func (o *overlayFile) Lock(lock vfs.LockLevel) error {
+	if o.lock >= lock {
+		return nil
+	}
+
+	if o.readOnly && lock >= vfs.LOCK_RESERVED {
+		return sqlite3.IOERR_LOCK
+	}
+
+	o.lockMtx.Lock()
+	defer o.lockMtx.Unlock()
+
+	switch lock {
+	case vfs.LOCK_SHARED:
+		if o.pending {
+			return sqlite3.BUSY
+		}
+		o.shared++
+
+	case vfs.LOCK_RESERVED:
+		if o.reserved {
+			return sqlite3.BUSY
+		}
+		o.reserved = true
+
+	case vfs.LOCK_EXCLUSIVE:
+		if o.lock < vfs.LOCK_PENDING {
+			o.lock = vfs.LOCK_PENDING
+			o.pending = true
+		}
+
+		for before := time.Now(); o.shared > 1; {
+			if time.Since(before) > spinWait {
+				return sqlite3.BUSY
+			}
+			o.lockMtx.Unlock()
+			runtime.Gosched()
+			o.lockMtx.Lock()
+		}
+	}
+
+	o.lock = lock
+	return nil
+}
+
+func (o *overlayFile) Unlock(lock vfs.LockLevel) error {
+	if o.lock <= lock {
+		return nil
+	}
+
+	o.lockMtx.Lock()
+	defer o.lockMtx.Unlock()
+
+	if o.lock >= vfs.LOCK_RESERVED {
+		o.reserved = false
+	}
+	if o.lock >= vfs.LOCK_PENDING {
+		o.pending = false
+	}
+	if lock < vfs.LOCK_SHARED {
+		o.shared--
+	}
+	o.lock = lock
+	return nil
+}
+
+func (o *overlayFile) CheckReservedLock() (bool, error) {
+	// notest // OPEN_MEMORY
+	if o.lock >= vfs.LOCK_RESERVED {
+		return true, nil
+	}
+	o.lockMtx.Lock()
+	defer o.lockMtx.Unlock()
+	return o.reserved, nil
+}
+
+func (o *overlayFile) SectorSize() int {
+	// notest // IOCAP_POWERSAFE_OVERWRITE
+	return sectorSize
+}
+
+func (o *overlayFile) DeviceCharacteristics() vfs.DeviceCharacteristic {
+	return vfs.IOCAP_ATOMIC |
+		vfs.IOCAP_SEQUENTIAL |
+		vfs.IOCAP_SAFE_APPEND |
+		vfs.IOCAP_POWERSAFE_OVERWRITE
+}
+
+func (o *overlayFile) SizeHint(size int64) error {
+	o.dataMtx.Lock()
+	defer o.dataMtx.Unlock()
+	if size > o.size {
+		return o.truncate(size)
+	}
+	return nil
+}
+
+func (o *overlayFile) LockState() vfs.LockLevel {
+	return o.lock
+}
+
+func divRoundUp(a, b int64) int64 {
+	return (a + b - 1) / b
+}
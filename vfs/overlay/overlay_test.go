@@ -0,0 +1,189 @@
+package overlay_test
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	_ "github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/util/ioutil"
+	"github.com/ncruces/go-sqlite3/vfs/overlay"
+)
+
+func createBase(t testing.TB) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "base.db")
+	db, err := sqlite3.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Exec(`
+		CREATE TABLE users (id INT, name VARCHAR(10));
+		INSERT INTO users (id, name) VALUES (0, 'go'), (1, 'zig'), (2, 'whatever');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func count(t testing.TB, db *sql.DB) (n int) {
+	t.Helper()
+	err := db.QueryRow(`SELECT count(*) FROM users`).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestOverlay(t *testing.T) {
+	path := createBase(t)
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+filepath.ToSlash(path)+"?vfs=overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := count(t, db); got != 4 {
+		t.Errorf("got %d, want 4", got)
+	}
+
+	// Grow, then shrink, the database.
+	_, err = db.Exec(`
+		CREATE TABLE blobs (data BLOB);
+		INSERT INTO blobs SELECT randomblob(1000) FROM generate_series(1, 1000);
+		DROP TABLE blobs;
+		VACUUM;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var check string
+	err = db.QueryRow(`PRAGMA integrity_check`).Scan(&check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if check != "ok" {
+		t.Error(check)
+	}
+	if got := count(t, db); got != 4 {
+		t.Errorf("got %d, want 4", got)
+	}
+
+	// The base is unchanged.
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("base database was modified")
+	}
+}
+
+func TestFork(t *testing.T) {
+	path := createBase(t)
+
+	base, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	err = overlay.Create("test.db", ioutil.NewSizeReaderAt(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer overlay.Delete("test.db")
+
+	db, err := sql.Open("sqlite3", "file:test.db?vfs=overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = overlay.Fork("test.db", "fork.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer overlay.Delete("fork.db")
+
+	_, err = db.Exec(`INSERT INTO users (id, name) VALUES (4, 'java')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fork, err := sql.Open("sqlite3", "file:fork.db?vfs=overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fork.Close()
+
+	// The fork should not see java.
+	if got := count(t, db); got != 5 {
+		t.Errorf("got %d, want 5", got)
+	}
+	if got := count(t, fork); got != 4 {
+		t.Errorf("got %d, want 4", got)
+	}
+
+	err = overlay.Fork("missing.db", "fork.db")
+	if err != sqlite3.CANTOPEN {
+		t.Errorf("got %v, want CANTOPEN", err)
+	}
+}
+
+func TestOverlay_lock(t *testing.T) {
+	path := createBase(t)
+
+	db, err := sqlite3.Open("file:" + filepath.ToSlash(path) + "?vfs=overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base, err := sqlite3.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	// The overlay holds a SHARED lock on the base.
+	err = base.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)
+	if !errors.Is(err, sqlite3.BUSY) {
+		t.Errorf("got %v, want BUSY", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = base.Exec(`INSERT INTO users (id, name) VALUES (3, 'rust')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
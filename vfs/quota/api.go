@@ -0,0 +1,153 @@
+// Package quota wraps an SQLite VFS to enforce size limits.
+//
+// The "quota" [vfs.VFS] wraps the default VFS,
+// and limits the space used by database files,
+// like SQLite's [quota] extension.
+//
+// A quota applies to a database file, including its journal and WAL,
+// or to a group of database files, with names matching a pattern.
+// Writes that would make a quota exceed its limit fail with [sqlite3.FULL],
+// unless a [Callback] raises the limit.
+//
+// Importing package quota registers that VFS,
+// and a wrapper to stack it over other VFSes (e.g. "xts+quota"):
+//
+//	import _ "github.com/ncruces/go-sqlite3/vfs/quota"
+//
+// Quotas are set for each VFS instance:
+//
+//	q := vfs.Find("quota").(*quota.VFS)
+//	q.SetGroupQuota("/var/lib/tenants/*.db", 1<<30, nil)
+//
+// The quota of a database file can also be set
+// with the "quota" [URI] parameter (in bytes),
+// unless it already has one.
+//
+// Only files opened through the VFS count towards a quota,
+// and their sizes are only known once they've been opened.
+//
+// [quota]: https://sqlite.org/src/doc/trunk/src/test_quota.c
+// [URI]: https://sqlite.org/uri.html
+package quota
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+func init() {
+	vfs.Register("quota", Wrap(vfs.Find("")))
+	vfs.RegisterWrapper("quota", func(base vfs.VFS) vfs.VFS {
+		return Wrap(base)
+	})
+}
+
+// Callback is called when a write would make a quota exceed its limit.
+// It receives the name of the file being written,
+// the current limit, and the size the quota would grow to,
+// and returns the new limit.
+// If size is still over the limit, the write fails.
+//
+// Callbacks are called with the VFS locked,
+// and must not use it.
+type Callback func(name string, limit, size int64) int64
+
+// VFS is a [vfs.VFS] that enforces quotas.
+type VFS struct {
+	base vfs.VFS
+	mtx  sync.Mutex
+	// +checklocks:mtx
+	files map[string]*fileSize
+	// +checklocks:mtx
+	quotas map[string]*quota
+	// +checklocks:mtx
+	groups []*quota
+}
+
+// Wrap wraps base to enforce quotas.
+func Wrap(base vfs.VFS) *VFS {
+	return &VFS{
+		base:   base,
+		files:  map[string]*fileSize{},
+		quotas: map[string]*quota{},
+	}
+}
+
+// SetFileQuota sets the limit, in bytes, of the space used by
+// a database file, its journal, and its WAL.
+// A limit of zero removes the quota.
+func (v *VFS) SetFileQuota(name string, limit int64, callback Callback) error {
+	name, err := v.base.FullPathname(name)
+	if err != nil {
+		return err
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if limit <= 0 {
+		delete(v.quotas, name)
+	} else if q := v.quotas[name]; q != nil {
+		q.limit = limit
+		q.callback = callback
+	} else {
+		v.quotas[name] = &quota{name: name, limit: limit, callback: callback}
+	}
+	v.recount()
+	return nil
+}
+
+// SetGroupQuota sets the limit, in bytes, of the space used by
+// all database files (and their journals, and WALs)
+// with names matching pattern (see [filepath.Match]).
+// A limit of zero removes the quota.
+//
+// Patterns are matched against full pathnames.
+// A database file belongs to the first group that matches it,
+// in the order groups were created,
+// in addition to any quota set for the file itself.
+func (v *VFS) SetGroupQuota(pattern string, limit int64, callback Callback) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return err
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	for i, q := range v.groups {
+		if q.name == pattern {
+			if limit <= 0 {
+				v.groups = append(v.groups[:i], v.groups[i+1:]...)
+			} else {
+				q.limit = limit
+				q.callback = callback
+			}
+			v.recount()
+			return nil
+		}
+	}
+	if limit > 0 {
+		v.groups = append(v.groups, &quota{name: pattern, limit: limit, callback: callback})
+		v.recount()
+	}
+	return nil
+}
+
+// Usage returns the space used, in bytes, by a database file,
+// its journal, and its WAL.
+func (v *VFS) Usage(name string) (int64, error) {
+	name, err := v.base.FullPathname(name)
+	if err != nil {
+		return 0, err
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	var size int64
+	for _, f := range v.files {
+		if f.db == name {
+			size += f.size
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,276 @@
+package quota
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+type quota struct {
+	name     string // database name, or group pattern
+	limit    int64
+	callback Callback
+	size     int64
+}
+
+type fileSize struct {
+	db      string // the database the file belongs to
+	size    int64
+	refs    int
+	deleted bool
+}
+
+// Open implements [vfs.VFS].
+func (v *VFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	file, flags, err := v.base.Open(name, flags)
+	if err != nil {
+		return file, flags, err
+	}
+
+	// Journals and WAL files count towards their database.
+	db := name
+	switch {
+	case flags&vfs.OPEN_MAIN_JOURNAL != 0:
+		db = strings.TrimSuffix(name, "-journal")
+	case flags&vfs.OPEN_WAL != 0:
+		db = strings.TrimSuffix(name, "-wal")
+	}
+
+	file, err = v.wrap(file, name, db, flags)
+	return file, flags, err
+}
+
+// OpenFilename implements [vfs.VFSFilename].
+func (v *VFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	file, flags, err := vfsutil.WrapOpenFilename(v.base, name, flags)
+	if err != nil {
+		return file, flags, err
+	}
+
+	if flags&vfs.OPEN_MAIN_DB != 0 {
+		if s := name.URIParameter("quota"); s != "" {
+			limit, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				file.Close()
+				return nil, flags, sqlite3.CANTOPEN
+			}
+			v.uriQuota(name.String(), limit)
+		}
+	}
+
+	// Journals and WAL files count towards their database.
+	db := name.Database()
+	if db == "" {
+		db = name.String()
+	}
+
+	file, err = v.wrap(file, name.String(), db, flags)
+	return file, flags, err
+}
+
+// uriQuota sets the quota of a database file from its URI,
+// unless it already has one (and its callback).
+func (v *VFS) uriQuota(name string, limit int64) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if limit > 0 && v.quotas[name] == nil {
+		v.quotas[name] = &quota{name: name, limit: limit}
+		v.recount()
+	}
+}
+
+// Delete implements [vfs.VFS].
+func (v *VFS) Delete(name string, dirSync bool) error {
+	err := v.base.Delete(name, dirSync)
+	if err != nil {
+		return err
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if f := v.files[name]; f != nil {
+		if f.refs > 0 {
+			f.deleted = true
+		} else {
+			v.resize(name, f, 0)
+			delete(v.files, name)
+		}
+	}
+	return nil
+}
+
+// Access implements [vfs.VFS].
+func (v *VFS) Access(name string, flag vfs.AccessFlag) (bool, error) {
+	return v.base.Access(name, flag)
+}
+
+// FullPathname implements [vfs.VFS].
+func (v *VFS) FullPathname(name string) (string, error) {
+	return v.base.FullPathname(name)
+}
+
+func (v *VFS) wrap(file vfs.File, name, db string, flags vfs.OpenFlag) (vfs.File, error) {
+	// Temporary files are not counted.
+	if name == "" {
+		return file, nil
+	}
+
+	size, err := file.Size()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	f := v.files[name]
+	if f == nil {
+		f = &fileSize{db: db}
+		v.files[name] = f
+	}
+	f.refs++
+	f.deleted = f.deleted || flags&vfs.OPEN_DELETEONCLOSE != 0
+	v.resize(name, f, size)
+
+	return &quotaFile{
+		WrappedFile: vfsutil.WrappedFile{File: file},
+		vfs:         v,
+		name:        name,
+	}, nil
+}
+
+// grow checks that a file can grow to size,
+// and reserves the space for it.
+func (v *VFS) grow(name string, size int64) error {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	f := v.files[name]
+	delta := size - f.size
+	if delta <= 0 {
+		return nil
+	}
+
+	quotas := v.quotasFor(f.db)
+	for _, q := range quotas {
+		if q.size+delta > q.limit && q.callback != nil {
+			q.limit = q.callback(name, q.limit, q.size+delta)
+		}
+		if q.size+delta > q.limit {
+			return sqlite3.FULL
+		}
+	}
+	for _, q := range quotas {
+		q.size += delta
+	}
+	f.size = size
+	return nil
+}
+
+// +checklocks:v.mtx
+func (v *VFS) resize(name string, f *fileSize, size int64) {
+	delta := size - f.size
+	for _, q := range v.quotasFor(f.db) {
+		q.size += delta
+	}
+	f.size = size
+}
+
+// +checklocks:v.mtx
+func (v *VFS) quotasFor(db string) []*quota {
+	var quotas []*quota
+	if q := v.quotas[db]; q != nil {
+		quotas = append(quotas, q)
+	}
+	for _, q := range v.groups {
+		if ok, _ := filepath.Match(q.name, db); ok {
+			quotas = append(quotas, q)
+			break
+		}
+	}
+	return quotas
+}
+
+// recount recomputes the size of every quota,
+// after quotas are added or removed.
+//
+// +checklocks:v.mtx
+func (v *VFS) recount() {
+	for _, q := range v.quotas {
+		q.size = 0
+	}
+	for _, q := range v.groups {
+		q.size = 0
+	}
+	for _, f := range v.files {
+		for _, q := range v.quotasFor(f.db) {
+			q.size += f.size
+		}
+	}
+}
+
+type quotaFile struct {
+	vfsutil.WrappedFile
+	vfs  *VFS
+	name string
+}
+
+func (f *quotaFile) Close() error {
+	err := f.File.Close()
+
+	v := f.vfs
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	s := v.files[f.name]
+	s.refs--
+	if s.refs == 0 && s.deleted {
+		v.resize(f.name, s, 0)
+		delete(v.files, f.name)
+	}
+	return err
+}
+
+func (f *quotaFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.vfs.grow(f.name, off+int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := f.File.WriteAt(p, off)
+	if err != nil {
+		f.refresh()
+	}
+	return n, err
+}
+
+func (f *quotaFile) Truncate(size int64) error {
+	if err := f.vfs.grow(f.name, size); err != nil {
+		return err
+	}
+	err := f.File.Truncate(size)
+	f.refresh()
+	return err
+}
+
+func (f *quotaFile) SizeHint(size int64) error {
+	if err := f.vfs.grow(f.name, size); err != nil {
+		return err
+	}
+	err := f.WrappedFile.SizeHint(size)
+	f.refresh()
+	return err
+}
+
+// refresh updates the size of the file,
+// releasing any space it reserved, but didn't use.
+func (f *quotaFile) refresh() {
+	size, err := f.File.Size()
+	if err != nil {
+		return
+	}
+	v := f.vfs
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.resize(f.name, v.files[f.name], size)
+}
@@ -0,0 +1,206 @@
+package quota_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/quota"
+	"github.com/ncruces/go-sqlite3/vfs/vfstest"
+)
+
+func Test_vfstest(t *testing.T) {
+	if !vfs.SupportsFileLocking {
+		t.Skip("skipping without locks")
+	}
+	vfstest.Test(t, quota.Wrap(vfs.Find("")), nil)
+}
+
+func TestQuota_file(t *testing.T) {
+	const limit = 256 * 1024
+
+	for _, mode := range []string{"delete", "wal"} {
+		t.Run(mode, func(t *testing.T) {
+			q := quota.Wrap(vfs.Find(""))
+			vfs.Register("quota-file-"+mode, q)
+			defer vfs.Unregister("quota-file-" + mode)
+
+			path := filepath.Join(t.TempDir(), "test.db")
+			if err := q.SetFileQuota(path, limit, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := sqlite3.Open("file:" + filepath.ToSlash(path) + "?vfs=quota-file-" + mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			testcfg.Exec(t, db, `PRAGMA journal_mode=`+mode)
+			testcfg.Exec(t, db, `CREATE TABLE blobs (id INTEGER PRIMARY KEY, data BLOB)`)
+
+			// Grow the database a page at a time, until it's full.
+			var blobs int
+			for {
+				err := db.Exec(`INSERT INTO blobs (data) VALUES (randomblob(4000))`)
+				if errors.Is(err, sqlite3.FULL) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if blobs++; blobs > limit/4096 {
+					t.Fatal("quota not enforced")
+				}
+			}
+
+			// Usage is just short of the limit.
+			usage, err := q.Usage(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage > limit || usage < limit-8*4096 {
+				t.Errorf("got usage %d", usage)
+			}
+
+			// The journal, or the WAL, counts towards the quota:
+			// rewriting every page doesn't grow the database,
+			// but there's no room to log the rewrite.
+			err = db.Exec(`UPDATE blobs SET data = zeroblob(4000)`)
+			if !errors.Is(err, sqlite3.FULL) {
+				t.Errorf("got %v, want FULL", err)
+			}
+
+			// The database is intact.
+			if got := testcfg.Query(t, db, `SELECT count(*) FROM blobs WHERE data <> zeroblob(4000)`); got != fmt.Sprint(blobs) {
+				t.Errorf("got %s blobs, want %d", got, blobs)
+			}
+			testcfg.Exec(t, db, `PRAGMA integrity_check`)
+
+			// Raising the limit allows the rewrite.
+			if err := q.SetFileQuota(path, 2*limit, nil); err != nil {
+				t.Fatal(err)
+			}
+			testcfg.Exec(t, db, `UPDATE blobs SET data = zeroblob(4000)`)
+		})
+	}
+}
+
+func TestQuota_group(t *testing.T) {
+	q := quota.Wrap(vfs.Find(""))
+	vfs.Register("quota-group", q)
+	defer vfs.Unregister("quota-group")
+
+	// A database belongs to the first group that matches it:
+	// test0.db is not limited by the second group.
+	dir := t.TempDir()
+	if err := q.SetGroupQuota(filepath.Join(dir, "*.db"), 256*1024, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.SetGroupQuota(filepath.Join(dir, "test0*"), 64*1024, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var dbs [2]*sqlite3.Conn
+	for i := range dbs {
+		path := filepath.Join(dir, fmt.Sprintf("test%d.db", i))
+		db, err := sqlite3.Open("file:" + filepath.ToSlash(path) + "?vfs=quota-group")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		testcfg.Exec(t, db, `CREATE TABLE blobs (id INTEGER PRIMARY KEY, data BLOB)`)
+		dbs[i] = db
+	}
+
+	// Both databases share the quota.
+	testcfg.Exec(t, dbs[0], `INSERT INTO blobs (data) VALUES (zeroblob(150 * 1024))`)
+	err := dbs[1].Exec(`INSERT INTO blobs (data) VALUES (zeroblob(150 * 1024))`)
+	if !errors.Is(err, sqlite3.FULL) {
+		t.Errorf("got %v, want FULL", err)
+	}
+
+	// Deleting data, and vacuuming, frees space.
+	testcfg.Exec(t, dbs[0], `DELETE FROM blobs`)
+	testcfg.Exec(t, dbs[0], `VACUUM`)
+	testcfg.Exec(t, dbs[1], `INSERT INTO blobs (data) VALUES (zeroblob(150 * 1024))`)
+}
+
+func TestQuota_callback(t *testing.T) {
+	q := quota.Wrap(vfs.Find(""))
+	vfs.Register("quota-callback", q)
+	defer vfs.Unregister("quota-callback")
+
+	// Grant a single raise, just enough for the write.
+	var calls int
+	callback := func(name string, limit, size int64) int64 {
+		calls++
+		if size <= limit {
+			t.Errorf("got size %d, limit %d", size, limit)
+		}
+		if calls == 1 {
+			return size
+		}
+		return limit
+	}
+
+	dir := t.TempDir()
+	if err := q.SetGroupQuota(filepath.Join(dir, "*"), 128*1024, callback); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sqlite3.Open("file:" + filepath.ToSlash(filepath.Join(dir, "test.db")) + "?vfs=quota-callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testcfg.Exec(t, db, `CREATE TABLE blobs (id INTEGER PRIMARY KEY, data BLOB)`)
+	testcfg.Exec(t, db, `INSERT INTO blobs (data) VALUES (zeroblob(120 * 1024))`)
+	if calls != 1 {
+		t.Errorf("got %d calls", calls)
+	}
+	err = db.Exec(`INSERT INTO blobs (data) VALUES (zeroblob(4000))`)
+	if !errors.Is(err, sqlite3.FULL) {
+		t.Errorf("got %v, want FULL", err)
+	}
+	if calls < 2 {
+		t.Errorf("got %d calls", calls)
+	}
+}
+
+func TestQuota_uri(t *testing.T) {
+	path := filepath.ToSlash(filepath.Join(t.TempDir(), "test.db"))
+
+	db, err := sqlite3.Open("file:" + path + "?vfs=quota&quota=65536")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testcfg.Exec(t, db, `CREATE TABLE blobs (id INTEGER PRIMARY KEY, data BLOB)`)
+	err = db.Exec(`INSERT INTO blobs (data) VALUES (zeroblob(65536))`)
+	if !errors.Is(err, sqlite3.FULL) {
+		t.Errorf("got %v, want FULL", err)
+	}
+
+	// The URI doesn't replace a quota that was already set.
+	q := vfs.Find("quota").(*quota.VFS)
+	if err := q.SetFileQuota(path, 1<<20, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer q.SetFileQuota(path, 0, nil)
+	db2, err := sqlite3.Open("file:" + path + "?vfs=quota&quota=65536")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	testcfg.Exec(t, db2, `INSERT INTO blobs (data) VALUES (zeroblob(65536))`)
+
+	_, err = sqlite3.Open("file:" + path + "?vfs=quota&quota=bad")
+	if !errors.Is(err, sqlite3.CANTOPEN) {
+		t.Errorf("got %v, want CANTOPEN", err)
+	}
+}
@@ -2,6 +2,8 @@
 //
 // The "reader" [vfs.VFS] permits accessing any [io.ReaderAt]
 // as an immutable SQLite database.
+// [NewHTTPReader] reads a remote database using HTTP range requests,
+// and [NewCachedReader] adds a page cache to any slow reader.
 //
 // Importing package readervfs registers the VFS:
 //
@@ -0,0 +1,306 @@
+package readervfs
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ncruces/go-sqlite3/util/ioutil"
+)
+
+// PageCache caches the pages of a remote database.
+//
+// Implementations must be safe for concurrent use.
+// Pages should not be modified once cached.
+type PageCache interface {
+	Get(page int64) ([]byte, bool)
+	Put(page int64, data []byte)
+}
+
+// NewLRUCache returns a [PageCache] that keeps
+// up to size of the most recently used pages.
+func NewLRUCache(size int) PageCache {
+	return &lruCache{
+		size:  size,
+		pages: map[int64]*list.Element{},
+	}
+}
+
+type lruCache struct {
+	mtx   sync.Mutex
+	size  int
+	order list.List               // +checklocks:mtx
+	pages map[int64]*list.Element // +checklocks:mtx
+}
+
+type lruEntry struct {
+	page int64
+	data []byte
+}
+
+func (c *lruCache) Get(page int64) ([]byte, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.pages[page]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*lruEntry).data, true
+	}
+	return nil, false
+}
+
+func (c *lruCache) Put(page int64, data []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.pages[page]; ok {
+		e.Value.(*lruEntry).data = data
+		c.order.MoveToFront(e)
+		return
+	}
+	c.pages[page] = c.order.PushFront(&lruEntry{page, data})
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.pages, e.Value.(*lruEntry).page)
+	}
+}
+
+// CacheOptions configure a [CachedReader].
+type CacheOptions struct {
+	// Cache holds pages read from the source.
+	// Defaults to an LRU cache of 256 pages.
+	Cache PageCache
+
+	// PageSize is the size of each read, and of the cached pages.
+	// Defaults to 4096.
+	PageSize int
+
+	// MaxReadAhead is the largest number of pages
+	// sequential reads coalesce into a single read.
+	// Defaults to 64.
+	MaxReadAhead int
+}
+
+// CacheStats are statistics for a page cache.
+type CacheStats struct {
+	Hits      int64 // Pages found in the cache.
+	Misses    int64 // Pages read from the source.
+	ReadAhead int64 // Pages read ahead of a sequential read.
+}
+
+// CachedReader adds a page cache to a slow [ioutil.SizeReaderAt],
+// like a compressed archive, a network file, or an encrypted blob.
+//
+// Sequential reads, like those of full table scans,
+// are coalesced into increasingly larger reads.
+// Concurrent reads of the same page share a read.
+type CachedReader struct {
+	reader ioutil.SizeReaderAt
+	pager  pager
+
+	mtx  sync.Mutex
+	size int64 // +checklocks:mtx
+}
+
+// NewCachedReader wraps reader with a page cache.
+// Options may be nil.
+func NewCachedReader(reader ioutil.SizeReaderAt, opts *CacheOptions) *CachedReader {
+	r := &CachedReader{reader: reader, size: -1}
+	r.pager.init(opts, r.read)
+	return r
+}
+
+// Size implements [ioutil.SizeReaderAt].
+// The size is only read once.
+func (r *CachedReader) Size() (int64, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.size < 0 {
+		size, err := r.reader.Size()
+		if err != nil {
+			return 0, err
+		}
+		r.size = size
+	}
+	return r.size, nil
+}
+
+// ReadAt implements [io.ReaderAt].
+func (r *CachedReader) ReadAt(p []byte, off int64) (n int, err error) {
+	size, err := r.Size()
+	if err != nil {
+		return 0, err
+	}
+	return r.pager.readAt(p, off, size)
+}
+
+// Stats returns statistics for the page cache.
+func (r *CachedReader) Stats() CacheStats {
+	return r.pager.stats()
+}
+
+func (r *CachedReader) read(start, end int64) ([]byte, error) {
+	data := make([]byte, end-start)
+	n, err := r.reader.ReadAt(data, start)
+	if n == len(data) {
+		return data, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// Stats returns page cache statistics for the database name,
+// if it was created from a [CachedReader] or an [HTTPReader].
+func Stats(name string) (CacheStats, bool) {
+	readerMtx.RLock()
+	reader := readerDBs[name]
+	readerMtx.RUnlock()
+
+	if s, ok := reader.(interface{ Stats() CacheStats }); ok {
+		return s.Stats(), true
+	}
+	return CacheStats{}, false
+}
+
+// pager reads pages through a cache,
+// coalescing sequential reads.
+type pager struct {
+	cache    PageCache
+	pageSize int64
+	maxAhead int64
+	read     func(start, end int64) ([]byte, error)
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	readAhead atomic.Int64
+
+	mtx      sync.Mutex
+	next     int64                  // +checklocks:mtx
+	ahead    int64                  // +checklocks:mtx
+	inflight map[int64]*pageRequest // +checklocks:mtx
+}
+
+type pageRequest struct {
+	done  chan struct{}
+	first int64
+	data  []byte
+	err   error
+}
+
+func (p *pager) init(opts *CacheOptions, read func(start, end int64) ([]byte, error)) {
+	var o CacheOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Cache == nil {
+		o.Cache = NewLRUCache(256)
+	}
+	if o.PageSize <= 0 {
+		o.PageSize = 4096
+	}
+	if o.MaxReadAhead <= 0 {
+		o.MaxReadAhead = 64
+	}
+	p.cache = o.Cache
+	p.pageSize = int64(o.PageSize)
+	p.maxAhead = int64(o.MaxReadAhead)
+	p.read = read
+	p.ahead = 1
+	p.inflight = map[int64]*pageRequest{}
+}
+
+func (p *pager) stats() CacheStats {
+	return CacheStats{
+		Hits:      p.hits.Load(),
+		Misses:    p.misses.Load(),
+		ReadAhead: p.readAhead.Load(),
+	}
+}
+
+func (p *pager) readAt(b []byte, off, size int64) (n int, err error) {
+	for n < len(b) {
+		if off >= size {
+			return n, io.EOF
+		}
+		page := off / p.pageSize
+		data, err := p.page(page, size)
+		if err != nil {
+			return n, err
+		}
+		i := copy(b[n:], data[off-page*p.pageSize:])
+		off += int64(i)
+		n += i
+	}
+	return n, nil
+}
+
+func (p *pager) page(page, size int64) ([]byte, error) {
+	data, ok := p.cache.Get(page)
+
+	p.mtx.Lock()
+	// Sequential reads fetch increasingly more pages ahead.
+	switch page {
+	case p.next - 1: // same page
+	case p.next:
+		p.ahead = min(2*p.ahead, p.maxAhead)
+	default:
+		p.ahead = 1
+	}
+	p.next = page + 1
+	if ok {
+		p.mtx.Unlock()
+		p.hits.Add(1)
+		return data, nil
+	}
+	p.misses.Add(1)
+
+	req := p.inflight[page]
+	if req == nil {
+		last := min(page+p.ahead, divRoundUp(size, p.pageSize))
+		req = &pageRequest{
+			done:  make(chan struct{}),
+			first: page,
+		}
+		// Don't read pages that are already being read.
+		for i := page; i < last; i++ {
+			if p.inflight[i] != nil {
+				last = i
+				break
+			}
+			p.inflight[i] = req
+		}
+		p.mtx.Unlock()
+
+		req.data, req.err = p.read(page*p.pageSize, min(last*p.pageSize, size))
+		if req.err == nil {
+			for i := page; i < last; i++ {
+				p.cache.Put(i, req.page(i, p.pageSize))
+			}
+			p.readAhead.Add(last - page - 1)
+		}
+
+		p.mtx.Lock()
+		for i := page; i < last; i++ {
+			delete(p.inflight, i)
+		}
+		close(req.done)
+	}
+	p.mtx.Unlock()
+
+	<-req.done
+	if req.err != nil {
+		return nil, req.err
+	}
+	return req.page(page, p.pageSize), nil
+}
+
+func (r *pageRequest) page(page, pageSize int64) []byte {
+	start := (page - r.first) * pageSize
+	return r.data[start:min(start+pageSize, int64(len(r.data)))]
+}
+
+func divRoundUp(a, b int64) int64 {
+	return (a + b - 1) / b
+}
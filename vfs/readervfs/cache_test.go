@@ -0,0 +1,156 @@
+package readervfs_test
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/util/ioutil"
+	"github.com/ncruces/go-sqlite3/vfs/readervfs"
+)
+
+type countingReader struct {
+	*bytes.Reader
+	reads atomic.Int32
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	r.reads.Add(1)
+	return r.Reader.ReadAt(p, off)
+}
+
+func (r *countingReader) Size() (int64, error) {
+	return r.Reader.Size(), nil
+}
+
+func TestLRUCache(t *testing.T) {
+	c := readervfs.NewLRUCache(2)
+	c.Put(1, []byte("1"))
+	c.Put(2, []byte("2"))
+	c.Get(1)
+	c.Put(3, []byte("3"))
+
+	if _, ok := c.Get(2); ok {
+		t.Error("page 2 was not evicted")
+	}
+	for _, page := range []int64{1, 3} {
+		if _, ok := c.Get(page); !ok {
+			t.Errorf("page %d was evicted", page)
+		}
+	}
+}
+
+func TestCachedReader(t *testing.T) {
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i / 4096)
+	}
+	src := &countingReader{Reader: bytes.NewReader(data)}
+
+	r := readervfs.NewCachedReader(src, &readervfs.CacheOptions{
+		Cache:        readervfs.NewLRUCache(1024),
+		MaxReadAhead: 32,
+	})
+
+	// Read the file sequentially, in unaligned chunks.
+	got, err := io.ReadAll(io.NewSectionReader(r, 0, int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data mismatch")
+	}
+
+	// 256 pages are coalesced into far fewer reads.
+	if n := src.reads.Load(); n > 12 {
+		t.Errorf("got %d reads", n)
+	}
+	stats := r.Stats()
+	if stats.Misses+stats.ReadAhead != 256 {
+		t.Errorf("got %+v", stats)
+	}
+
+	// Random reads hit the cache.
+	reads := src.reads.Load()
+	var buf [100]byte
+	for _, off := range []int64{500000, 3, 70000, 1<<20 - 100} {
+		if _, err := r.ReadAt(buf[:], off); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:], data[off:][:len(buf)]) {
+			t.Errorf("data mismatch at %d", off)
+		}
+	}
+	if n := src.reads.Load(); n != reads {
+		t.Errorf("got %d reads, want %d", n, reads)
+	}
+	if got := r.Stats().Hits; got < stats.Hits+4 {
+		t.Errorf("got %d hits", got)
+	}
+
+	if _, err := r.ReadAt(buf[:], 1<<20-10); err != io.EOF {
+		t.Errorf("got %v, want EOF", err)
+	}
+}
+
+func TestCachedReader_short(t *testing.T) {
+	r := readervfs.NewCachedReader(short{}, nil)
+
+	var buf [100]byte
+	if _, err := r.ReadAt(buf[:], 0); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+// short claims to be larger than it is.
+type short struct{}
+
+func (short) ReadAt(p []byte, off int64) (int, error) { return 0, io.EOF }
+func (short) Size() (int64, error)                    { return 1 << 20, nil }
+
+func TestStats(t *testing.T) {
+	src := &countingReader{Reader: bytes.NewReader([]byte(testDB))}
+	readervfs.Create("cached.db", readervfs.NewCachedReader(src, &readervfs.CacheOptions{
+		PageSize: 512,
+	}))
+	defer readervfs.Delete("cached.db")
+
+	readervfs.Create("uncached.db", ioutil.NewSeekingReaderAt(strings.NewReader(testDB)))
+	defer readervfs.Delete("uncached.db")
+	if _, ok := readervfs.Stats("uncached.db"); ok {
+		t.Error("want no stats")
+	}
+
+	db, err := sql.Open("sqlite3", "file:cached.db?vfs=reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for range 3 {
+		var count int
+		err := db.QueryRow(`SELECT count(*) FROM users`).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 3 {
+			t.Errorf("got %d", count)
+		}
+	}
+
+	stats, ok := readervfs.Stats("cached.db")
+	if !ok {
+		t.Fatal("want stats")
+	}
+	if stats.Hits == 0 || stats.Misses == 0 {
+		t.Errorf("got %+v", stats)
+	}
+	if n := src.reads.Load(); int64(n) > stats.Misses {
+		t.Errorf("got %d reads, %+v", n, stats)
+	}
+}
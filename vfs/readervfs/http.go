@@ -0,0 +1,192 @@
+package readervfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var defaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// HTTPOptions configure an [HTTPReader].
+type HTTPOptions struct {
+	// Client makes the requests.
+	// Defaults to a client with a 30 second timeout.
+	Client *http.Client
+
+	// CacheOptions configure the page cache;
+	// each read is a single request.
+	CacheOptions
+}
+
+// HTTPReader reads a remote file using HTTP range requests.
+// It implements [ioutil.SizeReaderAt], and can be passed to [Create]
+// to query a static database on a web server or object store
+// without downloading it.
+//
+// Pages are cached, and sequential reads are coalesced
+// into increasingly larger requests.
+// Concurrent reads of the same page share a request.
+//
+// The file should not change: if the server reports an ETag,
+// requests fail once it changes.
+type HTTPReader struct {
+	url    string
+	client *http.Client
+	pager  pager
+
+	mtx  sync.Mutex
+	size int64  // +checklocks:mtx
+	etag string // +checklocks:mtx
+}
+
+// NewHTTPReader creates a reader for url.
+// Options may be nil.
+func NewHTTPReader(url string, opts *HTTPOptions) *HTTPReader {
+	var o HTTPOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Client == nil {
+		o.Client = defaultClient
+	}
+	r := &HTTPReader{
+		url:    url,
+		client: o.Client,
+		size:   -1,
+	}
+	r.pager.init(&o.CacheOptions, r.fetch)
+	return r
+}
+
+// Size returns the size of the remote file.
+// The first call makes a request, which also reads the first page.
+func (r *HTTPReader) Size() (int64, error) {
+	r.mtx.Lock()
+	size := r.size
+	r.mtx.Unlock()
+	if size >= 0 {
+		return size, nil
+	}
+
+	// Concurrent first calls may make concurrent requests;
+	// the first response wins.
+	resp, err := r.get(0, r.pager.pageSize-1, "")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	size, err = contentSize(resp)
+	if err != nil {
+		return 0, err
+	}
+	var page []byte
+	if size > 0 {
+		page = make([]byte, min(size, r.pager.pageSize))
+		if _, err := io.ReadFull(resp.Body, page); err != nil {
+			return 0, err
+		}
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.size >= 0 {
+		return r.size, nil
+	}
+	if page != nil {
+		r.pager.cache.Put(0, page)
+	}
+	if etag := resp.Header.Get("ETag"); !strings.HasPrefix(etag, "W/") {
+		r.etag = etag
+	}
+	r.size = size
+	return size, nil
+}
+
+// ReadAt implements [io.ReaderAt].
+func (r *HTTPReader) ReadAt(p []byte, off int64) (n int, err error) {
+	size, err := r.Size()
+	if err != nil {
+		return 0, err
+	}
+	return r.pager.readAt(p, off, size)
+}
+
+// Stats returns statistics for the page cache.
+func (r *HTTPReader) Stats() CacheStats {
+	return r.pager.stats()
+}
+
+func (r *HTTPReader) fetch(start, end int64) ([]byte, error) {
+	r.mtx.Lock()
+	etag := r.etag
+	r.mtx.Unlock()
+
+	resp, err := r.get(start, end-1, etag)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data := make([]byte, end-start)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (r *HTTPReader) get(start, end int64, etag string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if etag != "" {
+		// If the file changed, the server sends all of it.
+		req.Header.Set("If-Range", etag)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent &&
+		(etag == "" || etag == resp.Header.Get("ETag")):
+		return resp, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && start == 0:
+		return resp, nil // empty file
+	}
+
+	resp.Body.Close()
+	switch {
+	case etag != "" && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent):
+		return nil, errors.New("readervfs: remote file changed")
+	case resp.StatusCode == http.StatusOK:
+		return nil, errors.New("readervfs: server does not support range requests")
+	default:
+		return nil, fmt.Errorf("readervfs: unexpected status: %s", resp.Status)
+	}
+}
+
+// contentSize parses the complete length from a Content-Range header:
+// "bytes 0-4095/16384" or "bytes */0".
+func contentSize(resp *http.Response) (int64, error) {
+	cr := resp.Header.Get("Content-Range")
+	_, size, ok := strings.Cut(cr, "/")
+	if !ok || !strings.HasPrefix(cr, "bytes ") {
+		return 0, fmt.Errorf("readervfs: invalid Content-Range: %q", cr)
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("readervfs: unknown size: %q", cr)
+	}
+	return n, nil
+}
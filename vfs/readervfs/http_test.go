@@ -0,0 +1,172 @@
+package readervfs_test
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/vfs/readervfs"
+)
+
+type server struct {
+	*httptest.Server
+	requests atomic.Int32
+	etag     atomic.Value
+}
+
+func newServer(t *testing.T, data []byte) *server {
+	s := &server{}
+	s.etag.Store(`"v1"`)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		w.Header().Set("ETag", s.etag.Load().(string))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestHTTPReader(t *testing.T) {
+	srv := newServer(t, []byte(testDB))
+
+	readervfs.Create("http.db", readervfs.NewHTTPReader(srv.URL, nil))
+	defer readervfs.Delete("http.db")
+
+	db, err := sql.Open("sqlite3", "file:http.db?vfs=reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	query := func() string {
+		var names []string
+		rows, err := db.Query(`SELECT name FROM users ORDER BY id`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+		}
+		return strings.Join(names, " ")
+	}
+
+	if got := query(); got != "go zig whatever" {
+		t.Errorf("got %q", got)
+	}
+	requests := srv.requests.Load()
+
+	// Cached pages don't make requests.
+	if got := query(); got != "go zig whatever" {
+		t.Errorf("got %q", got)
+	}
+	if got := srv.requests.Load(); got != requests {
+		t.Errorf("got %d requests, want %d", got, requests)
+	}
+}
+
+func TestHTTPReader_sequential(t *testing.T) {
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i / 4096)
+	}
+	srv := newServer(t, data)
+
+	r := readervfs.NewHTTPReader(srv.URL, &readervfs.HTTPOptions{
+		CacheOptions: readervfs.CacheOptions{
+			Cache:        readervfs.NewLRUCache(1024),
+			MaxReadAhead: 32,
+		},
+	})
+	size, err := r.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("got size %d", size)
+	}
+
+	// Read the file sequentially, in unaligned chunks.
+	got, err := io.ReadAll(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data mismatch")
+	}
+
+	// 256 pages are coalesced into far fewer requests.
+	if n := srv.requests.Load(); n > 12 {
+		t.Errorf("got %d requests", n)
+	}
+}
+
+func TestHTTPReader_concurrent(t *testing.T) {
+	data := make([]byte, 1<<16)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	srv := newServer(t, data)
+	r := readervfs.NewHTTPReader(srv.URL, nil)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf [100]byte
+			for off := int64(i); off < int64(len(data)-len(buf)); off += 997 {
+				if _, err := r.ReadAt(buf[:], off); err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(buf[:], data[off:off+int64(len(buf))]) {
+					t.Errorf("data mismatch at %d", off)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHTTPReader_changed(t *testing.T) {
+	data := make([]byte, 1<<16)
+	srv := newServer(t, data)
+	r := readervfs.NewHTTPReader(srv.URL, nil)
+
+	var buf [100]byte
+	if _, err := r.ReadAt(buf[:], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.etag.Store(`"v2"`)
+	if _, err := r.ReadAt(buf[:], 50000); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestHTTPReader_noRange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, testDB)
+	}))
+	defer srv.Close()
+
+	r := readervfs.NewHTTPReader(srv.URL, nil)
+	if _, err := r.Size(); err == nil {
+		t.Error("want error")
+	}
+}
@@ -0,0 +1,26 @@
+package readervfs_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3/util/ioutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/readervfs"
+	"github.com/ncruces/go-sqlite3/vfs/vfstest"
+)
+
+func Test_vfstest(t *testing.T) {
+	vfstest.Test(t, vfs.Find("reader"), &vfstest.Options{
+		ReadOnly: true,
+		Name: func(t *testing.T) string {
+			return t.Name() + ".db"
+		},
+		Create: func(t *testing.T, data []byte) string {
+			name := t.Name() + ".db"
+			readervfs.Create(name, ioutil.NewSizeReaderAt(bytes.NewReader(data)))
+			t.Cleanup(func() { readervfs.Delete(name) })
+			return name
+		},
+	})
+}
@@ -1,25 +1,38 @@
 package vfs
 
-import "sync"
+import (
+	"strings"
+	"sync"
+)
 
 var (
 	// +checklocks:vfsRegistryMtx
-	vfsRegistry    map[string]VFS
-	vfsRegistryMtx sync.RWMutex
+	vfsRegistry map[string]VFS
+	// +checklocks:vfsRegistryMtx
+	wrapperRegistry map[string]Wrapper
+	vfsRegistryMtx  sync.RWMutex
 )
 
 // Find returns a VFS given its name.
 // If there is no match, nil is returned.
 // If name is empty, the default VFS is returned.
 //
+// Names like "adiantum+stats" describe a stack (see [RegisterStack]),
+// which is registered the first time it's found,
+// if all of its layers are registered.
+//
 // https://sqlite.org/c3ref/vfs_find.html
 func Find(name string) VFS {
 	if name == "" || name == "os" {
 		return vfsOS{}
 	}
 	vfsRegistryMtx.RLock()
-	defer vfsRegistryMtx.RUnlock()
-	return vfsRegistry[name]
+	vfs := vfsRegistry[name]
+	vfsRegistryMtx.RUnlock()
+	if vfs == nil && strings.Contains(name, "+") {
+		return RegisterStack(name)
+	}
+	return vfs
 }
 
 // Register registers a VFS.
@@ -32,6 +45,11 @@ func Register(name string, vfs VFS) {
 	}
 	vfsRegistryMtx.Lock()
 	defer vfsRegistryMtx.Unlock()
+	register(name, vfs)
+}
+
+// +checklocks:vfsRegistryMtx
+func register(name string, vfs VFS) {
 	if vfsRegistry == nil {
 		vfsRegistry = map[string]VFS{}
 	}
@@ -46,3 +64,88 @@ func Unregister(name string) {
 	defer vfsRegistryMtx.Unlock()
 	delete(vfsRegistry, name)
 }
+
+// Wrapper wraps a base VFS to add features to it
+// (e.g. encryption, or statistics).
+type Wrapper func(base VFS) VFS
+
+// RegisterWrapper registers a wrapper,
+// so it can be used in the name of a stack (see [RegisterStack]).
+func RegisterWrapper(name string, wrap Wrapper) {
+	vfsRegistryMtx.Lock()
+	defer vfsRegistryMtx.Unlock()
+	if wrapperRegistry == nil {
+		wrapperRegistry = map[string]Wrapper{}
+	}
+	wrapperRegistry[name] = wrap
+}
+
+// Stack wraps base with each of wrappers, in order,
+// and registers the resulting VFS as name.
+// The last wrapper is the one closest to SQLite.
+// If base is nil, the default VFS is used.
+func Stack(name string, base VFS, wrappers ...Wrapper) VFS {
+	if base == nil {
+		base = vfsOS{}
+	}
+	for _, wrap := range wrappers {
+		base = wrap(base)
+	}
+	Register(name, base)
+	return base
+}
+
+// RegisterStack registers the stack described by name.
+// [Find] registers stacks as they're found,
+// so a stack can be used in a URI (e.g. "file:demo.db?vfs=adiantum+stats")
+// without registering it first.
+//
+// Names like "adiantum+stats" describe a stack:
+// a registered VFS ("adiantum"),
+// wrapped by registered wrappers ("stats"), in order.
+// If the first layer is not a VFS, but a wrapper,
+// it wraps the default VFS.
+//
+// RegisterStack returns the registered VFS,
+// or nil if some layer is not registered.
+// If name is already registered, that VFS is returned:
+// concurrent calls return the same VFS.
+func RegisterStack(name string) VFS {
+	vfsRegistryMtx.RLock()
+	vfs := vfsRegistry[name]
+	vfsRegistryMtx.RUnlock()
+	if vfs != nil {
+		return vfs
+	}
+
+	layers := strings.Split(name, "+")
+	base := Find(layers[0])
+	if base != nil {
+		layers = layers[1:]
+	} else {
+		// The first layer may be a wrapper.
+		base = vfsOS{}
+	}
+
+	vfsRegistryMtx.RLock()
+	wrappers := make([]Wrapper, len(layers))
+	for i, layer := range layers {
+		wrappers[i] = wrapperRegistry[layer]
+	}
+	vfsRegistryMtx.RUnlock()
+
+	for _, wrap := range wrappers {
+		if wrap == nil {
+			return nil
+		}
+		base = wrap(base)
+	}
+
+	vfsRegistryMtx.Lock()
+	defer vfsRegistryMtx.Unlock()
+	if vfs := vfsRegistry[name]; vfs != nil {
+		return vfs // lost a race
+	}
+	register(name, base)
+	return base
+}
@@ -1,10 +1,13 @@
 package vfs_test
 
 import (
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/ncruces/go-sqlite3"
 	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
 	"github.com/ncruces/go-sqlite3/vfs"
 )
 
@@ -62,3 +65,204 @@ func TestRegister_os(t *testing.T) {
 		t.Fail()
 	}
 }
+
+type countingVFS struct {
+	vfs.VFS
+	opens *int
+}
+
+func (c countingVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	*c.opens++
+	return c.VFS.Open(name, flags)
+}
+
+func (c countingVFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	*c.opens++
+	return vfsutil.WrapOpenFilename(c.VFS, name, flags)
+}
+
+func TestRegisterStack(t *testing.T) {
+	var inner, outer int
+	vfs.RegisterWrapper("inner", func(base vfs.VFS) vfs.VFS {
+		return countingVFS{base, &inner}
+	})
+	vfs.RegisterWrapper("outer", func(base vfs.VFS) vfs.VFS {
+		return countingVFS{base, &outer}
+	})
+
+	if vfs.RegisterStack("inner+missing") != nil || vfs.Find("inner+missing") != nil {
+		t.Error("want nil")
+	}
+	if vfs.RegisterStack("missing+inner") != nil || vfs.Find("missing+inner") != nil {
+		t.Error("want nil")
+	}
+
+	// Stacks are registered when they're first found.
+	stack := vfs.Find("inner+outer")
+	if stack == nil {
+		t.Fatal("want stack")
+	}
+	defer vfs.Unregister("inner+outer")
+	if vfs.Find("inner+outer") != stack || vfs.RegisterStack("inner+outer") != stack {
+		t.Error("want the same stack")
+	}
+	if c, ok := stack.(countingVFS); !ok || c.opens != &outer {
+		t.Error("want outer wrapper last")
+	}
+
+	conn, err := sqlite3.Open("file:" + filepath.ToSlash(filepath.Join(t.TempDir(), "test.db")) + "?vfs=inner+outer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = conn.Exec(`CREATE TABLE t (x)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner == 0 || inner != outer {
+		t.Errorf("got %d and %d opens", inner, outer)
+	}
+}
+
+func TestStack(t *testing.T) {
+	var opens int
+	stack := vfs.Stack("counting", nil, func(base vfs.VFS) vfs.VFS {
+		return countingVFS{base, &opens}
+	})
+	defer vfs.Unregister("counting")
+	if vfs.Find("counting") != stack {
+		t.Error("want the stack")
+	}
+
+	conn, err := sqlite3.Open("file:" + filepath.ToSlash(filepath.Join(t.TempDir(), "test.db")) + "?vfs=counting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if opens == 0 {
+		t.Error("want opens")
+	}
+}
+
+func TestRegisterStack_race(t *testing.T) {
+	vfs.RegisterWrapper("racing", func(base vfs.VFS) vfs.VFS {
+		return countingVFS{base, new(int)}
+	})
+	defer vfs.Unregister("racing+racing")
+
+	// Concurrent finds register a single stack.
+	var stacks [8]vfs.VFS
+	var wg sync.WaitGroup
+	for i := range stacks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stacks[i] = vfs.Find("racing+racing")
+		}()
+	}
+	wg.Wait()
+	for _, stack := range stacks {
+		if stack == nil || stack != stacks[0] {
+			t.Fatal("want the same stack")
+		}
+	}
+}
+
+const probeOp = sqlite3.FCNTL_CUSTOM + 256
+
+// probeVFS opens files that answer a PRAGMA and a file control.
+type probeVFS struct{ vfs.VFS }
+
+func (p probeVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	file, flags, err := p.VFS.Open(name, flags)
+	if err != nil {
+		return nil, flags, err
+	}
+	return &probeFile{vfsutil.WrappedFile{File: file}}, flags, nil
+}
+
+type probeFile struct{ vfsutil.WrappedFile }
+
+func (p *probeFile) Pragma(name, value string) (string, error) {
+	if name == "probe" {
+		return "bottom", nil
+	}
+	return p.WrappedFile.Pragma(name, value)
+}
+
+func (p *probeFile) CustomControl(op uint32, arg any) (any, error) {
+	if op == uint32(probeOp) {
+		return arg, nil
+	}
+	return p.WrappedFile.CustomControl(op, arg)
+}
+
+// layerVFS wraps files without overriding any of their methods.
+type layerVFS struct{ vfs.VFS }
+
+func (l layerVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	return l.OpenFilename(nil, flags)
+}
+
+func (l layerVFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	file, flags, err := vfsutil.WrapOpenFilename(l.VFS, name, flags)
+	if err != nil {
+		return nil, flags, err
+	}
+	return layerFile{vfsutil.WrappedFile{File: file}}, flags, nil
+}
+
+type layerFile struct{ vfsutil.WrappedFile }
+
+func TestStack_passthrough(t *testing.T) {
+	vfs.Register("probe", probeVFS{vfs.Find("")})
+	defer vfs.Unregister("probe")
+	for _, name := range []string{"lower", "upper"} {
+		vfs.RegisterWrapper(name, func(base vfs.VFS) vfs.VFS {
+			return layerVFS{base}
+		})
+	}
+	defer vfs.Unregister("probe+lower+upper")
+
+	conn, err := sqlite3.Open("file:" + filepath.ToSlash(filepath.Join(t.TempDir(), "test.db")) + "?vfs=probe+lower+upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A PRAGMA reaches the bottom layer.
+	stmt, _, err := conn.Prepare(`PRAGMA probe`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	if !stmt.Step() {
+		t.Fatal(stmt.Err())
+	}
+	if got := stmt.ColumnText(0); got != "bottom" {
+		t.Errorf("got %q", got)
+	}
+
+	// So does a custom file control.
+	got, err := conn.FileControl("main", probeOp, "arg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "arg" {
+		t.Errorf("got %v", got)
+	}
+
+	// The file unwraps through every layer.
+	ptr, err := conn.FileControl("main", sqlite3.FCNTL_FILE_POINTER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, ok := vfsutil.UnwrapFile[layerFile](ptr.(vfs.File))
+	if !ok {
+		t.Fatalf("got %T", ptr)
+	}
+	if _, ok := vfsutil.UnwrapFile[*probeFile](file.Unwrap()); !ok {
+		t.Error("want probe file")
+	}
+}
@@ -0,0 +1,99 @@
+// Package replica wraps an SQLite VFS to continuously replicate databases.
+//
+// The "replica" [vfs.VFS] wraps the default VFS,
+// and ships every transaction committed to the WAL of a database
+// to a [Sink], where it can be used to [Restore] the database
+// to any point in time.
+//
+// Importing package replica registers that VFS,
+// and a wrapper to stack it over other VFSes (e.g. "xts+replica"):
+//
+//	import _ "github.com/ncruces/go-sqlite3/vfs/replica"
+//
+// The registered VFS replicates databases opened
+// with the "replica" [URI] parameter to a directory:
+//
+//	file:demo.db?vfs=replica&replica=/var/backups/demo
+//
+// Only databases in [WAL mode] are replicated.
+// Replication starts with a snapshot of the database,
+// followed by each of its transactions, as they're committed.
+// New snapshots are taken if the sink fails, and after a checkpoint,
+// once the transactions shipped since the last snapshot
+// outgrow the database.
+//
+// A reopened database resumes replication from the last segment in its sink,
+// if the database still has the checksum stored with that segment;
+// otherwise, replication restarts with a new snapshot.
+// Checking the database reads it, but doesn't ship it.
+//
+// Transactions are shipped as they're committed,
+// before they're synced to the WAL.
+// Databases must not be written by more than one process at a time.
+//
+// [URI]: https://sqlite.org/uri.html
+// [WAL mode]: https://sqlite.org/wal.html
+package replica
+
+import (
+	"io"
+	"time"
+
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+func init() {
+	vfs.Register("replica", Wrap(vfs.Find(""), nil))
+	vfs.RegisterWrapper("replica", func(base vfs.VFS) vfs.VFS {
+		return Wrap(base, nil)
+	})
+}
+
+// Wrap wraps a base VFS to create a replicating VFS.
+//
+// The sink function is called when a main database file is opened,
+// and returns the [Sink] to replicate it to,
+// or nil to not replicate it.
+//
+// If sink is nil, databases are replicated to the directory
+// in their "replica" URI parameter (see [DirSink]).
+func Wrap(base vfs.VFS, sink func(name *vfs.Filename) Sink) vfs.VFS {
+	if sink == nil {
+		sink = uriSink
+	}
+	return &replicaVFS{
+		VFS:      base,
+		sink:     sink,
+		replicas: map[string]*replica{},
+	}
+}
+
+// Segment describes a unit of replication:
+// either a snapshot of a database, or a transaction.
+type Segment struct {
+	Seq      uint64    // sequence number, increasing by one with each segment
+	Time     time.Time // when the segment was shipped
+	Snapshot bool      // whether the segment holds every page of the database
+	PageSize uint32    // database page size
+	Pages    uint32    // database size in pages, after the segment
+	Checksum uint64    // database checksum, after the segment (zero for snapshots)
+}
+
+// Sink stores the segments of a replicated database.
+//
+// The data of a snapshot are its pages, in order.
+// The data of a transaction are the pages it changed,
+// each preceded by its 4-byte big-endian page number.
+//
+// A reopened database resumes replication
+// only if the sink stores the checksums of segments.
+type Sink interface {
+	// Write stores a segment, and its data.
+	// Writes must be atomic, and durable.
+	// A failed write may be retried with the same sequence number.
+	Write(seg Segment, data io.Reader) error
+	// Segments lists the stored segments, by sequence number.
+	Segments() ([]Segment, error)
+	// Read returns the data of a stored segment.
+	Read(seg Segment) (io.ReadCloser, error)
+}
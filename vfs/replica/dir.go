@@ -0,0 +1,138 @@
+package replica
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DirSink returns a [Sink] that stores segments as files in a directory,
+// which is created if it doesn't exist.
+//
+// Each segment is stored in its own file, named after its sequence number.
+// Files are written to a temporary name, synced, and then renamed.
+func DirSink(dir string) Sink {
+	return dirSink(dir)
+}
+
+type dirSink string
+
+const (
+	snapshotExt = ".snapshot"
+	txExt       = ".tx"
+	headerSize  = 24 // time, page size, pages, checksum
+)
+
+func (d dirSink) Write(seg Segment, data io.Reader) error {
+	err := os.MkdirAll(string(d), 0777)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(string(d), "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var hdr [headerSize]byte
+	binary.BigEndian.PutUint64(hdr[0:], uint64(seg.Time.UnixNano()))
+	binary.BigEndian.PutUint32(hdr[8:], seg.PageSize)
+	binary.BigEndian.PutUint32(hdr[12:], seg.Pages)
+	binary.BigEndian.PutUint64(hdr[16:], seg.Checksum)
+	if _, err := f.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), d.path(seg)); err != nil {
+		return err
+	}
+	if dir, err := os.Open(string(d)); err == nil {
+		// Not all platforms can sync directories.
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (d dirSink) Segments() ([]Segment, error) {
+	entries, err := os.ReadDir(string(d))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries are sorted by name, and so by sequence number.
+	var segs []Segment
+	for _, e := range entries {
+		var seg Segment
+		name := e.Name()
+		switch {
+		case strings.HasSuffix(name, snapshotExt):
+			name = strings.TrimSuffix(name, snapshotExt)
+			seg.Snapshot = true
+		case strings.HasSuffix(name, txExt):
+			name = strings.TrimSuffix(name, txExt)
+		default:
+			continue
+		}
+		seg.Seq, err = strconv.ParseUint(name, 16, 64)
+		if err != nil || len(name) != 16 {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(string(d), e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var hdr [headerSize]byte
+		_, err = io.ReadFull(f, hdr[:])
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		seg.Time = time.Unix(0, int64(binary.BigEndian.Uint64(hdr[0:])))
+		seg.PageSize = binary.BigEndian.Uint32(hdr[8:])
+		seg.Pages = binary.BigEndian.Uint32(hdr[12:])
+		seg.Checksum = binary.BigEndian.Uint64(hdr[16:])
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+func (d dirSink) Read(seg Segment) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(seg))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(headerSize, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d dirSink) path(seg Segment) string {
+	ext := txExt
+	if seg.Snapshot {
+		ext = snapshotExt
+	}
+	return filepath.Join(string(d), fmt.Sprintf("%016x%s", seg.Seq, ext))
+}
@@ -0,0 +1,432 @@
+package replica
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+)
+
+type replicaVFS struct {
+	vfs.VFS
+	sink func(name *vfs.Filename) Sink
+	mtx  sync.Mutex
+	// +checklocks:mtx
+	replicas map[string]*replica
+}
+
+func uriSink(name *vfs.Filename) Sink {
+	if dir := name.URIParameter("replica"); dir != "" {
+		return DirSink(dir)
+	}
+	return nil
+}
+
+func (v *replicaVFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	file, flags, err := vfsutil.WrapOpenFilename(v.VFS, name, flags)
+	if err != nil {
+		return file, flags, err
+	}
+
+	switch {
+	case flags&vfs.OPEN_MAIN_DB != 0:
+		if sink := v.sink(name); sink != nil {
+			return &dbFile{
+				WrappedFile: vfsutil.WrappedFile{File: file},
+				vfs:         v,
+				rep:         v.acquire(name.String(), sink),
+			}, flags, nil
+		}
+
+	case flags&vfs.OPEN_WAL != 0:
+		// The WAL is replicated if its database is.
+		if db, ok := vfsutil.UnwrapFile[*dbFile](name.DatabaseFile()); ok {
+			return &walFile{
+				WrappedFile: vfsutil.WrappedFile{File: file},
+				db:          db.File,
+				rep:         db.rep,
+			}, flags, nil
+		}
+	}
+	return file, flags, nil
+}
+
+// acquire returns the replica of a database,
+// shared by all connections to it.
+func (v *replicaVFS) acquire(name string, sink Sink) *replica {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	r := v.replicas[name]
+	if r == nil {
+		r = &replica{
+			name:     name,
+			sink:     sink,
+			snapshot: true,
+			resume:   true,
+			txStart:  -1,
+		}
+		v.replicas[name] = r
+	}
+	r.refs++
+	return r
+}
+
+func (v *replicaVFS) release(r *replica) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	r.refs--
+	if r.refs == 0 {
+		delete(v.replicas, r.name)
+	}
+}
+
+type replica struct {
+	name string
+	sink Sink
+	refs int // +checklocks:replicaVFS.mtx
+
+	mtx      sync.Mutex
+	seq      uint64 // last shipped sequence number
+	synced   bool   // seq is known
+	snapshot bool   // the next commit needs a snapshot
+	resume   bool   // the next commit may resume from the last stored segment
+	shipped  int64  // bytes shipped since the last snapshot
+	snapSize int64  // bytes in the last snapshot
+	txStart  int64  // WAL offset of the current transaction, or -1
+	pageSize uint32
+	sums     pageSums // checksums of the replicated database
+}
+
+// written observes a write to the WAL.
+func (r *replica) written(f *walFile, p []byte, off int64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	// The WAL header is written when the WAL is restarted.
+	if off == 0 {
+		r.txStart = -1
+		r.pageSize = 0
+		if len(p) >= walHeaderSize {
+			r.pageSize = binary.BigEndian.Uint32(p[8:])
+		}
+		return
+	}
+
+	if r.pageSize == 0 {
+		var hdr [walHeaderSize]byte
+		if _, err := f.File.ReadAt(hdr[:], 0); err != nil {
+			r.fail()
+			return
+		}
+		r.pageSize = binary.BigEndian.Uint32(hdr[8:])
+	}
+
+	frameSize := walFrameHeaderSize + int64(r.pageSize)
+	if r.txStart < 0 {
+		r.txStart = walHeaderSize + (off-walHeaderSize)/frameSize*frameSize
+	}
+
+	// A transaction is committed when its commit frame is written.
+	end := off + int64(len(p))
+	if (end-walHeaderSize)%frameSize != 0 {
+		return
+	}
+	var hdr [walFrameHeaderSize]byte
+	if _, err := f.File.ReadAt(hdr[:], end-frameSize); err != nil {
+		r.fail()
+		return
+	}
+	if pages := binary.BigEndian.Uint32(hdr[4:]); pages != 0 {
+		r.commit(f, end, pages)
+		r.txStart = -1
+	}
+}
+
+// truncated observes a truncation of the WAL.
+func (r *replica) truncated() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.txStart = -1
+}
+
+// checkpointed decides if a new snapshot is due after a checkpoint.
+func (r *replica) checkpointed() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.shipped > r.snapSize {
+		r.snapshot = true
+	}
+}
+
+// fail forces a new snapshot,
+// after a transaction could not be shipped.
+//
+// +checklocks:r.mtx
+func (r *replica) fail() {
+	r.snapshot = true
+	r.resume = false
+}
+
+// commit ships a transaction, and a snapshot if needed.
+// If the sink fails, the next commit ships a new snapshot.
+//
+// +checklocks:r.mtx
+func (r *replica) commit(f *walFile, end int64, pages uint32) {
+	if !r.synced {
+		segs, err := r.sink.Segments()
+		if err != nil {
+			r.fail()
+			return
+		}
+		if len(segs) > 0 {
+			last := segs[len(segs)-1]
+			r.seq = last.Seq
+			// The first commit after opening resumes from the last segment,
+			// if the database matches it, instead of shipping a new snapshot.
+			if r.resume && r.resumes(f, last) {
+				r.snapshot = false
+			}
+		}
+		r.synced = true
+	}
+	r.resume = false
+
+	if r.snapshot {
+		if err := r.shipSnapshot(f); err != nil {
+			r.fail()
+			return
+		}
+		r.snapshot = false
+	}
+
+	frames, _, err := r.frames(f, r.txStart, end)
+	if err != nil {
+		r.fail()
+		return
+	}
+	var buf bytes.Buffer
+	page := make([]byte, r.pageSize)
+	for _, pgno := range slices.Sorted(maps.Keys(frames)) {
+		if _, err := f.File.ReadAt(page, frames[pgno]+walFrameHeaderSize); err != nil {
+			r.fail()
+			return
+		}
+		buf.Write(binary.BigEndian.AppendUint32(nil, pgno))
+		buf.Write(page)
+		r.sums.set(pgno, page)
+	}
+	r.sums.resize(pages)
+
+	size := int64(buf.Len())
+	err = r.sink.Write(Segment{
+		Seq:      r.seq + 1,
+		Time:     time.Now(),
+		PageSize: r.pageSize,
+		Pages:    pages,
+		Checksum: r.sums.sum,
+	}, &buf)
+	if err != nil {
+		r.fail()
+		return
+	}
+	r.seq++
+	r.shipped += size
+}
+
+// resumes reports if the database, as of the start of the current transaction,
+// has the page size, page count, and checksum of the last stored segment.
+// The database is read to compute its checksum, but not shipped.
+//
+// +checklocks:r.mtx
+func (r *replica) resumes(f *walFile, last Segment) bool {
+	if last.PageSize != r.pageSize {
+		return false
+	}
+	db, err := r.snapshotReader(f)
+	if err != nil || db.pages != last.Pages {
+		return false
+	}
+	if _, err := io.Copy(io.Discard, db); err != nil {
+		return false
+	}
+	return r.sums.sum == last.Checksum
+}
+
+// shipSnapshot ships the database as of the start of the current transaction.
+//
+// +checklocks:r.mtx
+func (r *replica) shipSnapshot(f *walFile) error {
+	db, err := r.snapshotReader(f)
+	if err != nil {
+		return err
+	}
+	err = r.sink.Write(Segment{
+		Seq:      r.seq + 1,
+		Time:     time.Now(),
+		Snapshot: true,
+		PageSize: r.pageSize,
+		Pages:    db.pages,
+	}, db)
+	if err != nil {
+		return err
+	}
+	r.seq++
+	r.shipped = 0
+	r.snapSize = int64(db.pages) * int64(r.pageSize)
+	return nil
+}
+
+// snapshotReader returns a reader for the database
+// as of the start of the current transaction:
+// the database file, updated by the committed frames in the WAL.
+// Reading it recomputes the checksums of the database.
+//
+// +checklocks:r.mtx
+func (r *replica) snapshotReader(f *walFile) (*snapshotReader, error) {
+	frames, pages, err := r.frames(f, walHeaderSize, r.txStart)
+	if err != nil {
+		return nil, err
+	}
+	if pages == 0 {
+		pages, err = r.dbPages(f.db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.sums.reset()
+	return &snapshotReader{
+		db:     f.db,
+		wal:    f.File,
+		frames: frames,
+		pages:  pages,
+		sums:   &r.sums,
+		buf:    make([]byte, 0, r.pageSize),
+	}, nil
+}
+
+// frames returns the latest frame for each page in a range of the WAL,
+// and the database size of the last commit frame.
+//
+// +checklocks:r.mtx
+func (r *replica) frames(f *walFile, start, end int64) (map[uint32]int64, uint32, error) {
+	var hdr [walFrameHeaderSize]byte
+	var pages uint32
+	frames := map[uint32]int64{}
+	for off := start; off < end; off += walFrameHeaderSize + int64(r.pageSize) {
+		if _, err := f.File.ReadAt(hdr[:], off); err != nil {
+			return nil, 0, err
+		}
+		frames[binary.BigEndian.Uint32(hdr[0:])] = off
+		if commit := binary.BigEndian.Uint32(hdr[4:]); commit != 0 {
+			pages = commit
+		}
+	}
+	return frames, pages, nil
+}
+
+// dbPages returns the size of the database file in pages.
+//
+// +checklocks:r.mtx
+func (r *replica) dbPages(db vfs.File) (uint32, error) {
+	// The in-header database size.
+	var buf [4]byte
+	if _, err := db.ReadAt(buf[:], 28); err == nil {
+		if pages := binary.BigEndian.Uint32(buf[:]); pages != 0 {
+			return pages, nil
+		}
+	}
+	size, err := db.Size()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(size / int64(r.pageSize)), nil
+}
+
+// snapshotReader reads the pages of a database, in order,
+// from the WAL if they're in it, or from the database file.
+type snapshotReader struct {
+	db     vfs.File
+	wal    vfs.File
+	frames map[uint32]int64
+	sums   *pageSums
+	pages  uint32
+	pgno   uint32
+	buf    []byte
+	pos    int
+}
+
+func (s *snapshotReader) Read(p []byte) (int, error) {
+	if s.pos == len(s.buf) {
+		if s.pgno >= s.pages {
+			return 0, io.EOF
+		}
+		s.pgno++
+		s.pos = 0
+		s.buf = s.buf[:cap(s.buf)]
+
+		var err error
+		var n int
+		if off, ok := s.frames[s.pgno]; ok {
+			n, err = s.wal.ReadAt(s.buf, off+walFrameHeaderSize)
+		} else {
+			n, err = s.db.ReadAt(s.buf, int64(s.pgno-1)*int64(len(s.buf)))
+		}
+		if err == io.EOF {
+			// Pages past the end of the file are zero.
+			clear(s.buf[n:])
+		} else if err != nil {
+			return 0, err
+		}
+		s.sums.set(s.pgno, s.buf)
+	}
+	n := copy(p, s.buf[s.pos:])
+	s.pos += n
+	return n, nil
+}
+
+type dbFile struct {
+	vfsutil.WrappedFile
+	vfs *replicaVFS
+	rep *replica
+}
+
+func (f *dbFile) Close() error {
+	f.vfs.release(f.rep)
+	return f.File.Close()
+}
+
+func (f *dbFile) CheckpointDone() {
+	f.WrappedFile.CheckpointDone()
+	f.rep.checkpointed()
+}
+
+type walFile struct {
+	vfsutil.WrappedFile
+	db  vfs.File
+	rep *replica
+}
+
+func (f *walFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	if err == nil {
+		f.rep.written(f, p, off)
+	}
+	return n, err
+}
+
+func (f *walFile) Truncate(size int64) error {
+	err := f.File.Truncate(size)
+	f.rep.truncated()
+	return err
+}
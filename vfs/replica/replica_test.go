@@ -0,0 +1,308 @@
+package replica_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/faultvfs"
+	"github.com/ncruces/go-sqlite3/vfs/replica"
+	"github.com/ncruces/go-sqlite3/vfs/vfstest"
+)
+
+func Test_vfstest(t *testing.T) {
+	if !vfs.SupportsFileLocking {
+		t.Skip("skipping without locks")
+	}
+	sink := replica.DirSink(t.TempDir())
+	vfstest.Test(t, replica.Wrap(vfs.Find(""), func(*vfs.Filename) replica.Sink {
+		return sink
+	}), nil)
+}
+
+func TestReplica(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.ToSlash(filepath.Join(dir, "test.db"))
+	sink := replica.DirSink(filepath.Join(dir, "replica"))
+
+	db := open(t, path, filepath.Join(dir, "replica"))
+	testcfg.Exec(t, db, `PRAGMA journal_mode=wal`)
+	testcfg.Exec(t, db, `CREATE TABLE events (seq INTEGER PRIMARY KEY, payload BLOB)`)
+
+	// Record points in time between transactions
+	// that grow to span many frames, across WAL restarts.
+	var points []time.Time
+	for i := range 10 {
+		insert(t, db, i+1, 1000*(i+1))
+		if i%3 == 0 {
+			testcfg.Exec(t, db, `PRAGMA wal_checkpoint(TRUNCATE)`)
+		}
+		points = append(points, time.Now())
+	}
+
+	// Shrinking the database is replicated too.
+	testcfg.Exec(t, db, `DELETE FROM events WHERE seq % 2 = 0`)
+	testcfg.Exec(t, db, `VACUUM`)
+	db.Close()
+
+	segs, err := sink.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shipped := len(segs)
+
+	// Reopening the database resumes replication, without a snapshot.
+	db = open(t, path, filepath.Join(dir, "replica"))
+	insert(t, db, 11, 100)
+	db.Close()
+
+	segs, err = sink.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != shipped+1 || segs[shipped].Snapshot {
+		t.Errorf("got %d segments, want %d", len(segs), shipped+1)
+	}
+
+	// Writing the database without replication, even without growing it,
+	// makes the next replicated session take a new snapshot.
+	db, err = sqlite3.Open("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcfg.Exec(t, db, `UPDATE events SET payload = zeroblob(length(payload))`)
+	db.Close()
+	db = open(t, path, filepath.Join(dir, "replica"))
+	insert(t, db, 12, 100)
+	db.Close()
+
+	segs, err = sink.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !segs[len(segs)-2].Snapshot {
+		t.Error("want snapshot")
+	}
+	var snapshots int
+	for i, seg := range segs {
+		if seg.Seq != segs[0].Seq+uint64(i) {
+			t.Errorf("got sequence %d at %d", seg.Seq, i)
+		}
+		if seg.Snapshot {
+			snapshots++
+		}
+	}
+	if snapshots < 2 {
+		t.Errorf("got %d snapshots", snapshots)
+	}
+
+	// Restore the latest state.
+	latest := filepath.Join(dir, "latest.db")
+	if err := replica.Restore(sink, time.Time{}, latest); err != nil {
+		t.Fatal(err)
+	}
+	check(t, latest, `SELECT group_concat(seq) FROM events`, "1,3,5,7,9,11,12")
+	check(t, latest, `SELECT count(*) FROM events WHERE payload = zeroblob(length(payload))`, "6")
+
+	// Restore each point in time.
+	for i, point := range points {
+		name := filepath.Join(dir, fmt.Sprintf("point%d.db", i))
+		if err := replica.Restore(sink, point, name); err != nil {
+			t.Fatal(err)
+		}
+		check(t, name, `SELECT max(seq) || ':' || sum(length(payload)) FROM events`,
+			fmt.Sprintf("%d:%d", i+1, 1000*(i+1)*(i+2)/2))
+	}
+
+	// Restore refuses to overwrite a file.
+	if err := replica.Restore(sink, time.Time{}, latest); !errors.Is(err, os.ErrExist) {
+		t.Errorf("got %v, want ErrExist", err)
+	}
+
+	// Nothing to restore before the first snapshot.
+	before := filepath.Join(dir, "before.db")
+	if err := replica.Restore(sink, segs[0].Time.Add(-time.Second), before); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestReplica_snapshot(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.ToSlash(filepath.Join(dir, "test.db"))
+	sink := replica.DirSink(filepath.Join(dir, "replica"))
+
+	db := open(t, path, filepath.Join(dir, "replica"))
+	defer db.Close()
+	testcfg.Exec(t, db, `PRAGMA journal_mode=wal`)
+	testcfg.Exec(t, db, `CREATE TABLE events (seq INTEGER PRIMARY KEY, payload BLOB)`)
+	insert(t, db, 1, 20000)
+
+	// Rewriting the same pages outgrows the snapshot,
+	// and a checkpoint triggers a new one.
+	for range 10 {
+		testcfg.Exec(t, db, `UPDATE events SET payload = randomblob(20000)`)
+	}
+	testcfg.Exec(t, db, `PRAGMA wal_checkpoint`)
+	insert(t, db, 2, 100)
+
+	segs, err := sink.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !segs[len(segs)-2].Snapshot {
+		t.Error("want snapshot")
+	}
+
+	name := filepath.Join(dir, "restored.db")
+	if err := replica.Restore(sink, time.Time{}, name); err != nil {
+		t.Fatal(err)
+	}
+	check(t, name, `SELECT group_concat(seq || ':' || length(payload)) FROM events`, "1:20000,2:100")
+}
+
+func TestReplica_sink(t *testing.T) {
+	dir := t.TempDir()
+	sink := &failingSink{Sink: replica.DirSink(filepath.Join(dir, "replica"))}
+	vfs.Register("replica-sink", replica.Wrap(vfs.Find(""), func(*vfs.Filename) replica.Sink {
+		return sink
+	}))
+	defer vfs.Unregister("replica-sink")
+
+	db, err := sqlite3.Open("file:" + filepath.ToSlash(filepath.Join(dir, "test.db")) + "?vfs=replica-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testcfg.Exec(t, db, `PRAGMA journal_mode=wal`)
+	testcfg.Exec(t, db, `CREATE TABLE events (seq INTEGER PRIMARY KEY, payload BLOB)`)
+
+	// The database survives a failing sink,
+	// and replication resumes with a snapshot.
+	sink.fail = true
+	insert(t, db, 1, 10000)
+	sink.fail = false
+	insert(t, db, 2, 10000)
+
+	segs, err := sink.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !segs[len(segs)-2].Snapshot {
+		t.Error("want snapshot")
+	}
+
+	name := filepath.Join(dir, "restored.db")
+	if err := replica.Restore(sink, time.Time{}, name); err != nil {
+		t.Fatal(err)
+	}
+	check(t, name, `SELECT group_concat(seq) FROM events`, "1,2")
+}
+
+func TestReplica_resume(t *testing.T) {
+	dir := t.TempDir()
+	path := "file:" + filepath.ToSlash(filepath.Join(dir, "test.db")) + "?vfs=replica-resume"
+	sink := &failingSink{Sink: replica.DirSink(filepath.Join(dir, "replica"))}
+	vfs.Register("replica-resume", replica.Wrap(vfs.Find(""), func(*vfs.Filename) replica.Sink {
+		return sink
+	}))
+	defer vfs.Unregister("replica-resume")
+
+	db, err := sqlite3.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testcfg.Exec(t, db, `PRAGMA journal_mode=wal`)
+	testcfg.Exec(t, db, `CREATE TABLE t (x)`)
+	testcfg.Exec(t, db, `INSERT INTO t VALUES ('a'), ('b')`)
+	db.Close()
+
+	// The first transaction after reopening isn't shipped,
+	// and doesn't change the size of the database.
+	db, err = sqlite3.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.fail = true
+	testcfg.Exec(t, db, `UPDATE t SET x = 'c' WHERE rowid = 1`)
+	sink.fail = false
+	testcfg.Exec(t, db, `UPDATE t SET x = 'd' WHERE rowid = 2`)
+	db.Close()
+
+	// Replication restarts with a snapshot that includes it.
+	segs, err := sink.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !segs[len(segs)-2].Snapshot {
+		t.Error("want snapshot")
+	}
+
+	name := filepath.Join(dir, "restored.db")
+	if err := replica.Restore(sink, time.Time{}, name); err != nil {
+		t.Fatal(err)
+	}
+	db, err = sqlite3.Open("file:" + filepath.ToSlash(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := testcfg.Query(t, db, `SELECT group_concat(x) FROM t`); got != "c,d" {
+		t.Errorf("got %q", got)
+	}
+}
+
+type failingSink struct {
+	replica.Sink
+	fail bool
+}
+
+func (s *failingSink) Write(seg replica.Segment, data io.Reader) error {
+	if s.fail {
+		return errors.New("sink failed")
+	}
+	return s.Sink.Write(seg, data)
+}
+
+func (s *failingSink) Segments() ([]replica.Segment, error) {
+	if s.fail {
+		return nil, errors.New("sink failed")
+	}
+	return s.Sink.Segments()
+}
+
+func open(t *testing.T, path, replica string) *sqlite3.Conn {
+	t.Helper()
+	db, err := sqlite3.Open("file:" + path + "?vfs=replica&replica=" + filepath.ToSlash(replica))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func insert(t *testing.T, db *sqlite3.Conn, seq, size int) {
+	t.Helper()
+	testcfg.Exec(t, db, fmt.Sprintf(`INSERT INTO events VALUES (%d, randomblob(%d))`, seq, size))
+}
+
+func check(t *testing.T, path, sql, want string) {
+	t.Helper()
+	db, err := sqlite3.Open("file:" + filepath.ToSlash(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := faultvfs.IntegrityCheck(db); err != nil {
+		t.Errorf("%s: %v", filepath.Base(path), err)
+	}
+	if got := testcfg.Query(t, db, sql); got != want {
+		t.Errorf("%s: got %s, want %s", filepath.Base(path), got, want)
+	}
+}
@@ -0,0 +1,100 @@
+package replica
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Restore restores a database replicated to sink,
+// as it was at the point in time t, to a new file at path.
+// If t is zero, the latest replicated state is restored.
+//
+// Restore starts from the latest snapshot taken up to t,
+// and applies the transactions shipped after it, up to t,
+// stopping early at any gap in the sequence.
+func Restore(sink Sink, t time.Time, path string) (err error) {
+	segs, err := sink.Segments()
+	if err != nil {
+		return err
+	}
+
+	start := -1
+	for i, seg := range segs {
+		if !t.IsZero() && seg.Time.After(t) {
+			segs = segs[:i]
+			break
+		}
+		if seg.Snapshot {
+			start = i
+		}
+	}
+	if start < 0 {
+		return errors.New("replica: no snapshot to restore")
+	}
+	segs = segs[start:]
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	for i, seg := range segs {
+		if i > 0 && seg.Seq != segs[i-1].Seq+1 {
+			break
+		}
+		if err := restore(sink, seg, f); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+func restore(sink Sink, seg Segment, f *os.File) error {
+	r, err := sink.Read(seg)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	size := int64(seg.Pages) * int64(seg.PageSize)
+	if seg.Snapshot {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(f, r, size); err != nil {
+			return err
+		}
+		return f.Truncate(size)
+	}
+
+	var pgno [4]byte
+	page := make([]byte, seg.PageSize)
+	br := bufio.NewReader(r)
+	for {
+		if _, err := io.ReadFull(br, pgno[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(br, page); err != nil {
+			return err
+		}
+		off := int64(binary.BigEndian.Uint32(pgno[:])-1) * int64(seg.PageSize)
+		if _, err := f.WriteAt(page, off); err != nil {
+			return err
+		}
+	}
+	return f.Truncate(size)
+}
@@ -0,0 +1,58 @@
+package replica
+
+import (
+	"encoding/binary"
+	"hash/crc64"
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// pageSums tracks the checksum of a database, page by page.
+//
+// The checksum of a database is the sum of the checksums of its pages,
+// so it can be updated as pages change.
+// Pages of zeroes have a zero checksum,
+// so the database can grow without hashing them.
+type pageSums struct {
+	sums []uint64 // indexed by page number, minus one
+	sum  uint64
+}
+
+func (s *pageSums) reset() {
+	s.sums = s.sums[:0]
+	s.sum = 0
+}
+
+// set updates the checksum of a page,
+// growing the database if needed.
+func (s *pageSums) set(pgno uint32, page []byte) {
+	if int(pgno) > len(s.sums) {
+		s.resize(pgno)
+	}
+	sum := pageSum(pgno, page)
+	s.sum += sum - s.sums[pgno-1]
+	s.sums[pgno-1] = sum
+}
+
+// resize grows or shrinks the database to a number of pages.
+func (s *pageSums) resize(pages uint32) {
+	if n := int(pages); n < len(s.sums) {
+		for _, sum := range s.sums[n:] {
+			s.sum -= sum
+		}
+		s.sums = s.sums[:n]
+	} else {
+		s.sums = append(s.sums, make([]uint64, n-len(s.sums))...)
+	}
+}
+
+func pageSum(pgno uint32, page []byte) uint64 {
+	for _, b := range page {
+		if b != 0 {
+			var buf [4]byte
+			binary.BigEndian.PutUint32(buf[:], pgno)
+			return crc64.Update(crc64.Checksum(buf[:], crcTable), crcTable, page)
+		}
+	}
+	return 0
+}
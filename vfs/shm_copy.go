@@ -2,16 +2,7 @@
 
 package vfs
 
-import (
-	"unsafe"
-
-	"github.com/ncruces/go-sqlite3/internal/util"
-)
-
-const (
-	_WALINDEX_HDR_SIZE = 136
-	_WALINDEX_PGSZ     = 32768
-)
+import "github.com/ncruces/go-sqlite3/internal/util"
 
 // This seems a safe way of keeping the WAL-index in sync.
 //
@@ -40,15 +31,7 @@ func (s *vfsShm) shmAcquire(ptr *_ErrorCode) {
 	}
 	// Copies modified words from shared to private memory.
 	for id, p := range s.ptrs {
-		shared := shmPage(s.shared[id][:])
-		shadow := shmPage(s.shadow[id][:])
-		privat := shmPage(util.View(s.mod, p, _WALINDEX_PGSZ))
-		for i, shared := range shared {
-			if shadow[i] != shared {
-				shadow[i] = shared
-				privat[i] = shared
-			}
-		}
+		shmCopy(util.View(s.mod, p, _WALINDEX_PGSZ), s.shadow[id][:], s.shared[id][:])
 	}
 }
 
@@ -58,15 +41,7 @@ func (s *vfsShm) shmRelease() {
 	}
 	// Copies modified words from private to shared memory.
 	for id, p := range s.ptrs {
-		shared := shmPage(s.shared[id][:])
-		shadow := shmPage(s.shadow[id][:])
-		privat := shmPage(util.View(s.mod, p, _WALINDEX_PGSZ))
-		for i, privat := range privat {
-			if shadow[i] != privat {
-				shadow[i] = privat
-				shared[i] = privat
-			}
-		}
+		shmCopy(s.shared[id][:], s.shadow[id][:], util.View(s.mod, p, _WALINDEX_PGSZ))
 	}
 }
 
@@ -76,12 +51,3 @@ func (s *vfsShm) shmBarrier() {
 	s.shmRelease()
 	s.Unlock()
 }
-
-func shmPage(s []byte) *[_WALINDEX_PGSZ / 4]uint32 {
-	p := (*uint32)(unsafe.Pointer(unsafe.SliceData(s)))
-	return (*[_WALINDEX_PGSZ / 4]uint32)(unsafe.Slice(p, _WALINDEX_PGSZ/4))
-}
-
-func shmEqual(v1, v2 []byte) bool {
-	return *(*[_WALINDEX_HDR_SIZE]byte)(v1[:]) == *(*[_WALINDEX_HDR_SIZE]byte)(v2[:])
-}
@@ -0,0 +1,280 @@
+package vfs
+
+import (
+	"context"
+	"sync"
+	"unsafe"
+
+	"github.com/tetratelabs/wazero/api"
+
+	"github.com/ncruces/go-sqlite3/internal/util"
+)
+
+const (
+	_WALINDEX_HDR_SIZE = 136
+	_WALINDEX_PGSZ     = 32768
+)
+
+// NewMemorySharedMemory returns a shared-memory WAL-index
+// that lives in process memory, instead of being backed by a file.
+//
+// It's meant for in-memory VFSes that want to support WAL mode:
+// connections in the same process share a WAL-index
+// if they use instances created with the same key,
+// which must be comparable (a pointer to the database works well).
+// The WAL-index is discarded once all instances are closed.
+func NewMemorySharedMemory(key any) SharedMemory {
+	return &memShm{key: key}
+}
+
+type memShmParent struct {
+	shared [][_WALINDEX_PGSZ]byte
+	refs   int // +checklocks:memShmListMtx
+
+	lock [_SHM_NLOCK]int8 // +checklocks:Mutex
+	sync.Mutex
+}
+
+var (
+	// +checklocks:memShmListMtx
+	memShmList    = map[any]*memShmParent{}
+	memShmListMtx sync.Mutex
+)
+
+type memShm struct {
+	*memShmParent
+	mod    api.Module
+	alloc  api.Function
+	free   api.Function
+	key    any
+	shadow [][_WALINDEX_PGSZ]byte
+	ptrs   []ptr_t
+	stack  [1]stk_t
+	lock   [_SHM_NLOCK]bool
+}
+
+func (s *memShm) Close() error {
+	if s.memShmParent == nil {
+		return nil
+	}
+
+	memShmListMtx.Lock()
+	defer memShmListMtx.Unlock()
+
+	// Unlock everything.
+	s.shmLock(0, _SHM_NLOCK, _SHM_UNLOCK)
+
+	// Decrease reference count.
+	if s.memShmParent.refs--; s.memShmParent.refs == 0 {
+		delete(memShmList, s.key)
+	}
+	s.memShmParent = nil
+	return nil
+}
+
+func (s *memShm) shmOpen() {
+	if s.memShmParent != nil {
+		return
+	}
+
+	memShmListMtx.Lock()
+	defer memShmListMtx.Unlock()
+
+	// Find a shared buffer, or add a new one.
+	g, ok := memShmList[s.key]
+	if !ok {
+		g = &memShmParent{}
+		memShmList[s.key] = g
+	}
+	s.memShmParent = g
+	g.refs++
+}
+
+func (s *memShm) shmMap(ctx context.Context, mod api.Module, id, size int32, extend bool) (ptr_t, _ErrorCode) {
+	if size != _WALINDEX_PGSZ {
+		return 0, _IOERR_SHMMAP
+	}
+	if s.mod == nil {
+		s.mod = mod
+		s.free = mod.ExportedFunction("sqlite3_free")
+		s.alloc = mod.ExportedFunction("sqlite3_malloc64")
+	}
+	s.shmOpen()
+
+	s.Lock()
+	defer s.Unlock()
+	defer s.shmAcquire()
+
+	// Extend shared memory.
+	if int(id) >= len(s.shared) {
+		if !extend {
+			return 0, _OK
+		}
+		s.shared = append(s.shared, make([][_WALINDEX_PGSZ]byte, int(id)-len(s.shared)+1)...)
+	}
+
+	// Allocate shadow memory.
+	if int(id) >= len(s.shadow) {
+		s.shadow = append(s.shadow, make([][_WALINDEX_PGSZ]byte, int(id)-len(s.shadow)+1)...)
+	}
+
+	// Allocate local memory.
+	for int(id) >= len(s.ptrs) {
+		s.stack[0] = stk_t(size)
+		if err := s.alloc.CallWithStack(ctx, s.stack[:]); err != nil {
+			panic(err)
+		}
+		if s.stack[0] == 0 {
+			panic(util.OOMErr)
+		}
+		clear(util.View(s.mod, ptr_t(s.stack[0]), _WALINDEX_PGSZ))
+		s.ptrs = append(s.ptrs, ptr_t(s.stack[0]))
+	}
+
+	// Force the next acquire to copy everything.
+	s.shadow[0][4] = 1
+	return s.ptrs[id], _OK
+}
+
+func (s *memShm) shmLock(offset, n int32, flags _ShmFlag) (rc _ErrorCode) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch {
+	case flags&_SHM_LOCK != 0:
+		defer func() {
+			if rc == _OK {
+				s.shmAcquire()
+			}
+		}()
+	case flags&_SHM_EXCLUSIVE != 0:
+		s.shmRelease()
+	}
+
+	return shmLockSlots(&s.memShmParent.lock, &s.lock, offset, n, flags)
+}
+
+func (s *memShm) shmUnmap(delete bool) {
+	if s.memShmParent == nil {
+		return
+	}
+	defer s.Close()
+
+	s.Lock()
+	s.shmRelease()
+	defer s.Unlock()
+
+	for _, p := range s.ptrs {
+		s.stack[0] = stk_t(p)
+		if err := s.free.CallWithStack(context.Background(), s.stack[:]); err != nil {
+			panic(err)
+		}
+	}
+	s.ptrs = nil
+	s.shadow = nil
+}
+
+func (s *memShm) shmBarrier() {
+	s.Lock()
+	s.shmAcquire()
+	s.shmRelease()
+	s.Unlock()
+}
+
+// Each connection has its own copy of the WAL-index in Wasm memory,
+// kept in sync with process memory the same way as in shm_copy.go.
+
+// +checklocks:s.Mutex
+func (s *memShm) shmAcquire() {
+	if len(s.ptrs) == 0 || shmEqual(s.shadow[0][:], s.shared[0][:]) {
+		return
+	}
+	// Copies modified words from shared to private memory.
+	for id, p := range s.ptrs {
+		shmCopy(util.View(s.mod, p, _WALINDEX_PGSZ), s.shadow[id][:], s.shared[id][:])
+	}
+}
+
+// +checklocks:s.Mutex
+func (s *memShm) shmRelease() {
+	if len(s.ptrs) == 0 || shmEqual(s.shadow[0][:], util.View(s.mod, s.ptrs[0], _WALINDEX_HDR_SIZE)) {
+		return
+	}
+	// Copies modified words from private to shared memory.
+	for id, p := range s.ptrs {
+		shmCopy(s.shared[id][:], s.shadow[id][:], util.View(s.mod, p, _WALINDEX_PGSZ))
+	}
+}
+
+// shmLockSlots implements WAL-index locks in process memory.
+// Each shared slot counts SHARED locks held, or is -1 if held EXCLUSIVE;
+// local records which slots are held by this connection.
+// Callers must hold the mutex that guards shared.
+func shmLockSlots(shared *[_SHM_NLOCK]int8, local *[_SHM_NLOCK]bool, offset, n int32, flags _ShmFlag) _ErrorCode {
+	switch {
+	case flags&_SHM_UNLOCK != 0:
+		for i := offset; i < offset+n; i++ {
+			if local[i] {
+				if shared[i] <= 0 {
+					shared[i] = 0
+				} else {
+					shared[i]--
+				}
+				local[i] = false
+			}
+		}
+	case flags&_SHM_SHARED != 0:
+		for i := offset; i < offset+n; i++ {
+			if !local[i] &&
+				shared[i]+1 <= 0 {
+				return _BUSY
+			}
+		}
+		for i := offset; i < offset+n; i++ {
+			if !local[i] {
+				shared[i]++
+				local[i] = true
+			}
+		}
+	case flags&_SHM_EXCLUSIVE != 0:
+		for i := offset; i < offset+n; i++ {
+			if local[i] {
+				// SQLite never requests an exclusive lock that it already holds.
+				panic(util.AssertErr())
+			}
+			if shared[i] != 0 {
+				return _BUSY
+			}
+		}
+		for i := offset; i < offset+n; i++ {
+			shared[i] = -1
+			local[i] = true
+		}
+	default:
+		panic(util.AssertErr())
+	}
+
+	return _OK
+}
+
+// shmCopy copies the words of src that differ from shadow
+// to both shadow and dst.
+func shmCopy(dst, shadow, src []byte) {
+	d := shmPage(dst)
+	w := shmPage(shadow)
+	for i, v := range shmPage(src) {
+		if w[i] != v {
+			w[i] = v
+			d[i] = v
+		}
+	}
+}
+
+func shmPage(s []byte) *[_WALINDEX_PGSZ / 4]uint32 {
+	p := (*uint32)(unsafe.Pointer(unsafe.SliceData(s)))
+	return (*[_WALINDEX_PGSZ / 4]uint32)(unsafe.Slice(p, _WALINDEX_PGSZ/4))
+}
+
+func shmEqual(v1, v2 []byte) bool {
+	return *(*[_WALINDEX_HDR_SIZE]byte)(v1[:]) == *(*[_WALINDEX_HDR_SIZE]byte)(v2[:])
+}
@@ -0,0 +1,70 @@
+// Package statsvfs implements an SQLite VFS that collects I/O statistics.
+//
+// The "stats" [vfs.VFS] wraps the default VFS, and counts reads, writes,
+// syncs, truncates, and lock transitions, with latency histograms,
+// by file type (main databases, WAL files, journals, etc).
+//
+// Statistics are collected for each VFS, and for each connection.
+// Connection statistics are available through [ConnStats],
+// or the [FCNTL_STATS] file control opcode,
+// and can be used to attribute I/O to specific queries.
+//
+// Use [Wrap] to collect statistics for any VFS.
+//
+// Importing package statsvfs registers the VFS,
+// and a wrapper to stack it over other VFSes (e.g. "xts+stats"):
+//
+//	import _ "github.com/ncruces/go-sqlite3/vfs/statsvfs"
+package statsvfs
+
+import (
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/internal/util"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+func init() {
+	vfs.Register("stats", Wrap(vfs.Find("")))
+	vfs.RegisterWrapper("stats", func(base vfs.VFS) vfs.VFS {
+		return Wrap(base)
+	})
+}
+
+// FCNTL_STATS is the file control opcode that returns
+// the [Stats] of a connection, and resets them if its argument is true.
+//
+//	stats, err := db.FileControl("main", statsvfs.FCNTL_STATS)
+const FCNTL_STATS = sqlite3.FcntlOpcode(util.FCNTL_STATSVFS_STATS)
+
+// VFS is a [vfs.VFS] that collects I/O statistics.
+type VFS struct {
+	base     vfs.VFS
+	counters counters
+}
+
+// Wrap wraps base to collect I/O statistics.
+func Wrap(base vfs.VFS) *VFS {
+	return &VFS{base: base}
+}
+
+// Stats returns the I/O statistics
+// for all files opened through the VFS.
+func (v *VFS) Stats() Stats {
+	return v.counters.stats()
+}
+
+// Reset resets the I/O statistics of the VFS.
+func (v *VFS) Reset() {
+	v.counters.reset()
+}
+
+// ConnStats returns the I/O statistics for the files
+// (database, journal, WAL) that a connection opened
+// for the schema database, and optionally resets them.
+func ConnStats(db *sqlite3.Conn, schema string, reset bool) (Stats, error) {
+	ret, err := db.FileControl(schema, FCNTL_STATS, reset)
+	if err != nil {
+		return nil, err
+	}
+	return ret.(Stats), nil
+}
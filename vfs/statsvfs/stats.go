@@ -0,0 +1,190 @@
+package statsvfs
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// Stats are I/O statistics, by file type
+// ([vfs.OPEN_MAIN_DB], [vfs.OPEN_WAL], [vfs.OPEN_MAIN_JOURNAL], etc).
+// File types with no I/O are omitted.
+type Stats map[vfs.OpenFlag]FileStats
+
+// FileStats are I/O statistics for a file type.
+type FileStats struct {
+	Read     OpStats
+	Write    OpStats
+	Sync     OpStats
+	Truncate OpStats
+	Lock     OpStats
+	Unlock   OpStats
+}
+
+// OpStats are statistics for a file operation.
+type OpStats struct {
+	Count   int64         // Number of operations.
+	Errors  int64         // Number of failed operations.
+	Bytes   int64         // Bytes read or written.
+	Time    time.Duration // Total time spent.
+	Latency Histogram
+}
+
+// Mean returns the mean latency of the operation.
+func (s *OpStats) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Time / time.Duration(s.Count)
+}
+
+// Histogram is a latency histogram, with power of two buckets.
+// Bucket 0 counts operations that took less than 1µs,
+// bucket i operations that took less than 1µs<<i
+// (and at least 1µs<<(i-1)),
+// and the last bucket all slower operations.
+type Histogram [24]int64
+
+// Bound returns the upper bound of bucket i.
+// The last bucket has no upper bound.
+func (h *Histogram) Bound(i int) time.Duration {
+	if i >= len(h)-1 {
+		return 1<<63 - 1
+	}
+	return time.Microsecond << i
+}
+
+// Quantile returns an upper bound for quantile q of the latencies
+// (e.g. 0.99 for the 99th percentile).
+func (h *Histogram) Quantile(q float64) time.Duration {
+	var total int64
+	for _, n := range h {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	var seen int64
+	rank := int64(q * float64(total))
+	for i, n := range h {
+		seen += n
+		if seen > rank {
+			return h.Bound(i)
+		}
+	}
+	return h.Bound(len(h) - 1)
+}
+
+func bucket(d time.Duration) int {
+	var i int
+	for d >= time.Microsecond && i < len(Histogram{})-1 {
+		d >>= 1
+		i++
+	}
+	return i
+}
+
+type op int
+
+const (
+	opRead op = iota
+	opWrite
+	opSync
+	opTruncate
+	opLock
+	opUnlock
+	numOps
+)
+
+// fileTypes are the file types for which statistics are kept;
+// zero is for files of unknown type.
+var fileTypes = [...]vfs.OpenFlag{
+	0,
+	vfs.OPEN_MAIN_DB,
+	vfs.OPEN_MAIN_JOURNAL,
+	vfs.OPEN_WAL,
+	vfs.OPEN_TEMP_DB,
+	vfs.OPEN_TEMP_JOURNAL,
+	vfs.OPEN_TRANSIENT_DB,
+	vfs.OPEN_SUBJOURNAL,
+	vfs.OPEN_SUPER_JOURNAL,
+}
+
+func fileType(flags vfs.OpenFlag) int {
+	for i, typ := range fileTypes {
+		if flags&typ != 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+type opCounters struct {
+	count   atomic.Int64
+	errors  atomic.Int64
+	bytes   atomic.Int64
+	nanos   atomic.Int64
+	latency [len(Histogram{})]atomic.Int64
+}
+
+type counters [len(fileTypes)][numOps]opCounters
+
+func (c *counters) record(typ int, op op, bytes int, d time.Duration, err error) {
+	o := &c[typ][op]
+	o.count.Add(1)
+	o.nanos.Add(int64(d))
+	o.latency[bucket(d)].Add(1)
+	if bytes > 0 {
+		o.bytes.Add(int64(bytes))
+	}
+	if err != nil {
+		o.errors.Add(1)
+	}
+}
+
+func (c *counters) stats() Stats {
+	stats := Stats{}
+	for typ := range c {
+		var fs FileStats
+		var used bool
+		for op, s := range [numOps]*OpStats{
+			opRead:     &fs.Read,
+			opWrite:    &fs.Write,
+			opSync:     &fs.Sync,
+			opTruncate: &fs.Truncate,
+			opLock:     &fs.Lock,
+			opUnlock:   &fs.Unlock,
+		} {
+			o := &c[typ][op]
+			s.Count = o.count.Load()
+			s.Errors = o.errors.Load()
+			s.Bytes = o.bytes.Load()
+			s.Time = time.Duration(o.nanos.Load())
+			for i := range o.latency {
+				s.Latency[i] = o.latency[i].Load()
+			}
+			used = used || s.Count != 0
+		}
+		if used {
+			stats[fileTypes[typ]] = fs
+		}
+	}
+	return stats
+}
+
+func (c *counters) reset() {
+	for typ := range c {
+		for op := range c[typ] {
+			o := &c[typ][op]
+			o.count.Store(0)
+			o.errors.Store(0)
+			o.bytes.Store(0)
+			o.nanos.Store(0)
+			for i := range o.latency {
+				o.latency[i].Store(0)
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package statsvfs
+
+import (
+	"io"
+	"time"
+
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// Open implements [vfs.VFS].
+func (v *VFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	file, flags, err := v.base.Open(name, flags)
+	if err != nil {
+		return file, flags, err
+	}
+	return v.wrap(file, flags, nil), flags, nil
+}
+
+// OpenFilename implements [vfs.VFSFilename].
+func (v *VFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	file, flags, err := vfsutil.WrapOpenFilename(v.base, name, flags)
+	if err != nil {
+		return file, flags, err
+	}
+
+	// Journals and WAL files count towards
+	// the connection that opened the database.
+	var conn *counters
+	if flags&vfs.OPEN_MAIN_DB == 0 {
+		if f, ok := vfsutil.UnwrapFile[*statsFile](name.DatabaseFile()); ok {
+			conn = f.conn
+		}
+	}
+	return v.wrap(file, flags, conn), flags, nil
+}
+
+// Delete implements [vfs.VFS].
+func (v *VFS) Delete(name string, dirSync bool) error {
+	return v.base.Delete(name, dirSync)
+}
+
+// Access implements [vfs.VFS].
+func (v *VFS) Access(name string, flag vfs.AccessFlag) (bool, error) {
+	return v.base.Access(name, flag)
+}
+
+// FullPathname implements [vfs.VFS].
+func (v *VFS) FullPathname(name string) (string, error) {
+	return v.base.FullPathname(name)
+}
+
+func (v *VFS) wrap(file vfs.File, flags vfs.OpenFlag, conn *counters) *statsFile {
+	if flags&vfs.OPEN_MAIN_DB != 0 {
+		conn = new(counters)
+	}
+	return &statsFile{
+		WrappedFile: vfsutil.WrappedFile{File: file},
+		typ:         fileType(flags),
+		vfs:         &v.counters,
+		conn:        conn,
+		main:        flags&vfs.OPEN_MAIN_DB != 0,
+	}
+}
+
+type statsFile struct {
+	vfsutil.WrappedFile
+	vfs  *counters
+	conn *counters // nil if the connection is unknown
+	typ  int
+	main bool
+}
+
+func (f *statsFile) record(op op, bytes int, start time.Time, err error) {
+	d := time.Since(start)
+	f.vfs.record(f.typ, op, bytes, d, err)
+	if f.conn != nil {
+		f.conn.record(f.typ, op, bytes, d, err)
+	}
+}
+
+func (f *statsFile) ReadAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := f.File.ReadAt(p, off)
+	if err == io.EOF {
+		// Short reads are expected.
+		f.record(opRead, n, start, nil)
+	} else {
+		f.record(opRead, n, start, err)
+	}
+	return n, err
+}
+
+func (f *statsFile) WriteAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := f.File.WriteAt(p, off)
+	f.record(opWrite, n, start, err)
+	return n, err
+}
+
+func (f *statsFile) Truncate(size int64) error {
+	start := time.Now()
+	err := f.File.Truncate(size)
+	f.record(opTruncate, 0, start, err)
+	return err
+}
+
+func (f *statsFile) Sync(flags vfs.SyncFlag) error {
+	start := time.Now()
+	err := f.File.Sync(flags)
+	f.record(opSync, 0, start, err)
+	return err
+}
+
+func (f *statsFile) Lock(lock vfs.LockLevel) error {
+	start := time.Now()
+	err := f.File.Lock(lock)
+	f.record(opLock, 0, start, err)
+	return err
+}
+
+func (f *statsFile) Unlock(lock vfs.LockLevel) error {
+	start := time.Now()
+	err := f.File.Unlock(lock)
+	f.record(opUnlock, 0, start, err)
+	return err
+}
+
+func (f *statsFile) CustomControl(op uint32, arg any) (any, error) {
+	if op != uint32(FCNTL_STATS) || !f.main {
+		return vfsutil.WrapCustomControl(f.File, op, arg)
+	}
+	stats := f.conn.stats()
+	if reset, _ := arg.(bool); reset {
+		f.conn.reset()
+	}
+	return stats, nil
+}
@@ -0,0 +1,210 @@
+package statsvfs_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ncruces/go-sqlite3"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	_ "github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/statsvfs"
+	_ "github.com/ncruces/go-sqlite3/vfs/xts"
+)
+
+func TestConnStats(t *testing.T) {
+	uri := "file:" + filepath.ToSlash(filepath.Join(t.TempDir(), "test.db")) + "?vfs=stats"
+	db, err := sqlite3.Open(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Exec(`
+		PRAGMA journal_mode=wal;
+		CREATE TABLE t (x);
+		INSERT INTO t VALUES (randomblob(10000));
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := statsvfs.ConnStats(db, "main", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal := stats[vfs.OPEN_WAL]
+	if wal.Write.Count == 0 || wal.Write.Bytes < 10000 {
+		t.Errorf("got %+v", wal.Write)
+	}
+	main := stats[vfs.OPEN_MAIN_DB]
+	if main.Read.Count == 0 || main.Lock.Count == 0 || main.Unlock.Count == 0 {
+		t.Errorf("got %+v", main)
+	}
+	var count int64
+	for _, n := range main.Lock.Latency {
+		count += n
+	}
+	if count != main.Lock.Count {
+		t.Errorf("got %d, want %d", count, main.Lock.Count)
+	}
+
+	// Stats were reset: only the WAL is read.
+	err = db.Exec(`SELECT * FROM t`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = statsvfs.ConnStats(db, "main", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := stats[vfs.OPEN_WAL].Write; w.Count != 0 {
+		t.Errorf("got %+v", w)
+	}
+
+	// Checkpointing writes and syncs the database.
+	err = db.Exec(`PRAGMA wal_checkpoint`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = statsvfs.ConnStats(db, "main", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := stats[vfs.OPEN_MAIN_DB].Write; w.Bytes < 10000 {
+		t.Errorf("got %+v", w)
+	}
+	if s := stats[vfs.OPEN_MAIN_DB].Sync; s.Count == 0 || s.Time <= 0 || s.Mean() <= 0 {
+		t.Errorf("got %+v", s)
+	}
+
+	// The VFS sees all connections.
+	all := vfs.Find("stats").(*statsvfs.VFS).Stats()
+	if all[vfs.OPEN_WAL].Write.Count < wal.Write.Count {
+		t.Errorf("got %+v", all[vfs.OPEN_WAL].Write)
+	}
+}
+
+func TestConnStats_journal(t *testing.T) {
+	stats := statsvfs.Wrap(vfs.Find(""))
+	vfs.Register("stats_journal", stats)
+	defer vfs.Unregister("stats_journal")
+
+	uri := "file:" + filepath.ToSlash(filepath.Join(t.TempDir(), "test.db")) + "?vfs=stats_journal"
+	db, err := sqlite3.Open(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Exec(`
+		CREATE TABLE t (x);
+		INSERT INTO t VALUES (randomblob(10000));
+		UPDATE t SET x = randomblob(10000);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := statsvfs.ConnStats(db, "main", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal := conn[vfs.OPEN_MAIN_JOURNAL]
+	if journal.Write.Count == 0 || journal.Sync.Count == 0 {
+		t.Errorf("got %+v", journal)
+	}
+	if got := stats.Stats()[vfs.OPEN_MAIN_JOURNAL]; got != journal {
+		t.Errorf("got %+v, want %+v", got, journal)
+	}
+
+	stats.Reset()
+	if got := stats.Stats(); len(got) != 0 {
+		t.Errorf("got %+v", got)
+	}
+
+	// Other VFSes don't know the opcode.
+	db, err = sqlite3.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.FileControl("main", statsvfs.FCNTL_STATS)
+	if !errors.Is(err, sqlite3.NOTFOUND) {
+		t.Errorf("got %v, want NOTFOUND", err)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h statsvfs.Histogram
+	if q := h.Quantile(0.5); q != 0 {
+		t.Errorf("got %v", q)
+	}
+
+	h[0] = 50  // < 1µs
+	h[4] = 40  // < 16µs
+	h[10] = 10 // < 1ms
+	if q := h.Quantile(0.5); q != 16*time.Microsecond {
+		t.Errorf("got %v", q)
+	}
+	if q := h.Quantile(0.95); q != 1024*time.Microsecond {
+		t.Errorf("got %v", q)
+	}
+	if q := h.Quantile(0.1); q != time.Microsecond {
+		t.Errorf("got %v", q)
+	}
+}
+
+func TestConnStats_stack(t *testing.T) {
+	for _, name := range []string{"xts+stats", "stats+xts"} {
+		t.Run(name, func(t *testing.T) {
+			if vfs.RegisterStack(name) == nil {
+				t.Fatal("want stack")
+			}
+			defer vfs.Unregister(name)
+
+			path := filepath.Join(t.TempDir(), "test.db")
+			uri := "file:" + filepath.ToSlash(path) + "?vfs=" + name + "&textkey=secret"
+			db, err := sqlite3.Open(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			err = db.Exec(`
+				PRAGMA journal_mode=wal;
+				CREATE TABLE t (x);
+				INSERT INTO t VALUES ('hello');
+			`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The file control, and the WAL, go through all layers.
+			stats, err := statsvfs.ConnStats(db, "main", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats[vfs.OPEN_WAL].Write.Count == 0 {
+				t.Errorf("got %+v", stats)
+			}
+
+			// The database is encrypted.
+			err = db.Exec(`PRAGMA wal_checkpoint`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.HasPrefix(data, []byte("SQLite format 3")) {
+				t.Error("not encrypted")
+			}
+		})
+	}
+}
@@ -381,6 +381,19 @@ func vfsFileControlImpl(ctx context.Context, mod api.Module, file File, op _Fcnt
 			file.SetDB(ctx.Value(util.ConnKey{}))
 			return _OK
 		}
+
+	default:
+		if file, ok := file.(FileCustomControl); ok && op >= _FCNTL_CUSTOM {
+			ctl, ok := util.GetHandle(ctx, util.Read32[ptr_t](mod, pArg)).(*util.CustomControl)
+			if !ok {
+				return _MISUSE
+			}
+			ret, err := file.CustomControl(uint32(op), ctl.Arg)
+			if err == nil {
+				ctl.Ret = ret
+			}
+			return vfsErrorCode(err, _ERROR)
+		}
 	}
 
 	return _NOTFOUND
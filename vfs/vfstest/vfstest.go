@@ -0,0 +1,514 @@
+// Package vfstest implements a conformance test suite for SQLite VFSes.
+//
+// [Test] exercises a [vfs.VFS] directly, checking that it follows
+// the rules SQLite expects of it: the lock state machine,
+// reads past the end of files and over holes, truncation,
+// and deleting and checking for the existence of files.
+// It also uses the VFS through SQLite to check shared-memory locking
+// in WAL mode, for VFSes that support it.
+//
+// Tests that use SQLite need it to be loaded,
+// e.g. by importing package embed:
+//
+//	import _ "github.com/ncruces/go-sqlite3/embed"
+//
+//	func TestConformance(t *testing.T) {
+//		vfstest.Test(t, myVFS{}, nil)
+//	}
+package vfstest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/internal/util"
+	"github.com/ncruces/go-sqlite3/util/vfsutil"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// Options configures the conformance tests.
+type Options struct {
+	// Name returns the name for a new database file.
+	// Opening the same name again must open the same file.
+	// Defaults to a file in [testing.T.TempDir].
+	Name func(t *testing.T) string
+
+	// Create, if not nil, creates a database file
+	// with the given contents, and returns its name.
+	// Read-only VFSes must set it.
+	Create func(t *testing.T, data []byte) string
+
+	// ReadOnly skips tests that need to create or write files,
+	// or take write locks.
+	ReadOnly bool
+}
+
+// Test runs the conformance tests against a VFS.
+func Test(t *testing.T, v vfs.VFS, opts *Options) {
+	s := suite{vfs: v}
+	if opts != nil {
+		s.Options = *opts
+	}
+	if s.Name == nil {
+		s.Name = func(t *testing.T) string {
+			return filepath.Join(t.TempDir(), "test.db")
+		}
+	}
+
+	t.Run("open", s.testOpen)
+	t.Run("read", s.testRead)
+	if s.ReadOnly {
+		return
+	}
+	t.Run("sparse", s.testSparse)
+	t.Run("truncate", s.testTruncate)
+	t.Run("access", s.testAccess)
+	t.Run("lock", s.testLock)
+	t.Run("shm", s.testSharedMemory)
+}
+
+type suite struct {
+	Options
+	vfs vfs.VFS
+}
+
+const (
+	mainFlags = vfs.OPEN_MAIN_DB | vfs.OPEN_READWRITE | vfs.OPEN_CREATE
+	walFlags  = vfs.OPEN_WAL | vfs.OPEN_READWRITE | vfs.OPEN_CREATE
+)
+
+func (s *suite) open(t *testing.T, name string, flags vfs.OpenFlag) vfs.File {
+	t.Helper()
+	f, _, err := s.vfs.Open(name, flags)
+	if err := vfsError(err); err != nil {
+		t.Fatalf("open %q: %v", name, err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func (s *suite) testOpen(t *testing.T) {
+	// A file that doesn't exist is not created without OPEN_CREATE.
+	name := s.Name(t)
+	if f, _, err := s.vfs.Open(name, vfs.OPEN_MAIN_DB|vfs.OPEN_READWRITE); vfsError(err) == nil {
+		f.Close()
+		t.Error("opened a file that doesn't exist")
+	}
+	if s.ReadOnly {
+		name = s.Create(t, pattern(4096))
+		f := s.open(t, name, vfs.OPEN_MAIN_DB|vfs.OPEN_READONLY)
+		checkSize(t, f, 4096)
+		return
+	}
+
+	f1 := s.open(t, name, mainFlags)
+	checkSize(t, f1, 0)
+	write(t, f1, pattern(4096), 0)
+
+	// Opening the same file again sees the same contents.
+	f2 := s.open(t, name, vfs.OPEN_MAIN_DB|vfs.OPEN_READWRITE)
+	checkSize(t, f2, 4096)
+	checkRead(t, f2, pattern(4096), 0)
+}
+
+func (s *suite) testRead(t *testing.T) {
+	const size = 3*4096 + 100
+	data := pattern(size)
+
+	var f vfs.File
+	if s.Create != nil {
+		f = s.open(t, s.Create(t, data), vfs.OPEN_MAIN_DB|vfs.OPEN_READONLY)
+	} else {
+		f = s.open(t, s.Name(t), mainFlags)
+		write(t, f, data, 0)
+	}
+
+	checkSize(t, f, size)
+	checkRead(t, f, data, 0)
+	checkRead(t, f, data[4096:8192], 4096)
+	checkRead(t, f, data[1000:1010], 1000)
+
+	// Reads past the end of the file are short, and return io.EOF.
+	checkShortRead(t, f, data[size-50:], size-50, 100)
+	checkShortRead(t, f, nil, size, 100)
+	checkShortRead(t, f, nil, 2*size, 100)
+}
+
+func (s *suite) testSparse(t *testing.T) {
+	const off = 70000
+	data := pattern(100)
+
+	f := s.open(t, s.Name(t), mainFlags)
+	write(t, f, data, 0)
+	write(t, f, data, off)
+	checkSize(t, f, off+100)
+
+	// Holes read as zeros.
+	checkRead(t, f, data, 0)
+	checkRead(t, f, make([]byte, off-100), 100)
+	checkRead(t, f, data, off)
+	checkShortRead(t, f, data[50:], off+50, 100)
+}
+
+func (s *suite) testTruncate(t *testing.T) {
+	data := pattern(10000)
+
+	f := s.open(t, s.Name(t), mainFlags)
+	write(t, f, data, 0)
+
+	truncate(t, f, 5000)
+	checkSize(t, f, 5000)
+	checkRead(t, f, data[:5000], 0)
+	checkShortRead(t, f, data[4990:5000], 4990, 20)
+
+	// Growing the file again doesn't bring back truncated data.
+	truncate(t, f, 8192)
+	checkSize(t, f, 8192)
+	checkRead(t, f, data[:5000], 0)
+	checkRead(t, f, make([]byte, 8192-5000), 5000)
+
+	truncate(t, f, 0)
+	checkSize(t, f, 0)
+	checkShortRead(t, f, nil, 0, 100)
+}
+
+func (s *suite) testAccess(t *testing.T) {
+	// In-memory VFSes may not delete database files,
+	// but all VFSes that support WAL mode delete WAL files.
+	name := s.Name(t)
+	s.open(t, name, mainFlags)
+	wal := name + "-wal"
+
+	checkAccess(t, s.vfs, wal, false)
+	if err := s.vfs.Delete(wal, false); !isCode(err, sqlite3.IOERR) {
+		t.Errorf("deleting a file that doesn't exist: got %v, want IOERR_DELETE_NOENT", err)
+	}
+
+	f, _, err := s.vfs.Open(wal, walFlags)
+	if err := vfsError(err); err != nil {
+		t.Skipf("open %q: %v", wal, err)
+	}
+	write(t, f, pattern(100), 0)
+	if err := vfsError(f.Close()); err != nil {
+		t.Fatal(err)
+	}
+	checkAccess(t, s.vfs, wal, true)
+
+	if err := vfsError(s.vfs.Delete(wal, true)); err != nil {
+		t.Fatal(err)
+	}
+	checkAccess(t, s.vfs, wal, false)
+	if f, _, err := s.vfs.Open(wal, vfs.OPEN_WAL|vfs.OPEN_READWRITE); vfsError(err) == nil {
+		f.Close()
+		t.Error("opened a deleted file")
+	}
+}
+
+func (s *suite) testLock(t *testing.T) {
+	name := s.Name(t)
+	f1 := s.open(t, name, mainFlags)
+	f2 := s.open(t, name, vfs.OPEN_MAIN_DB|vfs.OPEN_READWRITE)
+
+	t.Run("shared", func(t *testing.T) {
+		checkLock(t, f1, vfs.LOCK_SHARED, false)
+		checkLock(t, f2, vfs.LOCK_SHARED, false)
+		checkReserved(t, f2, false)
+		checkUnlock(t, f1, vfs.LOCK_NONE)
+		checkUnlock(t, f2, vfs.LOCK_NONE)
+	})
+
+	t.Run("reserved", func(t *testing.T) {
+		checkLock(t, f1, vfs.LOCK_SHARED, false)
+		checkLock(t, f1, vfs.LOCK_RESERVED, false)
+		checkReserved(t, f2, true)
+		// Some VFSes allow new readers while there's a writer.
+		// Only one can be the writer.
+		if vfsError(f2.Lock(vfs.LOCK_SHARED)) == nil {
+			checkLock(t, f2, vfs.LOCK_RESERVED, true)
+			checkUnlock(t, f2, vfs.LOCK_NONE)
+		}
+		checkUnlock(t, f1, vfs.LOCK_SHARED)
+		checkReserved(t, f2, false)
+		checkUnlock(t, f1, vfs.LOCK_NONE)
+	})
+
+	t.Run("exclusive", func(t *testing.T) {
+		checkLock(t, f1, vfs.LOCK_SHARED, false)
+		checkLock(t, f1, vfs.LOCK_EXCLUSIVE, false)
+		checkLock(t, f2, vfs.LOCK_SHARED, true)
+		checkUnlock(t, f1, vfs.LOCK_SHARED)
+		checkLock(t, f2, vfs.LOCK_SHARED, false)
+		checkUnlock(t, f1, vfs.LOCK_NONE)
+		checkUnlock(t, f2, vfs.LOCK_NONE)
+	})
+
+	t.Run("readers", func(t *testing.T) {
+		// A writer waits for readers to leave.
+		checkLock(t, f1, vfs.LOCK_SHARED, false)
+		checkLock(t, f2, vfs.LOCK_SHARED, false)
+		checkLock(t, f1, vfs.LOCK_EXCLUSIVE, true)
+		checkUnlock(t, f2, vfs.LOCK_NONE)
+		checkLock(t, f1, vfs.LOCK_EXCLUSIVE, false)
+		checkUnlock(t, f1, vfs.LOCK_NONE)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		// Closing a file releases its locks.
+		f3, _, err := s.vfs.Open(name, vfs.OPEN_MAIN_DB|vfs.OPEN_READWRITE)
+		if err := vfsError(err); err != nil {
+			t.Fatal(err)
+		}
+		checkLock(t, f3, vfs.LOCK_SHARED, false)
+		checkLock(t, f3, vfs.LOCK_EXCLUSIVE, false)
+		if err := vfsError(f3.Close()); err != nil {
+			t.Fatal(err)
+		}
+		checkReserved(t, f2, false)
+		checkLock(t, f2, vfs.LOCK_SHARED, false)
+		checkLock(t, f2, vfs.LOCK_EXCLUSIVE, false)
+		checkUnlock(t, f2, vfs.LOCK_NONE)
+	})
+}
+
+var registered atomic.Int64
+
+func (s *suite) testSharedMemory(t *testing.T) {
+	name := s.Name(t)
+	f := s.open(t, name, mainFlags)
+	if shm, ok := f.(vfs.FileSharedMemory); !ok || shm.SharedMemory() == nil {
+		t.Skip("skipping without shared memory")
+	}
+
+	// Use the VFS through SQLite.
+	// Wrap it, so SQLite doesn't bypass the OS VFS.
+	vfsName := fmt.Sprintf("vfstest-%d", registered.Add(1))
+	vfs.Register(vfsName, wrapVFS{s.vfs})
+	t.Cleanup(func() { vfs.Unregister(vfsName) })
+
+	uri := (&url.URL{
+		Scheme:   "file",
+		OmitHost: true,
+		Path:     filepath.ToSlash(name),
+		RawQuery: url.Values{"vfs": {vfsName}}.Encode(),
+	}).String()
+
+	db1 := s.conn(t, uri)
+	db2 := s.conn(t, uri)
+
+	exec(t, db1, `PRAGMA journal_mode=wal`)
+	if got := query(t, db1, `PRAGMA journal_mode`); got != "wal" {
+		t.Skipf("journal_mode: got %q, want wal", got)
+	}
+	exec(t, db1, `CREATE TABLE t (x)`)
+	exec(t, db1, `INSERT INTO t VALUES (1)`)
+
+	// A reader keeps its snapshot while a writer commits.
+	exec(t, db2, `BEGIN`)
+	if got := query(t, db2, `SELECT count(*) FROM t`); got != "1" {
+		t.Errorf("got %s rows, want 1", got)
+	}
+	exec(t, db1, `INSERT INTO t VALUES (2)`)
+	if got := query(t, db2, `SELECT count(*) FROM t`); got != "1" {
+		t.Errorf("got %s rows, want 1", got)
+	}
+	exec(t, db2, `COMMIT`)
+	if got := query(t, db2, `SELECT count(*) FROM t`); got != "2" {
+		t.Errorf("got %s rows, want 2", got)
+	}
+
+	// There's only one writer.
+	exec(t, db1, `BEGIN IMMEDIATE`)
+	if err := db2.Exec(`BEGIN IMMEDIATE`); !errors.Is(err, sqlite3.BUSY) {
+		t.Errorf("got %v, want BUSY", err)
+	}
+	exec(t, db1, `COMMIT`)
+	exec(t, db2, `BEGIN IMMEDIATE; INSERT INTO t VALUES (3); COMMIT`)
+	if got := query(t, db1, `SELECT count(*) FROM t`); got != "3" {
+		t.Errorf("got %s rows, want 3", got)
+	}
+}
+
+type wrapVFS struct{ vfs.VFS }
+
+func (w wrapVFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
+	return vfsutil.WrapOpenFilename(w.VFS, name, flags)
+}
+
+func (s *suite) conn(t *testing.T, uri string) *sqlite3.Conn {
+	t.Helper()
+	db, err := sqlite3.Open(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func exec(t *testing.T, db *sqlite3.Conn, sql string) {
+	t.Helper()
+	if err := db.Exec(sql); err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+}
+
+func query(t *testing.T, db *sqlite3.Conn, sql string) string {
+	t.Helper()
+	stmt, _, err := db.Prepare(sql)
+	if err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	defer stmt.Close()
+	if !stmt.Step() {
+		t.Fatalf("%s: %v", sql, stmt.Err())
+	}
+	return stmt.ColumnText(0)
+}
+
+func pattern(n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(i%251 + 1)
+	}
+	return buf
+}
+
+func write(t *testing.T, f vfs.File, data []byte, off int64) {
+	t.Helper()
+	n, err := f.WriteAt(data, off)
+	if err := vfsError(err); err != nil {
+		t.Fatalf("write at %d: %v", off, err)
+	}
+	if n != len(data) {
+		t.Fatalf("write at %d: wrote %d bytes, want %d", off, n, len(data))
+	}
+}
+
+func truncate(t *testing.T, f vfs.File, size int64) {
+	t.Helper()
+	if err := vfsError(f.Truncate(size)); err != nil {
+		t.Fatalf("truncate to %d: %v", size, err)
+	}
+}
+
+func checkSize(t *testing.T, f vfs.File, want int64) {
+	t.Helper()
+	got, err := f.Size()
+	if err := vfsError(err); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got size %d, want %d", got, want)
+	}
+}
+
+func checkRead(t *testing.T, f vfs.File, want []byte, off int64) {
+	t.Helper()
+	got := make([]byte, len(want))
+	n, err := f.ReadAt(got, off)
+	if n != len(want) {
+		t.Errorf("read at %d: got %d bytes, want %d (%v)", off, n, len(want), err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("read at %d: data mismatch", off)
+	}
+}
+
+func checkShortRead(t *testing.T, f vfs.File, want []byte, off int64, size int) {
+	t.Helper()
+	got := make([]byte, size)
+	n, err := f.ReadAt(got, off)
+	if err != io.EOF {
+		t.Errorf("short read at %d: got %v, want io.EOF", off, err)
+	}
+	if n != len(want) {
+		t.Errorf("short read at %d: got %d bytes, want %d", off, n, len(want))
+	} else if !bytes.Equal(got[:n], want) {
+		t.Errorf("short read at %d: data mismatch", off)
+	}
+}
+
+func checkAccess(t *testing.T, v vfs.VFS, name string, want bool) {
+	t.Helper()
+	got, err := v.Access(name, vfs.ACCESS_EXISTS)
+	if err := vfsError(err); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("access %q: got %v, want %v", name, got, want)
+	}
+}
+
+func checkLock(t *testing.T, f vfs.File, lock vfs.LockLevel, busy bool) {
+	t.Helper()
+	before := lockState(f)
+	err := vfsError(f.Lock(lock))
+	switch {
+	case !busy && err != nil:
+		t.Fatalf("lock %v: %v", lock, err)
+	case busy && !isCode(err, sqlite3.BUSY):
+		t.Fatalf("lock %v: got %v, want BUSY", lock, err)
+	}
+	got := lockState(f)
+	switch {
+	case got == vfs.LOCK_EXCLUSIVE+1:
+		// The VFS doesn't report its lock state.
+	case err == nil && got != lock:
+		t.Errorf("lock %v: got state %v", lock, got)
+	case err != nil && got != before && got != vfs.LOCK_PENDING:
+		// A failed EXCLUSIVE lock may leave a PENDING lock.
+		t.Errorf("lock %v failed: got state %v, want %v", lock, got, before)
+	}
+}
+
+func checkUnlock(t *testing.T, f vfs.File, lock vfs.LockLevel) {
+	t.Helper()
+	if err := vfsError(f.Unlock(lock)); err != nil {
+		t.Fatalf("unlock %v: %v", lock, err)
+	}
+	if got := lockState(f); got != lock && got != vfs.LOCK_EXCLUSIVE+1 {
+		t.Errorf("unlock %v: got state %v", lock, got)
+	}
+}
+
+func checkReserved(t *testing.T, f vfs.File, want bool) {
+	t.Helper()
+	got, err := f.CheckReservedLock()
+	if err := vfsError(err); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got reserved %v, want %v", got, want)
+	}
+}
+
+func lockState(f vfs.File) vfs.LockLevel {
+	if f, ok := f.(vfs.FileLockState); ok {
+		return f.LockState()
+	}
+	return vfs.LOCK_EXCLUSIVE + 1 // UNKNOWN_LOCK
+}
+
+// vfsError returns nil for a zero error code:
+// SQLite treats it as success.
+func vfsError(err error) error {
+	var code util.ErrorCode
+	if errors.As(err, &code) && code == util.OK {
+		return nil
+	}
+	return err
+}
+
+// isCode reports whether err has the primary error code.
+func isCode(err error, code sqlite3.ErrorCode) bool {
+	var c util.ErrorCode
+	if errors.As(err, &c) {
+		return sqlite3.ErrorCode(c) == code
+	}
+	return errors.Is(err, code)
+}
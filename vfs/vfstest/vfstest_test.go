@@ -0,0 +1,17 @@
+package vfstest_test
+
+import (
+	"testing"
+
+	_ "github.com/ncruces/go-sqlite3/embed"
+	_ "github.com/ncruces/go-sqlite3/internal/testcfg"
+	"github.com/ncruces/go-sqlite3/vfs"
+	"github.com/ncruces/go-sqlite3/vfs/vfstest"
+)
+
+func TestOS(t *testing.T) {
+	if !vfs.SupportsFileLocking {
+		t.Skip("skipping without locks")
+	}
+	vfstest.Test(t, vfs.Find("os"), nil)
+}
@@ -1,12 +1,12 @@
 package xts
 
 import (
-	"encoding/hex"
 	"io"
 
 	"golang.org/x/crypto/xts"
 
 	"github.com/ncruces/go-sqlite3"
+	"github.com/ncruces/go-sqlite3/internal/rekey"
 	"github.com/ncruces/go-sqlite3/internal/util"
 	"github.com/ncruces/go-sqlite3/util/vfsutil"
 	"github.com/ncruces/go-sqlite3/vfs"
@@ -14,7 +14,7 @@ import (
 
 type xtsVFS struct {
 	vfs.VFS
-	init XTSCreator
+	keys rekey.Keys[*xts.Cipher]
 }
 
 func (x *xtsVFS) Open(name string, flags vfs.OpenFlag) (vfs.File, vfs.OpenFlag, error) {
@@ -30,31 +30,16 @@ func (x *xtsVFS) OpenFilename(name *vfs.Filename, flags vfs.OpenFlag) (file vfs.
 		return file, flags, err
 	}
 
-	var cipher *xts.Cipher
-	if f, ok := vfsutil.UnwrapFile[*xtsFile](name.DatabaseFile()); ok {
-		cipher = f.cipher
-	} else {
-		var key []byte
-		if params := name.URIParameters(); name == nil {
-			key = x.init.KDF("") // Temporary files get a random key.
-		} else if t, ok := params["key"]; ok {
-			key = []byte(t[0])
-		} else if t, ok := params["hexkey"]; ok {
-			key, _ = hex.DecodeString(t[0])
-		} else if t, ok := params["textkey"]; ok && len(t[0]) > 0 {
-			key = x.init.KDF(t[0])
-		} else if flags&vfs.OPEN_MAIN_DB != 0 {
-			// Main databases may have their key specified as a PRAGMA.
-			return &xtsFile{File: file, init: x.init}, flags, nil
-		}
-		cipher = x.init.XTS(key)
+	f := &xtsFile{}
+	var main *rekey.KeyedFile[*xts.Cipher]
+	if m, ok := vfsutil.UnwrapFile[*xtsFile](name.DatabaseFile()); ok {
+		main = &m.KeyedFile
 	}
-
-	if cipher == nil {
+	if err := x.keys.Open(&f.KeyedFile, main, x.VFS, file, name, flags); err != nil {
 		file.Close()
-		return nil, flags, sqlite3.CANTOPEN
+		return nil, flags, err
 	}
-	return &xtsFile{File: file, cipher: cipher, init: x.init}, flags, nil
+	return f, flags, nil
 }
 
 // Larger sectors don't seem to significantly improve security,
@@ -76,35 +61,16 @@ func roundUp[T int | int64](i T) T {
 }
 
 type xtsFile struct {
-	vfs.File
-	init   XTSCreator
-	cipher *xts.Cipher
+	rekey.KeyedFile[*xts.Cipher]
 	sector [sectorSize]byte
 }
 
-func (x *xtsFile) Pragma(name string, value string) (string, error) {
-	var key []byte
-	switch name {
-	case "key":
-		key = []byte(value)
-	case "hexkey":
-		key, _ = hex.DecodeString(value)
-	case "textkey":
-		if len(value) > 0 {
-			key = x.init.KDF(value)
-		}
-	default:
-		return vfsutil.WrapPragma(x.File, name, value)
-	}
-
-	if x.cipher = x.init.XTS(key); x.cipher != nil {
-		return "ok", nil
-	}
-	return "", sqlite3.CANTOPEN
-}
-
 func (x *xtsFile) ReadAt(p []byte, off int64) (n int, err error) {
-	if x.cipher == nil {
+	cipher, plain := x.Key()
+	if plain {
+		return x.File.ReadAt(p, off)
+	}
+	if cipher == nil {
 		// Only OPEN_MAIN_DB can have a missing key.
 		if off == 0 && len(p) == 100 {
 			// SQLite is trying to read the header of a database file.
@@ -125,7 +91,7 @@ func (x *xtsFile) ReadAt(p []byte, off int64) (n int, err error) {
 		}
 
 		sectorNum := uint64(min / sectorSize)
-		x.cipher.Decrypt(x.sector[:], x.sector[:], sectorNum)
+		cipher.Decrypt(x.sector[:], x.sector[:], sectorNum)
 
 		data := x.sector[:]
 		if off > min {
@@ -141,7 +107,11 @@ func (x *xtsFile) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (x *xtsFile) WriteAt(p []byte, off int64) (n int, err error) {
-	if x.cipher == nil {
+	cipher, plain := x.Key()
+	if plain {
+		return x.File.WriteAt(p, off)
+	}
+	if cipher == nil {
 		return 0, sqlite3.READONLY
 	}
 
@@ -168,7 +138,7 @@ func (x *xtsFile) WriteAt(p []byte, off int64) (n int, err error) {
 				// Either way, zero pad the file to the next block size.
 				clear(data)
 			} else {
-				x.cipher.Decrypt(data, data, sectorNum)
+				cipher.Decrypt(data, data, sectorNum)
 			}
 			if off > min {
 				data = data[off-min:]
@@ -176,7 +146,7 @@ func (x *xtsFile) WriteAt(p []byte, off int64) (n int, err error) {
 		}
 
 		t := copy(data, p[n:])
-		x.cipher.Encrypt(x.sector[:], x.sector[:], sectorNum)
+		cipher.Encrypt(x.sector[:], x.sector[:], sectorNum)
 
 		m, err := x.File.WriteAt(x.sector[:], min)
 		if m != sectorSize {
@@ -212,71 +182,20 @@ func (x *xtsFile) Truncate(size int64) error {
 }
 
 func (x *xtsFile) ChunkSize(size int) {
-	vfsutil.WrapChunkSize(x.File, roundUp(size))
+	x.WrappedFile.ChunkSize(roundUp(size))
 }
 
 func (x *xtsFile) SizeHint(size int64) error {
-	return vfsutil.WrapSizeHint(x.File, roundUp(size))
-}
-
-func (x *xtsFile) Unwrap() vfs.File {
-	return x.File
-}
-
-func (x *xtsFile) SharedMemory() vfs.SharedMemory {
-	return vfsutil.WrapSharedMemory(x.File)
-}
-
-// Wrap optional methods.
-
-func (x *xtsFile) LockState() vfs.LockLevel {
-	return vfsutil.WrapLockState(x.File) // notest
+	return x.WrappedFile.SizeHint(roundUp(size))
 }
 
-func (x *xtsFile) PersistentWAL() bool {
-	return vfsutil.WrapPersistWAL(x.File) // notest
-}
-
-func (x *xtsFile) SetPersistentWAL(keepWAL bool) {
-	vfsutil.WrapSetPersistWAL(x.File, keepWAL) // notest
-}
-
-func (x *xtsFile) HasMoved() (bool, error) {
-	return vfsutil.WrapHasMoved(x.File) // notest
-}
-
-func (x *xtsFile) Overwrite() error {
-	return vfsutil.WrapOverwrite(x.File) // notest
-}
-
-func (x *xtsFile) SyncSuper(super string) error {
-	return vfsutil.WrapSyncSuper(x.File, super) // notest
-}
-
-func (x *xtsFile) CommitPhaseTwo() error {
-	return vfsutil.WrapCommitPhaseTwo(x.File) // notest
-}
-
-func (x *xtsFile) BeginAtomicWrite() error {
-	return vfsutil.WrapBeginAtomicWrite(x.File) // notest
-}
-
-func (x *xtsFile) CommitAtomicWrite() error {
-	return vfsutil.WrapCommitAtomicWrite(x.File) // notest
-}
-
-func (x *xtsFile) RollbackAtomicWrite() error {
-	return vfsutil.WrapRollbackAtomicWrite(x.File) // notest
-}
-
-func (x *xtsFile) CheckpointStart() {
-	vfsutil.WrapCheckpointStart(x.File) // notest
-}
+// xtsCipher adapts an XTS cipher to rekey files.
+type xtsCipher struct{ cipher *xts.Cipher }
 
-func (x *xtsFile) CheckpointDone() {
-	vfsutil.WrapCheckpointDone(x.File) // notest
+func (c xtsCipher) Encrypt(block []byte, off int64) {
+	c.cipher.Encrypt(block, block, uint64(off/sectorSize))
 }
 
-func (x *xtsFile) BusyHandler(handler func() bool) {
-	vfsutil.WrapBusyHandler(x.File, handler) // notest
+func (c xtsCipher) Decrypt(block []byte, off int64) {
+	c.cipher.Decrypt(block, block, uint64(off/sectorSize))
 }